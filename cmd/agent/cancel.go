@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cancelTombstoneTTL is how long a cancelled job ID is remembered so that
+// an /execute arriving after its /cancel is refused.
+const cancelTombstoneTTL = 10 * time.Minute
+
+// errTaskRunning is returned by taskTracker.start for an attempt that is
+// already running, e.g. one delivered twice.
+var errTaskRunning = errors.New("attempt is already running")
+
+// cancelRequest is the JSON payload the coordinator sends to /cancel. A
+// lease token limits it to the attempt holding that lease, e.g. one evicted
+// for a higher-priority job, which may be sent here again.
+type cancelRequest struct {
+	JobID      string `json:"job_id"`
+	LeaseToken uint64 `json:"lease_token,omitempty"`
+}
+
+// cancelResponse reports whether the job was running when it was cancelled.
+type cancelResponse struct {
+	JobID      string `json:"job_id"`
+	WasRunning bool   `json:"was_running"`
+}
+
+// taskTracker remembers the jobs running on this agent so they can be
+// cancelled and their leases renewed, and the jobs cancelled recently.
+// The zero value is ready to use.
+type taskTracker struct {
+	mu        sync.Mutex
+	running   map[string]*trackedTask
+	cancelled map[string]time.Time
+}
+
+// trackedTask is a running job and the lease it runs under.
+type trackedTask struct {
+	stop  context.CancelFunc
+	lease leaseRef
+}
+
+// start registers req's job as running and returns a context that is
+// cancelled by cancel(jobID). done must be called when the job finishes.
+func (t *taskTracker) start(parent context.Context, req executeRequest) (ctx context.Context, done func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	jobID := req.JobID
+	if _, ok := t.cancelled[jobID]; ok {
+		return nil, nil, fmt.Errorf("job %s was cancelled", jobID)
+	}
+	if running, ok := t.running[jobID]; ok {
+		if running.lease.Attempt == req.Attempt && running.lease.LeaseToken == req.LeaseToken {
+			return nil, nil, fmt.Errorf("job %s: %w", jobID, errTaskRunning)
+		}
+		return nil, nil, fmt.Errorf("job %s is already running attempt %d", jobID, running.lease.Attempt)
+	}
+	if t.running == nil {
+		t.running = make(map[string]*trackedTask)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	t.running[jobID] = &trackedTask{
+		stop:  cancel,
+		lease: leaseRef{JobID: jobID, Attempt: req.Attempt, LeaseToken: req.LeaseToken},
+	}
+
+	done = func() {
+		cancel()
+		t.mu.Lock()
+		delete(t.running, jobID)
+		t.mu.Unlock()
+	}
+	return ctx, done, nil
+}
+
+// cancel stops jobID if it is running and remembers it as cancelled.
+// It reports whether the job was running.
+func (t *taskTracker) cancel(jobID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.cancelled == nil {
+		t.cancelled = make(map[string]time.Time)
+	}
+	for id, at := range t.cancelled {
+		if now.Sub(at) > cancelTombstoneTTL {
+			delete(t.cancelled, id)
+		}
+	}
+	t.cancelled[jobID] = now
+
+	task, ok := t.running[jobID]
+	if ok {
+		task.stop()
+	}
+	return ok
+}
+
+// revoke stops jobID if it is still running under lease token. Unlike
+// cancel it leaves no tombstone: the coordinator may place the job here again.
+func (t *taskTracker) revoke(jobID string, token uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	task, ok := t.running[jobID]
+	if !ok || task.lease.LeaseToken != token {
+		return false
+	}
+	task.stop()
+	return true
+}
+
+// leases returns the lease of every running job that has one, by job ID.
+func (t *taskTracker) leases() []leaseRef {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []leaseRef
+	for _, task := range t.running {
+		if task.lease.LeaseToken != 0 {
+			out = append(out, task.lease)
+		}
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].JobID < out[k].JobID })
+	return out
+}
+
+// count returns how many jobs are running.
+func (t *taskTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.running)
+}
+
+// wasCancelled reports whether jobID has been cancelled recently.
+func (t *taskTracker) wasCancelled(jobID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.cancelled[jobID]
+	return ok
+}
+
+// Implements POST /cancel on the agent.
+// A running job has its whole process tree killed; its /execute call then
+// returns with status "cancelled".
+func (s *server) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req cancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.JobID == "" {
+		http.Error(w, "job_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var wasRunning bool
+	if req.LeaseToken != 0 {
+		wasRunning = s.tasks.revoke(req.JobID, req.LeaseToken)
+		log.Printf("agent: stopped job %s under lease %d (was running: %v)", req.JobID, req.LeaseToken, wasRunning)
+	} else {
+		wasRunning = s.tasks.cancel(req.JobID)
+		log.Printf("agent: cancelled job %s (was running: %v)", req.JobID, wasRunning)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cancelResponse{JobID: req.JobID, WasRunning: wasRunning}); err != nil {
+		log.Printf("agent: failed to encode /cancel response: %v", err)
+	}
+}
+
+// revokeLeases stops jobs whose leases the coordinator has given up on;
+// another attempt may already be running elsewhere.
+func (s *server) revokeLeases(leases []leaseRef) {
+	for _, l := range leases {
+		if s.tasks.revoke(l.JobID, l.LeaseToken) {
+			log.Printf("agent: stopped job %s: lease %d of attempt %d was revoked", l.JobID, l.LeaseToken, l.Attempt)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that /cancel kills a running job, including processes it spawned
+func TestCancelHandlerKillsRunningJob(t *testing.T) {
+	srv := newTestServer()
+
+	body, _ := json.Marshal(executeRequest{
+		JobID:   "job-1",
+		Type:    "shell",
+		Payload: "sleep 30 & sleep 30; wait",
+	})
+
+	type result struct {
+		resp executeResponse
+		took time.Duration
+	}
+	results := make(chan result, 1)
+	go func() {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		srv.executeHandler(w, httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(body)))
+
+		var resp executeResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		results <- result{resp: resp, took: time.Since(start)}
+	}()
+
+	// wait for the job to be registered as running.
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.running.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("job never started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancelBody, _ := json.Marshal(cancelRequest{JobID: "job-1"})
+	w := httptest.NewRecorder()
+	srv.cancelHandler(w, httptest.NewRequest(http.MethodPost, "/cancel", bytes.NewReader(cancelBody)))
+
+	var cancelResp cancelResponse
+	if err := json.NewDecoder(w.Body).Decode(&cancelResp); err != nil {
+		t.Fatalf("failed to decode cancel response: %v", err)
+	}
+	if !cancelResp.WasRunning {
+		t.Fatalf("expected job to be reported as running")
+	}
+
+	select {
+	case r := <-results:
+		if r.resp.Status != "cancelled" {
+			t.Fatalf("expected status cancelled, got %q", r.resp.Status)
+		}
+		// the background sleep holds stdout open; only a process-group kill
+		// lets the job return before WaitDelay gives up on the pipes.
+		if r.took > 1500*time.Millisecond {
+			t.Fatalf("expected cancellation to kill the process tree promptly, took %s", r.took)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job did not stop after cancel")
+	}
+}
+
+// Test that an /execute arriving after /cancel for the same job is refused
+func TestExecuteAfterCancelIsRefused(t *testing.T) {
+	srv := newTestServer()
+
+	if srv.tasks.cancel("job-2") {
+		t.Fatalf("expected job-2 not to be running")
+	}
+
+	body, _ := json.Marshal(executeRequest{JobID: "job-2", Type: "echo", Payload: "hi"})
+	w := httptest.NewRecorder()
+	srv.executeHandler(w, httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(body)))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 for a cancelled job, got %d", w.Code)
+	}
+}
+
+// Test that revoked leases stop only the attempt they fence, without a tombstone
+func TestRevokeLeases(t *testing.T) {
+	srv := newTestServer()
+
+	ctx, done, err := srv.tasks.start(context.Background(), executeRequest{JobID: "job-1", Attempt: 2, LeaseToken: 7})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer done()
+
+	if got := srv.tasks.leases(); len(got) != 1 || got[0] != (leaseRef{JobID: "job-1", Attempt: 2, LeaseToken: 7}) {
+		t.Fatalf("unexpected leases: %+v", got)
+	}
+
+	srv.revokeLeases([]leaseRef{{JobID: "job-1", Attempt: 1, LeaseToken: 3}})
+	if ctx.Err() != nil {
+		t.Fatalf("a revoked older lease should not stop the current attempt")
+	}
+
+	srv.revokeLeases([]leaseRef{{JobID: "job-1", Attempt: 2, LeaseToken: 7}})
+	if ctx.Err() == nil {
+		t.Fatalf("expected the job to be stopped")
+	}
+	if srv.tasks.wasCancelled("job-1") {
+		t.Fatalf("revoking a lease should not tombstone the job")
+	}
+}
+
+// Test that a /cancel naming a lease stops only that attempt and leaves no tombstone
+func TestCancelHandlerWithLease(t *testing.T) {
+	srv := newTestServer()
+
+	ctx, done, err := srv.tasks.start(context.Background(), executeRequest{JobID: "job-1", Attempt: 1, LeaseToken: 4})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer done()
+
+	for _, token := range []uint64{3, 4} {
+		body, _ := json.Marshal(cancelRequest{JobID: "job-1", LeaseToken: token})
+		w := httptest.NewRecorder()
+		srv.cancelHandler(w, httptest.NewRequest(http.MethodPost, "/cancel", bytes.NewReader(body)))
+
+		var resp cancelResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode cancel response: %v", err)
+		}
+		if want := token == 4; resp.WasRunning != want || (ctx.Err() != nil) != want {
+			t.Fatalf("lease %d: expected stopped=%v, got was_running=%v ctx=%v", token, want, resp.WasRunning, ctx.Err())
+		}
+	}
+	if srv.tasks.wasCancelled("job-1") {
+		t.Fatalf("stopping one lease should not tombstone the job")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// capabilities is what the agent reports about its machine on every heartbeat.
+// Memory and disk figures are 0 where the platform gives no cheap way to read them.
+type capabilities struct {
+	CPUCores      int               `json:"cpu_cores"`
+	MemoryTotalMB int64             `json:"memory_total_mb"`
+	MemoryFreeMB  int64             `json:"memory_free_mb"`
+	DiskFreeMB    int64             `json:"disk_free_mb"`
+	OS            string            `json:"os"`
+	Arch          string            `json:"arch"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// discoverCapabilities inspects the local machine. Disk space is measured
+// for the temp dir, which is where script jobs write their files.
+func discoverCapabilities(labels map[string]string) capabilities {
+	total, free := memoryMB()
+
+	return capabilities{
+		CPUCores:      runtime.NumCPU(),
+		MemoryTotalMB: total,
+		MemoryFreeMB:  free,
+		DiskFreeMB:    diskFreeMB(os.TempDir()),
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Labels:        labels,
+	}
+}
+
+// parseLabels reads labels like "gpu=nvidia,zone=lab-1".
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("label %q is not key=value", part)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
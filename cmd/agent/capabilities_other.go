@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// memoryMB is not implemented on this platform.
+func memoryMB() (total, free int64) {
+	return 0, 0
+}
+
+// diskFreeMB is not implemented on this platform.
+func diskFreeMB(path string) int64 {
+	return 0
+}
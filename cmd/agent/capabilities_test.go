@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	got, err := parseLabels("gpu=nvidia, zone = lab-1,,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"gpu": "nvidia", "zone": "lab-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if _, err := parseLabels("gpu"); err == nil {
+		t.Fatalf("expected error for label without value, got nil")
+	}
+}
+
+func TestDiscoverCapabilities(t *testing.T) {
+	caps := discoverCapabilities(map[string]string{"zone": "lab-1"})
+
+	if caps.CPUCores != runtime.NumCPU() {
+		t.Errorf("expected %d cores, got %d", runtime.NumCPU(), caps.CPUCores)
+	}
+	if caps.OS != runtime.GOOS || caps.Arch != runtime.GOARCH {
+		t.Errorf("expected %s/%s, got %s/%s", runtime.GOOS, runtime.GOARCH, caps.OS, caps.Arch)
+	}
+	if caps.Labels["zone"] != "lab-1" {
+		t.Errorf("expected labels to be passed through, got %v", caps.Labels)
+	}
+	if runtime.GOOS == "linux" && (caps.MemoryTotalMB <= 0 || caps.MemoryFreeMB > caps.MemoryTotalMB) {
+		t.Errorf("unexpected memory figures: total=%d free=%d", caps.MemoryTotalMB, caps.MemoryFreeMB)
+	}
+}
@@ -14,18 +14,43 @@ import (
 type registerPayload struct {
 	ID      string `json:"id"`
 	Address string `json:"address"`
+
+	// "pull" when the agent fetches work from GET /tasks/next instead of
+	// being sent it; empty means push.
+	Mode string `json:"mode,omitempty"`
+
+	// job types this agent has executors for.
+	JobTypes []string `json:"job_types,omitempty"`
+
+	// current load: jobs running now out of the slots this agent offers.
+	Running int     `json:"running"`
+	Slots   int     `json:"slots"`
+	Load    float64 `json:"load"`
+
+	Capabilities capabilities `json:"capabilities"`
+
+	// leases of the jobs running here, renewed by every heartbeat.
+	Leases []leaseRef `json:"leases,omitempty"`
 }
 
-// registerWithCoordinator sends a POST /register to the coordinator.
-func registerWithCoordinator(coordBaseURL, nodeID, addr string) error {
-	payload := registerPayload{
-		ID:      nodeID,
-		Address: addr, // For now we just send the listen address (e.g., ":8081").
-	}
+// leaseRef identifies the lease a job attempt runs under.
+type leaseRef struct {
+	JobID      string `json:"job_id"`
+	Attempt    int    `json:"attempt"`
+	LeaseToken uint64 `json:"lease_token"`
+}
+
+// registerResponse is the part of the coordinator's /register answer the agent uses.
+type registerResponse struct {
+	// leases the coordinator no longer honours; their jobs should stop.
+	RevokedLeases []leaseRef `json:"revoked_leases,omitempty"`
+}
 
+// registerWithCoordinator sends a POST /register to the coordinator.
+func registerWithCoordinator(coordBaseURL string, payload registerPayload) (registerResponse, error) {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("marshal payload: %w", err)
+		return registerResponse{}, fmt.Errorf("marshal payload: %w", err)
 	}
 
 	url := coordBaseURL + "/register"
@@ -33,28 +58,38 @@ func registerWithCoordinator(coordBaseURL, nodeID, addr string) error {
 
 	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("post to coordinator: %w", err)
+		return registerResponse{}, fmt.Errorf("post to coordinator: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status from coordinator: %s", resp.Status)
+		return registerResponse{}, fmt.Errorf("unexpected status from coordinator: %s", resp.Status)
 	}
 
-	return nil
+	var out registerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return registerResponse{}, fmt.Errorf("decode register response: %w", err)
+	}
+	return out, nil
 }
 
 // startHeartbeatLoop periodically calls registerWithCoordinator to act as a heartbeat.
-func startHeartbeatLoop(coordBaseURL, nodeID, addr string) {
+// payload is called for every beat so the coordinator sees current load and
+// renews the leases of running jobs; onRevoked is told about leases it refused.
+func startHeartbeatLoop(coordBaseURL string, payload func() registerPayload, onRevoked func([]leaseRef)) {
 	interval := 10 * time.Second // how often to send heartbeats
 
 	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			if err := registerWithCoordinator(coordBaseURL, nodeID, addr); err != nil {
+			resp, err := registerWithCoordinator(coordBaseURL, payload())
+			if err != nil {
 				log.Printf("[agent] heartbeat failed: %v", err)
-			} else {
-				log.Printf("[agent] heartbeat OK")
+				continue
+			}
+			log.Printf("[agent] heartbeat OK")
+			if len(resp.RevokedLeases) > 0 && onRevoked != nil {
+				onRevoked(resp.RevokedLeases)
 			}
 		}
 	}()
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,11 +17,166 @@ type executeRequest struct {
 	JobID   string `json:"job_id"`
 	Type    string `json:"type"`
 	Payload string `json:"payload"`
+
+	// TimeoutMS, when set, is how long the job may run before it is killed.
+	TimeoutMS int64 `json:"timeout_ms,omitempty"`
+
+	// Attempt is the coordinator's attempt number, echoed on streamed logs
+	// and status reports.
+	Attempt int `json:"attempt,omitempty"`
+
+	// LeaseToken fences this attempt: it is renewed on every heartbeat while
+	// the job runs and echoed on status reports. Zero means no lease.
+	LeaseToken uint64 `json:"lease_token,omitempty"`
+
+	// Async asks the agent to answer 202 straight away and report the
+	// outcome to the coordinator's /tasks/{id}/status instead.
+	Async bool `json:"async,omitempty"`
+}
+
+// acceptedResponse is what /execute returns for an async job it has started.
+type acceptedResponse struct {
+	JobID   string `json:"job_id"`
+	Attempt int    `json:"attempt"`
+	Status  string `json:"status"`
+}
+
+// executeResponse is what /execute returns once the job has finished.
+// Status is "ok" when the job ran and exited 0, "cancelled" when it was
+// stopped through /cancel, "timed_out" when it was killed for running past
+// its timeout, and "failed" otherwise.
+// Stdout and Stderr hold at most the last maxOutputBytes of each stream.
+type executeResponse struct {
+	JobID    string `json:"job_id"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	StdoutTruncated bool `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool `json:"stderr_truncated,omitempty"`
+
+	// Outputs are the key=value pairs the job wrote to $MESH_OUTPUT_FILE.
+	Outputs    map[string]string `json:"outputs,omitempty"`
+	DurationMS int64             `json:"duration_ms"`
+	Usage      *resourceUsage    `json:"usage,omitempty"`
+}
+
+// errorResponse is the structured body for rejected /execute requests.
+type errorResponse struct {
+	Code           string   `json:"code"`
+	Message        string   `json:"message"`
+	SupportedTypes []string `json:"supported_types,omitempty"`
+}
+
+// Executor runs jobs of a single type.
+// An error means the payload could not be run at all; failures of the
+// job itself are reported through the response.
+type Executor interface {
+	Execute(ctx context.Context, payload string) (executeResponse, error)
+}
+
+// executorRegistry maps job types to the executor that runs them.
+type executorRegistry struct {
+	executors map[string]Executor
+}
+
+// newExecutorRegistry creates an empty registry.
+func newExecutorRegistry() *executorRegistry {
+	return &executorRegistry{
+		executors: make(map[string]Executor),
+	}
+}
+
+// defaultExecutors returns a registry with every built-in executor.
+func defaultExecutors() *executorRegistry {
+	r := newExecutorRegistry()
+	r.Register("exec", execExecutor{})
+	r.Register("echo", echoExecutor{})
+	r.Register("shell", shellExecutor{})
+	r.Register("script", scriptExecutor{})
+	r.Register("http-fetch", httpFetchExecutor{})
+	return r
+}
+
+// Register adds or replaces the executor for jobType.
+func (r *executorRegistry) Register(jobType string, e Executor) {
+	r.executors[jobType] = e
+}
+
+// Get returns the executor for jobType, if any.
+func (r *executorRegistry) Get(jobType string) (Executor, bool) {
+	e, ok := r.executors[jobType]
+	return e, ok
+}
+
+// Types returns the supported job types in sorted order.
+func (r *executorRegistry) Types() []string {
+	out := make([]string, 0, len(r.executors))
+	for t := range r.executors {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Restrict drops every executor whose type is not listed.
+// Unknown names in allowed are reported as an error.
+func (r *executorRegistry) Restrict(allowed []string) error {
+	keep := make(map[string]Executor, len(allowed))
+	for _, t := range allowed {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		e, ok := r.executors[t]
+		if !ok {
+			return fmt.Errorf("unknown job type %q", t)
+		}
+		keep[t] = e
+	}
+	r.executors = keep
+	return nil
+}
+
+// server holds dependencies for the agent's HTTP handlers.
+type server struct {
+	executors *executorRegistry
+
+	// slots is how many jobs this agent advertises it can run at once;
+	// running counts the jobs executing right now.
+	slots   int
+	running atomic.Int64
+
+	// tasks tracks running and recently cancelled jobs for /cancel.
+	tasks taskTracker
+
+	// coordURL is where job output is streamed and async outcomes are
+	// reported; empty disables both. coordClient sends them (nil means
+	// http.DefaultClient) on behalf of nodeID.
+	coordURL    string
+	coordClient *http.Client
+	nodeID      string
+}
+
+// withLoad returns base with the agent's current load filled in.
+func (s *server) withLoad(base registerPayload) registerPayload {
+	running := int(s.running.Load())
+
+	base.Running = running
+	base.Slots = s.slots
+	if s.slots > 0 {
+		base.Load = float64(running) / float64(s.slots)
+	}
+	return base
 }
 
 // Implements POST /execute on the agent.
-// For v1, "execution" just means: log the job, sleep for a bit
-func executeHandler(w http.ResponseWriter, r *http.Request) {
+// The job is handed to the executor registered for its type. By default it
+// runs to completion and the result is the response; async jobs are
+// acknowledged with 202 and their outcome reported to the coordinator.
+func (s *server) executeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -31,18 +192,125 @@ func executeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("agent: starting execution of job %s (type=%s, payload=%q)", req.JobID, req.Type, req.Payload)
+	executor, ok := s.executors.Get(req.Type)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errorResponse{
+			Code:           "unknown_type",
+			Message:        fmt.Sprintf("job type %q is not supported by this agent", req.Type),
+			SupportedTypes: s.executors.Types(),
+		})
+		return
+	}
+
+	// An async job outlives this request, so it must not inherit its context.
+	async := req.Async && s.coordURL != ""
+	parent := r.Context()
+	if async {
+		parent = context.Background()
+	}
 
-	// dummy work to simulate doing something.
-	time.Sleep(2 * time.Second)
+	ctx, done, err := s.tasks.start(parent, req)
+	if err != nil {
+		writeError(w, http.StatusConflict, errorResponse{
+			Code:    "not_runnable",
+			Message: err.Error(),
+		})
+		return
+	}
 
-	log.Printf("agent: finished execution of job %s", req.JobID)
+	if async {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(acceptedResponse{JobID: req.JobID, Attempt: req.Attempt, Status: "accepted"}); err != nil {
+			log.Printf("agent: failed to encode /execute response: %v", err)
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]string{
-		"status": "ok",
+		go s.runAsync(ctx, done, req, executor)
+		return
 	}
+	defer done()
+
+	resp, err := s.runJob(ctx, req, executor)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorResponse{
+			Code:    "invalid_payload",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("agent: failed to encode /execute response: %v", err)
 	}
 }
+
+// runJob runs req with executor under ctx, streaming its output to the
+// coordinator when configured. An error means the payload was rejected.
+func (s *server) runJob(ctx context.Context, req executeRequest, executor Executor) (executeResponse, error) {
+	if req.TimeoutMS > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, time.Duration(req.TimeoutMS)*time.Millisecond)
+		defer stop()
+	}
+
+	var shipper *logShipper
+	if s.coordURL != "" {
+		shipper = startLogShipper(s.coordURL, s.nodeID, req, s.client())
+		ctx = withOutputStreams(ctx, shipper.Writer("stdout"), shipper.Writer("stderr"))
+	}
+
+	log.Printf("agent: starting execution of job %s (type=%s)", req.JobID, req.Type)
+
+	s.running.Add(1)
+	started := time.Now()
+	resp, err := executor.Execute(ctx, req.Payload)
+	s.running.Add(-1)
+
+	// Ship the last of the output before the coordinator hears the job is done.
+	if shipper != nil {
+		shipper.Close()
+	}
+	if err != nil {
+		return executeResponse{}, err
+	}
+
+	resp.JobID = req.JobID
+	resp.DurationMS = time.Since(started).Milliseconds()
+	switch {
+	case s.tasks.wasCancelled(req.JobID):
+		resp.Status = "cancelled"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		resp.Status = "timed_out"
+		resp.Error = fmt.Sprintf("job exceeded its %s timeout", time.Duration(req.TimeoutMS)*time.Millisecond)
+	}
+
+	log.Printf("agent: finished execution of job %s (status=%s, exit=%d)", req.JobID, resp.Status, resp.ExitCode)
+	return resp, nil
+}
+
+// runAsync runs req and reports its progress and outcome to the
+// coordinator, calling done when finished.
+func (s *server) runAsync(ctx context.Context, done func(), req executeRequest, executor Executor) {
+	defer done()
+	s.reportStatus(taskStatus{JobID: req.JobID, Attempt: req.Attempt, LeaseToken: req.LeaseToken, State: taskStateRunning})
+	resp, err := s.runJob(ctx, req, executor)
+	s.reportStatus(finalStatus(req, resp, err))
+}
+
+// client returns the HTTP client used to talk to the coordinator.
+func (s *server) client() *http.Client {
+	if s.coordClient != nil {
+		return s.coordClient
+	}
+	return http.DefaultClient
+}
+
+// writeError writes a structured JSON error with the given status code.
+func writeError(w http.ResponseWriter, code int, body errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("agent: failed to encode error response: %v", err)
+	}
+}
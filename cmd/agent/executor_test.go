@@ -6,13 +6,26 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
-func TestExecuteHandlerSuccess(t *testing.T) {
+// newTestServer returns an agent server with every built-in executor.
+func newTestServer() *server {
+	return &server{executors: defaultExecutors()}
+}
+
+// postExecute sends an execute request for spec through executeHandler.
+func postExecute(t *testing.T, jobID string, spec commandSpec) *http.Response {
+	t.Helper()
+
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("failed to marshal spec: %v", err)
+	}
 	payload := executeRequest{
-		JobID:   "job-1",
-		Type:    "echo",
-		Payload: "hello",
+		JobID:   jobID,
+		Type:    "exec",
+		Payload: string(specBytes),
 	}
 	bodyBytes, err := json.Marshal(payload)
 	if err != nil {
@@ -23,22 +36,112 @@ func TestExecuteHandlerSuccess(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	executeHandler(w, req)
+	newTestServer().executeHandler(w, req)
 
-	res := w.Result()
+	return w.Result()
+}
+
+func TestExecuteHandlerSuccess(t *testing.T) {
+	res := postExecute(t, "job-1", commandSpec{
+		Executable: "sh",
+		Args:       []string{"-c", "echo $GREETING; echo oops >&2"},
+		Env:        map[string]string{"GREETING": "hello"},
+	})
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
 
-	var resp map[string]string
+	var resp executeResponse
 	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
 
-	if resp["status"] != "ok" {
-		t.Fatalf("expected status 'ok', got %q", resp["status"])
+	if resp.Status != "ok" {
+		t.Fatalf("expected status 'ok', got %q", resp.Status)
+	}
+	if resp.ExitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d", resp.ExitCode)
+	}
+	if resp.Stdout != "hello\n" {
+		t.Fatalf("expected stdout %q, got %q", "hello\n", resp.Stdout)
+	}
+	if resp.Stderr != "oops\n" {
+		t.Fatalf("expected stderr %q, got %q", "oops\n", resp.Stderr)
+	}
+}
+
+func TestExecuteHandlerNonZeroExit(t *testing.T) {
+	res := postExecute(t, "job-2", commandSpec{
+		Executable: "sh",
+		Args:       []string{"-c", "exit 3"},
+	})
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var resp executeResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if resp.Status != "failed" {
+		t.Fatalf("expected status 'failed', got %q", resp.Status)
+	}
+	if resp.ExitCode != 3 {
+		t.Fatalf("expected exit code 3, got %d", resp.ExitCode)
+	}
+}
+
+func TestExecuteHandlerTimeout(t *testing.T) {
+	body, _ := json.Marshal(executeRequest{
+		JobID:     "job-timeout",
+		Type:      "shell",
+		Payload:   "sleep 30",
+		TimeoutMS: 100,
+	})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	newTestServer().executeHandler(w, httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(body)))
+
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("expected the job to be killed at its timeout, took %s", took)
+	}
+
+	var resp executeResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Status != "timed_out" {
+		t.Fatalf("expected status 'timed_out', got %q", resp.Status)
+	}
+}
+
+func TestExecuteHandlerInvalidPayload(t *testing.T) {
+	payload := executeRequest{
+		JobID:   "job-1",
+		Type:    "exec",
+		Payload: "hello",
+	}
+	bodyBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(bodyBytes))
+	w := httptest.NewRecorder()
+
+	newTestServer().executeHandler(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for non-JSON payload, got %d", res.StatusCode)
 	}
 }
 
@@ -46,7 +149,7 @@ func TestExecuteHandlerInvalidJSON(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader([]byte("not-json")))
 	w := httptest.NewRecorder()
 
-	executeHandler(w, req)
+	newTestServer().executeHandler(w, req)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -69,7 +172,7 @@ func TestExecuteHandlerMissingJobID(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(bodyBytes))
 	w := httptest.NewRecorder()
 
-	executeHandler(w, req)
+	newTestServer().executeHandler(w, req)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -78,3 +181,51 @@ func TestExecuteHandlerMissingJobID(t *testing.T) {
 		t.Fatalf("expected status 400 for missing job_id, got %d", res.StatusCode)
 	}
 }
+
+func TestExecuteHandlerUnknownType(t *testing.T) {
+	payload := executeRequest{
+		JobID:   "job-1",
+		Type:    "gpu-render",
+		Payload: "{}",
+	}
+	bodyBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(bodyBytes))
+	w := httptest.NewRecorder()
+
+	newTestServer().executeHandler(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for unknown type, got %d", res.StatusCode)
+	}
+
+	var resp errorResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if resp.Code != "unknown_type" {
+		t.Fatalf("expected code unknown_type, got %q", resp.Code)
+	}
+	if len(resp.SupportedTypes) == 0 {
+		t.Fatalf("expected supported types to be listed")
+	}
+}
+
+func TestServerWithLoad(t *testing.T) {
+	s := &server{executors: defaultExecutors(), slots: 4}
+	s.running.Add(1)
+
+	p := s.withLoad(registerPayload{ID: "agent-1"})
+	if p.ID != "agent-1" {
+		t.Fatalf("expected base fields to be kept, got id %q", p.ID)
+	}
+	if p.Running != 1 || p.Slots != 4 || p.Load != 0.25 {
+		t.Fatalf("expected running=1 slots=4 load=0.25, got running=%d slots=%d load=%v", p.Running, p.Slots, p.Load)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxFetchBody bounds how much of an http-fetch response is kept.
+const maxFetchBody = 1 << 20
+
+// fetchClient makes http-fetch requests. Its timeout bounds a fetch even
+// when the job has no runtime limit, so a server that never answers can't
+// hold the agent's slot forever.
+var fetchClient = &http.Client{Timeout: 5 * time.Minute}
+
+// commandSpec describes the process an "exec" job runs.
+// It is carried as JSON in the job payload.
+type commandSpec struct {
+	Executable string            `json:"executable"`
+	Args       []string          `json:"args,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Dir        string            `json:"dir,omitempty"`
+}
+
+// scriptSpec describes a "script" job: source written to a temp file
+// and run by Interpreter (default "sh").
+type scriptSpec struct {
+	Interpreter string            `json:"interpreter,omitempty"`
+	Source      string            `json:"source"`
+	Args        []string          `json:"args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Dir         string            `json:"dir,omitempty"`
+}
+
+// fetchSpec describes an "http-fetch" job.
+type fetchSpec struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// execExecutor runs the process described by a commandSpec payload.
+type execExecutor struct{}
+
+func (execExecutor) Execute(ctx context.Context, payload string) (executeResponse, error) {
+	var spec commandSpec
+	if err := json.Unmarshal([]byte(payload), &spec); err != nil {
+		return executeResponse{}, fmt.Errorf("payload must be a JSON command spec: %w", err)
+	}
+	if spec.Executable == "" {
+		return executeResponse{}, errors.New("payload executable is required")
+	}
+	return runCommand(ctx, spec), nil
+}
+
+// echoExecutor returns the payload as stdout without starting a process.
+type echoExecutor struct{}
+
+func (echoExecutor) Execute(ctx context.Context, payload string) (executeResponse, error) {
+	return executeResponse{Status: "ok", Stdout: payload}, nil
+}
+
+// shellExecutor runs the payload as a `sh -c` command line.
+type shellExecutor struct{}
+
+func (shellExecutor) Execute(ctx context.Context, payload string) (executeResponse, error) {
+	if payload == "" {
+		return executeResponse{}, errors.New("payload must be a shell command")
+	}
+	return runCommand(ctx, commandSpec{Executable: "sh", Args: []string{"-c", payload}}), nil
+}
+
+// scriptExecutor writes the script source to a temp file and runs it.
+type scriptExecutor struct{}
+
+func (scriptExecutor) Execute(ctx context.Context, payload string) (executeResponse, error) {
+	var spec scriptSpec
+	if err := json.Unmarshal([]byte(payload), &spec); err != nil {
+		return executeResponse{}, fmt.Errorf("payload must be a JSON script spec: %w", err)
+	}
+	if spec.Source == "" {
+		return executeResponse{}, errors.New("payload source is required")
+	}
+	if spec.Interpreter == "" {
+		spec.Interpreter = "sh"
+	}
+
+	f, err := os.CreateTemp("", "mesh-script-*")
+	if err != nil {
+		return failedResponse(-1, fmt.Errorf("create script file: %w", err)), nil
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(spec.Source); err != nil {
+		f.Close()
+		return failedResponse(-1, fmt.Errorf("write script file: %w", err)), nil
+	}
+	if err := f.Close(); err != nil {
+		return failedResponse(-1, fmt.Errorf("close script file: %w", err)), nil
+	}
+
+	return runCommand(ctx, commandSpec{
+		Executable: spec.Interpreter,
+		Args:       append([]string{f.Name()}, spec.Args...),
+		Env:        spec.Env,
+		Dir:        spec.Dir,
+	}), nil
+}
+
+// httpFetchExecutor performs an HTTP request and returns the body as stdout.
+// Non-2xx responses count as a failed job with exit code 1.
+type httpFetchExecutor struct{}
+
+func (httpFetchExecutor) Execute(ctx context.Context, payload string) (executeResponse, error) {
+	var spec fetchSpec
+	if err := json.Unmarshal([]byte(payload), &spec); err != nil {
+		return executeResponse{}, fmt.Errorf("payload must be a JSON fetch spec: %w", err)
+	}
+	if spec.URL == "" {
+		return executeResponse{}, errors.New("payload url is required")
+	}
+	if spec.Method == "" {
+		spec.Method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, spec.Method, spec.URL, nil)
+	if err != nil {
+		return executeResponse{}, fmt.Errorf("build request: %w", err)
+	}
+	for k, v := range spec.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return failedResponse(-1, err), nil
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBody))
+	if err != nil {
+		return failedResponse(-1, fmt.Errorf("read body: %w", err)), nil
+	}
+
+	out := executeResponse{Status: "ok"}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		out = failedResponse(1, fmt.Errorf("unexpected status: %s", resp.Status))
+	}
+	out.Stdout, out.StdoutTruncated = truncateTail(string(body), maxOutputBytes)
+	out.Outputs = map[string]string{"status_code": strconv.Itoa(resp.StatusCode)}
+	return out, nil
+}
+
+// failedResponse builds a failed result for err with the given exit code.
+func failedResponse(exitCode int, err error) executeResponse {
+	return executeResponse{
+		Status:   "failed",
+		ExitCode: exitCode,
+		Error:    err.Error(),
+	}
+}
+
+// runCommand runs spec and captures its output and exit code.
+// A process that cannot be started is reported with exit code -1.
+func runCommand(ctx context.Context, spec commandSpec) executeResponse {
+	cmd := exec.CommandContext(ctx, spec.Executable, spec.Args...)
+	cmd.Dir = spec.Dir
+	cmd.Env = buildEnv(spec.Env)
+	configureProcessTree(cmd)
+
+	// Don't wait forever for output pipes held open by stray children.
+	cmd.WaitDelay = 2 * time.Second
+
+	stdout := newTailBuffer(maxOutputBytes)
+	stderr := newTailBuffer(maxOutputBytes)
+	liveOut, liveErr := streamsFrom(ctx)
+	cmd.Stdout = io.MultiWriter(stdout, liveOut)
+	cmd.Stderr = io.MultiWriter(stderr, liveErr)
+
+	// The job reports output values as key=value lines in this file.
+	outputPath := ""
+	if f, err := os.CreateTemp("", "mesh-output-*"); err == nil {
+		outputPath = f.Name()
+		f.Close()
+		defer os.Remove(outputPath)
+		cmd.Env = append(cmd.Env, outputFileEnv+"="+outputPath)
+	}
+
+	err := cmd.Run()
+
+	resp := executeResponse{Status: "ok"}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		resp = failedResponse(exitErr.ExitCode(), err)
+	default:
+		resp = failedResponse(-1, err)
+	}
+
+	resp.Stdout, resp.StdoutTruncated = stdout.Result()
+	resp.Stderr, resp.StderrTruncated = stderr.Result()
+	if cmd.ProcessState != nil {
+		resp.Usage = processUsage(cmd.ProcessState)
+	}
+	if outputPath != "" {
+		outputs, err := readOutputs(outputPath)
+		if err != nil {
+			log.Printf("agent: failed to read job outputs: %v", err)
+		}
+		resp.Outputs = outputs
+	}
+	return resp
+}
+
+// buildEnv appends the job's variables to the agent's own environment.
+// Keys are sorted so the resulting order is stable.
+func buildEnv(extra map[string]string) []string {
+	env := os.Environ()
+
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, extra[k]))
+	}
+	return env
+}
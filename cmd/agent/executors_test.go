@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExecutorRegistryTypesAndRestrict(t *testing.T) {
+	r := defaultExecutors()
+
+	want := []string{"echo", "exec", "http-fetch", "script", "shell"}
+	if got := r.Types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected types %v, got %v", want, got)
+	}
+
+	if err := r.Restrict([]string{"echo", " exec "}); err != nil {
+		t.Fatalf("unexpected error restricting registry: %v", err)
+	}
+	if got := r.Types(); !reflect.DeepEqual(got, []string{"echo", "exec"}) {
+		t.Fatalf("expected restricted types [echo exec], got %v", got)
+	}
+	if _, ok := r.Get("shell"); ok {
+		t.Fatalf("expected shell executor to be removed")
+	}
+
+	if err := r.Restrict([]string{"nope"}); err == nil {
+		t.Fatalf("expected error restricting to an unknown type, got nil")
+	}
+}
+
+// Test that a fetch from a server that never answers gives up
+func TestHTTPFetchTimesOut(t *testing.T) {
+	defer func(c *http.Client) { fetchClient = c }(fetchClient)
+	fetchClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer hung.Close()
+	defer close(release)
+
+	resp, err := httpFetchExecutor{}.Execute(context.Background(), `{"url":"`+hung.URL+`"}`)
+	if err != nil || resp.Status != "failed" || resp.ExitCode != -1 {
+		t.Fatalf("expected the fetch to fail, got %+v (%v)", resp, err)
+	}
+}
+
+func TestBuiltinExecutors(t *testing.T) {
+	fetchServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("fetched"))
+	}))
+	defer fetchServer.Close()
+
+	tests := []struct {
+		name     string
+		executor Executor
+		payload  string
+		status   string
+		exitCode int
+		stdout   string
+	}{
+		{"echo", echoExecutor{}, "hello", "ok", 0, "hello"},
+		{"shell", shellExecutor{}, "echo hi && exit 0", "ok", 0, "hi\n"},
+		{"shell failure", shellExecutor{}, "exit 7", "failed", 7, ""},
+		{"script", scriptExecutor{}, `{"source":"echo \"$1\"","args":["from-script"]}`, "ok", 0, "from-script\n"},
+		{"http-fetch", httpFetchExecutor{}, `{"url":"` + fetchServer.URL + `/ok"}`, "ok", 0, "fetched"},
+		{"http-fetch 404", httpFetchExecutor{}, `{"url":"` + fetchServer.URL + `/missing"}`, "failed", 1, "404 page not found\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.executor.Execute(context.Background(), tt.payload)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Status != tt.status {
+				t.Errorf("expected status %q, got %q", tt.status, resp.Status)
+			}
+			if resp.ExitCode != tt.exitCode {
+				t.Errorf("expected exit code %d, got %d", tt.exitCode, resp.ExitCode)
+			}
+			if resp.Stdout != tt.stdout {
+				t.Errorf("expected stdout %q, got %q", tt.stdout, resp.Stdout)
+			}
+		})
+	}
+}
+
+func TestBuiltinExecutorsRejectBadPayloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		executor Executor
+		payload  string
+	}{
+		{"exec not JSON", execExecutor{}, "ls"},
+		{"exec missing executable", execExecutor{}, `{"args":["x"]}`},
+		{"shell empty", shellExecutor{}, ""},
+		{"script missing source", scriptExecutor{}, `{"interpreter":"sh"}`},
+		{"http-fetch missing url", httpFetchExecutor{}, `{}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.executor.Execute(context.Background(), tt.payload); err == nil {
+				t.Fatalf("expected error for payload %q, got nil", tt.payload)
+			}
+		})
+	}
+}
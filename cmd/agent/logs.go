@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// logFlushInterval is how often buffered output is sent to the coordinator.
+	logFlushInterval = 500 * time.Millisecond
+	// logFlushBytes sends a batch early once this much output is buffered.
+	logFlushBytes = 32 << 10
+	// maxPendingLogBytes bounds output buffered while the coordinator is
+	// slow or unreachable; anything beyond it is dropped and reported.
+	maxPendingLogBytes = 1 << 20
+)
+
+// logChunk is one piece of a job's output.
+// Stream is "stdout", "stderr", or "agent" for notes from the agent itself.
+type logChunk struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// logBatch is what the agent POSTs to the coordinator's /jobs/{id}/logs,
+// under the node and lease token the attempt was dispatched with.
+type logBatch struct {
+	Attempt    int        `json:"attempt"`
+	NodeID     string     `json:"node_id"`
+	LeaseToken uint64     `json:"lease_token"`
+	Chunks     []logChunk `json:"chunks"`
+}
+
+// outputStreamsKey carries extra stdout/stderr writers through an executor's context.
+type outputStreamsKey struct{}
+
+type outputStreams struct {
+	stdout, stderr io.Writer
+}
+
+// withOutputStreams returns a context asking executors to copy the job's
+// output to stdout and stderr as it is produced.
+func withOutputStreams(ctx context.Context, stdout, stderr io.Writer) context.Context {
+	return context.WithValue(ctx, outputStreamsKey{}, outputStreams{stdout: stdout, stderr: stderr})
+}
+
+// streamsFrom returns the writers set by withOutputStreams, or io.Discard.
+func streamsFrom(ctx context.Context) (stdout, stderr io.Writer) {
+	s, ok := ctx.Value(outputStreamsKey{}).(outputStreams)
+	if !ok {
+		return io.Discard, io.Discard
+	}
+	return s.stdout, s.stderr
+}
+
+// logShipper streams a running job's output to the coordinator in batches.
+// Writes never block on the network.
+type logShipper struct {
+	url        string
+	attempt    int
+	nodeID     string
+	leaseToken uint64
+	client     *http.Client
+
+	mu      sync.Mutex
+	pending []logChunk
+	size    int
+	dropped int
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startLogShipper starts shipping output of req's attempt to coordBaseURL
+// on behalf of nodeID.
+func startLogShipper(coordBaseURL, nodeID string, req executeRequest, client *http.Client) *logShipper {
+	l := &logShipper{
+		url:        coordBaseURL + "/jobs/" + url.PathEscape(req.JobID) + "/logs",
+		attempt:    req.Attempt,
+		nodeID:     nodeID,
+		leaseToken: req.LeaseToken,
+		client:     client,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Writer returns an io.Writer that ships everything written to it on stream.
+func (l *logShipper) Writer(stream string) io.Writer {
+	return streamWriter{l: l, stream: stream}
+}
+
+type streamWriter struct {
+	l      *logShipper
+	stream string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.l.add(w.stream, p)
+	return len(p), nil
+}
+
+func (l *logShipper) add(stream string, p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size+len(p) > maxPendingLogBytes {
+		l.dropped += len(p)
+		return
+	}
+	// Merge consecutive writes to the same stream into one chunk.
+	if n := len(l.pending); n > 0 && l.pending[n-1].Stream == stream {
+		l.pending[n-1].Data += string(p)
+	} else {
+		l.pending = append(l.pending, logChunk{Stream: stream, Data: string(p)})
+	}
+	l.size += len(p)
+
+	if l.size >= logFlushBytes {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close sends whatever is still buffered and stops the shipper.
+func (l *logShipper) Close() {
+	close(l.done)
+	<-l.stopped
+}
+
+func (l *logShipper) run() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			l.flush()
+			return
+		case <-ticker.C:
+		case <-l.wake:
+		}
+		l.flush()
+	}
+}
+
+// flush sends the buffered chunks. A batch the coordinator doesn't take is
+// dropped rather than retried, so a dead coordinator can't stall the job.
+func (l *logShipper) flush() {
+	l.mu.Lock()
+	chunks := l.pending
+	if l.dropped > 0 {
+		chunks = append(chunks, logChunk{Stream: "agent", Data: fmt.Sprintf("[... %d bytes of output dropped ...]\n", l.dropped)})
+	}
+	l.pending, l.size, l.dropped = nil, 0, 0
+	l.mu.Unlock()
+
+	if len(chunks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(logBatch{Attempt: l.attempt, NodeID: l.nodeID, LeaseToken: l.leaseToken, Chunks: chunks})
+	if err != nil {
+		log.Printf("agent: failed to marshal log batch: %v", err)
+		return
+	}
+	resp, err := l.client.Post(l.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("agent: failed to ship logs to %s: %v", l.url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		log.Printf("agent: coordinator refused logs: %s", resp.Status)
+	}
+}
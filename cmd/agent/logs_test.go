@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test that a job's output reaches the coordinator before /execute returns
+func TestExecuteHandlerStreamsLogs(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		paths   []string
+		batches []logBatch
+	)
+	coord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b logBatch
+		_ = json.NewDecoder(r.Body).Decode(&b)
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		batches = append(batches, b)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer coord.Close()
+
+	srv := newTestServer()
+	srv.coordURL = coord.URL
+	srv.nodeID = "node-1"
+
+	body, _ := json.Marshal(executeRequest{
+		JobID:      "job-7",
+		Type:       "shell",
+		Payload:    "echo one; echo oops >&2; echo two",
+		Attempt:    2,
+		LeaseToken: 9,
+	})
+	w := httptest.NewRecorder()
+	srv.executeHandler(w, httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var stdout, stderr strings.Builder
+	for i, b := range batches {
+		if paths[i] != "/jobs/job-7/logs" || b.Attempt != 2 || b.NodeID != "node-1" || b.LeaseToken != 9 {
+			t.Fatalf("unexpected batch %d: path %s attempt %d node %q lease %d", i, paths[i], b.Attempt, b.NodeID, b.LeaseToken)
+		}
+		for _, c := range b.Chunks {
+			switch c.Stream {
+			case "stdout":
+				stdout.WriteString(c.Data)
+			case "stderr":
+				stderr.WriteString(c.Data)
+			}
+		}
+	}
+	if stdout.String() != "one\ntwo\n" || stderr.String() != "oops\n" {
+		t.Fatalf("unexpected streamed output: stdout %q stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+// Test that output beyond the pending limit is dropped and reported
+func TestLogShipperDropsWhenFull(t *testing.T) {
+	l := &logShipper{wake: make(chan struct{}, 1)}
+	l.add("stdout", make([]byte, maxPendingLogBytes))
+	l.add("stdout", []byte("lost"))
+
+	if l.size != maxPendingLogBytes || l.dropped != 4 {
+		t.Fatalf("expected 4 bytes dropped at the limit, got size %d dropped %d", l.size, l.dropped)
+	}
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"log"
 	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // main wires config, coordinator registration, heartbeat, and HTTP server.
@@ -11,18 +15,74 @@ func main() {
 	coordURL := getEnv("COORDINATOR_URL", "http://localhost:8080")
 	nodeID := getEnv("NODE_ID", defaultNodeID())
 
-	if err := registerWithCoordinator(coordURL, nodeID, addr); err != nil {
+	// Executors for every job type this agent accepts.
+	// AGENT_JOB_TYPES optionally narrows the built-in set, e.g. "echo,exec".
+	executors := defaultExecutors()
+	if allowed := getEnv("AGENT_JOB_TYPES", ""); allowed != "" {
+		if err := executors.Restrict(strings.Split(allowed, ",")); err != nil {
+			log.Fatalf("[agent] invalid AGENT_JOB_TYPES: %v", err)
+		}
+	}
+	// AGENT_SLOTS is how many jobs the coordinator may run here at once.
+	slots, err := strconv.Atoi(getEnv("AGENT_SLOTS", strconv.Itoa(runtime.NumCPU())))
+	if err != nil || slots < 1 {
+		log.Fatalf("[agent] invalid AGENT_SLOTS: must be a positive integer")
+	}
+
+	// AGENT_LABELS are free-form key=value tags jobs can select on, e.g. "gpu=nvidia,zone=lab-1".
+	labels, err := parseLabels(getEnv("AGENT_LABELS", ""))
+	if err != nil {
+		log.Fatalf("[agent] invalid AGENT_LABELS: %v", err)
+	}
+
+	srv := &server{
+		executors:   executors,
+		slots:       slots,
+		coordURL:    coordURL,
+		coordClient: &http.Client{Timeout: 10 * time.Second},
+		nodeID:      nodeID,
+	}
+
+	// AGENT_MODE=pull fetches work from the coordinator instead of waiting
+	// for it on /execute, for agents the coordinator can't reach (e.g. behind NAT).
+	mode := getEnv("AGENT_MODE", "push")
+	if mode != "push" && mode != "pull" {
+		log.Fatalf("[agent] invalid AGENT_MODE: must be push or pull")
+	}
+
+	base := registerPayload{
+		ID:       nodeID,
+		Address:  addr, // For now we just send the listen address (e.g., ":8081").
+		JobTypes: executors.Types(),
+	}
+	if mode == "pull" {
+		base.Address = ""
+		base.Mode = mode
+	}
+	payload := func() registerPayload {
+		p := srv.withLoad(base)
+		p.Capabilities = discoverCapabilities(labels)
+		p.Leases = srv.tasks.leases()
+		return p
+	}
+
+	if _, err := registerWithCoordinator(coordURL, payload()); err != nil {
 		log.Printf("[agent] failed to register with coordinator: %v", err)
 	} else {
-		log.Printf("[agent] registered with coordinator as %q", nodeID)
+		log.Printf("[agent] registered with coordinator as %q (job types: %v, slots: %d)", nodeID, base.JobTypes, slots)
 	}
 
 	// Start periodic heartbeat
-	startHeartbeatLoop(coordURL, nodeID, addr)
+	startHeartbeatLoop(coordURL, payload, srv.revokeLeases)
+
+	if mode == "pull" {
+		go srv.runPullLoop(make(chan struct{}))
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", healthHandler)
-	mux.HandleFunc("/execute", executeHandler)
+	mux.HandleFunc("/execute", srv.executeHandler)
+	mux.HandleFunc("/cancel", srv.cancelHandler)
 
 	log.Printf("[agent] starting on %s\n", addr)
 	if err := http.ListenAndServe(addr, mux); err != nil {
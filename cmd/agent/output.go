@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxOutputBytes bounds how much of each of a job's stdout and stderr is
+// returned; anything before the last maxOutputBytes is dropped.
+const maxOutputBytes = 64 << 10
+
+// maxOutputValues bounds how much of a job's output file is read.
+const maxOutputValues = 64 << 10
+
+// outputFileEnv names the variable holding the path a job writes
+// key=value output lines to.
+const outputFileEnv = "MESH_OUTPUT_FILE"
+
+// truncationMarker prefixes an output whose beginning was dropped.
+const truncationMarker = "[... %d bytes truncated ...]\n"
+
+// resourceUsage is what the agent measured of a job's process.
+type resourceUsage struct {
+	UserCPUMS   int64 `json:"user_cpu_ms"`
+	SystemCPUMS int64 `json:"system_cpu_ms"`
+	MaxRSSKB    int64 `json:"max_rss_kb,omitempty"`
+}
+
+// tailBuffer is an io.Writer that keeps only the last limit bytes written
+// and counts the rest.
+type tailBuffer struct {
+	limit   int
+	buf     []byte
+	dropped int64
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= t.limit {
+		t.dropped += int64(len(t.buf) + len(p) - t.limit)
+		t.buf = append(t.buf[:0], p[len(p)-t.limit:]...)
+		return n, nil
+	}
+
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.limit; over > 0 {
+		t.dropped += int64(over)
+		t.buf = t.buf[:copy(t.buf, t.buf[over:])]
+	}
+	return n, nil
+}
+
+// Result returns the kept output, prefixed with truncationMarker when
+// anything was dropped, and whether it was.
+func (t *tailBuffer) Result() (string, bool) {
+	if t.dropped == 0 {
+		return string(t.buf), false
+	}
+	return fmt.Sprintf(truncationMarker, t.dropped) + string(t.buf), true
+}
+
+// truncateTail caps s to its last limit bytes the same way tailBuffer does.
+func truncateTail(s string, limit int) (string, bool) {
+	t := newTailBuffer(limit)
+	_, _ = io.WriteString(t, s)
+	return t.Result()
+}
+
+// readOutputs parses the key=value lines a job wrote to path.
+// Blank lines and lines without "=" are ignored; later keys win.
+func readOutputs(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	outputs := make(map[string]string)
+	sc := bufio.NewScanner(io.LimitReader(f, maxOutputValues))
+	sc.Buffer(make([]byte, 0, 4096), maxOutputValues)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		outputs[key] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(outputs) == 0 {
+		return nil, nil
+	}
+	return outputs, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTailBufferKeepsLastBytes(t *testing.T) {
+	tb := newTailBuffer(4)
+	for _, chunk := range []string{"ab", "cd", "ef"} {
+		_, _ = tb.Write([]byte(chunk))
+	}
+
+	got, truncated := tb.Result()
+	if !truncated {
+		t.Fatalf("expected output to be truncated")
+	}
+	if want := "[... 2 bytes truncated ...]\ncdef"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	if got, truncated := truncateTail("short", 10); got != "short" || truncated {
+		t.Fatalf("expected short output untouched, got %q (truncated=%v)", got, truncated)
+	}
+	if got, _ := truncateTail("0123456789", 3); !strings.HasSuffix(got, "\n789") {
+		t.Fatalf("expected the tail to be kept, got %q", got)
+	}
+}
+
+func TestReadOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs")
+	if err := os.WriteFile(path, []byte("count=3\n\nnot a pair\nurl=http://x/?a=b\ncount=4\n"), 0o644); err != nil {
+		t.Fatalf("write outputs: %v", err)
+	}
+
+	got, err := readOutputs(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || got["count"] != "4" || got["url"] != "http://x/?a=b" {
+		t.Fatalf("unexpected outputs: %v", got)
+	}
+}
+
+func TestRunCommandResult(t *testing.T) {
+	script := `echo "answer=42" >> "$MESH_OUTPUT_FILE"; head -c 70000 /dev/zero | tr '\0' x`
+	resp := runCommand(context.Background(), commandSpec{Executable: "sh", Args: []string{"-c", script}})
+
+	if resp.Status != "ok" {
+		t.Fatalf("expected status ok, got %q (%s)", resp.Status, resp.Error)
+	}
+	if resp.Outputs["answer"] != "42" {
+		t.Fatalf("expected output answer=42, got %v", resp.Outputs)
+	}
+	if !resp.StdoutTruncated || !strings.HasPrefix(resp.Stdout, "[... ") {
+		t.Fatalf("expected stdout to be truncated with a marker, got %d bytes", len(resp.Stdout))
+	}
+	if resp.Usage == nil {
+		t.Fatalf("expected resource usage to be reported")
+	}
+}
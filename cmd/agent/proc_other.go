@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// configureProcessTree keeps the default behaviour of killing only the
+// direct child; process groups are not available on this platform.
+func configureProcessTree(cmd *exec.Cmd) {}
+
+// processUsage reports the CPU time of a finished process.
+func processUsage(state *os.ProcessState) *resourceUsage {
+	return &resourceUsage{
+		UserCPUMS:   state.UserTime().Milliseconds(),
+		SystemCPUMS: state.SystemTime().Milliseconds(),
+	}
+}
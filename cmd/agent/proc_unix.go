@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// configureProcessTree puts cmd in its own process group and makes context
+// cancellation kill the whole group, so children the job spawned die too.
+func configureProcessTree(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// processUsage reports the CPU time and peak memory of a finished process.
+func processUsage(state *os.ProcessState) *resourceUsage {
+	usage := &resourceUsage{
+		UserCPUMS:   state.UserTime().Milliseconds(),
+		SystemCPUMS: state.SystemTime().Milliseconds(),
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSSKB = int64(ru.Maxrss)
+		// darwin reports bytes where Linux and the BSDs report kilobytes.
+		if runtime.GOOS == "darwin" {
+			usage.MaxRSSKB /= 1024
+		}
+	}
+	return usage
+}
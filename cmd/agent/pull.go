@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// pollWait is how long the coordinator may hold a poll open; with no
+	// free slots the agent polls with pollWaitFull so a finishing job is
+	// noticed sooner.
+	pollWait     = 30 * time.Second
+	pollWaitFull = 5 * time.Second
+
+	// pollRetryMax caps the wait between polls while the coordinator is unreachable.
+	pollRetryMax = 30 * time.Second
+)
+
+// pollResponse mirrors the coordinator's GET /tasks/next response.
+type pollResponse struct {
+	Tasks  []executeRequest `json:"tasks"`
+	Cancel []string         `json:"cancel,omitempty"`
+}
+
+// runPullLoop long-polls the coordinator for work until stop is closed.
+// It is used instead of /execute when the agent can't be reached inbound.
+func (s *server) runPullLoop(stop <-chan struct{}) {
+	client := &http.Client{Timeout: pollWait + 15*time.Second}
+	retry := time.Second
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		free := max(s.slots-s.tasks.count(), 0)
+		wait := pollWait
+		if free == 0 {
+			wait = pollWaitFull
+		}
+
+		resp, err := s.poll(client, free, wait)
+		if err != nil {
+			log.Printf("agent: poll failed: %v; retrying in %s", err, retry)
+			select {
+			case <-stop:
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, pollRetryMax)
+			continue
+		}
+		retry = time.Second
+
+		for _, jobID := range resp.Cancel {
+			wasRunning := s.tasks.cancel(jobID)
+			log.Printf("agent: cancelled job %s (was running: %v)", jobID, wasRunning)
+		}
+		for _, req := range resp.Tasks {
+			s.startPulled(req)
+		}
+	}
+}
+
+// poll makes one GET /tasks/next call offering free slots.
+func (s *server) poll(client *http.Client, free int, wait time.Duration) (pollResponse, error) {
+	q := url.Values{}
+	q.Set("node_id", s.nodeID)
+	q.Set("slots", strconv.Itoa(free))
+	q.Set("wait", wait.String())
+
+	resp, err := client.Get(s.coordURL + "/tasks/next?" + q.Encode())
+	if err != nil {
+		return pollResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return pollResponse{}, fmt.Errorf("unexpected status from coordinator: %s", resp.Status)
+	}
+
+	var out pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return pollResponse{}, fmt.Errorf("decode poll response: %w", err)
+	}
+	return out, nil
+}
+
+// startPulled starts a task fetched from the coordinator in the background.
+// A task it can't start is reported as rejected, under the task's lease, so
+// the coordinator fails it instead of waiting for the lease to lapse.
+func (s *server) startPulled(req executeRequest) {
+	executor, ok := s.executors.Get(req.Type)
+	if !ok {
+		s.rejectPulled(req, fmt.Errorf("job type %q is not supported by this agent", req.Type))
+		return
+	}
+
+	ctx, done, err := s.tasks.start(context.Background(), req)
+	if errors.Is(err, errTaskRunning) {
+		// handed out again after a poll response went missing
+		log.Printf("agent: job %s attempt %d is already running", req.JobID, req.Attempt)
+		return
+	}
+	if err != nil {
+		s.rejectPulled(req, err)
+		return
+	}
+	go s.runAsync(ctx, done, req, executor)
+}
+
+// rejectPulled reports in the background that req can't be run.
+func (s *server) rejectPulled(req executeRequest, err error) {
+	log.Printf("agent: not starting job %s: %v", req.JobID, err)
+	go s.reportStatus(taskStatus{
+		JobID:      req.JobID,
+		Attempt:    req.Attempt,
+		LeaseToken: req.LeaseToken,
+		State:      taskStateRejected,
+		Error:      err.Error(),
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that the pull loop runs fetched tasks, honours cancellations and reports back
+func TestPullLoop(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		polls int
+		query string
+	)
+	reports := make(chan taskStatus, 10)
+
+	coord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/tasks/next":
+			mu.Lock()
+			polls++
+			n := polls
+			if n == 1 {
+				query = r.URL.RawQuery
+			}
+			mu.Unlock()
+
+			resp := pollResponse{}
+			switch n {
+			case 1:
+				resp.Tasks = []executeRequest{
+					{JobID: "job-1", Type: "echo", Payload: "hi", Attempt: 1, Async: true},
+					{JobID: "job-2", Type: "shell", Payload: "sleep 30", Attempt: 1, Async: true},
+				}
+			case 2:
+				resp.Cancel = []string{"job-2"}
+			default:
+				time.Sleep(20 * time.Millisecond)
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		case strings.HasSuffix(r.URL.Path, "/status"):
+			var st taskStatus
+			_ = json.NewDecoder(r.Body).Decode(&st)
+			if st.State != taskStateRunning {
+				reports <- st
+			}
+		}
+	}))
+	defer coord.Close()
+
+	srv := newTestServer()
+	srv.coordURL = coord.URL
+	srv.nodeID = "laptop"
+	srv.slots = 2
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go srv.runPullLoop(stop)
+
+	got := make(map[string]string)
+	for len(got) < 2 {
+		select {
+		case st := <-reports:
+			got[st.JobID] = st.Result.Status
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for reports, got %v", got)
+		}
+	}
+	if got["job-1"] != "ok" || got["job-2"] != "cancelled" {
+		t.Fatalf("expected job-1 ok and job-2 cancelled, got %v", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(query, "node_id=laptop") || !strings.Contains(query, "slots=2") {
+		t.Fatalf("expected poll to name the node and its free slots, got %q", query)
+	}
+}
+
+// Test that a pulled task of an unsupported type is rejected under its lease
+func TestPullRejectsUnsupportedType(t *testing.T) {
+	reports := make(chan taskStatus, 1)
+	coord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var st taskStatus
+		_ = json.NewDecoder(r.Body).Decode(&st)
+		reports <- st
+	}))
+	defer coord.Close()
+
+	srv := newTestServer()
+	srv.coordURL = coord.URL
+	srv.nodeID = "laptop"
+
+	srv.startPulled(executeRequest{JobID: "job-1", Type: "teleport", Attempt: 1, LeaseToken: 7, Async: true})
+
+	select {
+	case st := <-reports:
+		if st.State != taskStateRejected || st.LeaseToken != 7 || st.NodeID != "laptop" || !strings.Contains(st.Error, "teleport") {
+			t.Fatalf("expected a rejection under lease 7, got %+v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the rejection")
+	}
+}
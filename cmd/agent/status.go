@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// States an agent reports for an async job.
+const (
+	taskStateRunning  = "running"
+	taskStateFinished = "finished"
+	taskStateRejected = "rejected"
+)
+
+// statusReportBackoff is the first wait before a final status report is
+// sent again, doubling up to statusReportMaxBackoff.
+var (
+	statusReportBackoff    = 500 * time.Millisecond
+	statusReportMaxBackoff = 30 * time.Second
+)
+
+// taskStatus is what the agent POSTs to the coordinator's /tasks/{id}/status.
+type taskStatus struct {
+	JobID   string `json:"job_id"`
+	Attempt int    `json:"attempt"`
+	NodeID  string `json:"node_id,omitempty"`
+	State   string `json:"state"`
+
+	// the fencing token the attempt was dispatched with
+	LeaseToken uint64 `json:"lease_token,omitempty"`
+
+	// set when State is "finished"
+	Result *executeResponse `json:"result,omitempty"`
+	// set when State is "rejected": why the payload could not be run
+	Error string `json:"error,omitempty"`
+}
+
+// finalStatus turns the outcome of runJob into the report sent when it ends.
+func finalStatus(req executeRequest, resp executeResponse, err error) taskStatus {
+	st := taskStatus{JobID: req.JobID, Attempt: req.Attempt, LeaseToken: req.LeaseToken}
+	if err != nil {
+		st.State = taskStateRejected
+		st.Error = err.Error()
+		return st
+	}
+	st.State = taskStateFinished
+	st.Result = &resp
+	return st
+}
+
+// reportStatus sends st to the coordinator. Final reports are retried with
+// backoff for as long as it takes the coordinator to answer, since the
+// outcome would otherwise be lost; it accepts them idempotently, so a
+// report that arrives twice is harmless. Progress reports are sent once.
+func (s *server) reportStatus(st taskStatus) {
+	st.NodeID = s.nodeID
+	body, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("agent: failed to marshal status of job %s: %v", st.JobID, err)
+		return
+	}
+
+	final := st.State != taskStateRunning
+	statusURL := s.coordURL + "/tasks/" + url.PathEscape(st.JobID) + "/status"
+
+	wait := statusReportBackoff
+	for try := 1; ; try++ {
+		resp, err := s.client().Post(statusURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			// 4xx means the coordinator has made up its mind (e.g. a stale
+			// attempt); sending it again won't change that.
+			if resp.StatusCode < 500 {
+				if resp.StatusCode >= 300 {
+					log.Printf("agent: coordinator refused %s status of job %s: %s", st.State, st.JobID, resp.Status)
+				}
+				return
+			}
+			err = fmt.Errorf("coordinator returned %s", resp.Status)
+		}
+		log.Printf("agent: failed to report %s status of job %s (try %d): %v", st.State, st.JobID, try, err)
+		if !final {
+			return
+		}
+		time.Sleep(wait)
+		wait = min(2*wait, statusReportMaxBackoff)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newStatusCollector starts a fake coordinator that forwards every status report.
+func newStatusCollector(t *testing.T) (*httptest.Server, <-chan taskStatus) {
+	t.Helper()
+
+	reports := make(chan taskStatus, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jobs/job-1/logs" {
+			var st taskStatus
+			_ = json.NewDecoder(r.Body).Decode(&st)
+			reports <- st
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, reports
+}
+
+func nextReport(t *testing.T, reports <-chan taskStatus) taskStatus {
+	t.Helper()
+	select {
+	case st := <-reports:
+		return st
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a status report")
+	}
+	return taskStatus{}
+}
+
+// Test that an async job is acknowledged with 202 and its outcome reported afterwards
+func TestExecuteHandlerAsync(t *testing.T) {
+	coord, reports := newStatusCollector(t)
+
+	srv := newTestServer()
+	srv.coordURL = coord.URL
+	srv.nodeID = "node-a"
+
+	body, _ := json.Marshal(executeRequest{JobID: "job-1", Type: "echo", Payload: "hi", Attempt: 3, Async: true})
+	w := httptest.NewRecorder()
+	srv.executeHandler(w, httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(body)))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	if st := nextReport(t, reports); st.State != taskStateRunning || st.Attempt != 3 || st.NodeID != "node-a" {
+		t.Fatalf("expected a running report for attempt 3, got %+v", st)
+	}
+	st := nextReport(t, reports)
+	if st.State != taskStateFinished || st.Result == nil || st.Result.Status != "ok" || st.Result.Stdout != "hi" {
+		t.Fatalf("expected a finished report with the result, got %+v", st)
+	}
+}
+
+// Test that an async job whose payload can't run is reported as rejected
+func TestExecuteHandlerAsyncRejected(t *testing.T) {
+	coord, reports := newStatusCollector(t)
+
+	srv := newTestServer()
+	srv.coordURL = coord.URL
+
+	body, _ := json.Marshal(executeRequest{JobID: "job-2", Type: "exec", Payload: "not json", Async: true})
+	w := httptest.NewRecorder()
+	srv.executeHandler(w, httptest.NewRequest(http.MethodPost, "/execute", bytes.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	nextReport(t, reports) // running
+	if st := nextReport(t, reports); st.State != taskStateRejected || st.Error == "" {
+		t.Fatalf("expected a rejected report with an error, got %+v", st)
+	}
+}
+
+// Test that a final report is retried for as long as the coordinator is failing
+func TestReportStatusRetries(t *testing.T) {
+	defer func(d time.Duration) { statusReportBackoff = d }(statusReportBackoff)
+	statusReportBackoff = time.Millisecond
+	defer func(d time.Duration) { statusReportMaxBackoff = d }(statusReportMaxBackoff)
+	statusReportMaxBackoff = time.Millisecond
+
+	calls := 0
+	coord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 10 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer coord.Close()
+
+	srv := &server{coordURL: coord.URL}
+	srv.reportStatus(taskStatus{JobID: "job-3", Attempt: 1, State: taskStateFinished})
+
+	if calls != 10 {
+		t.Fatalf("expected the report to be retried until accepted, got %d calls", calls)
+	}
+}
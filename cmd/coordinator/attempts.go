@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// errStaleAttempt is returned when an outcome arrives for an attempt that
+// is no longer the job's current one, e.g. after the job was reaped
+var errStaleAttempt = errors.New("attempt is no longer current")
+
+// Outcomes recorded on a finished Attempt
+const (
+	AttemptSucceeded = "SUCCEEDED"
+	AttemptFailed    = "FAILED"
+	AttemptOrphaned  = "ORPHANED"
+)
+
+// RetryPolicy controls how often a job is attempted and how long it waits
+// between attempts. Backoff doubles after each failure up to MaxBackoffMS
+type RetryPolicy struct {
+	MaxAttempts  int   `json:"max_attempts"`
+	BackoffMS    int64 `json:"backoff_ms"`
+	MaxBackoffMS int64 `json:"max_backoff_ms,omitempty"`
+
+	// prefer nodes the job has not already failed on
+	ExcludeFailedNodes bool `json:"exclude_failed_nodes"`
+}
+
+// Returns the policy applied to jobs that don't specify one
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:        3,
+		BackoffMS:          1000,
+		MaxBackoffMS:       30000,
+		ExcludeFailedNodes: true,
+	}
+}
+
+// Validate rejects policies that can't be applied
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("retry.max_attempts must be at least 1")
+	}
+	if p.BackoffMS < 0 || p.MaxBackoffMS < 0 {
+		return errors.New("retry backoff must not be negative")
+	}
+	return nil
+}
+
+// Backoff returns how long to wait after the given (1-based) failed attempt
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := time.Duration(p.BackoffMS) * time.Millisecond
+	limit := time.Duration(p.MaxBackoffMS) * time.Millisecond
+
+	for i := 1; i < attempt && (limit == 0 || d < limit); i++ {
+		d *= 2
+	}
+	if limit > 0 && d > limit {
+		d = limit
+	}
+	return d
+}
+
+// maxAttempts treats an unset limit (e.g. jobs persisted before retries existed) as a single attempt
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Attempt is one try at running a job on a node
+type Attempt struct {
+	Number     int        `json:"number"`
+	NodeID     string     `json:"node_id"`
+	Scheduler  string     `json:"scheduler,omitempty"` // the policy that chose the node
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Outcome    string     `json:"outcome,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	// when the agent last said the attempt was still running
+	LastReportAt *time.Time `json:"last_report_at,omitempty"`
+
+	// fencing token the attempt was dispatched with, and when its lease
+	// runs out unless the agent renews it
+	LeaseToken     uint64     `json:"lease_token,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// CurrentAttempt returns the number of the latest attempt, or 0 if the job never ran
+func (j Job) CurrentAttempt() int {
+	return len(j.Attempts)
+}
+
+// clone returns a copy of j that shares no attempts with the store, whose
+// leases and outcomes are updated in place under s.mu
+func (j *Job) clone() Job {
+	c := *j
+	c.Attempts = slices.Clone(j.Attempts)
+	return c
+}
+
+// FailedNodes returns the nodes on which an attempt of this job failed, was orphaned or lost its lease
+func (j Job) FailedNodes() map[string]bool {
+	out := make(map[string]bool)
+	for _, a := range j.Attempts {
+		if a.Outcome == AttemptFailed || a.Outcome == AttemptOrphaned || a.Outcome == AttemptLeaseExpired {
+			out[a.NodeID] = true
+		}
+	}
+	return out
+}
+
+// Marks a QUEUED or RETRYING job ASSIGNED to nodeID, as chosen by the
+// scheduler policy, and opens a new attempt under a fresh lease. The job
+// becomes RUNNING once the node has it
+func (s *JobStore) StartAttempt(id, nodeID, scheduler string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %q not found", id)
+	}
+
+	now := time.Now().UTC()
+	n := len(j.Attempts) + 1
+	if err := s.transition(j, JobEvent{Time: now, To: JobStatusAssigned, NodeID: nodeID, Attempt: n, Reason: "placed on node"}); err != nil {
+		return Job{}, err
+	}
+	j.Attempts = append(j.Attempts, Attempt{
+		Number:    n,
+		NodeID:    nodeID,
+		Scheduler: scheduler,
+		StartedAt: now,
+	})
+	s.grantLease(&j.Attempts[n-1], now)
+	s.setNode(j, nodeID)
+	j.NextAttemptAt = nil
+	j.PendingReason = ""
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// Closes attempt n as successful and marks the job COMPLETED
+func (s *JobStore) CompleteAttempt(id string, n int) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return Job{}, err
+	}
+
+	if err := s.markRunning(j, n); err != nil {
+		return Job{}, err
+	}
+	now := time.Now().UTC()
+	if err := s.transition(j, JobEvent{Time: now, To: JobStatusCompleted, NodeID: j.NodeID, Attempt: n, Reason: "attempt succeeded"}); err != nil {
+		return Job{}, err
+	}
+	s.closeAttempt(j, now, AttemptSucceeded, "")
+	j.LastError = ""
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// Closes attempt n with outcome and either schedules another attempt
+// (RETRYING) or, when the failure isn't retryable, attempts are used up or
+// the retry would start past the job's deadline, marks the job FAILED
+func (s *JobStore) FailAttempt(id string, n int, outcome, msg string, retryable bool) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().UTC()
+	to, reason := JobStatusFailed, ""
+	next := now.Add(j.Retry.Backoff(j.chargedAttempts()))
+	switch {
+	case retryable && j.chargedAttempts() < j.Retry.maxAttempts() && !j.deadlinePassed(next):
+		to = JobStatusRetrying
+	case outcome == AttemptTimedOut || (retryable && j.deadlinePassed(next)):
+		reason = ReasonTimedOut
+	}
+	if err := s.transition(j, JobEvent{Time: now, To: to, NodeID: j.NodeID, Attempt: n, Reason: fmt.Sprintf("%s: %s", outcome, msg)}); err != nil {
+		return Job{}, err
+	}
+
+	s.closeAttempt(j, now, outcome, msg)
+	j.LastError = msg
+	if to == JobStatusRetrying {
+		j.NextAttemptAt = &next
+	}
+	if reason != "" {
+		j.Reason = reason
+	}
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// currentAttempt returns the job if n is its latest attempt and it is still ASSIGNED or RUNNING. Callers hold s.mu
+func (s *JobStore) currentAttempt(id string, n int) (*Job, error) {
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job %q not found", id)
+	}
+	if !j.Active() || n != len(j.Attempts) {
+		return nil, fmt.Errorf("job %q attempt %d: %w", id, n, errStaleAttempt)
+	}
+	return j, nil
+}
+
+// closeAttempt stamps the latest attempt with its outcome, if there is
+// one, and charges its run to the job's fair share and quotas. Callers hold s.mu
+func (s *JobStore) closeAttempt(j *Job, now time.Time, outcome, msg string) {
+	if len(j.Attempts) == 0 {
+		return
+	}
+	a := &j.Attempts[len(j.Attempts)-1]
+	a.FinishedAt = &now
+	a.Outcome = outcome
+	a.Error = msg
+	cpu := j.cpuSeconds(*a, now)
+	s.chargeUsage(j.Account(), cpu, now)
+	s.chargeQuota(j, cpu, now)
+}
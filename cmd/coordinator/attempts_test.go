@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BackoffMS: 100, MaxBackoffMS: 350}
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond}
+	for i, w := range want {
+		if got := p.Backoff(i + 1); got != w {
+			t.Errorf("attempt %d: expected backoff %s, got %s", i+1, w, got)
+		}
+	}
+}
+
+func TestJobStoreAttempts(t *testing.T) {
+	store := NewJobStore()
+	j := store.Submit(JobSpec{Type: "echo", Retry: &RetryPolicy{MaxAttempts: 2, BackoffMS: 10}})
+
+	started, err := store.StartAttempt(j.ID, "node-1", "")
+	if err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	if started.Status != JobStatusAssigned || started.CurrentAttempt() != 1 {
+		t.Fatalf("expected ASSIGNED attempt 1, got %s attempt %d", started.Status, started.CurrentAttempt())
+	}
+
+	// first failure is retried.
+	retrying, err := store.FailAttempt(j.ID, 1, AttemptFailed, "boom", true)
+	if err != nil {
+		t.Fatalf("fail attempt: %v", err)
+	}
+	if retrying.Status != JobStatusRetrying || retrying.NextAttemptAt == nil {
+		t.Fatalf("expected RETRYING with a next attempt time, got %s", retrying.Status)
+	}
+	if !retrying.FailedNodes()["node-1"] {
+		t.Fatalf("expected node-1 to be recorded as failed")
+	}
+
+	// a late result for attempt 1 is stale once attempt 2 starts.
+	if _, err := store.StartAttempt(j.ID, "node-2", ""); err != nil {
+		t.Fatalf("start second attempt: %v", err)
+	}
+	if _, err := store.CompleteAttempt(j.ID, 1); err == nil {
+		t.Fatalf("expected stale attempt error, got nil")
+	}
+
+	// second failure uses up the attempts.
+	failed, err := store.FailAttempt(j.ID, 2, AttemptFailed, "boom again", true)
+	if err != nil {
+		t.Fatalf("fail second attempt: %v", err)
+	}
+	if failed.Status != JobStatusFailed {
+		t.Fatalf("expected FAILED after max attempts, got %s", failed.Status)
+	}
+	if len(failed.Attempts) != 2 || failed.Attempts[1].NodeID != "node-2" || failed.Attempts[1].FinishedAt == nil {
+		t.Fatalf("unexpected attempts history: %+v", failed.Attempts)
+	}
+}
+
+// newFakeAgent starts an agent that answers /execute with status code and result.
+func newFakeAgent(t *testing.T, code int, result executeResponse) (*httptest.Server, string) {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test server URL: %v", err)
+	}
+	return ts, u.Host
+}
+
+// Test that a failed attempt is retried on a different node once backoff passes
+func TestDispatchRetriesOnAnotherNode(t *testing.T) {
+	_, badAddr := newFakeAgent(t, http.StatusOK, executeResponse{Status: "failed", ExitCode: 2})
+	_, goodAddr := newFakeAgent(t, http.StatusOK, executeResponse{Status: "ok"})
+
+	reg := NewNodeRegistry()
+	reg.Register("a-bad", badAddr, NodeInfo{})
+
+	jobs := NewJobStore()
+	job := jobs.Submit(JobSpec{Type: "echo", Retry: &RetryPolicy{MaxAttempts: 2, ExcludeFailedNodes: true}})
+
+	srv := &server{registry: reg, jobs: jobs}
+	srv.dispatchJob(job.ID)
+
+	got, _ := jobs.Get(job.ID)
+	if got.Status != JobStatusRetrying {
+		t.Fatalf("expected RETRYING after first failure, got %s", got.Status)
+	}
+	if srv.pending.Len() != 1 {
+		t.Fatalf("expected the job back on the pending queue")
+	}
+
+	// a second node joins; the failed node is avoided even though it sorts first.
+	reg.Register("b-good", goodAddr, NodeInfo{})
+	srv.dispatchJob(job.ID)
+
+	got, _ = jobs.Get(job.ID)
+	if got.Status != JobStatusCompleted {
+		t.Fatalf("expected COMPLETED on retry, got %s (%s)", got.Status, got.LastError)
+	}
+	if got.NodeID != "b-good" || got.CurrentAttempt() != 2 {
+		t.Fatalf("expected attempt 2 on b-good, got attempt %d on %s", got.CurrentAttempt(), got.NodeID)
+	}
+}
+
+// Test that a rejected payload fails without retrying
+func TestDispatchNonRetryableFailure(t *testing.T) {
+	_, addr := newFakeAgent(t, http.StatusBadRequest, executeResponse{Error: "bad payload"})
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", addr, NodeInfo{})
+
+	jobs := NewJobStore()
+	job := jobs.Create("exec", "not json")
+
+	srv := &server{registry: reg, jobs: jobs}
+	srv.dispatchJob(job.ID)
+
+	got, _ := jobs.Get(job.ID)
+	if got.Status != JobStatusFailed {
+		t.Fatalf("expected FAILED, got %s", got.Status)
+	}
+	if got.CurrentAttempt() != 1 {
+		t.Fatalf("expected a single attempt, got %d", got.CurrentAttempt())
+	}
+}
+
+// Test that RUNNING jobs on a node that went OFFLINE are requeued
+func TestReapOrphans(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", ":1", NodeInfo{})
+	reg.Register("node-2", ":2", NodeInfo{})
+
+	jobs := NewJobStore()
+	orphan := jobs.Create("echo", "a")
+	healthy := jobs.Create("echo", "b")
+	if _, err := jobs.StartAttempt(orphan.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	if _, err := jobs.StartAttempt(healthy.ID, "node-2", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+
+	reg.mu.Lock()
+	reg.nodes["node-1"].LastSeen = time.Now().Add(-time.Minute)
+	reg.mu.Unlock()
+
+	srv := &server{registry: reg, jobs: jobs}
+	srv.handleNodeTransitions(reg.UpdateHealthStates(time.Now(), 15*time.Second, 30*time.Second))
+
+	got, _ := jobs.Get(orphan.ID)
+	if got.Status != JobStatusRetrying {
+		t.Fatalf("expected orphaned job to be RETRYING, got %s", got.Status)
+	}
+	if got.Attempts[0].Outcome != AttemptOrphaned {
+		t.Fatalf("expected attempt outcome ORPHANED, got %s", got.Attempts[0].Outcome)
+	}
+	if got, _ := jobs.Get(healthy.ID); got.Status != JobStatusAssigned {
+		t.Fatalf("expected job on healthy node to stay ASSIGNED, got %s", got.Status)
+	}
+	if srv.pending.Len() != 1 {
+		t.Fatalf("expected orphaned job on the pending queue, got %d", srv.pending.Len())
+	}
+}
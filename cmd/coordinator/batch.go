@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxBatchJobs bounds the jobs one POST /jobs:batch may submit, counting
+// each task of a fan-out as a job.
+const maxBatchJobs = 10000
+
+// Ways a batch treats invalid jobs.
+const (
+	BatchAtomic  = "atomic"  // submit every job or none (the default)
+	BatchPartial = "partial" // submit the valid jobs and report the others
+)
+
+// batchJobsRequest is the JSON body of POST /jobs:batch.
+type batchJobsRequest struct {
+	Jobs []createJobRequest `json:"jobs"`
+	Mode string             `json:"mode,omitempty"`
+}
+
+// batchJobResult is the outcome of one job of a batch, by its index in the request.
+type batchJobResult struct {
+	Index    int    `json:"index"`
+	JobID    string `json:"job_id,omitempty"`
+	Replayed bool   `json:"replayed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// batchJobsResponse lists the IDs of the batch's jobs in request order,
+// and each job's outcome.
+type batchJobsResponse struct {
+	JobIDs  []string         `json:"job_ids"`
+	Results []batchJobResult `json:"results"`
+}
+
+// batchItem is one job of a batch, with its idempotency key and request
+// hash when it has a key
+type batchItem struct {
+	Spec        JobSpec
+	Key         string
+	RequestHash string
+}
+
+// batchOutcome is the job a batchItem created or replayed, or why it didn't
+type batchOutcome struct {
+	Job      Job
+	Replayed bool
+	Err      error
+}
+
+// Submits a batch of jobs in order under one lock. An item whose key was
+// already used, by an earlier item or within the retention window, returns
+// that job as replayed, or an error wrapping errIdempotencyConflict if the
+// request differs. An item creating a job that doesn't fit its accounts'
+// quotas fails with a *QuotaError. With atomic set, one error means no job
+// is submitted
+func (s *JobStore) SubmitBatch(items []batchItem, atomic bool) []batchOutcome {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	s.expireIdempotencyKeys(now)
+
+	out := make([]batchOutcome, len(items))
+	failed := false
+	hashes := make(map[string]string)
+	keyErrs := make(map[string]error)
+	for i, it := range items {
+		if it.Key == "" {
+			continue
+		}
+		// the first item with a key decides whether it conflicts with a
+		// stored one; the items repeating it share that result
+		h, ok := hashes[it.Key]
+		if !ok {
+			h = it.RequestHash
+			hashes[it.Key] = h
+			if _, err := s.replay(it.Key, it.RequestHash); err != nil {
+				keyErrs[it.Key] = err
+			}
+		}
+		switch {
+		case h != it.RequestHash:
+			out[i].Err = fmt.Errorf("key %q: %w", it.Key, errIdempotencyConflict)
+		case keyErrs[it.Key] != nil:
+			out[i].Err = keyErrs[it.Key]
+		}
+		failed = failed || out[i].Err != nil
+	}
+
+	// The items that create a job must fit their accounts' quotas, checked
+	// under the same lock that adds them; replays don't count against them,
+	// nor do items repeating a key, which share the first one's job.
+	var fresh []JobSpec
+	var freshAt []int
+	firstFresh := make(map[string]int)
+	var repeats []int
+	for i, it := range items {
+		if out[i].Err != nil {
+			continue
+		}
+		if it.Key != "" {
+			if j, _ := s.replay(it.Key, it.RequestHash); j != nil {
+				continue
+			}
+			if _, ok := firstFresh[it.Key]; ok {
+				repeats = append(repeats, i)
+				continue
+			}
+			firstFresh[it.Key] = len(fresh)
+		}
+		fresh = append(fresh, it.Spec)
+		freshAt = append(freshAt, i)
+	}
+	errs := s.admit(fresh, now)
+	for n, err := range errs {
+		if err != nil {
+			out[freshAt[n]].Err = err
+			failed = true
+		}
+	}
+	for _, i := range repeats {
+		out[i].Err = errs[firstFresh[items[i].Key]]
+	}
+	if atomic && failed {
+		return out
+	}
+
+	for i, it := range items {
+		switch {
+		case out[i].Err != nil:
+		case it.Key == "":
+			out[i].Job = *s.submit(it.Spec, now)
+		default:
+			j, err := s.replay(it.Key, it.RequestHash)
+			switch {
+			case err != nil:
+				out[i].Err = err
+			case j != nil:
+				out[i].Job, out[i].Replayed = j.clone(), true
+			default:
+				out[i].Job = *s.submitOnce(it.Key, it.RequestHash, it.Spec, now)
+			}
+		}
+	}
+	return out
+}
+
+// handleBatchJobs implements POST /jobs:batch. Each job is validated like
+// POST /jobs. An atomic batch with an invalid job, or one over its quota,
+// is refused as a whole; a partial one submits the rest and answers 207
+// Multi-Status. The jobs
+// are queued together once the response is written.
+func (s *server) handleBatchJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req batchJobsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(req.Jobs) == 0:
+		http.Error(w, "jobs is required", http.StatusBadRequest)
+		return
+	case len(req.Jobs) > maxBatchJobs:
+		http.Error(w, fmt.Sprintf("a batch may have at most %d jobs", maxBatchJobs), http.StatusBadRequest)
+		return
+	}
+	switch req.Mode {
+	case "":
+		req.Mode = BatchAtomic
+	case BatchAtomic, BatchPartial:
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", req.Mode), http.StatusBadRequest)
+		return
+	}
+	atomic := req.Mode == BatchAtomic
+
+	resp := batchJobsResponse{JobIDs: []string{}, Results: make([]batchJobResult, len(req.Jobs))}
+	items := make([]batchItem, 0, len(req.Jobs))
+	index := make([]int, 0, len(req.Jobs))
+	invalid := false
+	for i, jr := range req.Jobs {
+		resp.Results[i].Index = i
+		s.identify(r, &jr)
+		spec, err := jr.toSpec()
+		if err == nil {
+			err = s.checkPriorityClass(spec)
+		}
+		if err == nil {
+			err = checkIdempotencyKey(jr.IdempotencyKey)
+		}
+		if err != nil {
+			resp.Results[i].Error = err.Error()
+			invalid = true
+			continue
+		}
+		item := batchItem{Spec: spec, Key: jr.IdempotencyKey}
+		if item.Key != "" {
+			item.RequestHash = jr.fingerprint()
+		}
+		items = append(items, item)
+		index = append(index, i)
+	}
+	if atomic && invalid {
+		writeJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+	total := 0
+	for _, it := range items {
+		total += it.Spec.jobCount()
+	}
+	if total > maxBatchJobs {
+		http.Error(w, fmt.Sprintf("a batch may have at most %d jobs, counting fan-out tasks; this one has %d", maxBatchJobs, total), http.StatusBadRequest)
+		return
+	}
+
+	// Jobs over quota are refused like invalid ones.
+	outcomes := s.jobs.SubmitBatch(items, atomic)
+	nodes := s.registry.List()
+	var created []Job
+	var qe *QuotaError
+	conflict, overQuota := false, false
+	for k, o := range outcomes {
+		res := &resp.Results[index[k]]
+		if o.Err != nil {
+			res.Error = o.Err.Error()
+			conflict = conflict || errors.Is(o.Err, errIdempotencyConflict)
+			overQuota = overQuota || errors.As(o.Err, &qe)
+			continue
+		}
+		res.JobID, res.Replayed = o.Job.ID, o.Replayed
+		if !o.Replayed {
+			created = append(created, s.noteUnschedulable(o.Job, nodes))
+		}
+	}
+	for _, res := range resp.Results {
+		if res.JobID != "" {
+			resp.JobIDs = append(resp.JobIDs, res.JobID)
+		}
+	}
+
+	switch {
+	case atomic && overQuota:
+		writeJSON(w, http.StatusTooManyRequests, resp)
+		return
+	case atomic && conflict:
+		writeJSON(w, http.StatusUnprocessableEntity, resp)
+		return
+	case len(resp.JobIDs) < len(req.Jobs):
+		writeJSON(w, http.StatusMultiStatus, resp)
+	default:
+		writeJSON(w, http.StatusCreated, resp)
+	}
+
+	log.Printf("batch of %d jobs submitted: %d created, %d replayed", len(req.Jobs), len(created), len(resp.JobIDs)-len(created))
+	s.enqueueJobs(created)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends body to POST /jobs:batch through a mux routed like main's.
+func postBatch(t *testing.T, srv *server, body string) (int, batchJobsResponse) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs:batch", srv.handleBatchJobs)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs:batch", strings.NewReader(body)))
+
+	var resp batchJobsResponse
+	if w.Header().Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+// Test that a batch with an invalid job creates nothing unless it asks for partial results
+func TestBatchJobsAtomicAndPartial(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+	body := `{"jobs":[{"type":"echo","payload":"a"},{"payload":"no type"},{"type":"echo","payload":"c"}]%s}`
+
+	code, resp := postBatch(t, srv, strings.Replace(body, "%s", "", 1))
+	if code != http.StatusBadRequest || len(resp.JobIDs) != 0 || resp.Results[1].Error == "" {
+		t.Fatalf("expected the atomic batch refused, got %d %+v", code, resp)
+	}
+	if n := len(srv.jobs.List()); n != 0 {
+		t.Fatalf("expected no jobs, got %d", n)
+	}
+
+	code, resp = postBatch(t, srv, strings.Replace(body, "%s", `,"mode":"partial"`, 1))
+	if code != http.StatusMultiStatus || len(resp.JobIDs) != 2 || resp.Results[1].JobID != "" {
+		t.Fatalf("expected two jobs and one error, got %d %+v", code, resp)
+	}
+	if q := srv.pending.Snapshot(); len(q) != 2 || q[0] != resp.JobIDs[0] || q[1] != resp.JobIDs[1] {
+		t.Fatalf("expected both jobs queued in order, got %v", q)
+	}
+
+	// fan-out tasks count towards the batch limit
+	fanout := `{"type":"echo","fanout":{"range":{"end":6000}}}`
+	if code, _ := postBatch(t, srv, `{"mode":"partial","jobs":[`+fanout+`,`+fanout+`]}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a batch of more than %d tasks, got %d", maxBatchJobs, code)
+	}
+}
+
+// Test that idempotency keys apply to each job of a batch
+func TestBatchJobsIdempotency(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+
+	code, first := postBatch(t, srv, `{"jobs":[{"type":"echo","idempotency_key":"k1"},{"type":"echo","idempotency_key":"k1"},{"type":"echo"}]}`)
+	if code != http.StatusCreated || len(first.JobIDs) != 3 || first.JobIDs[0] != first.JobIDs[1] || !first.Results[1].Replayed {
+		t.Fatalf("expected the repeated key to reuse the job, got %d %+v", code, first)
+	}
+	if srv.pending.Len() != 2 {
+		t.Fatalf("expected two jobs queued, got %d", srv.pending.Len())
+	}
+
+	// a conflicting key rejects an atomic batch as a whole
+	code, resp := postBatch(t, srv, `{"jobs":[{"type":"echo","idempotency_key":"k2"},{"type":"other","idempotency_key":"k1"}]}`)
+	if code != http.StatusUnprocessableEntity || len(resp.JobIDs) != 0 {
+		t.Fatalf("expected 422 and no jobs, got %d %+v", code, resp)
+	}
+	if n := len(srv.jobs.List()); n != 2 {
+		t.Fatalf("expected still two jobs, got %d", n)
+	}
+
+	code, resp = postBatch(t, srv, `{"mode":"partial","jobs":[{"type":"echo","idempotency_key":"k2"},{"type":"other","idempotency_key":"k1"}]}`)
+	if code != http.StatusMultiStatus || len(resp.JobIDs) != 1 || resp.Results[1].Error == "" {
+		t.Fatalf("expected one job and one conflict, got %d %+v", code, resp)
+	}
+
+	// every repeat of a conflicting key conflicts too, and the key keeps its job
+	code, resp = postBatch(t, srv, `{"mode":"partial","jobs":[{"type":"other","idempotency_key":"k1"},{"type":"other","idempotency_key":"k1"}]}`)
+	if code != http.StatusMultiStatus || len(resp.JobIDs) != 0 || resp.Results[0].Error == "" || resp.Results[1].Error == "" {
+		t.Fatalf("expected both repeats refused, got %d %+v", code, resp)
+	}
+	_, resp = postBatch(t, srv, `{"jobs":[{"type":"echo","idempotency_key":"k1"}]}`)
+	if len(resp.JobIDs) != 1 || resp.JobIDs[0] != first.JobIDs[0] || !resp.Results[0].Replayed {
+		t.Fatalf("expected k1 still to replay %s, got %+v", first.JobIDs[0], resp)
+	}
+
+	if code, _ := postBatch(t, srv, `{"jobs":[]}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty batch, got %d", code)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// errJobFinished is returned when cancelling a job that has already
+// completed, failed or been cancelled.
+var errJobFinished = errors.New("job has already finished")
+
+// AttemptCancelled is recorded on the attempt that was running when its job was cancelled.
+const AttemptCancelled = "CANCELLED"
+
+// agentCancelTimeout bounds how long we wait for an agent to acknowledge /cancel.
+const agentCancelTimeout = 5 * time.Second
+
+// Finished reports whether the job is in a terminal state.
+func (j Job) Finished() bool {
+	switch j.Status {
+	case JobStatusCompleted, JobStatusPartiallyCompleted, JobStatusFailed, JobStatusCancelled, JobStatusSkipped:
+		return true
+	}
+	return false
+}
+
+// Marks a job that hasn't finished CANCELLED and closes its open attempt.
+// It returns the job as it was before and after cancellation; a late
+// outcome for the closed attempt is then rejected as stale.
+func (s *JobStore) Cancel(id, reason string) (before, after Job, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, Job{}, fmt.Errorf("job %q not found", id)
+	}
+	if j.Finished() {
+		c := j.clone()
+		return c, c, fmt.Errorf("job %q is %s: %w", id, j.Status, errJobFinished)
+	}
+	before = j.clone()
+
+	now := time.Now().UTC()
+	if err := s.transition(j, JobEvent{Time: now, To: JobStatusCancelled, NodeID: j.NodeID, Attempt: j.CurrentAttempt(), Reason: reason}); err != nil {
+		return before, before, err
+	}
+	if before.Active() {
+		s.closeAttempt(j, now, AttemptCancelled, reason)
+	}
+	j.NextAttemptAt = nil
+	j.PendingReason = ""
+	j.LastError = reason
+	s.persist(j)
+
+	return before, j.clone(), nil
+}
+
+// cancelJob cancels a job in the store, drops it from the pending queue and,
+// if it was running, asks its agent to stop it.
+func (s *server) cancelJob(jobID, reason string) (Job, error) {
+	before, job, err := s.jobs.Cancel(jobID, reason)
+	if err != nil {
+		return job, err
+	}
+	s.pending.Remove(jobID)
+	log.Printf("job %s cancelled (was %s): %s", jobID, before.Status, reason)
+
+	if before.Active() {
+		if node, ok := s.registry.Get(before.NodeID); ok && node.Pulls() {
+			// Can't call a pull node; it learns on its next poll.
+			s.pulls.Cancel(node.ID, jobID)
+		} else if ok {
+			go s.cancelOnAgent(jobID, 0, node)
+		}
+	}
+	if job.IsParent() {
+		s.cancelTasks(job, reason)
+	}
+	s.settle(job)
+	return job, nil
+}
+
+// cancelOnAgent asks the agent running jobID to kill it. With a lease token
+// only the attempt holding that lease is stopped, and the agent may be given
+// the job again. Failures are only logged: the attempt is already over as
+// far as the coordinator is concerned and its result will be ignored.
+func (s *server) cancelOnAgent(jobID string, leaseToken uint64, node Node) {
+	body, err := json.Marshal(struct {
+		JobID      string `json:"job_id"`
+		LeaseToken uint64 `json:"lease_token,omitempty"`
+	}{jobID, leaseToken})
+	if err != nil {
+		log.Printf("marshal cancel request for job %s: %v", jobID, err)
+		return
+	}
+
+	client := s.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// Use a bounded copy so a stuck agent can't hold this goroutine forever.
+	bounded := *client
+	if bounded.Timeout == 0 || bounded.Timeout > agentCancelTimeout {
+		bounded.Timeout = agentCancelTimeout
+	}
+
+	resp, err := bounded.Post(buildAgentBaseURL(node.Address)+"/cancel", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("failed to cancel job %s on node %s: %v", jobID, node.ID, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("node %s refused to cancel job %s: %s", node.ID, jobID, readErrorBody(resp))
+		return
+	}
+
+	var ack struct {
+		WasRunning bool `json:"was_running"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		log.Printf("unreadable cancel ack for job %s from node %s: %v", jobID, node.ID, err)
+		return
+	}
+	log.Printf("node %s acknowledged cancel of job %s (was running: %v)", node.ID, jobID, ack.WasRunning)
+}
+
+// handleCancelJob implements POST /jobs/{id}/cancel and DELETE /jobs/{id}.
+func (s *server) handleCancelJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	if _, ok := s.jobs.Get(jobID); !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := s.cancelJob(jobID, "cancelled by request")
+	if errors.Is(err, errJobFinished) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Printf("encode job response: %v", err)
+	}
+}
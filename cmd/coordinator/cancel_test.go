@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Test that cancelling a queued job removes it from the pending queue
+func TestCancelQueuedJob(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	srv.pending.Push(job.ID, job.Priority)
+
+	w := httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodPost, "/jobs/"+job.ID+"/cancel", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got Job
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.Status != JobStatusCancelled {
+		t.Fatalf("expected status CANCELLED, got %s", got.Status)
+	}
+	if srv.pending.Len() != 0 {
+		t.Fatalf("expected cancelled job to leave the pending queue")
+	}
+}
+
+// Test that cancelling a running job tells its agent and ignores the late result
+func TestCancelRunningJobNotifiesAgent(t *testing.T) {
+	cancelled := make(chan string, 1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			JobID string `json:"job_id"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path == "/cancel" {
+			cancelled <- req.JobID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"job_id":"` + req.JobID + `","was_running":true}`))
+	}))
+	defer agent.Close()
+	u, _ := url.Parse(agent.URL)
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", u.Host, NodeInfo{})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	job, err := jobs.StartAttempt(job.ID, "node-1", "")
+	if err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodDelete, "/jobs/"+job.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case id := <-cancelled:
+		if id != job.ID {
+			t.Fatalf("expected agent to be asked to cancel %s, got %s", job.ID, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("agent was never asked to cancel the job")
+	}
+
+	// the agent's result for the cancelled attempt arrives late and is ignored.
+	if _, err := jobs.CompleteAttempt(job.ID, job.CurrentAttempt()); err == nil {
+		t.Fatalf("expected late completion of a cancelled job to be rejected")
+	}
+	got, _ := jobs.Get(job.ID)
+	if got.Status != JobStatusCancelled {
+		t.Fatalf("expected job to stay CANCELLED, got %s", got.Status)
+	}
+	if a := got.Attempts[0]; a.Outcome != AttemptCancelled || a.FinishedAt == nil {
+		t.Fatalf("expected attempt closed as CANCELLED, got %+v", a)
+	}
+}
+
+// Test that cancelling a finished or unknown job is refused
+func TestCancelFinishedOrUnknownJob(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	job, _ = jobs.StartAttempt(job.ID, "node-1", "")
+	if _, err := jobs.CompleteAttempt(job.ID, job.CurrentAttempt()); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodPost, "/jobs/"+job.ID+"/cancel", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 for a completed job, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodPost, "/jobs/job-999/cancel", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unknown job, got %d", w.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cordonRequest is the optional JSON body of the admin node endpoints.
+type cordonRequest struct {
+	// who is taking the node out of rotation and why; By defaults to the
+	// client's address
+	By     string `json:"by,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// drain only: requeue the node's jobs elsewhere now instead of
+	// letting them finish
+	Migrate bool `json:"migrate,omitempty"`
+}
+
+// Cordon puts a node in an admin state (CORDONED, DRAINING or DRAINED),
+// recording by whom and why; the node's health is tracked on regardless.
+// It reports false if the node is unknown.
+func (r *NodeRegistry) Cordon(id string, state NodeState, by, reason string) (Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	if !n.Cordoned() {
+		n.Health = n.HealthState()
+	}
+	now := time.Now().UTC()
+	n.State = state
+	n.CordonedBy = by
+	n.CordonReason = reason
+	n.CordonedAt = &now
+
+	if err := r.storage.Put(nodesBucket, n.ID, n); err != nil {
+		log.Printf("[coordinator] failed to persist node %s: %v", n.ID, err)
+	}
+	return *n, true
+}
+
+// FinishDrain moves a DRAINING node to DRAINED, keeping who drained it,
+// why and since when. It reports false if the node is unknown or no longer
+// DRAINING, e.g. because it was uncordoned meanwhile.
+func (r *NodeRegistry) FinishDrain(id string) (Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok || n.State != NodeStateDraining {
+		return Node{}, false
+	}
+	n.State = NodeStateDrained
+
+	if err := r.storage.Put(nodesBucket, n.ID, n); err != nil {
+		log.Printf("[coordinator] failed to persist node %s: %v", n.ID, err)
+	}
+	return *n, true
+}
+
+// Uncordon puts a node back in rotation, showing its health as its state
+// again. It reports false if the node is unknown.
+func (r *NodeRegistry) Uncordon(id string) (Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	n.State = n.HealthState()
+	n.CordonedBy = ""
+	n.CordonReason = ""
+	n.CordonedAt = nil
+
+	if err := r.storage.Put(nodesBucket, n.ID, n); err != nil {
+		log.Printf("[coordinator] failed to persist node %s: %v", n.ID, err)
+	}
+	return *n, true
+}
+
+// drainNode stops new jobs going to a node and, with migrate, moves the
+// jobs it has back to the queue for other nodes. Otherwise they finish
+// where they are and finishDrains marks the node DRAINED afterwards.
+func (s *server) drainNode(id string, req cordonRequest) (Node, bool) {
+	node, ok := s.registry.Cordon(id, NodeStateDraining, req.By, req.Reason)
+	if !ok || !req.Migrate {
+		return node, ok
+	}
+
+	for _, j := range s.jobs.List() {
+		if !j.Active() || j.NodeID != id {
+			continue
+		}
+		if _, err := s.evict(j, node, fmt.Sprintf("node %s is draining", id)); err != nil {
+			log.Printf("failed to migrate job %s off node %s: %v", j.ID, id, err)
+			continue
+		}
+		log.Printf("job %s migrated off draining node %s", j.ID, id)
+	}
+	s.kick()
+	return node, true
+}
+
+// finishDrains marks DRAINING nodes that have no jobs left DRAINED.
+func (s *server) finishDrains() {
+	running := s.jobs.RunningByNode()
+	for _, n := range s.registry.List() {
+		if n.State != NodeStateDraining || running[n.ID] > 0 {
+			continue
+		}
+		if _, ok := s.registry.FinishDrain(n.ID); ok {
+			log.Printf("[coordinator] node %s drained", n.ID)
+		}
+	}
+}
+
+// handleAdminNode handles the admin actions on /admin/nodes/{id}/...:
+//   - POST /admin/nodes/{id}/cordon -> stop placing new jobs on the node
+//   - POST /admin/nodes/{id}/drain -> cordon it and let its jobs finish, or
+//     with "migrate":true requeue them elsewhere
+//   - POST /admin/nodes/{id}/uncordon -> put it back in rotation
+func (s *server) handleAdminNode(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/nodes/"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	if id == "" || (action != "cordon" && action != "drain" && action != "uncordon") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req cordonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.By == "" {
+		req.By = r.RemoteAddr
+	}
+
+	var node Node
+	var ok bool
+	switch action {
+	case "cordon":
+		node, ok = s.registry.Cordon(id, NodeStateCordoned, req.By, req.Reason)
+	case "drain":
+		node, ok = s.drainNode(id, req)
+	case "uncordon":
+		node, ok = s.registry.Uncordon(id)
+	}
+	if !ok {
+		http.Error(w, "node not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[coordinator] node %s: %s by %s", id, action, req.By)
+	if action == "uncordon" {
+		s.kick()
+	}
+	writeJSON(w, http.StatusOK, node)
+}
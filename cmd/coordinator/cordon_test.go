@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminNode posts an admin action on a node and returns the response
+func adminNode(srv *server, id, action, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	srv.handleAdminNode(w, httptest.NewRequest(http.MethodPost, "/admin/nodes/"+id+"/"+action, strings.NewReader(body)))
+	return w
+}
+
+// Test that a cordon outlasts health updates and re-registration until lifted
+func TestCordonNode(t *testing.T) {
+	storage := NewMemoryStorage()
+	reg, _ := NewNodeRegistryWithStorage(storage)
+	reg.Register("node-1", ":1", NodeInfo{})
+	srv := &server{registry: reg, jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+
+	if w := adminNode(srv, "nope", "cordon", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown node, got %d", w.Code)
+	}
+	w := adminNode(srv, "node-1", "cordon", `{"by":"alice","reason":"disk swap"}`)
+	var node Node
+	if err := json.NewDecoder(w.Body).Decode(&node); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if w.Code != http.StatusOK || node.State != NodeStateCordoned || node.CordonedBy != "alice" || node.CordonReason != "disk swap" || node.CordonedAt == nil {
+		t.Fatalf("expected node-1 cordoned by alice, got %d %+v", w.Code, node)
+	}
+
+	changed := reg.UpdateHealthStates(time.Now().Add(time.Minute), 15*time.Second, 30*time.Second)
+	want := []NodeTransition{{ID: "node-1", From: NodeStateHealthy, To: NodeStateOffline}}
+	if !reflect.DeepEqual(changed, want) {
+		t.Fatalf("expected the health change reported, got %v", changed)
+	}
+	if n, _ := reg.Get("node-1"); n.State != NodeStateCordoned || n.Health != NodeStateOffline {
+		t.Fatalf("expected node-1 CORDONED and OFFLINE, got %s and %s", n.State, n.Health)
+	}
+	if n := reg.Register("node-1", ":1", NodeInfo{}); n.State != NodeStateCordoned || n.Health != NodeStateHealthy {
+		t.Fatalf("expected the cordon to survive a heartbeat, got %s and %s", n.State, n.Health)
+	}
+
+	// the cordon survives a restart
+	restored, _ := NewNodeRegistryWithStorage(storage)
+	if n, _ := restored.Get("node-1"); n.State != NodeStateCordoned || n.CordonedBy != "alice" {
+		t.Fatalf("expected the cordon restored, got %+v", n)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleListNodes(w, httptest.NewRequest(http.MethodGet, "/nodes", nil))
+	if !strings.Contains(w.Body.String(), `"cordoned_by":"alice"`) {
+		t.Fatalf("expected GET /nodes to say who cordoned the node, got %s", w.Body)
+	}
+
+	w = adminNode(srv, "node-1", "uncordon", "")
+	node = Node{}
+	if err := json.NewDecoder(w.Body).Decode(&node); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if node.State != NodeStateHealthy || node.CordonedBy != "" || node.CordonedAt != nil {
+		t.Fatalf("expected node-1 back in rotation, got %+v", node)
+	}
+}
+
+// Test that cordoned nodes get no new jobs
+func TestCordonedNodeGetsNoJobs(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull, Slots: 2})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	adminNode(srv, "laptop", "cordon", "")
+	job := jobs.Submit(JobSpec{Type: "echo"})
+	srv.enqueue(job)
+	srv.dispatchPending()
+	if got, _ := jobs.Get(job.ID); got.Status != JobStatusQueued {
+		t.Fatalf("expected the job to wait, got %s", got.Status)
+	}
+
+	adminNode(srv, "laptop", "uncordon", "")
+	srv.dispatchPending()
+	if got, _ := jobs.Get(job.ID); got.Status != JobStatusAssigned {
+		t.Fatalf("expected the job placed once uncordoned, got %s", got.Status)
+	}
+}
+
+// Test that a drained node finishes its jobs, or hands them over with migrate
+func TestDrainNode(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("a", "", NodeInfo{Mode: NodeModePull, Slots: 2})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	first := jobs.Submit(JobSpec{Type: "echo"})
+	srv.enqueue(first)
+	srv.dispatchPending()
+
+	adminNode(srv, "a", "drain", `{"by":"ops"}`)
+	srv.finishDrains()
+	draining, _ := reg.Get("a")
+	if draining.State != NodeStateDraining {
+		t.Fatalf("expected a DRAINING while its job runs, got %s", draining.State)
+	}
+	if _, err := jobs.CompleteAttempt(first.ID, 1); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+	srv.finishDrains()
+	if n, _ := reg.Get("a"); n.State != NodeStateDrained || n.CordonedBy != "ops" || !n.CordonedAt.Equal(*draining.CordonedAt) {
+		t.Fatalf("expected a DRAINED by ops since the drain began, got %+v", n)
+	}
+
+	// with migrate, running jobs move to another node at no cost in attempts
+	adminNode(srv, "a", "uncordon", "")
+	second := jobs.Submit(JobSpec{Type: "echo"})
+	srv.enqueue(second)
+	srv.dispatchPending()
+	reg.Register("b", "", NodeInfo{Mode: NodeModePull, Slots: 2})
+
+	adminNode(srv, "a", "drain", `{"migrate":true}`)
+	moved, _ := jobs.Get(second.ID)
+	if moved.Status != JobStatusQueued || moved.Attempts[0].Outcome != AttemptPreempted || moved.chargedAttempts() != 0 {
+		t.Fatalf("expected the job requeued without using its attempt, got %s %+v", moved.Status, moved.Attempts)
+	}
+	srv.dispatchPending()
+	if got, _ := jobs.Get(second.ID); got.Status != JobStatusAssigned || got.NodeID != "b" {
+		t.Fatalf("expected the job placed on b, got %s on %q", got.Status, got.NodeID)
+	}
+	srv.finishDrains()
+	if n, _ := reg.Get("a"); n.State != NodeStateDrained {
+		t.Fatalf("expected a DRAINED, got %s", n.State)
+	}
+}
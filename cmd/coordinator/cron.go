@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week. Each field is a bit set of the values it
+// matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Like cron(8), when both day fields are restricted a day matching
+	// either one will do; anyDOM/anyDOW record a field that starts with "*".
+	anyDOM, anyDOW bool
+}
+
+// cronField describes the values one field of an expression may take.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // names for min, min+1, ...
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDOM    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12,
+		names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// 7 is accepted for Sunday as well as 0.
+	cronDOW = cronField{name: "day of week", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// cronMacros are the shorthands cron(8) accepts in place of five fields.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard cron expression such as "*/15 9-17 * * mon-fri"
+// or one of the @daily style macros. Fields take "*", values, ranges, lists
+// and "/step"; months and weekdays may be given by their first three letters.
+func parseCron(expr string) (cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if m, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	var c cronSchedule
+	var err error
+	for i, f := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{cronMinute, &c.minute},
+		{cronHour, &c.hour},
+		{cronDOM, &c.dom},
+		{cronMonth, &c.month},
+		{cronDOW, &c.dow},
+	} {
+		if *f.bits, err = f.field.parse(fields[i]); err != nil {
+			return cronSchedule{}, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDOM = strings.HasPrefix(fields[2], "*")
+	c.anyDOW = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parse turns one comma-separated field into the bit set of its values.
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepStr, f.name)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		switch lowStr, highStr, isRange := strings.Cut(rng, "-"); {
+		case rng == "*":
+			lo, hi = f.min, f.max
+		case isRange:
+			var err error
+			if lo, err = f.value(lowStr); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(highStr); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q in %s field is backwards", rng, f.name)
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			// "5/10" means every 10th value starting at 5.
+			lo, hi = v, v
+			if hasStep {
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name of the field.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q (want %d-%d)", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// next returns the first time after t, to the minute, that the expression
+// matches in loc, and false if there is none within five years (e.g. 30 Feb).
+// Wall-clock times a DST change skips don't match; ones it repeats match twice.
+func (c cronSchedule) next(t time.Time, loc *time.Location) (time.Time, bool) {
+	t = t.In(loc)
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// matchesDay reports whether t's day of month and day of week fit.
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDOM || c.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("load location: %v", err)
+	}
+	// A Wednesday.
+	from := time.Date(2025, 1, 15, 10, 7, 30, 0, time.UTC)
+
+	cases := []struct {
+		expr string
+		loc  *time.Location
+		want time.Time
+	}{
+		{"* * * * *", time.UTC, time.Date(2025, 1, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.UTC, time.Date(2025, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17 * * mon-fri", time.UTC, time.Date(2025, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 8 * * sat,sun", time.UTC, time.Date(2025, 1, 18, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.UTC, time.Date(2025, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.UTC, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.UTC, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either day field may match when both are restricted
+		{"0 12 1 * fri", time.UTC, time.Date(2025, 1, 17, 12, 0, 0, 0, time.UTC)},
+		// 09:00 in New York is 14:00 UTC in winter
+		{"0 9 * * *", ny, time.Date(2025, 1, 15, 14, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		got, ok := cron.next(from, c.loc)
+		if !ok || !got.Equal(c.want) {
+			t.Errorf("%q: expected %s, got %s (%v)", c.expr, c.want, got.UTC(), ok)
+		}
+	}
+
+	never, _ := parseCron("0 0 30 feb *")
+	if got, ok := never.next(from, time.UTC); ok {
+		t.Errorf("expected no run on 30 Feb, got %s", got)
+	}
+}
@@ -120,3 +120,79 @@ func TestDispatchJobNoHealthyNodes(t *testing.T) {
 		t.Fatalf("expected empty NodeID, got %s", unchanged.NodeID)
 	}
 }
+
+func TestDispatchJobNonZeroExit(t *testing.T) {
+	jobStore := NewJobStore()
+	job := jobStore.Submit(JobSpec{
+		Type:    "exec",
+		Payload: `{"executable":"false"}`,
+		Retry:   &RetryPolicy{MaxAttempts: 1},
+	})
+
+	reg := NewNodeRegistry()
+
+	// fake agent that ran the process but saw it exit non-zero.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(executeResponse{
+			JobID:    job.ID,
+			Status:   "failed",
+			ExitCode: 1,
+			Error:    "exit status 1",
+		})
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test server URL: %v", err)
+	}
+
+	reg.mu.Lock()
+	reg.nodes["node-1"] = &Node{
+		ID:       "node-1",
+		Address:  u.Host,
+		LastSeen: time.Now().UTC(),
+		State:    NodeStateHealthy,
+	}
+	reg.mu.Unlock()
+
+	srv := &server{
+		registry:   reg,
+		jobs:       jobStore,
+		httpClient: ts.Client(),
+	}
+
+	srv.dispatchJob(job.ID)
+
+	jobs := jobStore.List()
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(jobs))
+	}
+	if jobs[0].Status != JobStatusFailed {
+		t.Fatalf("expected job status FAILED, got %s", jobs[0].Status)
+	}
+}
+
+func TestDispatchJobSkipsNodesWithoutJobType(t *testing.T) {
+	jobStore := NewJobStore()
+	job := jobStore.Create("shell", "echo hi")
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{JobTypes: []string{"echo"}})
+
+	srv := &server{
+		registry: reg,
+		jobs:     jobStore,
+	}
+
+	srv.dispatchJob(job.ID)
+
+	updated, ok := jobStore.Get(job.ID)
+	if !ok {
+		t.Fatalf("expected job %s to exist", job.ID)
+	}
+	if updated.Status != JobStatusQueued {
+		t.Fatalf("expected job status QUEUED, got %s", updated.Status)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// sharesBucket is the Storage bucket holding one record per fair-share account.
+const sharesBucket = "shares"
+
+// defaultUsageHalfLife is how quickly past usage stops counting against an
+// account when the store isn't given a half-life.
+const defaultUsageHalfLife = time.Hour
+
+// anonymousAccount is the account of jobs submitted without a submitter or group.
+const anonymousAccount = "anonymous"
+
+// maxAccountNameLen bounds submitter and group names.
+const maxAccountNameLen = 128
+
+// runningUsageQuantum is how many CPU-seconds of usage each running core
+// counts as when ordering dispatch, on top of the usage already recorded.
+// It makes accounts take turns within a dispatch pass instead of the one
+// furthest below its share taking every free slot.
+const runningUsageQuantum = 60.0
+
+// errNoShare is returned for an account the fair-share scheduler doesn't know.
+var errNoShare = errors.New("no such account")
+
+// Share is an account's weight in the fair-share scheduler and the CPU
+// time its jobs have used, decayed as of UpdatedAt.
+type Share struct {
+	Account   string    `json:"account"`
+	Weight    float64   `json:"weight"`
+	Usage     float64   `json:"usage_cpu_seconds"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ShareStatus is an account's standing as served by GET /shares.
+type ShareStatus struct {
+	Account string  `json:"account"`
+	Weight  float64 `json:"weight"`
+
+	// the fraction of the mesh the account is entitled to: its weight over
+	// the weights of every account listed
+	Share float64 `json:"share"`
+
+	// decayed CPU-seconds used, counting running jobs so far, and the
+	// fraction of all accounts' usage that is
+	Usage      float64 `json:"usage_cpu_seconds"`
+	UsageShare float64 `json:"usage_share"`
+
+	QueuedJobs  int `json:"queued_jobs"`
+	RunningJobs int `json:"running_jobs"`
+}
+
+// Account returns who the job is accounted to for fair share: its group,
+// else its submitter, else the anonymous account
+func (j Job) Account() string {
+	switch {
+	case j.Group != "":
+		return j.Group
+	case j.Submitter != "":
+		return j.Submitter
+	}
+	return anonymousAccount
+}
+
+// cores returns how many CPU cores the job is charged for while it runs
+func (j Job) cores() float64 {
+	if j.Requirements != nil && j.Requirements.MinCPUCores > 1 {
+		return float64(j.Requirements.MinCPUCores)
+	}
+	return 1
+}
+
+// cpuSeconds returns what attempt a has used by now
+func (j Job) cpuSeconds(a Attempt, now time.Time) float64 {
+	d := now.Sub(a.StartedAt).Seconds()
+	if d < 0 {
+		d = 0
+	}
+	return d * j.cores()
+}
+
+// validAccountName reports whether name may be used as a submitter or
+// group; "" means none.
+func validAccountName(name string) bool {
+	if len(name) > maxAccountNameLen {
+		return false
+	}
+	for _, r := range name {
+		if r == '/' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// identityHeaders names the request headers that carry who is submitting
+// a job, set by an authenticating proxy in front of the coordinator. An
+// empty name leaves that part of the identity to the request body.
+type identityHeaders struct {
+	Submitter string
+	Group     string
+}
+
+// identify replaces the submitter and group a job request declares with
+// the ones the configured identity headers carry, so clients can't spend
+// another account's share or quota by naming it. A missing header makes
+// the job anonymous, or leaves it without a group.
+func (s *server) identify(r *http.Request, req *createJobRequest) {
+	if s.identity.Submitter != "" {
+		req.Submitter = r.Header.Get(s.identity.Submitter)
+	}
+	if s.identity.Group != "" {
+		req.Group = r.Header.Get(s.identity.Group)
+	}
+}
+
+// Sets how long it takes an account's recorded usage to halve; zero restores the default
+func (s *JobStore) SetUsageHalfLife(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.usageHalfLife = d
+}
+
+// decayedUsage returns sh's usage decayed to now. Callers hold s.mu
+func (s *JobStore) decayedUsage(sh *Share, now time.Time) float64 {
+	halfLife := s.usageHalfLife
+	if halfLife <= 0 {
+		halfLife = defaultUsageHalfLife
+	}
+	elapsed := now.Sub(sh.UpdatedAt)
+	if elapsed <= 0 {
+		return sh.Usage
+	}
+	return sh.Usage * math.Exp2(-float64(elapsed)/float64(halfLife))
+}
+
+// share returns the account's record, or a new one of weight 1 that isn't
+// stored yet. Callers hold s.mu
+func (s *JobStore) share(account string, now time.Time) *Share {
+	if sh, ok := s.shares[account]; ok {
+		return sh
+	}
+	return &Share{Account: account, Weight: 1, UpdatedAt: now}
+}
+
+// chargeUsage adds cpuSeconds to the account's decayed usage, to be
+// written out by the next FlushShares. Callers hold s.mu
+func (s *JobStore) chargeUsage(account string, cpuSeconds float64, now time.Time) {
+	sh := s.share(account, now)
+	sh.Usage = s.decayedUsage(sh, now) + cpuSeconds
+	sh.UpdatedAt = now
+	s.shares[account] = sh
+	s.dirtyShares[account] = true
+}
+
+// Writes the usage charged since the last flush to storage in one write.
+// Usage charged after it is lost if the coordinator stops before the next
+func (s *JobStore) FlushShares() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.dirtyShares) == 0 {
+		return
+	}
+	values := make(map[string]any, len(s.dirtyShares))
+	for account := range s.dirtyShares {
+		if sh, ok := s.shares[account]; ok {
+			values[account] = sh
+		}
+	}
+	if err := s.storage.PutAll(sharesBucket, values); err != nil {
+		log.Printf("[coordinator] failed to persist fair-share usage: %v", err)
+		return
+	}
+	clear(s.dirtyShares)
+}
+
+// countRunning adds j to the active jobs of its fair-share account, or
+// removes it. Callers hold s.mu
+func (s *JobStore) countRunning(j *Job, running bool) {
+	account := j.Account()
+	if running {
+		if s.running[account] == nil {
+			s.running[account] = make(map[string]*Job)
+		}
+		s.running[account][j.ID] = j
+		return
+	}
+	delete(s.running[account], j.ID)
+	if len(s.running[account]) == 0 {
+		delete(s.running, account)
+	}
+}
+
+// Sets an account's fair-share weight, keeping its usage. An account of
+// weight 2 is entitled to twice the mesh of one of weight 1
+func (s *JobStore) SetShareWeight(account string, weight float64) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if account == "" || !validAccountName(account) {
+		return Share{}, fmt.Errorf("invalid account %q", account)
+	}
+	if !(weight > 0) || math.IsInf(weight, 0) {
+		return Share{}, errors.New("weight must be a positive number")
+	}
+	now := time.Now().UTC()
+	sh := s.share(account, now)
+	sh.Usage = s.decayedUsage(sh, now)
+	sh.UpdatedAt = now
+	sh.Weight = weight
+	s.shares[account] = sh
+	s.persistShare(sh)
+	return *sh, nil
+}
+
+// Forgets an account's weight and usage, so it starts over at weight 1
+func (s *JobStore) ResetShare(account string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.shares[account]; !ok {
+		return fmt.Errorf("account %q: %w", account, errNoShare)
+	}
+	delete(s.shares, account)
+	delete(s.dirtyShares, account)
+	if err := s.storage.Delete(sharesBucket, account); err != nil {
+		log.Printf("[coordinator] failed to delete share of %s: %v", account, err)
+	}
+	return nil
+}
+
+// Returns the standing of every account with recorded usage, a weight or
+// unfinished jobs, by account name
+func (s *JobStore) Shares() []ShareStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	byAccount := make(map[string]*ShareStatus)
+	status := func(account string) *ShareStatus {
+		st, ok := byAccount[account]
+		if !ok {
+			sh := s.share(account, now)
+			st = &ShareStatus{Account: account, Weight: sh.Weight, Usage: s.decayedUsage(sh, now)}
+			byAccount[account] = st
+		}
+		return st
+	}
+	for account := range s.shares {
+		status(account)
+	}
+	for _, j := range s.jobs {
+		switch {
+		case j.Active():
+			st := status(j.Account())
+			st.RunningJobs++
+			st.Usage += j.cpuSeconds(j.Attempts[len(j.Attempts)-1], now)
+		case !j.IsParent() && (j.Status == JobStatusQueued || j.Status == JobStatusRetrying):
+			status(j.Account()).QueuedJobs++
+		}
+	}
+
+	var weights, usage float64
+	out := make([]ShareStatus, 0, len(byAccount))
+	for _, st := range byAccount {
+		weights += st.Weight
+		usage += st.Usage
+	}
+	for _, st := range byAccount {
+		st.Share = st.Weight / weights
+		if usage > 0 {
+			st.UsageShare = st.Usage / usage
+		}
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].Account < out[k].Account })
+	return out
+}
+
+// persistShare writes sh through to storage. Callers hold s.mu
+func (s *JobStore) persistShare(sh *Share) {
+	if err := s.storage.Put(sharesBucket, sh.Account, sh); err != nil {
+		log.Printf("[coordinator] failed to persist share of %s: %v", sh.Account, err)
+	}
+}
+
+// loadShares replays stored fair-share accounts into the store. Callers have exclusive access
+func (s *JobStore) loadShares() error {
+	records, err := s.storage.Load(sharesBucket)
+	if err != nil {
+		return fmt.Errorf("load shares: %w", err)
+	}
+	for account, raw := range records {
+		var sh Share
+		if err := json.Unmarshal(raw, &sh); err != nil {
+			return fmt.Errorf("decode share %q: %w", account, err)
+		}
+		s.shares[account] = &sh
+	}
+	return nil
+}
+
+// dispatchOrder hands out the jobs of one dispatch pass: highest priority
+// first and, within a priority, from the account using least of the mesh
+// for its weight, oldest first within an account. It also keeps the pass's
+// jobs within their running and CPU-time quotas
+type dispatchOrder struct {
+	queues []*accountQueue
+	loads  map[string]*accountLoad
+	jobs   map[string]Job
+
+	quotas map[string]*Quota
+	usage  map[string]*quotaUsage
+	now    time.Time
+}
+
+// accountQueue is one account's pending jobs of one priority, with their
+// positions in the pending queue
+type accountQueue struct {
+	account  string
+	priority int
+	ids      []string
+	pos      []int
+}
+
+// accountLoad is what the fair-share order weighs an account by
+type accountLoad struct {
+	usage   float64
+	running float64
+	weight  float64
+}
+
+// Returns the pending jobs ids in the order a dispatch pass should try them
+func (s *JobStore) DispatchOrder(ids []string) *dispatchOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	o := &dispatchOrder{
+		loads: make(map[string]*accountLoad),
+		jobs:  make(map[string]Job, len(ids)),
+
+		quotas: make(map[string]*Quota, len(s.quotas)),
+		usage:  s.quotaUsage(now),
+		now:    now,
+	}
+	for account, q := range s.quotas {
+		copied := *q
+		o.quotas[account] = &copied
+	}
+	load := func(account string) *accountLoad {
+		l, ok := o.loads[account]
+		if !ok {
+			sh := s.share(account, now)
+			l = &accountLoad{usage: s.decayedUsage(sh, now), weight: sh.Weight}
+			o.loads[account] = l
+		}
+		return l
+	}
+	for account, active := range s.running {
+		l := load(account)
+		for _, j := range active {
+			l.usage += j.cpuSeconds(j.Attempts[len(j.Attempts)-1], now)
+			l.running += j.cores()
+		}
+	}
+
+	queues := make(map[string]*accountQueue)
+	for i, id := range ids {
+		var j Job
+		if stored, ok := s.jobs[id]; ok {
+			j = *stored
+		}
+		account := j.Account()
+		load(account)
+		o.jobs[id] = j
+
+		key := fmt.Sprintf("%d/%s", j.Priority, account)
+		q, ok := queues[key]
+		if !ok {
+			q = &accountQueue{account: account, priority: j.Priority}
+			queues[key] = q
+			o.queues = append(o.queues, q)
+		}
+		q.ids = append(q.ids, id)
+		q.pos = append(q.pos, i)
+	}
+	return o
+}
+
+// Next returns the job to try next, or false once every job was handed out.
+func (o *dispatchOrder) Next() (string, bool) {
+	var best *accountQueue
+	for _, q := range o.queues {
+		if len(q.ids) > 0 && (best == nil || o.before(q, best)) {
+			best = q
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	id := best.ids[0]
+	best.ids, best.pos = best.ids[1:], best.pos[1:]
+	return id, true
+}
+
+// OverQuota returns why starting a job handed out by Next would break one
+// of its quotas, or nil.
+func (o *dispatchOrder) OverQuota(id string) *QuotaError {
+	return overQuota(o.jobs[id], o.quotas, o.usage, 0, 1, o.now)
+}
+
+// Placed counts a job handed out by Next as running from now on.
+func (o *dispatchOrder) Placed(id string) {
+	j := o.jobs[id]
+	o.loads[j.Account()].running += j.cores()
+	for _, account := range j.quotaAccounts() {
+		if u, ok := o.usage[account]; ok {
+			u.running++
+			u.queued--
+		}
+	}
+}
+
+// before reports whether the head of a goes before the head of b.
+func (o *dispatchOrder) before(a, b *accountQueue) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if la, lb := o.loads[a.account].normalized(), o.loads[b.account].normalized(); la != lb {
+		return la < lb
+	}
+	return a.pos[0] < b.pos[0]
+}
+
+// normalized returns the account's usage, counting its running cores,
+// per unit of weight
+func (l *accountLoad) normalized() float64 {
+	return (l.usage + l.running*runningUsageQuantum) / l.weight
+}
+
+// handleShares handles fair share:
+//   - GET /shares -> every account's weight, share and usage
+//   - GET /shares/{account} -> one account's
+//   - PUT /admin/shares/{account} -> set the account's weight
+//   - DELETE /admin/shares/{account} -> forget its weight and usage
+func (s *server) handleShares(w http.ResponseWriter, r *http.Request) {
+	admin := strings.HasPrefix(r.URL.Path, "/admin/")
+	account := strings.Trim(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin"), "/shares"), "/")
+	switch {
+	case !admin && r.Method == http.MethodGet:
+		shares := s.jobs.Shares()
+		if account == "" {
+			writeJSON(w, http.StatusOK, shares)
+			return
+		}
+		for _, st := range shares {
+			if st.Account == account {
+				writeJSON(w, http.StatusOK, st)
+				return
+			}
+		}
+		http.Error(w, "account not found", http.StatusNotFound)
+	case admin && account != "" && r.Method == http.MethodPut:
+		var req struct {
+			Weight float64 `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		sh, err := s.jobs.SetShareWeight(account, req.Weight)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("fair-share weight of %s set to %g", account, sh.Weight)
+		writeJSON(w, http.StatusOK, sh)
+		s.kick()
+	case admin && account != "" && r.Method == http.MethodDelete:
+		if err := s.jobs.ResetShare(account); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("fair share of %s reset", account)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
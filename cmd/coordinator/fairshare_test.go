@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drain hands out every job of o, counting each as placed
+func drain(o *dispatchOrder) []string {
+	var out []string
+	for id, ok := o.Next(); ok; id, ok = o.Next() {
+		o.Placed(id)
+		out = append(out, id)
+	}
+	return out
+}
+
+// Test that accounts take turns within a priority, by weight and past usage
+func TestDispatchOrderFairShare(t *testing.T) {
+	jobs := NewJobStore()
+	var ids []string
+	submit := func(spec JobSpec) string {
+		j := jobs.Submit(spec)
+		ids = append(ids, j.ID)
+		return j.ID
+	}
+	a1 := submit(JobSpec{Type: "echo", Submitter: "alice"})
+	a2 := submit(JobSpec{Type: "echo", Submitter: "alice"})
+	a3 := submit(JobSpec{Type: "echo", Submitter: "alice"})
+	a4 := submit(JobSpec{Type: "echo", Submitter: "alice"})
+	b1 := submit(JobSpec{Type: "echo", Submitter: "bob", Group: "lab"})
+	b2 := submit(JobSpec{Type: "echo", Submitter: "carol", Group: "lab"})
+	urgent := submit(JobSpec{Type: "echo", Submitter: "alice", PriorityClass: "high"})
+
+	if got, want := drain(jobs.DispatchOrder(ids)), []string{urgent, b1, a1, b2, a2, a3, a4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected accounts to alternate within a priority, got %v, want %v", got, want)
+	}
+
+	// twice the weight, twice the turns (the urgent job took one of alice's)
+	if _, err := jobs.SetShareWeight("alice", 2); err != nil {
+		t.Fatalf("set weight: %v", err)
+	}
+	if got, want := drain(jobs.DispatchOrder(ids)), []string{urgent, b1, a1, a2, b2, a3, a4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected weighted order %v, want %v", got, want)
+	}
+
+	// alice's past usage puts the lab first
+	jobs.mu.Lock()
+	jobs.chargeUsage("alice", 1000, time.Now().UTC())
+	jobs.mu.Unlock()
+	if got, want := drain(jobs.DispatchOrder(ids)), []string{urgent, b1, b2, a1, a2, a3, a4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected order after usage %v, want %v", got, want)
+	}
+}
+
+// Test that finished attempts are charged to their account and the charge decays
+func TestShareUsage(t *testing.T) {
+	jobs := NewJobStore()
+	jobs.SetUsageHalfLife(time.Hour)
+
+	job := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice", Requirements: &Requirements{MinCPUCores: 2}})
+	if _, err := jobs.StartAttempt(job.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	jobs.mu.Lock()
+	jobs.jobs[job.ID].Attempts[0].StartedAt = time.Now().UTC().Add(-10 * time.Second)
+	jobs.mu.Unlock()
+	jobs.Submit(JobSpec{Type: "echo", Submitter: "bob"})
+
+	shares := jobs.Shares()
+	if len(shares) != 2 || shares[0].Account != "alice" || shares[0].RunningJobs != 1 || shares[1].QueuedJobs != 1 {
+		t.Fatalf("unexpected shares %+v", shares)
+	}
+	if shares[0].Usage < 20 || shares[0].UsageShare != 1 || shares[0].Share != 0.5 {
+		t.Fatalf("expected alice to have used 2 cores for 10s, got %+v", shares[0])
+	}
+
+	if _, err := jobs.CompleteAttempt(job.ID, 1); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+	jobs.mu.Lock()
+	sh := jobs.shares["alice"]
+	used := sh.Usage
+	sh.UpdatedAt = sh.UpdatedAt.Add(-time.Hour)
+	jobs.mu.Unlock()
+	if used < 20 || used > 30 {
+		t.Fatalf("expected about 20 CPU-seconds charged, got %f", used)
+	}
+	if got := jobs.Shares()[0].Usage; math.Abs(got-used/2) > 0.01 {
+		t.Fatalf("expected usage to halve after an hour, got %f of %f", got, used)
+	}
+}
+
+// Test that usage is written out by FlushShares rather than on every attempt
+func TestShareUsageFlush(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	job := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice"})
+	jobs.StartAttempt(job.ID, "node-1", "")
+	if n := len(jobs.running["alice"]); n != 1 {
+		t.Fatalf("expected alice to have one running job, got %d", n)
+	}
+	jobs.CompleteAttempt(job.ID, 1)
+	if _, ok := jobs.running["alice"]; ok {
+		t.Fatalf("expected alice to have no running jobs left")
+	}
+
+	if restored, _ := NewJobStoreWithStorage(storage); len(restored.shares) != 0 {
+		t.Fatalf("expected no usage written before a flush, got %+v", restored.shares)
+	}
+	jobs.FlushShares()
+	restored, _ := NewJobStoreWithStorage(storage)
+	if sh, ok := restored.shares["alice"]; !ok || sh.Usage <= 0 {
+		t.Fatalf("expected alice's usage restored after a flush, got %+v", sh)
+	}
+}
+
+// Test the fair-share endpoints
+func TestShareEndpoints(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs, wake: make(chan struct{}, 1)}
+
+	if w := postJob(srv, "", `{"type":"echo","submitter":"alice smith"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a submitter with a space, got %d", w.Code)
+	}
+	if w := postJob(srv, "", `{"type":"echo","submitter":"alice"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	put := func(account, body string) int {
+		w := httptest.NewRecorder()
+		srv.handleShares(w, httptest.NewRequest(http.MethodPut, "/admin/shares/"+account, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := put("lab", `{"weight":0}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a zero weight, got %d", code)
+	}
+	if code := put("lab", `{"weight":3}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleShares(w, httptest.NewRequest(http.MethodGet, "/shares", nil))
+	var shares []ShareStatus
+	if err := json.NewDecoder(w.Body).Decode(&shares); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(shares) != 2 || shares[0].Account != "alice" || shares[0].QueuedJobs != 1 || shares[1].Share != 0.75 {
+		t.Fatalf("unexpected shares %+v", shares)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleShares(w, httptest.NewRequest(http.MethodGet, "/shares/nobody", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	srv.handleShares(w, httptest.NewRequest(http.MethodPut, "/shares/lab", strings.NewReader(`{"weight":1}`)))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected weights to be set through /admin only, got %d", w.Code)
+	}
+
+	// weights survive a restart
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := restored.Shares(); len(got) != 2 || got[1].Weight != 3 {
+		t.Fatalf("expected lab's weight restored, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleShares(w, httptest.NewRequest(http.MethodDelete, "/admin/shares/lab", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if got := jobs.Shares(); len(got) != 1 {
+		t.Fatalf("expected lab forgotten, got %+v", got)
+	}
+}
+
+// Test that configured identity headers decide who a job is for
+func TestIdentityHeaders(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+	srv.identity = identityHeaders{Submitter: "X-Forwarded-User"}
+
+	submit := func(user string) Job {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"type":"echo","submitter":"alice","group":"lab"}`))
+		if user != "" {
+			r.Header.Set("X-Forwarded-User", user)
+		}
+		w := httptest.NewRecorder()
+		srv.handleJobs(w, r)
+		var job Job
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return job
+	}
+	if job := submit("mallory"); job.Submitter != "mallory" || job.Group != "lab" {
+		t.Fatalf("expected the header's submitter and the declared group, got %q %q", job.Submitter, job.Group)
+	}
+	if job := submit(""); job.Submitter != "" {
+		t.Fatalf("expected a job without the header to be anonymous, got %q", job.Submitter)
+	}
+}
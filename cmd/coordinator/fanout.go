@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobStatusPartiallyCompleted is the status of a job split into tasks of
+// which some completed and some did not
+const JobStatusPartiallyCompleted JobStatus = "PARTIALLY_COMPLETED"
+
+// maxFanoutTasks bounds how many tasks one job may split into
+const maxFanoutTasks = 10000
+
+// How the results of a job's tasks are combined into the job's result
+const (
+	AggregateConcat    = "concat"
+	AggregateJSONArray = "json_array"
+	AggregateSum       = "sum"
+	AggregateReducer   = "reducer"
+)
+
+// parentTransitions is the state machine of a job split into tasks. It
+// never holds a node itself, so it goes from QUEUED to RUNNING as soon as
+// its first task is placed, and finishes when its tasks (and reducer) have.
+var parentTransitions = transitionTable{
+	JobStatusWaiting:            {JobStatusQueued, JobStatusSkipped, JobStatusCancelled},
+	JobStatusQueued:             {JobStatusRunning, JobStatusCompleted, JobStatusPartiallyCompleted, JobStatusFailed, JobStatusCancelled},
+	JobStatusRunning:            {JobStatusCompleted, JobStatusPartiallyCompleted, JobStatusFailed, JobStatusCancelled},
+	JobStatusCompleted:          nil,
+	JobStatusPartiallyCompleted: nil,
+	JobStatusFailed:             nil,
+	JobStatusCancelled:          nil,
+	JobStatusSkipped:            nil,
+}
+
+// FanoutSpec splits a job into one task per item, index or grid point.
+// Exactly one of Items, Range and Grid is set. Each task runs the job's
+// payload with {{key}} placeholders replaced from its payload subset:
+// {{index}} always, {{item}} for Items and Range, one key per Grid parameter
+type FanoutSpec struct {
+	Items []string            `json:"items,omitempty"`
+	Range *IndexRange         `json:"range,omitempty"`
+	Grid  map[string][]string `json:"grid,omitempty"`
+
+	// concat (default), json_array, sum or reducer
+	Aggregate string `json:"aggregate,omitempty"`
+
+	// the task that combines the results when Aggregate is reducer; its
+	// payload's {{results}} is replaced by the json_array aggregate
+	Reducer *ReducerSpec `json:"reducer,omitempty"`
+}
+
+// IndexRange is the numbers Start, Start+Step, ... up to but not including End
+type IndexRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Step  int64 `json:"step,omitempty"`
+}
+
+// ReducerSpec is the job run to combine a fanned-out job's task results
+type ReducerSpec struct {
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+}
+
+// Validate rejects fan-outs that can't be expanded or aggregated
+func (f FanoutSpec) Validate() error {
+	kinds := 0
+	if len(f.Items) > 0 {
+		kinds++
+	}
+	if f.Range != nil {
+		kinds++
+	}
+	if len(f.Grid) > 0 {
+		kinds++
+	}
+	if kinds != 1 {
+		return errors.New("fanout needs exactly one of items, range or grid")
+	}
+
+	if r := f.Range; r != nil {
+		if r.Step < 0 {
+			return errors.New("fanout.range.step must be positive")
+		}
+		if r.End <= r.Start {
+			return errors.New("fanout.range.end must be greater than start")
+		}
+	}
+	for name, values := range f.Grid {
+		if name == "" || name == "index" {
+			return fmt.Errorf("fanout.grid parameter name %q is not allowed", name)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("fanout.grid parameter %q has no values", name)
+		}
+	}
+	if n := f.size(); n > maxFanoutTasks {
+		return fmt.Errorf("fanout would create %d tasks; at most %d are allowed", n, maxFanoutTasks)
+	}
+
+	switch f.Aggregate {
+	case "", AggregateConcat, AggregateJSONArray, AggregateSum:
+		if f.Reducer != nil {
+			return errors.New("fanout.reducer is only used with aggregate reducer")
+		}
+	case AggregateReducer:
+		if f.Reducer == nil || f.Reducer.Type == "" {
+			return errors.New("fanout.reducer.type is required with aggregate reducer")
+		}
+	default:
+		return fmt.Errorf("unknown fanout.aggregate %q", f.Aggregate)
+	}
+	return nil
+}
+
+// size returns how many tasks the fan-out expands to, saturating past maxFanoutTasks
+func (f FanoutSpec) size() int64 {
+	switch {
+	case len(f.Items) > 0:
+		return int64(len(f.Items))
+	case f.Range != nil:
+		// in uint64 so that End-Start can't overflow; Validate checked End > Start
+		step := uint64(f.Range.Step)
+		if step == 0 {
+			step = 1
+		}
+		span := uint64(f.Range.End) - uint64(f.Range.Start)
+		if n := (span-1)/step + 1; n <= maxFanoutTasks {
+			return int64(n)
+		}
+		return maxFanoutTasks + 1
+	default:
+		n := int64(1)
+		for _, values := range f.Grid {
+			n *= int64(len(values))
+			if n > maxFanoutTasks {
+				return n
+			}
+		}
+		return n
+	}
+}
+
+// Expand returns the payload subset of every task, in task order. Grid
+// parameters are varied in name order, the last name fastest
+func (f FanoutSpec) Expand() []map[string]string {
+	var out []map[string]string
+	add := func(subset map[string]string) {
+		subset["index"] = strconv.Itoa(len(out))
+		out = append(out, subset)
+	}
+
+	switch {
+	case len(f.Items) > 0:
+		for _, item := range f.Items {
+			add(map[string]string{"item": item})
+		}
+	case f.Range != nil:
+		step := f.Range.Step
+		if step == 0 {
+			step = 1
+		}
+		// counted rather than stepped past End, which could overflow
+		for i, n := int64(0), f.size(); i < n; i++ {
+			add(map[string]string{"item": strconv.FormatInt(f.Range.Start+i*step, 10)})
+		}
+	default:
+		names := make([]string, 0, len(f.Grid))
+		for name := range f.Grid {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		idx := make([]int, len(names))
+		for {
+			subset := make(map[string]string, len(names)+1)
+			for i, name := range names {
+				subset[name] = f.Grid[name][idx[i]]
+			}
+			add(subset)
+
+			i := len(names) - 1
+			for ; i >= 0; i-- {
+				idx[i]++
+				if idx[i] < len(f.Grid[names[i]]) {
+					break
+				}
+				idx[i] = 0
+			}
+			if i < 0 {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// expandPayload replaces each {{key}} in payload with its value from subset
+func expandPayload(payload string, subset map[string]string) string {
+	pairs := make([]string, 0, 2*len(subset))
+	for k, v := range subset {
+		pairs = append(pairs, "{{"+k+"}}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(payload)
+}
+
+// IsParent reports whether the job is split into tasks rather than run itself
+func (j Job) IsParent() bool {
+	return j.Fanout != nil
+}
+
+// submitTasks creates a QUEUED task for every point of parent's fan-out,
+// persisting them in one write. Callers hold s.mu
+func (s *JobStore) submitTasks(parent *Job, spec JobSpec, now time.Time) {
+	tasks := make(map[string]any)
+	for _, subset := range parent.Fanout.Expand() {
+		task := spec
+		task.Fanout = nil
+		task.Payload = expandPayload(spec.Payload, subset)
+
+		t := s.newJob(task, JobStatusQueued, now)
+		t.ParentID = parent.ID
+		t.PayloadSubset = subset
+		tasks[t.ID] = t
+		parent.Tasks = append(parent.Tasks, t.ID)
+	}
+	s.taskCounts[parent.ID] = &taskCounts{queued: len(parent.Tasks)}
+	if err := s.storage.PutAll(jobsBucket, tasks); err != nil {
+		log.Printf("[coordinator] failed to persist the tasks of job %s: %v", parent.ID, err)
+	}
+}
+
+// taskCounts tallies a fanned-out job's tasks by state, so rolling them up
+// needn't look at every task
+type taskCounts struct {
+	queued, finished, completed int
+}
+
+// add counts n more (or, when negative, fewer) tasks in status
+func (c *taskCounts) add(status JobStatus, n int) {
+	switch status {
+	case JobStatusQueued:
+		c.queued += n
+	case JobStatusCompleted:
+		c.completed += n
+	}
+	if (Job{Status: status}).Finished() {
+		c.finished += n
+	}
+}
+
+// countTask moves j from status from to status to in its parent's task
+// counts, if it is one of the parent's tasks. Callers hold s.mu
+func (s *JobStore) countTask(j *Job, from, to JobStatus) {
+	c, ok := s.taskCounts[j.ParentID]
+	if !ok || s.jobs[j.ParentID].ReducerID == j.ID {
+		return
+	}
+	c.add(from, -1)
+	c.add(to, 1)
+}
+
+// restoreTaskCounts tallies the tasks of every unfinished fanned-out job
+// after they were loaded from storage. Callers have exclusive access
+func (s *JobStore) restoreTaskCounts() {
+	for _, p := range s.jobs {
+		if !p.IsParent() || p.Finished() {
+			continue
+		}
+		c := &taskCounts{}
+		for _, id := range p.Tasks {
+			if t, ok := s.jobs[id]; ok {
+				c.add(t.Status, 1)
+			}
+		}
+		s.taskCounts[p.ID] = c
+	}
+}
+
+// Brings a fanned-out job's status in line with its tasks: RUNNING once a
+// task has been placed, and finished once every task (and the reducer, if
+// any) has. It returns the job, and the reducer job if one was created and
+// needs queueing
+func (s *JobStore) RollUp(parentID string) (Job, *Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.jobs[parentID]
+	if !ok {
+		return Job{}, nil, fmt.Errorf("job %q not found", parentID)
+	}
+	if !p.IsParent() {
+		return Job{}, nil, fmt.Errorf("job %q has no tasks", parentID)
+	}
+	if p.Finished() {
+		return *p, nil, nil
+	}
+
+	now := time.Now().UTC()
+	counts := s.taskCounts[p.ID]
+	done, completed := counts.finished, counts.completed
+
+	if done < len(p.Tasks) {
+		if counts.queued < len(p.Tasks) && p.Status == JobStatusQueued {
+			if err := s.transition(p, JobEvent{Time: now, To: JobStatusRunning, Reason: "first task placed"}); err != nil {
+				return Job{}, nil, err
+			}
+			s.persist(p)
+		}
+		return *p, nil, nil
+	}
+
+	reducer, err := s.conclude(p, completed, now)
+	if err != nil {
+		return Job{}, nil, err
+	}
+	return *p, reducer, nil
+}
+
+// conclude finishes p once all its tasks have: it aggregates their results,
+// or creates the reducer job and waits for it. A reducer created here is
+// returned. Callers hold s.mu
+func (s *JobStore) conclude(p *Job, completed int, now time.Time) (*Job, error) {
+	final := JobStatusCompleted
+	if completed < len(p.Tasks) {
+		final = JobStatusPartiallyCompleted
+	}
+	summary := fmt.Sprintf("%d of %d tasks completed", completed, len(p.Tasks))
+
+	if completed == 0 {
+		return nil, s.finishParent(p, JobStatusFailed, summary, nil, now)
+	}
+
+	if p.Fanout.Aggregate != AggregateReducer {
+		out, err := s.aggregate(p)
+		if err != nil {
+			return nil, s.finishParent(p, JobStatusFailed, fmt.Sprintf("%s; aggregate failed: %v", summary, err), nil, now)
+		}
+		return nil, s.finishParent(p, final, summary, &out, now)
+	}
+
+	if p.ReducerID == "" {
+		results, err := s.aggregateJSONArray(p)
+		if err != nil {
+			return nil, s.finishParent(p, JobStatusFailed, fmt.Sprintf("%s; aggregate failed: %v", summary, err), nil, now)
+		}
+		r := s.newJob(JobSpec{
+			Type:         p.Fanout.Reducer.Type,
+			Payload:      expandPayload(p.Fanout.Reducer.Payload, quoteInputs(p.Fanout.Reducer.Type, map[string]string{"results": results})),
+			Requirements: p.Requirements,
+			Retry:        &p.Retry,
+			Deadline:     p.Deadline,
+
+			PriorityClass: p.PriorityClass,
+			Submitter:     p.Submitter,
+			Group:         p.Group,
+			Scheduler:     p.Scheduler,
+		}, JobStatusQueued, now)
+		r.ParentID = p.ID
+		s.persist(r)
+		p.ReducerID = r.ID
+
+		if p.Status == JobStatusQueued {
+			if err := s.transition(p, JobEvent{Time: now, To: JobStatusRunning, Reason: "reducer queued"}); err != nil {
+				return nil, err
+			}
+		}
+		s.persist(p)
+		reducer := *r
+		return &reducer, nil
+	}
+
+	r := s.jobs[p.ReducerID]
+	if !r.Finished() {
+		return nil, nil
+	}
+	if r.Status != JobStatusCompleted {
+		return nil, s.finishParent(p, JobStatusFailed, fmt.Sprintf("%s; reducer %s %s", summary, r.ID, r.Status), nil, now)
+	}
+	var out string
+	if res, ok := s.results[r.ID]; ok {
+		out = res.Stdout
+	}
+	return nil, s.finishParent(p, final, summary, &out, now)
+}
+
+// finishParent moves p to its final status and, given an aggregate,
+// stores it as p's result. Callers hold s.mu
+func (s *JobStore) finishParent(p *Job, status JobStatus, summary string, aggregate *string, now time.Time) error {
+	if err := s.transition(p, JobEvent{Time: now, To: status, Reason: summary}); err != nil {
+		return err
+	}
+	if status != JobStatusCompleted {
+		p.LastError = summary
+	}
+	s.persist(p)
+
+	if aggregate == nil {
+		return nil
+	}
+	r := JobResult{JobID: p.ID, Status: "ok", ReceivedAt: now}
+	r.Stdout, r.StdoutTruncated = truncateTail(*aggregate, maxResultOutput)
+	s.results[p.ID] = &r
+	if err := s.storage.Put(resultsBucket, p.ID, r); err != nil {
+		log.Printf("[coordinator] failed to persist result of job %s: %v", p.ID, err)
+	}
+	return nil
+}
+
+// aggregate combines the stdout of p's completed tasks as its fan-out
+// asks. Callers hold s.mu
+func (s *JobStore) aggregate(p *Job) (string, error) {
+	switch p.Fanout.Aggregate {
+	case AggregateJSONArray:
+		return s.aggregateJSONArray(p)
+	case AggregateSum:
+		var sum float64
+		for _, out := range s.taskOutputs(p) {
+			if out == nil {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(*out), 64)
+			if err != nil {
+				return "", fmt.Errorf("task output %q is not a number", strings.TrimSpace(*out))
+			}
+			sum += v
+		}
+		return strconv.FormatFloat(sum, 'g', -1, 64), nil
+	default:
+		var b strings.Builder
+		for _, out := range s.taskOutputs(p) {
+			if out != nil {
+				b.WriteString(*out)
+			}
+		}
+		return b.String(), nil
+	}
+}
+
+// aggregateJSONArray returns a JSON array with one element per task, in
+// task order: its stdout as JSON if it parses, else as a string, and null
+// for tasks that didn't complete. Callers hold s.mu
+func (s *JobStore) aggregateJSONArray(p *Job) (string, error) {
+	outs := s.taskOutputs(p)
+	elems := make([]json.RawMessage, len(outs))
+	for i, out := range outs {
+		switch {
+		case out == nil:
+			elems[i] = json.RawMessage("null")
+		case json.Valid([]byte(*out)):
+			elems[i] = json.RawMessage(strings.TrimSpace(*out))
+		default:
+			raw, err := json.Marshal(*out)
+			if err != nil {
+				return "", err
+			}
+			elems[i] = raw
+		}
+	}
+	b, err := json.Marshal(elems)
+	return string(b), err
+}
+
+// taskOutputs returns the stdout of each of p's tasks in order, nil for
+// tasks that didn't complete. Callers hold s.mu
+func (s *JobStore) taskOutputs(p *Job) []*string {
+	out := make([]*string, len(p.Tasks))
+	for i, id := range p.Tasks {
+		if s.jobs[id].Status != JobStatusCompleted {
+			continue
+		}
+		stdout := ""
+		if r, ok := s.results[id]; ok {
+			stdout = r.Stdout
+		}
+		out[i] = &stdout
+	}
+	return out
+}
+
+// enqueueJob queues a submitted job for dispatch, or its tasks if it fans out.
+func (s *server) enqueueJob(job Job) {
+	s.enqueueJobs([]Job{job})
+}
+
+// enqueueJobs queues submitted jobs the same way, waking the dispatch loop once.
+func (s *server) enqueueJobs(jobs []Job) {
+	for _, job := range jobs {
+		if !job.IsParent() {
+			s.pending.Push(job.ID, job.Priority)
+			continue
+		}
+		// Tasks share the job's priority.
+		for _, id := range job.Tasks {
+			s.pending.Push(id, job.Priority)
+		}
+	}
+	s.kick()
+}
+
+// settleParent rolls a task's progress up into the job it belongs to and
+// queues the job's reducer once it is needed.
+func (s *server) settleParent(task Job) {
+	if task.ParentID == "" {
+		return
+	}
+	parent, reducer, err := s.jobs.RollUp(task.ParentID)
+	if err != nil {
+		log.Printf("failed to update job %s from task %s: %v", task.ParentID, task.ID, err)
+		return
+	}
+	if reducer != nil {
+		log.Printf("job %s: all tasks finished; queued reducer %s", parent.ID, reducer.ID)
+		s.enqueue(*reducer)
+	}
+	if parent.Finished() {
+		log.Printf("job %s %s: %s", parent.ID, parent.Status, parent.LastError)
+		s.advanceWorkflow(parent)
+	}
+}
+
+// rollUpParents settles every fanned-out job that hasn't finished, e.g.
+// after a restart that interrupted one.
+func (s *server) rollUpParents() {
+	for _, j := range s.jobs.List() {
+		if !j.IsParent() || j.Finished() {
+			continue
+		}
+		if _, reducer, err := s.jobs.RollUp(j.ID); err != nil {
+			log.Printf("failed to update job %s from its tasks: %v", j.ID, err)
+		} else if reducer != nil {
+			s.pending.Push(reducer.ID, reducer.Priority)
+		}
+	}
+}
+
+// cancelTasks cancels the tasks and reducer of a cancelled fanned-out job
+// that haven't finished.
+func (s *server) cancelTasks(parent Job, reason string) {
+	ids := parent.Tasks
+	if parent.ReducerID != "" {
+		ids = append(append([]string(nil), ids...), parent.ReducerID)
+	}
+	for _, id := range ids {
+		if _, err := s.cancelJob(id, reason); err != nil && !errors.Is(err, errJobFinished) {
+			log.Printf("failed to cancel task %s of job %s: %v", id, parent.ID, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that each kind of fan-out expands to the expected payload subsets
+func TestFanoutExpand(t *testing.T) {
+	items := FanoutSpec{Items: []string{"a", "b"}}.Expand()
+	if want := []map[string]string{{"index": "0", "item": "a"}, {"index": "1", "item": "b"}}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("items: expected %v, got %v", want, items)
+	}
+
+	rng := FanoutSpec{Range: &IndexRange{Start: 10, End: 15, Step: 2}}.Expand()
+	var got []string
+	for _, s := range rng {
+		got = append(got, s["item"])
+	}
+	if want := []string{"10", "12", "14"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("range: expected %v, got %v", want, got)
+	}
+
+	grid := FanoutSpec{Grid: map[string][]string{"lr": {"0.1", "0.01"}, "bs": {"32", "64"}}}.Expand()
+	if len(grid) != 4 {
+		t.Fatalf("grid: expected 4 points, got %d", len(grid))
+	}
+	if want := (map[string]string{"index": "1", "bs": "32", "lr": "0.01"}); !reflect.DeepEqual(grid[1], want) {
+		t.Fatalf("grid: expected the last name to vary fastest, got %v", grid[1])
+	}
+
+	// ranges at the ends of int64 neither overflow nor run forever
+	edge := FanoutSpec{Range: &IndexRange{Start: math.MaxInt64 - 1, End: math.MaxInt64, Step: math.MaxInt64}}.Expand()
+	if len(edge) != 1 || edge[0]["item"] != "9223372036854775806" {
+		t.Fatalf("edge range: expected one task, got %v", edge)
+	}
+
+	if p := expandPayload("run {{item}} #{{index}}", items[1]); p != "run b #1" {
+		t.Fatalf("unexpected payload %q", p)
+	}
+}
+
+// Test that malformed fan-outs are refused
+func TestFanoutValidate(t *testing.T) {
+	bad := []FanoutSpec{
+		{},
+		{Items: []string{"a"}, Range: &IndexRange{End: 2}},
+		{Range: &IndexRange{Start: 5, End: 5}},
+		{Grid: map[string][]string{"index": {"1"}}},
+		{Grid: map[string][]string{"x": {}}},
+		{Range: &IndexRange{End: maxFanoutTasks + 1}},
+		{Range: &IndexRange{Start: math.MinInt64, End: math.MaxInt64}},
+		{Range: &IndexRange{Start: math.MinInt64, End: 0, Step: 1 << 40}},
+		{Items: []string{"a"}, Aggregate: "median"},
+		{Items: []string{"a"}, Aggregate: AggregateReducer},
+	}
+	for i, f := range bad {
+		if err := f.Validate(); err == nil {
+			t.Errorf("case %d: expected an error for %+v", i, f)
+		}
+	}
+	if err := (FanoutSpec{Items: []string{"a"}, Aggregate: AggregateSum}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// newFanoutServer returns a server with one node and a fanned-out job submitted on it.
+func newFanoutServer(t *testing.T, fanout FanoutSpec) (*server, Job) {
+	t.Helper()
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	parent := jobs.Submit(JobSpec{Type: "echo", Payload: "{{item}}", Retry: &RetryPolicy{MaxAttempts: 1}, Fanout: &fanout})
+	return srv, parent
+}
+
+// finishTask places a task and applies the given agent result to it.
+func finishTask(t *testing.T, srv *server, id string, result executeResponse) {
+	t.Helper()
+
+	if _, _, err := srv.placeJob(id); err != nil {
+		t.Fatalf("place %s: %v", id, err)
+	}
+	srv.applyResult(id, 1, "node-1", result)
+}
+
+// Test that a fanned-out job follows its tasks and sums their output
+func TestFanoutSum(t *testing.T) {
+	srv, parent := newFanoutServer(t, FanoutSpec{Items: []string{"1", "2", "3"}, Aggregate: AggregateSum})
+	if len(parent.Tasks) != 3 {
+		t.Fatalf("expected 3 tasks, got %v", parent.Tasks)
+	}
+	task, _ := srv.jobs.Get(parent.Tasks[1])
+	if task.Payload != "2" || task.ParentID != parent.ID || task.PayloadSubset["index"] != "1" {
+		t.Fatalf("unexpected task %+v", task)
+	}
+
+	finishTask(t, srv, parent.Tasks[0], executeResponse{Status: "ok", Stdout: "1\n"})
+	if got, _ := srv.jobs.Get(parent.ID); got.Status != JobStatusRunning {
+		t.Fatalf("expected RUNNING once a task ran, got %s", got.Status)
+	}
+	finishTask(t, srv, parent.Tasks[1], executeResponse{Status: "ok", Stdout: "2"})
+	finishTask(t, srv, parent.Tasks[2], executeResponse{Status: "ok", Stdout: "3.5"})
+
+	got, _ := srv.jobs.Get(parent.ID)
+	if got.Status != JobStatusCompleted {
+		t.Fatalf("expected COMPLETED, got %s (%s)", got.Status, got.LastError)
+	}
+	if res, ok := srv.jobs.Result(parent.ID); !ok || res.Stdout != "6.5" {
+		t.Fatalf("expected aggregate 6.5, got %+v", res)
+	}
+}
+
+// Test that a job with failed tasks ends PARTIALLY_COMPLETED with the rest aggregated
+func TestFanoutPartialFailure(t *testing.T) {
+	srv, parent := newFanoutServer(t, FanoutSpec{Items: []string{"a", "b", "c"}, Aggregate: AggregateJSONArray})
+
+	finishTask(t, srv, parent.Tasks[0], executeResponse{Status: "ok", Stdout: `{"n":1}`})
+	finishTask(t, srv, parent.Tasks[1], executeResponse{Status: "failed", ExitCode: 1})
+	finishTask(t, srv, parent.Tasks[2], executeResponse{Status: "ok", Stdout: "c"})
+
+	got, _ := srv.jobs.Get(parent.ID)
+	if got.Status != JobStatusPartiallyCompleted || got.LastError != "2 of 3 tasks completed" {
+		t.Fatalf("expected PARTIALLY_COMPLETED with 2 of 3, got %s (%s)", got.Status, got.LastError)
+	}
+	if res, _ := srv.jobs.Result(parent.ID); res.Stdout != `[{"n":1},null,"c"]` {
+		t.Fatalf("unexpected aggregate %s", res.Stdout)
+	}
+}
+
+// Test that a reducer task is queued once the tasks finish and provides the result
+func TestFanoutReducer(t *testing.T) {
+	srv, parent := newFanoutServer(t, FanoutSpec{
+		Items:     []string{"x", "y"},
+		Aggregate: AggregateReducer,
+		Reducer:   &ReducerSpec{Type: "shell", Payload: "echo {{results}} | wc -c"},
+	})
+
+	finishTask(t, srv, parent.Tasks[0], executeResponse{Status: "ok", Stdout: "x"})
+	finishTask(t, srv, parent.Tasks[1], executeResponse{Status: "ok", Stdout: "y"})
+
+	got, _ := srv.jobs.Get(parent.ID)
+	if got.Status != JobStatusRunning || got.ReducerID == "" {
+		t.Fatalf("expected RUNNING with a reducer, got %s reducer %q", got.Status, got.ReducerID)
+	}
+	reducer, _ := srv.jobs.Get(got.ReducerID)
+	if reducer.Type != "shell" || reducer.Payload != `echo '["x","y"]' | wc -c` {
+		t.Fatalf("unexpected reducer %+v", reducer)
+	}
+	if q := srv.pending.Snapshot(); len(q) != 1 || q[0] != reducer.ID {
+		t.Fatalf("expected the reducer on the pending queue, got %v", q)
+	}
+
+	finishTask(t, srv, reducer.ID, executeResponse{Status: "ok", Stdout: "10\n"})
+	got, _ = srv.jobs.Get(parent.ID)
+	if got.Status != JobStatusCompleted {
+		t.Fatalf("expected COMPLETED, got %s", got.Status)
+	}
+	if res, _ := srv.jobs.Result(parent.ID); res.Stdout != "10\n" {
+		t.Fatalf("expected the reducer's output, got %q", res.Stdout)
+	}
+}
+
+// Test that a fanned-out job's task counts follow its tasks and its reducer
+// isn't counted among them, also after a restart
+func TestFanoutTaskCounts(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	parent := jobs.Submit(JobSpec{
+		Type:    "echo",
+		Payload: "{{item}}",
+		Retry:   &RetryPolicy{MaxAttempts: 1},
+		Fanout:  &FanoutSpec{Items: []string{"a", "b", "c"}, Aggregate: AggregateReducer, Reducer: &ReducerSpec{Type: "echo"}},
+	})
+
+	jobs.StartAttempt(parent.Tasks[0], "node-1", "")
+	jobs.CompleteAttempt(parent.Tasks[0], 1)
+	jobs.StartAttempt(parent.Tasks[1], "node-1", "")
+	jobs.FailAttempt(parent.Tasks[1], 1, AttemptFailed, "boom", false)
+
+	want := taskCounts{queued: 1, finished: 2, completed: 1}
+	if got := *jobs.taskCounts[parent.ID]; got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	restored, _ := NewJobStoreWithStorage(storage)
+	if got := *restored.taskCounts[parent.ID]; got != want {
+		t.Fatalf("expected %+v after a restart, got %+v", want, got)
+	}
+
+	jobs.StartAttempt(parent.Tasks[2], "node-1", "")
+	jobs.CompleteAttempt(parent.Tasks[2], 1)
+	_, reducer, err := jobs.RollUp(parent.ID)
+	if err != nil || reducer == nil {
+		t.Fatalf("expected a reducer once the tasks finished, got %v %v", reducer, err)
+	}
+	jobs.StartAttempt(reducer.ID, "node-1", "")
+	want = taskCounts{finished: 3, completed: 2}
+	if got := *jobs.taskCounts[parent.ID]; got != want {
+		t.Fatalf("expected the reducer not to be counted, got %+v", got)
+	}
+}
+
+// Test that cancelling a fanned-out job cancels its unfinished tasks
+func TestFanoutCancel(t *testing.T) {
+	srv, parent := newFanoutServer(t, FanoutSpec{Range: &IndexRange{End: 3}})
+	finishTask(t, srv, parent.Tasks[0], executeResponse{Status: "ok"})
+
+	if _, err := srv.cancelJob(parent.ID, "stop"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	want := []JobStatus{JobStatusCompleted, JobStatusCancelled, JobStatusCancelled}
+	for i, id := range parent.Tasks {
+		if got, _ := srv.jobs.Get(id); got.Status != want[i] {
+			t.Fatalf("task %d: expected %s, got %s", i, want[i], got.Status)
+		}
+	}
+	if got, _ := srv.jobs.Get(parent.ID); got.Status != JobStatusCancelled {
+		t.Fatalf("expected CANCELLED, got %s", got.Status)
+	}
+}
+
+// Test that POST /jobs with a fan-out queues its tasks and refuses bad fan-outs
+func TestCreateFanoutJob(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+
+	w := httptest.NewRecorder()
+	srv.handleJobs(w, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"type":"echo","payload":"{{item}}","fanout":{"range":{"start":1,"end":3}}}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var parent Job
+	if err := json.NewDecoder(w.Body).Decode(&parent); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(srv.pending.Snapshot(), parent.Tasks) || len(parent.Tasks) != 2 {
+		t.Fatalf("expected the tasks %v queued, got %v", parent.Tasks, srv.pending.Snapshot())
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleJobs(w, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"type":"echo","fanout":{"items":["a"],"aggregate":"median"}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad fan-out, got %d", w.Code)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// idempotencyBucket is the Storage bucket holding one record per idempotency key.
+const idempotencyBucket = "idempotency"
+
+// defaultIdempotencyTTL is how long a key is remembered when the store
+// isn't given a retention window.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLen bounds the keys clients may send.
+const maxIdempotencyKeyLen = 255
+
+// errIdempotencyConflict is returned when a key is reused for a different request.
+var errIdempotencyConflict = errors.New("idempotency key was already used for a different request")
+
+// idempotencyRecord remembers the job a key created and a hash of the
+// request that created it
+type idempotencyRecord struct {
+	JobID       string    `json:"job_id"`
+	RequestHash string    `json:"request_hash"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Sets how long idempotency keys are remembered; zero restores the default
+func (s *JobStore) SetIdempotencyTTL(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.idempotencyTTL = d
+}
+
+// Submits spec under an idempotency key. If the key was used within the
+// retention window the job it created is returned instead, with true, as
+// long as requestHash matches; otherwise the error wraps errIdempotencyConflict.
+// A new job must fit its accounts' quotas, or the *QuotaError it broke is
+// returned; a replay is answered whatever the quota
+func (s *JobStore) SubmitOnce(key, requestHash string, spec JobSpec) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	s.expireIdempotencyKeys(now)
+	j, err := s.replay(key, requestHash)
+	if err != nil {
+		return Job{}, false, err
+	}
+	if j != nil {
+		return j.clone(), true, nil
+	}
+	if err := s.admitAll([]JobSpec{spec}, now); err != nil {
+		return Job{}, false, err
+	}
+	return *s.submitOnce(key, requestHash, spec, now), false, nil
+}
+
+// replay returns the job key already created, nil if it created none, or
+// an error wrapping errIdempotencyConflict if requestHash differs. Callers hold s.mu
+func (s *JobStore) replay(key, requestHash string) (*Job, error) {
+	rec, ok := s.idempotency[key]
+	if !ok {
+		return nil, nil
+	}
+	if rec.RequestHash != requestHash {
+		return nil, fmt.Errorf("key %q: %w", key, errIdempotencyConflict)
+	}
+	return s.jobs[rec.JobID], nil
+}
+
+// submitOnce submits spec and remembers it under key. Callers hold s.mu
+func (s *JobStore) submitOnce(key, requestHash string, spec JobSpec, now time.Time) *Job {
+	j := s.submit(spec, now)
+	j.IdempotencyKey = key
+	s.persist(j)
+
+	rec := &idempotencyRecord{JobID: j.ID, RequestHash: requestHash, CreatedAt: now}
+	s.idempotency[key] = rec
+	s.idempotencyOrder = append(s.idempotencyOrder, key)
+	if err := s.storage.Put(idempotencyBucket, key, rec); err != nil {
+		log.Printf("[coordinator] failed to persist idempotency key of job %s: %v", j.ID, err)
+	}
+	return j
+}
+
+// expireIdempotencyKeys forgets keys older than the retention window,
+// stopping at the oldest one still in it. Callers hold s.mu
+func (s *JobStore) expireIdempotencyKeys(now time.Time) {
+	ttl := s.idempotencyTTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	n := 0
+	for _, key := range s.idempotencyOrder {
+		rec := s.idempotency[key]
+		if now.Sub(rec.CreatedAt) < ttl {
+			break
+		}
+		n++
+		delete(s.idempotency, key)
+		if err := s.storage.Delete(idempotencyBucket, key); err != nil {
+			log.Printf("[coordinator] failed to delete idempotency key of job %s: %v", rec.JobID, err)
+		}
+	}
+	s.idempotencyOrder = s.idempotencyOrder[n:]
+}
+
+// loadIdempotencyKeys replays stored idempotency keys into the store. Callers have exclusive access
+func (s *JobStore) loadIdempotencyKeys() error {
+	records, err := s.storage.Load(idempotencyBucket)
+	if err != nil {
+		return fmt.Errorf("load idempotency keys: %w", err)
+	}
+	for key, raw := range records {
+		var rec idempotencyRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return fmt.Errorf("decode idempotency key %q: %w", key, err)
+		}
+		s.idempotency[key] = &rec
+		s.idempotencyOrder = append(s.idempotencyOrder, key)
+	}
+	sort.Slice(s.idempotencyOrder, func(i, k int) bool {
+		return s.idempotency[s.idempotencyOrder[i]].CreatedAt.Before(s.idempotency[s.idempotencyOrder[k]].CreatedAt)
+	})
+	return nil
+}
+
+// idempotencyKey returns the key a create request was sent with, from the
+// Idempotency-Key header or the idempotency_key field, or "" if none.
+func idempotencyKey(r *http.Request, req createJobRequest) (string, error) {
+	key := r.Header.Get("Idempotency-Key")
+	switch {
+	case key == "":
+		key = req.IdempotencyKey
+	case req.IdempotencyKey != "" && req.IdempotencyKey != key:
+		return "", errors.New("Idempotency-Key header and idempotency_key field differ")
+	}
+	return key, checkIdempotencyKey(key)
+}
+
+// checkIdempotencyKey rejects keys clients may not use.
+func checkIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLen {
+		return fmt.Errorf("idempotency key must be at most %d bytes", maxIdempotencyKeyLen)
+	}
+	return nil
+}
+
+// fingerprint hashes the request without its idempotency key, so a retry
+// matches however the key was sent.
+func (req createJobRequest) fingerprint() string {
+	req.IdempotencyKey = ""
+	// A request decoded from JSON always encodes again.
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postJob sends body to POST /jobs with an optional Idempotency-Key header.
+func postJob(srv *server, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	srv.handleJobs(w, req)
+	return w
+}
+
+// Test that a repeated submission under the same key returns the original job
+func TestIdempotentCreateJob(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+
+	first := postJob(srv, "abc", `{"type":"echo","payload":"hi"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", first.Code, first.Body)
+	}
+	var job Job
+	if err := json.NewDecoder(first.Body).Decode(&job); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if job.IdempotencyKey != "abc" {
+		t.Fatalf("expected the key on the job, got %q", job.IdempotencyKey)
+	}
+
+	// the same key in the body instead of the header is the same request
+	again := postJob(srv, "", `{"type":"echo","payload":"hi","idempotency_key":"abc"}`)
+	var replayed Job
+	if err := json.NewDecoder(again.Body).Decode(&replayed); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if again.Code != http.StatusOK || again.Header().Get("Idempotent-Replayed") != "true" || replayed.ID != job.ID {
+		t.Fatalf("expected job %s replayed, got %d %s", job.ID, again.Code, replayed.ID)
+	}
+	if n := len(srv.jobs.List()); n != 1 || srv.pending.Len() != 1 {
+		t.Fatalf("expected one job queued once, got %d jobs and %d queued", n, srv.pending.Len())
+	}
+
+	if w := postJob(srv, "abc", `{"type":"echo","payload":"bye"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a different body, got %d", w.Code)
+	}
+	if w := postJob(srv, "xyz", `{"type":"echo","idempotency_key":"abc"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for mismatched keys, got %d", w.Code)
+	}
+	if w := postJob(srv, "other", `{"type":"echo","payload":"hi"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected a new job under another key, got %d", w.Code)
+	}
+}
+
+// Test that keys survive a restart and are forgotten after the retention window
+func TestIdempotencyKeyRetention(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	job, _, err := jobs.SubmitOnce("k", "hash", JobSpec{Type: "echo"})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got, replayed, err := restored.SubmitOnce("k", "hash", JobSpec{Type: "echo"}); err != nil || !replayed || got.ID != job.ID {
+		t.Fatalf("expected job %s replayed after restart, got %s %v %v", job.ID, got.ID, replayed, err)
+	}
+
+	restored.SetIdempotencyTTL(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	got, replayed, err := restored.SubmitOnce("k", "other", JobSpec{Type: "echo"})
+	if err != nil || replayed || got.ID == job.ID {
+		t.Fatalf("expected a new job once the key expired, got %s %v %v", got.ID, replayed, err)
+	}
+
+	// keys expire oldest first, leaving the ones still in the window
+	restored.SetIdempotencyTTL(time.Hour)
+	restored.mu.Lock()
+	restored.idempotency["k"].CreatedAt = time.Now().UTC().Add(-2 * time.Hour)
+	restored.mu.Unlock()
+	restored.SubmitOnce("k2", "hash", JobSpec{Type: "echo"})
+	restored.SubmitOnce("k3", "hash", JobSpec{Type: "echo"})
+	if _, ok := restored.idempotency["k"]; ok || len(restored.idempotency) != 2 || len(restored.idempotencyOrder) != 2 {
+		t.Fatalf("expected only k expired, got %v", restored.idempotencyOrder)
+	}
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"maps"
 	"sync"
 	"time"
 )
 
 // JobStatus represents the lifecycle state of a job.
-// For v0 we only use QUEUED, but we define a few more
+// jobTransitions says which status may follow which
 type JobStatus string
 
 const (
 	JobStatusQueued    JobStatus = "QUEUED"
+	JobStatusAssigned  JobStatus = "ASSIGNED"
+	JobStatusRetrying  JobStatus = "RETRYING"
 	JobStatusRunning   JobStatus = "RUNNING"
 	JobStatusCompleted JobStatus = "COMPLETED"
 	JobStatusFailed    JobStatus = "FAILED"
@@ -30,46 +35,315 @@ type Job struct {
 	// is the ID of the node executing / that executed the job
 	NodeID string `json:"node_id,omitempty"`
 
+	// resources and labels the job needs from its node; nil means any node
+	Requirements *Requirements `json:"requirements,omitempty"`
+
+	// the job's priority class and its value when the job was submitted;
+	// higher priorities are dispatched first
+	PriorityClass string `json:"priority_class"`
+	Priority      int    `json:"priority"`
+
+	// who submitted the job and the group they submitted it for; fair
+	// share is accounted per group, or per submitter when there is none
+	Submitter string `json:"submitter,omitempty"`
+	Group     string `json:"group,omitempty"`
+
+	// the placement policy the job asked for; empty means the default one
+	Scheduler string `json:"scheduler,omitempty"`
+
+	// why the job is still waiting for a node, if the last placement failed
+	PendingReason string `json:"pending_reason,omitempty"`
+
+	// how failed attempts are retried, and the history of every attempt so far
+	Retry    RetryPolicy `json:"retry"`
+	Attempts []Attempt   `json:"attempts,omitempty"`
+
+	// how long each attempt may run, and when the job must be finished by overall
+	MaxRuntimeSeconds int64      `json:"max_runtime_seconds,omitempty"`
+	Deadline          *time.Time `json:"deadline,omitempty"`
+
+	// set while RETRYING: the job is not placed again before this time
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+
+	// why a finished job ended the way it did when the status alone doesn't say, e.g. TIMED_OUT
+	Reason string `json:"reason,omitempty"`
+
+	// the attempt whose result was accepted; results from any other attempt are refused
+	AcceptedAttempt int `json:"accepted_attempt,omitempty"`
+
+	// set on a job split into tasks: how it fans out, its tasks in order,
+	// and the job combining their results when it uses a reducer
+	Fanout    *FanoutSpec `json:"fanout,omitempty"`
+	Tasks     []string    `json:"tasks,omitempty"`
+	ReducerID string      `json:"reducer_id,omitempty"`
+
+	// set on a task: the job it belongs to and the values it was run with
+	ParentID      string            `json:"parent_id,omitempty"`
+	PayloadSubset map[string]string `json:"payload_subset,omitempty"`
+
+	// set on a workflow's job: the workflow, the job's step name in it,
+	// and the jobs that must complete before it is queued
+	WorkflowID string   `json:"workflow_id,omitempty"`
+	Step       string   `json:"step,omitempty"`
+	DependsOn  []string `json:"depends_on,omitempty"`
+
+	// the client's key for the submission; resubmitting under it returns this job
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// JobStore is an in-memory, concurrency-safe job registry
-// It mirrors NodeRegistry: a map protected by a mutex
+// JobSpec is everything a client decides about a job at submission time
+type JobSpec struct {
+	Type    string
+	Payload string
+
+	// nil means any node will do
+	Requirements *Requirements
+
+	// nil means DefaultRetryPolicy
+	Retry *RetryPolicy
+
+	// zero / nil mean no limit of the job's own
+	MaxRuntimeSeconds int64
+	Deadline          *time.Time
+
+	// nil means the job runs as a single task
+	Fanout *FanoutSpec
+
+	// empty means the default priority class
+	PriorityClass string
+
+	// empty means the anonymous account
+	Submitter string
+	Group     string
+
+	// empty means the default placement policy
+	Scheduler string
+}
+
+// jobsBucket is the Storage bucket holding one record per job.
+const jobsBucket = "jobs"
+
+// JobStore is a concurrency-safe job registry
+// It mirrors NodeRegistry: a map protected by a mutex, with every change
+// written through to a Storage
 type JobStore struct {
-	mu     sync.Mutex
-	jobs   map[string]*Job
-	nextID uint64
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	results map[string]*JobResult
+	events  map[string][]JobEvent
+	nextID  uint64
+
+	workflows      map[string]*Workflow
+	nextWorkflowID uint64
+
+	// each fanned-out job's tasks tallied by state, by parent ID
+	taskCounts map[string]*taskCounts
+
+	// priority classes jobs may name, by name
+	classes map[string]*PriorityClass
+
+	// fair-share weight and decaying usage by account; usage halves every
+	// usageHalfLife (zero means defaultUsageHalfLife). Usage charged since
+	// the last FlushShares is written out then, by account in dirtyShares.
+	// running holds each account's active jobs by ID
+	shares        map[string]*Share
+	dirtyShares   map[string]bool
+	running       map[string]map[string]*Job
+	usageHalfLife time.Duration
+
+	// quotas by account, each account's CPU time in its current quota
+	// period, and the jobs that count against its quota
+	quotas     map[string]*Quota
+	cpuWindows map[string]*cpuWindow
+	accounts   map[string]*accountJobs
+
+	// how many ASSIGNED or RUNNING jobs each node has
+	inFlight map[string]int
+
+	// submissions by idempotency key, remembered for idempotencyTTL
+	// (zero means defaultIdempotencyTTL); idempotencyOrder has the keys
+	// oldest first, so expiring them needn't look at the rest
+	idempotency      map[string]*idempotencyRecord
+	idempotencyOrder []string
+	idempotencyTTL   time.Duration
+
+	storage Storage
+
+	// lastToken is the latest fencing token handed out; leaseTTL is how
+	// long a lease lasts between renewals (zero means defaultLeaseTTL)
+	lastToken uint64
+	leaseTTL  time.Duration
 }
 
-// Creates an empty job store
+// Creates an empty job store backed by in-memory storage
 func NewJobStore() *JobStore {
 	return &JobStore{
-		jobs: make(map[string]*Job),
+		jobs:    make(map[string]*Job),
+		results: make(map[string]*JobResult),
+		events:  make(map[string][]JobEvent),
+		storage: NewMemoryStorage(),
+
+		workflows:   make(map[string]*Workflow),
+		taskCounts:  make(map[string]*taskCounts),
+		idempotency: make(map[string]*idempotencyRecord),
+		classes:     defaultPriorityClasses(),
+		shares:      make(map[string]*Share),
+		dirtyShares: make(map[string]bool),
+		running:     make(map[string]map[string]*Job),
+		quotas:      make(map[string]*Quota),
+		cpuWindows:  make(map[string]*cpuWindow),
+		accounts:    make(map[string]*accountJobs),
+		inFlight:    make(map[string]int),
+	}
+}
+
+// Creates a job store and replays any jobs, results, events, workflows,
+// idempotency keys, priority classes, fair shares and quotas already in storage
+// nextID resumes after the highest persisted job number so IDs are never reused
+func NewJobStoreWithStorage(storage Storage) (*JobStore, error) {
+	records, err := storage.Load(jobsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("load jobs: %w", err)
+	}
+
+	s := &JobStore{
+		jobs:    make(map[string]*Job, len(records)),
+		results: make(map[string]*JobResult),
+		events:  make(map[string][]JobEvent),
+		storage: storage,
+
+		workflows:   make(map[string]*Workflow),
+		taskCounts:  make(map[string]*taskCounts),
+		idempotency: make(map[string]*idempotencyRecord),
+		classes:     defaultPriorityClasses(),
+		shares:      make(map[string]*Share),
+		dirtyShares: make(map[string]bool),
+		running:     make(map[string]map[string]*Job),
+		quotas:      make(map[string]*Quota),
+		cpuWindows:  make(map[string]*cpuWindow),
+		accounts:    make(map[string]*accountJobs),
+		inFlight:    make(map[string]int),
+	}
+	for id, raw := range records {
+		var j Job
+		if err := json.Unmarshal(raw, &j); err != nil {
+			return nil, fmt.Errorf("decode job %q: %w", id, err)
+		}
+		s.jobs[id] = &j
+		s.countJob(&j, "", j.Status)
+
+		var n uint64
+		if _, err := fmt.Sscanf(id, "job-%d", &n); err == nil && n > s.nextID {
+			s.nextID = n
+		}
+	}
+	if err := s.loadResults(); err != nil {
+		return nil, err
+	}
+	if err := s.loadEvents(); err != nil {
+		return nil, err
+	}
+	if err := s.loadWorkflows(); err != nil {
+		return nil, err
+	}
+	if err := s.loadIdempotencyKeys(); err != nil {
+		return nil, err
+	}
+	if err := s.loadPriorityClasses(); err != nil {
+		return nil, err
+	}
+	if err := s.loadShares(); err != nil {
+		return nil, err
+	}
+	if err := s.loadQuotas(); err != nil {
+		return nil, err
 	}
+	s.restoreLastToken()
+	s.restoreTaskCounts()
+	return s, nil
 }
 
-// Allocates a new job, assigns it an ID, stores it, and return a copy
+// persist writes j through to storage. Callers hold s.mu
+func (s *JobStore) persist(j *Job) {
+	if err := s.storage.Put(jobsBucket, j.ID, j); err != nil {
+		log.Printf("[coordinator] failed to persist job %s: %v", j.ID, err)
+	}
+}
+
+// Allocates a new job with default options, stores it, and return a copy
 func (s *JobStore) Create(jobType, payload string) Job {
+	return s.Submit(JobSpec{Type: jobType, Payload: payload})
+}
+
+// Allocates a new job from spec, assigns it an ID, stores it, and return a copy.
+// A job with a fan-out gets its tasks created with it, listed in Tasks
+func (s *JobStore) Submit(spec JobSpec) Job {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	return *s.submit(spec, time.Now().UTC())
+}
+
+// submit adds and persists a QUEUED job, with its tasks if it fans out.
+// Callers hold s.mu
+func (s *JobStore) submit(spec JobSpec, now time.Time) *Job {
+	j := s.newJob(spec, JobStatusQueued, now)
+	if spec.Fanout != nil {
+		s.submitTasks(j, spec, now)
+	}
+	s.persist(j)
+	return j
+}
+
+// newJob allocates a job from spec in its first status (QUEUED, or WAITING
+// on upstream jobs) and adds it to the store without persisting it.
+// Callers hold s.mu
+func (s *JobStore) newJob(spec JobSpec, status JobStatus, now time.Time) *Job {
 	s.nextID++
 	id := fmt.Sprintf("job-%d", s.nextID)
-	now := time.Now().UTC()
+
+	retry := DefaultRetryPolicy()
+	if spec.Retry != nil {
+		retry = *spec.Retry
+	}
 
 	j := &Job{
-		ID:        id,
-		Type:      jobType,
-		Payload:   payload,
-		Status:    JobStatusQueued,
+		ID:           id,
+		Type:         spec.Type,
+		Payload:      spec.Payload,
+		Status:       status,
+		Requirements: spec.Requirements,
+		Retry:        retry,
+
+		MaxRuntimeSeconds: spec.MaxRuntimeSeconds,
+		Deadline:          spec.Deadline,
+
+		Submitter: spec.Submitter,
+		Group:     spec.Group,
+		Scheduler: spec.Scheduler,
+
+		Fanout: spec.Fanout,
+
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
-
+	// A class deleted since the spec was checked falls back to the default.
+	class := s.priorityClass(spec.PriorityClass)
+	if class == nil {
+		class = s.priorityClass("")
+	}
+	if class != nil {
+		j.PriorityClass, j.Priority = class.Name, class.Value
+	}
 	s.jobs[id] = j
+	s.countJob(j, "", status)
+	s.record(j, JobEvent{Time: now, To: status, Reason: "submitted"})
 
-	return *j
+	return j
 }
 
 // Returns a slice of Job values (copies) for all jobs currently known to the coordinator
@@ -79,12 +353,68 @@ func (s *JobStore) List() []Job {
 
 	result := make([]Job, 0, len(s.jobs))
 	for _, j := range s.jobs {
-		result = append(result, *j)
+		result = append(result, j.clone())
 	}
 	return result
 }
 
-// Updates the status (and optionally NodeID) of a job
+// Returns how many ASSIGNED or RUNNING jobs each node has
+func (s *JobStore) RunningByNode() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.inFlight)
+}
+
+// countInFlight adds n to the in-flight jobs of nodeID. Callers hold s.mu
+func (s *JobStore) countInFlight(nodeID string, n int) {
+	s.inFlight[nodeID] += n
+	if s.inFlight[nodeID] == 0 {
+		delete(s.inFlight, nodeID)
+	}
+}
+
+// setNode moves j to nodeID, taking its in-flight count along while it
+// holds a node. Callers hold s.mu
+func (s *JobStore) setNode(j *Job, nodeID string) {
+	if j.Active() && nodeID != j.NodeID {
+		s.countInFlight(j.NodeID, -1)
+		s.countInFlight(nodeID, 1)
+	}
+	j.NodeID = nodeID
+}
+
+// Returns a copy of the job with the given ID
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.clone(), true
+}
+
+// Records why a job is still waiting for a node; unchanged reasons are not rewritten
+func (s *JobStore) SetPendingReason(id, reason string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %q not found", id)
+	}
+	if j.PendingReason != reason {
+		j.PendingReason = reason
+		j.UpdatedAt = time.Now().UTC()
+		s.persist(j)
+	}
+	return j.clone(), nil
+}
+
+// Updates the status (and optionally NodeID) of a job. A transition the
+// state machine doesn't allow returns a *TransitionError
 func (s *JobStore) UpdateStatus(id string, status JobStatus, nodeID string) (Job, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -94,11 +424,14 @@ func (s *JobStore) UpdateStatus(id string, status JobStatus, nodeID string) (Job
 		return Job{}, fmt.Errorf("job %q not found", id)
 	}
 
-	j.Status = status
-	if nodeID != "" {
-		j.NodeID = nodeID
+	if nodeID == "" {
+		nodeID = j.NodeID
+	}
+	if err := s.transition(j, JobEvent{To: status, NodeID: nodeID, Attempt: j.CurrentAttempt()}); err != nil {
+		return Job{}, err
 	}
-	j.UpdatedAt = time.Now().UTC()
+	s.setNode(j, nodeID)
+	s.persist(j)
 
-	return *j, nil
+	return j.clone(), nil
 }
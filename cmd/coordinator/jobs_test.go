@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"maps"
+	"testing"
+)
 
 func TestJobStoreCreateAndList(t *testing.T) {
 	store := NewJobStore()
@@ -53,19 +57,29 @@ func TestJobStoreUpdateStatus(t *testing.T) {
 		t.Fatalf("expected initial NodeID to be empty, got %s", j.NodeID)
 	}
 
-	// first update: set RUNNING + NodeID.
-	updated, err := store.UpdateStatus(j.ID, JobStatusRunning, "node-1")
+	// a job can't skip ASSIGNED on its way to RUNNING.
+	_, err := store.UpdateStatus(j.ID, JobStatusRunning, "node-1")
+	var terr *TransitionError
+	if !errors.As(err, &terr) || terr.From != JobStatusQueued || terr.To != JobStatusRunning {
+		t.Fatalf("expected a QUEUED -> RUNNING TransitionError, got %v", err)
+	}
+
+	// first update: set ASSIGNED + NodeID.
+	updated, err := store.UpdateStatus(j.ID, JobStatusAssigned, "node-1")
 	if err != nil {
 		t.Fatalf("unexpected error updating status: %v", err)
 	}
-	if updated.Status != JobStatusRunning {
-		t.Fatalf("expected status RUNNING, got %s", updated.Status)
+	if updated.Status != JobStatusAssigned {
+		t.Fatalf("expected status ASSIGNED, got %s", updated.Status)
 	}
 	if updated.NodeID != "node-1" {
 		t.Fatalf("expected NodeID node-1, got %s", updated.NodeID)
 	}
 
-	// second update: set COMPLETED, but keep existing NodeID (empty nodeID argument).
+	// second update: set RUNNING then COMPLETED, but keep existing NodeID (empty nodeID argument).
+	if _, err := store.UpdateStatus(j.ID, JobStatusRunning, ""); err != nil {
+		t.Fatalf("unexpected error updating status: %v", err)
+	}
 	updated2, err := store.UpdateStatus(j.ID, JobStatusCompleted, "")
 	if err != nil {
 		t.Fatalf("unexpected error updating status: %v", err)
@@ -77,8 +91,65 @@ func TestJobStoreUpdateStatus(t *testing.T) {
 		t.Fatalf("expected NodeID to remain node-1, got %s", updated2.NodeID)
 	}
 
+	// a finished job stays finished.
+	if _, err := store.UpdateStatus(j.ID, JobStatusRunning, ""); !errors.As(err, &terr) {
+		t.Fatalf("expected a TransitionError moving COMPLETED back to RUNNING, got %v", err)
+	}
+
 	// updating a non-existent job should return an error.
 	if _, err := store.UpdateStatus("does-not-exist", JobStatusFailed, "node-x"); err == nil {
 		t.Fatalf("expected error when updating non-existent job, got nil")
 	}
 }
+
+// Test that a job read from the store doesn't share attempts the store keeps
+// updating, e.g. when the attempt is closed (run with -race)
+func TestJobStoreGetCopiesAttempts(t *testing.T) {
+	store := NewJobStore()
+
+	job := store.Create("echo", "hello")
+	if _, err := store.StartAttempt(job.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	job, _ = store.Get(job.ID)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _ = store.Cancel(job.ID, "stop")
+	}()
+	finished := job.Attempts[0].FinishedAt
+	<-done
+
+	if finished != nil || job.Attempts[0].Outcome != "" {
+		t.Fatalf("expected the copy to keep the open attempt, got %+v", job.Attempts[0])
+	}
+}
+
+// Test that each node's in-flight count follows its jobs' attempts, also after a restart
+func TestJobStoreRunningByNode(t *testing.T) {
+	storage := NewMemoryStorage()
+	store, _ := NewJobStoreWithStorage(storage)
+
+	j1 := store.Create("echo", "one")
+	j2 := store.Create("echo", "two")
+	store.StartAttempt(j1.ID, "node-1", "")
+	store.StartAttempt(j2.ID, "node-1", "")
+	store.FailAttempt(j2.ID, 1, AttemptFailed, "boom", true)
+	store.StartAttempt(j2.ID, "node-2", "")
+
+	want := map[string]int{"node-1": 1, "node-2": 1}
+	if got := store.RunningByNode(); !maps.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	restored, _ := NewJobStoreWithStorage(storage)
+	if got := restored.RunningByNode(); !maps.Equal(got, want) {
+		t.Fatalf("expected %v after a restart, got %v", want, got)
+	}
+
+	store.CompleteAttempt(j1.ID, 1)
+	store.Cancel(j2.ID, "stop")
+	if got := store.RunningByNode(); len(got) != 0 {
+		t.Fatalf("expected no jobs in flight, got %v", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// AttemptLeaseExpired is the outcome of an attempt whose agent stopped
+// renewing its lease
+const AttemptLeaseExpired = "LEASE_EXPIRED"
+
+// defaultLeaseTTL is how long an attempt's lease lasts between renewals
+// when the store isn't given one. Agents renew on every heartbeat (10s)
+// and status report.
+const defaultLeaseTTL = 30 * time.Second
+
+// leaseRef names the lease an agent holds for one attempt of a job.
+type leaseRef struct {
+	JobID      string `json:"job_id"`
+	Attempt    int    `json:"attempt"`
+	LeaseToken uint64 `json:"lease_token"`
+}
+
+// registerResponse is the node record returned from /register, plus the
+// leases the agent sent that are no longer honoured and whose jobs it
+// should stop.
+type registerResponse struct {
+	Node
+	RevokedLeases []leaseRef `json:"revoked_leases,omitempty"`
+}
+
+// Sets how long a lease lasts between renewals; zero restores the default
+func (s *JobStore) SetLeaseTTL(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leaseTTL = d
+}
+
+// ttl returns the lease duration in effect. Callers hold s.mu
+func (s *JobStore) ttl() time.Duration {
+	if s.leaseTTL > 0 {
+		return s.leaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// grantLease gives attempt a a fresh fencing token and lease. Tokens only
+// ever grow, across jobs and restarts. Callers hold s.mu
+func (s *JobStore) grantLease(a *Attempt, now time.Time) {
+	s.lastToken++
+	expires := now.Add(s.ttl())
+	a.LeaseToken = s.lastToken
+	a.LeaseExpiresAt = &expires
+}
+
+// Extends the lease of attempt n if nodeID holds it under token
+func (s *JobStore) RenewLease(id string, n int, nodeID string, token uint64) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return Job{}, err
+	}
+	a := &j.Attempts[n-1]
+	if a.NodeID != nodeID || a.LeaseToken != token {
+		return Job{}, fmt.Errorf("job %q attempt %d lease %d: %w", id, n, token, errStaleAttempt)
+	}
+
+	expires := time.Now().UTC().Add(s.ttl())
+	a.LeaseExpiresAt = &expires
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// Renews the lease of every ASSIGNED or RUNNING job, e.g. after a restart,
+// so agents get a full lease to check back in before their attempts are
+// given up
+func (s *JobStore) RenewAllLeases() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().UTC().Add(s.ttl())
+	for _, j := range s.jobs {
+		if !j.Active() || len(j.Attempts) == 0 {
+			continue
+		}
+		j.Attempts[len(j.Attempts)-1].LeaseExpiresAt = &expires
+		s.persist(j)
+	}
+}
+
+// Returns the ASSIGNED or RUNNING jobs whose current lease ran out before now
+func (s *JobStore) ExpiredLeases(now time.Time) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Job
+	for _, j := range s.jobs {
+		if !j.Active() || len(j.Attempts) == 0 {
+			continue
+		}
+		a := j.Attempts[len(j.Attempts)-1]
+		if a.LeaseExpiresAt != nil && a.LeaseExpiresAt.Before(now) {
+			out = append(out, j.clone())
+		}
+	}
+	return out
+}
+
+// restoreLastToken resumes fencing tokens after the highest one persisted.
+// Callers have exclusive access
+func (s *JobStore) restoreLastToken() {
+	for _, j := range s.jobs {
+		for _, a := range j.Attempts {
+			if a.LeaseToken > s.lastToken {
+				s.lastToken = a.LeaseToken
+			}
+		}
+	}
+}
+
+// expireLeases gives up on attempts whose agent stopped renewing their
+// lease. The job goes back to the queue under its retry policy, and any
+// result the old attempt sends later is refused as stale.
+func (s *server) expireLeases() {
+	expired := s.jobs.ExpiredLeases(time.Now())
+	for _, j := range expired {
+		a := j.Attempts[len(j.Attempts)-1]
+		log.Printf("[coordinator] lease %d of job %s attempt %d on node %s expired", a.LeaseToken, j.ID, a.Number, a.NodeID)
+		s.recordFailure(j.ID, a.Number, AttemptLeaseExpired, fmt.Sprintf("lease on node %s expired", a.NodeID), true)
+	}
+	if len(expired) > 0 {
+		s.kick()
+	}
+}
+
+// renewLeases renews the leases a node reports on its heartbeat and
+// returns the ones it should give up.
+func (s *server) renewLeases(nodeID string, leases []leaseRef) []leaseRef {
+	var revoked []leaseRef
+	for _, l := range leases {
+		if _, err := s.jobs.RenewLease(l.JobID, l.Attempt, nodeID, l.LeaseToken); err != nil {
+			log.Printf("[coordinator] revoking lease of node %s: %v", nodeID, err)
+			revoked = append(revoked, l)
+		}
+	}
+	return revoked
+}
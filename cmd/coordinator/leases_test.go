@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that every attempt gets a larger fencing token, also after a restart
+func TestLeaseTokensAreMonotonic(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	a := jobs.Create("echo", "a")
+	b := jobs.Create("echo", "b")
+	a, _ = jobs.StartAttempt(a.ID, "node-1", "")
+	b, _ = jobs.StartAttempt(b.ID, "node-1", "")
+	if a.Attempts[0].LeaseToken == 0 || b.Attempts[0].LeaseToken <= a.Attempts[0].LeaseToken {
+		t.Fatalf("expected increasing tokens, got %d then %d", a.Attempts[0].LeaseToken, b.Attempts[0].LeaseToken)
+	}
+	if a.Attempts[0].LeaseExpiresAt == nil {
+		t.Fatalf("expected the attempt to carry a lease expiry")
+	}
+
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("failed to restore store: %v", err)
+	}
+	c := restored.Create("echo", "c")
+	c, _ = restored.StartAttempt(c.ID, "node-1", "")
+	if c.Attempts[0].LeaseToken <= b.Attempts[0].LeaseToken {
+		t.Fatalf("expected token after restart to exceed %d, got %d", b.Attempts[0].LeaseToken, c.Attempts[0].LeaseToken)
+	}
+}
+
+// Test that an attempt whose lease lapses is retried and its late result refused
+func TestExpiredLeaseRetriesAndFencesLateResult(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{})
+	jobs := NewJobStore()
+	jobs.SetLeaseTTL(time.Millisecond)
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	job, _ = jobs.StartAttempt(job.ID, "node-1", "")
+	token := job.Attempts[0].LeaseToken
+
+	time.Sleep(5 * time.Millisecond)
+	srv.expireLeases()
+
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusRetrying || job.Attempts[0].Outcome != AttemptLeaseExpired {
+		t.Fatalf("expected RETRYING after lease expiry, got %s (%s)", job.Status, job.Attempts[0].Outcome)
+	}
+
+	late := taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token, State: taskStateFinished, Result: &executeResponse{Status: "ok"}}
+	if code, resp := postTaskStatus(t, srv, job.ID, late); code != http.StatusOK || resp.Accepted {
+		t.Fatalf("expected late result to be refused, got %d %+v", code, resp)
+	}
+	if _, ok := jobs.Result(job.ID); ok {
+		t.Fatalf("expected no result from the expired attempt")
+	}
+}
+
+// Test that a report carrying another attempt's token is refused
+func TestTaskStatusChecksLeaseToken(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	job, _ = jobs.StartAttempt(job.ID, "node-1", "")
+	token := job.Attempts[0].LeaseToken
+
+	wrong := taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token + 1, State: taskStateFinished, Result: &executeResponse{Status: "ok"}}
+	if code, _ := postTaskStatus(t, srv, job.ID, wrong); code != http.StatusConflict {
+		t.Fatalf("expected 409 for a foreign lease token, got %d", code)
+	}
+
+	right := wrong
+	right.LeaseToken = token
+	if code, resp := postTaskStatus(t, srv, job.ID, right); code != http.StatusOK || !resp.Accepted {
+		t.Fatalf("expected result to be accepted, got %d %+v", code, resp)
+	}
+	if job, _ = jobs.Get(job.ID); job.AcceptedAttempt != 1 {
+		t.Fatalf("expected accepted_attempt 1, got %d", job.AcceptedAttempt)
+	}
+}
+
+// Test that heartbeats renew held leases and revoke stale ones
+func TestRegisterRenewsAndRevokesLeases(t *testing.T) {
+	reg := NewNodeRegistry()
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	live := jobs.Create("echo", "live")
+	live, _ = jobs.StartAttempt(live.ID, "node-1", "")
+	before := *live.Attempts[0].LeaseExpiresAt
+
+	gone := jobs.Create("echo", "gone")
+	gone, _ = jobs.StartAttempt(gone.ID, "node-1", "")
+	jobs.FailAttempt(gone.ID, 1, AttemptFailed, "boom", false)
+
+	time.Sleep(5 * time.Millisecond)
+	body, _ := json.Marshal(registerRequest{
+		ID:      "node-1",
+		Address: "127.0.0.1:1",
+		Leases: []leaseRef{
+			{JobID: live.ID, Attempt: 1, LeaseToken: live.Attempts[0].LeaseToken},
+			{JobID: gone.ID, Attempt: 1, LeaseToken: gone.Attempts[0].LeaseToken},
+		},
+	})
+	w := httptest.NewRecorder()
+	srv.handleRegister(w, httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var resp registerResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.ID != "node-1" {
+		t.Fatalf("expected node fields in the response, got %+v", resp)
+	}
+	if len(resp.RevokedLeases) != 1 || resp.RevokedLeases[0].JobID != gone.ID {
+		t.Fatalf("expected only %s to be revoked, got %+v", gone.ID, resp.RevokedLeases)
+	}
+
+	live, _ = jobs.Get(live.ID)
+	if !live.Attempts[0].LeaseExpiresAt.After(before) {
+		t.Fatalf("expected the live lease to be extended")
+	}
+}
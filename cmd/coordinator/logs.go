@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLogBacklogBytes is how much output is kept per job for late subscribers.
+	defaultLogBacklogBytes = 256 << 10
+	// defaultLogJobs is how many jobs keep a backlog; the least recently
+	// written one is forgotten first.
+	defaultLogJobs = 1000
+	// logKeepAlive is how often an idle follower gets an SSE comment so
+	// proxies don't close the connection.
+	logKeepAlive = 15 * time.Second
+	// maxLogBatchBytes bounds the body of one POST /jobs/{id}/logs; it
+	// leaves room for the megabyte agents buffer, JSON-escaped.
+	maxLogBatchBytes = 8 << 20
+)
+
+// logStatusPoll is how often a follower checks whether its job has
+// finished. It is a variable so tests can shorten it.
+var logStatusPoll = time.Second
+
+// LogChunk is a piece of a job's output as streamed by its agent.
+// Seq increases by one per chunk within a job.
+type LogChunk struct {
+	Seq     uint64    `json:"seq"`
+	Attempt int       `json:"attempt"`
+	Stream  string    `json:"stream"`
+	Data    string    `json:"data"`
+	Time    time.Time `json:"time"`
+}
+
+// logBatch is what agents POST to /jobs/{id}/logs, under the node and
+// lease token of the attempt the output is from.
+type logBatch struct {
+	Attempt    int    `json:"attempt"`
+	NodeID     string `json:"node_id"`
+	LeaseToken uint64 `json:"lease_token"`
+	Chunks     []struct {
+		Stream string `json:"stream"`
+		Data   string `json:"data"`
+	} `json:"chunks"`
+}
+
+// jobLog is the bounded backlog of one job's output.
+type jobLog struct {
+	chunks    []LogChunk
+	size      int
+	nextSeq   uint64
+	lastWrite time.Time
+
+	// changed is closed and replaced whenever chunks are appended.
+	changed chan struct{}
+}
+
+// logStore keeps a bounded backlog of recent output per job in memory and
+// wakes followers when more arrives. The zero value is ready to use.
+type logStore struct {
+	mu   sync.Mutex
+	jobs map[string]*jobLog
+
+	// added is closed and replaced whenever a job gets a log, waking the
+	// followers of jobs that had none yet.
+	added chan struct{}
+
+	// zero means defaultLogBacklogBytes / defaultLogJobs.
+	maxBytes int
+	maxJobs  int
+}
+
+// get returns the log for jobID, creating it if needed. Callers hold ls.mu.
+func (ls *logStore) get(jobID string) *jobLog {
+	if ls.jobs == nil {
+		ls.jobs = make(map[string]*jobLog)
+	}
+	if l, ok := ls.jobs[jobID]; ok {
+		return l
+	}
+
+	maxJobs := ls.maxJobs
+	if maxJobs <= 0 {
+		maxJobs = defaultLogJobs
+	}
+	if len(ls.jobs) >= maxJobs {
+		ls.evictOldest()
+	}
+
+	l := &jobLog{nextSeq: 1, changed: make(chan struct{})}
+	ls.jobs[jobID] = l
+	if ls.added != nil {
+		close(ls.added)
+		ls.added = nil
+	}
+	return l
+}
+
+// evictOldest forgets the least recently written job log. Callers hold ls.mu.
+func (ls *logStore) evictOldest() {
+	var oldestID string
+	var oldest time.Time
+	for id, l := range ls.jobs {
+		if oldestID == "" || l.lastWrite.Before(oldest) {
+			oldestID, oldest = id, l.lastWrite
+		}
+	}
+	if l, ok := ls.jobs[oldestID]; ok {
+		close(l.changed)
+		delete(ls.jobs, oldestID)
+	}
+}
+
+// Append adds chunks to jobID's backlog, trimming the oldest output once
+// the backlog exceeds its size limit, and wakes any followers.
+func (ls *logStore) Append(jobID string, attempt int, chunks []LogChunk) {
+	if len(chunks) == 0 {
+		return
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	maxBytes := ls.maxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultLogBacklogBytes
+	}
+
+	l := ls.get(jobID)
+	now := time.Now().UTC()
+	for _, c := range chunks {
+		c.Seq = l.nextSeq
+		c.Attempt = attempt
+		c.Time = now
+		l.nextSeq++
+		l.chunks = append(l.chunks, c)
+		l.size += len(c.Data)
+	}
+	for l.size > maxBytes && len(l.chunks) > 1 {
+		l.size -= len(l.chunks[0].Data)
+		l.chunks = l.chunks[1:]
+	}
+	l.lastWrite = now
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Since returns the backlogged chunks of jobID with Seq > after, and a
+// channel that is closed when more are appended. Reading a job without
+// output doesn't give it a log, so readers can't push out others' logs.
+func (ls *logStore) Since(jobID string, after uint64) ([]LogChunk, <-chan struct{}) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.jobs[jobID]
+	if !ok {
+		if ls.added == nil {
+			ls.added = make(chan struct{})
+		}
+		return nil, ls.added
+	}
+	var out []LogChunk
+	for _, c := range l.chunks {
+		if c.Seq > after {
+			out = append(out, c)
+		}
+	}
+	return out, l.changed
+}
+
+// handleJobLogs is the multiplexer for /jobs/{id}/logs:
+//   - POST -> agents append output of the job's current attempt
+//   - GET -> the backlog as JSON, or with ?follow=true a Server-Sent Events stream
+func (s *server) handleJobLogs(w http.ResponseWriter, r *http.Request, jobID string) {
+	job, ok := s.jobs.Get(jobID)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.handleAppendLogs(w, r, job)
+	case http.MethodGet:
+		s.handleGetLogs(w, r, job)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAppendLogs implements POST /jobs/{id}/logs.
+func (s *server) handleAppendLogs(w http.ResponseWriter, r *http.Request, job Job) {
+	var batch logBatch
+	r.Body = http.MaxBytesReader(w, r.Body, maxLogBatchBytes)
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("log batch larger than %d bytes", tooBig.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Output of an attempt the coordinator has given up on, or from a node
+	// that no longer holds its lease, would only confuse readers, so every
+	// batch must say which attempt it is from and under which lease.
+	if batch.Attempt < 1 || batch.NodeID == "" || batch.LeaseToken == 0 {
+		http.Error(w, "attempt, node_id and lease_token are required", http.StatusBadRequest)
+		return
+	}
+	if batch.Attempt != job.CurrentAttempt() {
+		http.Error(w, fmt.Sprintf("attempt %d is not the job's current attempt", batch.Attempt), http.StatusConflict)
+		return
+	}
+	attempt := job.Attempts[batch.Attempt-1]
+	if batch.NodeID != attempt.NodeID {
+		http.Error(w, fmt.Sprintf("attempt %d of job %s belongs to node %s", batch.Attempt, job.ID, attempt.NodeID), http.StatusConflict)
+		return
+	}
+	if batch.LeaseToken != attempt.LeaseToken {
+		http.Error(w, fmt.Sprintf("lease %d does not fence attempt %d of job %s", batch.LeaseToken, batch.Attempt, job.ID), http.StatusConflict)
+		return
+	}
+
+	chunks := make([]LogChunk, 0, len(batch.Chunks))
+	for _, c := range batch.Chunks {
+		chunks = append(chunks, LogChunk{Stream: c.Stream, Data: c.Data})
+	}
+	s.logs.Append(job.ID, batch.Attempt, chunks)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetLogs implements GET /jobs/{id}/logs[?follow=true][&after=seq].
+// A follower first gets the backlog, then new output as it arrives, and an
+// "end" event once the job has finished. Last-Event-ID resumes a stream.
+func (s *server) handleGetLogs(w http.ResponseWriter, r *http.Request, job Job) {
+	q := r.URL.Query()
+
+	var after uint64
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			after = n
+		}
+	}
+
+	if q.Get("follow") != "true" {
+		chunks, _ := s.logs.Since(job.ID, after)
+		if chunks == nil {
+			chunks = []LogChunk{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(chunks); err != nil {
+			log.Printf("encode logs response: %v", err)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(logStatusPoll)
+	defer poll.Stop()
+	lastWrite := time.Now()
+
+	for {
+		// Read the job's state before the chunks: agents ship their last
+		// output before reporting, so a finished job has nothing more to come.
+		current, _ := s.jobs.Get(job.ID)
+		chunks, changed := s.logs.Since(job.ID, after)
+
+		for _, c := range chunks {
+			data, err := json.Marshal(c)
+			if err != nil {
+				log.Printf("encode log chunk: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", c.Seq, data); err != nil {
+				return
+			}
+			after = c.Seq
+		}
+		if len(chunks) > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		if current.Finished() {
+			fmt.Fprintf(w, "event: end\ndata: {\"status\":%q}\n\n", current.Status)
+			flusher.Flush()
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-poll.C:
+			if time.Since(lastWrite) >= logKeepAlive {
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+				lastWrite = time.Now()
+			}
+		}
+	}
+}
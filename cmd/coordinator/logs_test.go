@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogStoreBoundsBacklog(t *testing.T) {
+	ls := &logStore{maxBytes: 10, maxJobs: 2}
+
+	ls.Append("job-1", 1, []LogChunk{{Stream: "stdout", Data: "aaaaa"}, {Stream: "stdout", Data: "bbbbb"}})
+	ls.Append("job-1", 1, []LogChunk{{Stream: "stderr", Data: "ccccc"}})
+
+	chunks, _ := ls.Since("job-1", 0)
+	if len(chunks) != 2 || chunks[0].Seq != 2 || chunks[1].Data != "ccccc" {
+		t.Fatalf("expected the two newest chunks, got %+v", chunks)
+	}
+	if later, _ := ls.Since("job-1", 2); len(later) != 1 || later[0].Seq != 3 {
+		t.Fatalf("expected only chunks after seq 2, got %+v", later)
+	}
+
+	// a third job pushes out the least recently written one.
+	ls.Append("job-2", 1, []LogChunk{{Data: "x"}})
+	ls.Append("job-3", 1, []LogChunk{{Data: "y"}})
+	if _, ok := ls.jobs["job-1"]; ok {
+		t.Fatalf("expected job-1's log to be evicted")
+	}
+
+	// reading jobs without output evicts nothing
+	ls.Since("job-4", 0)
+	ls.Since("job-5", 0)
+	if _, ok := ls.jobs["job-2"]; !ok || len(ls.jobs) != 2 {
+		t.Fatalf("expected reads to leave the logs alone, got %d logs", len(ls.jobs))
+	}
+}
+
+func TestAppendLogsRejectsStaleAttempt(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+	job := jobs.Create("echo", "hi")
+	job, err := jobs.StartAttempt(job.ID, "node-1", "")
+	if err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	token := job.Attempts[0].LeaseToken
+
+	post := func(attempt int, nodeID string, token uint64) int {
+		body, _ := json.Marshal(map[string]any{
+			"attempt":     attempt,
+			"node_id":     nodeID,
+			"lease_token": token,
+			"chunks":      []map[string]string{{"stream": "stdout", "data": "hello\n"}},
+		})
+		w := httptest.NewRecorder()
+		srv.handleJob(w, httptest.NewRequest(http.MethodPost, "/jobs/"+job.ID+"/logs", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post(1, "node-1", token); code != http.StatusNoContent {
+		t.Fatalf("expected status 204 for the current attempt, got %d", code)
+	}
+	if code := post(5, "node-1", token); code != http.StatusConflict {
+		t.Fatalf("expected status 409 for another attempt, got %d", code)
+	}
+	if code := post(1, "node-2", token); code != http.StatusConflict {
+		t.Fatalf("expected status 409 from another node, got %d", code)
+	}
+	if code := post(1, "node-1", token+1); code != http.StatusConflict {
+		t.Fatalf("expected status 409 under a foreign lease token, got %d", code)
+	}
+	if code := post(0, "node-1", token); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without an attempt, got %d", code)
+	}
+	if code := post(1, "", 0); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without a node and lease, got %d", code)
+	}
+	huge := `{"attempt":1,"node_id":"node-1","lease_token":1,"chunks":[{"stream":"stdout","data":"` + strings.Repeat("x", maxLogBatchBytes) + `"}]}`
+	w := httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodPost, "/jobs/"+job.ID+"/logs", strings.NewReader(huge)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 for an oversized batch, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/logs", nil))
+	var chunks []LogChunk
+	if err := json.NewDecoder(w.Body).Decode(&chunks); err != nil {
+		t.Fatalf("failed to decode logs: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Data != "hello\n" || chunks[0].Attempt != 1 {
+		t.Fatalf("unexpected backlog: %+v", chunks)
+	}
+}
+
+// Test that a follower gets the backlog, live output, and an end event
+func TestFollowLogs(t *testing.T) {
+	defer func(d time.Duration) { logStatusPoll = d }(logStatusPoll)
+	logStatusPoll = 20 * time.Millisecond
+
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleJob))
+	defer ts.Close()
+
+	job := jobs.Create("echo", "hi")
+	job, _ = jobs.StartAttempt(job.ID, "node-1", "")
+	srv.logs.Append(job.ID, 1, []LogChunk{{Stream: "stdout", Data: "early\n"}})
+
+	resp, err := http.Get(ts.URL + "/jobs/" + job.ID + "/logs?follow=true")
+	if err != nil {
+		t.Fatalf("follow logs: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+
+	events := make(chan string, 10)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if line := sc.Text(); strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(events)
+	}()
+
+	next := func() string {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("stream closed early")
+			}
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for an event")
+		}
+		return ""
+	}
+
+	if e := next(); !strings.Contains(e, `"data":"early\n"`) {
+		t.Fatalf("expected backlog first, got %s", e)
+	}
+
+	srv.logs.Append(job.ID, 1, []LogChunk{{Stream: "stdout", Data: "late\n"}})
+	if e := next(); !strings.Contains(e, `"data":"late\n"`) {
+		t.Fatalf("expected live output, got %s", e)
+	}
+
+	if _, err := jobs.CompleteAttempt(job.ID, 1); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+	if e := next(); e != `{"status":"COMPLETED"}` {
+		t.Fatalf("expected end event, got %s", e)
+	}
+}
@@ -4,30 +4,138 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
 func main() {
 	// Coordinator listen address, default :8080.
 	addr := getEnv("COORDINATOR_ADDR", ":8080")
 
-	// In-memory node registry.
-	registry := NewNodeRegistry()
-	jobStore := NewJobStore()
+	// Durable state lives in COORDINATOR_DATA_DIR; without it everything is in memory.
+	storage := NewMemoryStorage()
+	if dir := getEnv("COORDINATOR_DATA_DIR", ""); dir != "" {
+		fileStorage, err := OpenFileStorage(dir, 1000)
+		if err != nil {
+			log.Fatalf("[coordinator] failed to open storage in %s: %v", dir, err)
+		}
+		storage = fileStorage
+		log.Printf("[coordinator] persisting state in %s", dir)
+	}
+	defer storage.Close()
+
+	registry, err := NewNodeRegistryWithStorage(storage)
+	if err != nil {
+		log.Fatalf("[coordinator] failed to restore nodes: %v", err)
+	}
+	jobStore, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		log.Fatalf("[coordinator] failed to restore jobs: %v", err)
+	}
+	schedules, err := NewScheduleStoreWithStorage(storage)
+	if err != nil {
+		log.Fatalf("[coordinator] failed to restore schedules: %v", err)
+	}
+	// Default placement policy (score, round-robin, random, least-loaded,
+	// bin-packing), which jobs and admins can override, and the score
+	// policy's weights, e.g. "rtt=0.1,load=2".
+	weights, err := ParseScoreWeights(getEnv("COORDINATOR_SCORE_WEIGHTS", ""))
+	if err != nil {
+		log.Fatalf("[coordinator] invalid COORDINATOR_SCORE_WEIGHTS: %v", err)
+	}
+	scheduler, err := NewScheduler(getEnv("COORDINATOR_SCHEDULER", SchedulerScore), weights)
+	if err != nil {
+		log.Fatalf("[coordinator] invalid COORDINATOR_SCHEDULER: %v", err)
+	}
+	log.Printf("[coordinator] using %s scheduler", scheduler.Name())
+
+	// Upper bound on an attempt of a job that sets no max runtime or deadline,
+	// so a hung agent can't hold a dispatch forever. "0" disables it.
+	defaultTimeout, err := time.ParseDuration(getEnv("COORDINATOR_JOB_TIMEOUT", "1h"))
+	if err != nil || defaultTimeout < 0 {
+		log.Fatalf("[coordinator] invalid COORDINATOR_JOB_TIMEOUT: %q", getEnv("COORDINATOR_JOB_TIMEOUT", ""))
+	}
+
+	// How long an attempt survives without its agent renewing the lease.
+	leaseTTL, err := time.ParseDuration(getEnv("COORDINATOR_LEASE_TTL", "30s"))
+	if err != nil || leaseTTL <= 0 {
+		log.Fatalf("[coordinator] invalid COORDINATOR_LEASE_TTL: %q", getEnv("COORDINATOR_LEASE_TTL", ""))
+	}
+	jobStore.SetLeaseTTL(leaseTTL)
+
+	// How long a job submitted with an Idempotency-Key is returned for
+	// repeats of the same key.
+	idempotencyTTL, err := time.ParseDuration(getEnv("COORDINATOR_IDEMPOTENCY_TTL", "24h"))
+	if err != nil || idempotencyTTL <= 0 {
+		log.Fatalf("[coordinator] invalid COORDINATOR_IDEMPOTENCY_TTL: %q", getEnv("COORDINATOR_IDEMPOTENCY_TTL", ""))
+	}
+	jobStore.SetIdempotencyTTL(idempotencyTTL)
+
+	// How long it takes an account's past CPU usage to count half as much
+	// against its fair share.
+	usageHalfLife, err := time.ParseDuration(getEnv("COORDINATOR_USAGE_HALF_LIFE", "1h"))
+	if err != nil || usageHalfLife <= 0 {
+		log.Fatalf("[coordinator] invalid COORDINATOR_USAGE_HALF_LIFE: %q", getEnv("COORDINATOR_USAGE_HALF_LIFE", ""))
+	}
+	jobStore.SetUsageHalfLife(usageHalfLife)
+
+	// Headers an authenticating proxy sets to say who submits a job, e.g.
+	// X-Forwarded-User. Without them jobs name their own submitter and
+	// group, and fair share and quotas trust whatever they say.
+	identity := identityHeaders{
+		Submitter: getEnv("COORDINATOR_SUBMITTER_HEADER", ""),
+		Group:     getEnv("COORDINATOR_GROUP_HEADER", ""),
+	}
+
 	srv := &server{
 		registry:   registry,
 		jobs:       jobStore,
 		httpClient: http.DefaultClient,
+		wake:       make(chan struct{}, 1),
+		schedules:  schedules,
+		identity:   identity,
+
+		defaultTimeout: defaultTimeout,
 	}
+	srv.schedulers.Use(scheduler, weights)
+
+	// Start background health checker and RTT prober for nodes.
+	startHealthChecker(registry, srv.handleNodeTransitions)
+	startRTTProber(registry, &http.Client{Timeout: 2 * time.Second}, 10*time.Second)
 
-	// Start background health checker for nodes.
-	startHealthChecker(registry)
+	// Catch fanned-out jobs and workflows up with their jobs, pick up jobs
+	// restored as QUEUED or left RUNNING on vanished nodes, watch the ones
+	// still running elsewhere, then keep placing jobs as capacity appears
+	// and starting scheduled jobs (catching up on runs missed while down).
+	srv.rollUpParents()
+	srv.advanceWorkflows()
+	srv.requeuePending()
+	srv.reapOrphans()
+	srv.watchRunning()
+	go srv.runDispatchLoop(make(chan struct{}), 5*time.Second)
+	go srv.runSchedules(make(chan struct{}), time.Second)
 
 	// HTTP routing.
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", healthHandler)
 	mux.HandleFunc("/register", srv.handleRegister)
 	mux.HandleFunc("/nodes", srv.handleListNodes)
+	mux.HandleFunc("/admin/nodes/", srv.handleAdminNode)
 	mux.HandleFunc("/jobs", srv.handleJobs)
+	mux.HandleFunc("/jobs:batch", srv.handleBatchJobs)
+	mux.HandleFunc("/jobs/", srv.handleJob)
+	mux.HandleFunc("/tasks/", srv.handleTask)
+	mux.HandleFunc("/workflows", srv.handleWorkflows)
+	mux.HandleFunc("/workflows/", srv.handleWorkflow)
+	mux.HandleFunc("/schedules", srv.handleSchedules)
+	mux.HandleFunc("/schedules/", srv.handleSchedule)
+	mux.HandleFunc("/admin/priority-classes", srv.handlePriorityClasses)
+	mux.HandleFunc("/admin/priority-classes/", srv.handlePriorityClasses)
+	mux.HandleFunc("/shares", srv.handleShares)
+	mux.HandleFunc("/shares/", srv.handleShares)
+	mux.HandleFunc("/admin/shares/", srv.handleShares)
+	mux.HandleFunc("/admin/quotas", srv.handleQuotas)
+	mux.HandleFunc("/admin/quotas/", srv.handleQuotas)
+	mux.HandleFunc("/admin/scheduler", srv.handleAdminScheduler)
 
 	log.Printf("[coordinator] starting on %s\n", addr)
 	if err := http.ListenAndServe(addr, mux); err != nil {
@@ -1,17 +1,41 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
 
-// NodeState represents the health state of a node.
+// NodeState represents the health state of a node, or the state an admin
+// put it in to take it out of rotation.
 type NodeState string
 
 const (
 	NodeStateHealthy NodeState = "HEALTHY"
 	NodeStateSuspect NodeState = "SUSPECT"
 	NodeStateOffline NodeState = "OFFLINE"
+
+	// Set by admins and kept whatever the node's health: CORDONED nodes get
+	// no new jobs, DRAINING ones also shed or finish the jobs they have,
+	// and they are DRAINED once none are left.
+	NodeStateCordoned NodeState = "CORDONED"
+	NodeStateDraining NodeState = "DRAINING"
+	NodeStateDrained  NodeState = "DRAINED"
+)
+
+// NodeMode is how a node receives work.
+type NodeMode string
+
+const (
+	// NodeModePush nodes are sent jobs on POST /execute at their Address.
+	NodeModePush NodeMode = "push"
+	// NodeModePull nodes can't be reached inbound; they long-poll
+	// GET /tasks/next for jobs placed on them.
+	NodeModePull NodeMode = "pull"
 )
 
 // Node represents an agent node known to the coordinator.
@@ -20,24 +44,143 @@ type Node struct {
 	Address  string    `json:"address"`
 	LastSeen time.Time `json:"last_seen"`
 	State    NodeState `json:"state"`
+
+	// health from heartbeats. State shows it unless an admin took the node
+	// out of rotation, in which case the fields below say who, why and when.
+	Health       NodeState  `json:"health"`
+	CordonedBy   string     `json:"cordoned_by,omitempty"`
+	CordonReason string     `json:"cordon_reason,omitempty"`
+	CordonedAt   *time.Time `json:"cordoned_at,omitempty"`
+
+	// how the node gets work; empty means push.
+	Mode NodeMode `json:"mode,omitempty"`
+
+	// job types the agent advertised; empty means it did not say.
+	JobTypes []string `json:"job_types,omitempty"`
+
+	// machine resources and labels the agent reported on its last heartbeat.
+	Capabilities Capabilities `json:"capabilities"`
+
+	// load the agent reported on its last heartbeat. Slots of 0 means
+	// the agent did not advertise a limit.
+	Slots   int     `json:"slots"`
+	Running int     `json:"running"`
+	Load    float64 `json:"load"`
+
+	// measured by the coordinator: smoothed round-trip time to the agent,
+	// jobs currently placed on the node, and its attempt history.
+	RTTMillis float64 `json:"rtt_ms"`
+	InFlight  int     `json:"in_flight"`
+	Successes int     `json:"successes"`
+	Failures  int     `json:"failures"`
+}
+
+// NodeInfo is what an agent advertises about itself when it registers.
+type NodeInfo struct {
+	Mode         NodeMode
+	JobTypes     []string
+	Capabilities Capabilities
+	Slots        int
+	Running      int
+	Load         float64
+}
+
+// Reliability is the node's smoothed success ratio in (0, 1).
+// A node with no history scores 0.5.
+func (n Node) Reliability() float64 {
+	return float64(n.Successes+1) / float64(n.Successes+n.Failures+2)
+}
+
+// Pulls reports whether the node fetches its jobs instead of being sent them.
+func (n Node) Pulls() bool {
+	return n.Mode == NodeModePull
+}
+
+// Cordoned reports whether an admin took the node out of rotation.
+func (n Node) Cordoned() bool {
+	return n.State == NodeStateCordoned || n.State == NodeStateDraining || n.State == NodeStateDrained
+}
+
+// HealthState returns the node's health from heartbeats, whatever state an
+// admin put it in.
+func (n Node) HealthState() NodeState {
+	if n.Health == "" && !n.Cordoned() {
+		return n.State
+	}
+	return n.Health
 }
 
-// NodeRegistry safely stores nodes in memory.
+// setHealth records the node's health, shown as its state unless it is cordoned.
+func (n *Node) setHealth(h NodeState) {
+	n.Health = h
+	if !n.Cordoned() {
+		n.State = h
+	}
+}
+
+// HasCapacity reports whether the node can take another job.
+func (n Node) HasCapacity() bool {
+	return n.Slots <= 0 || n.InFlight < n.Slots
+}
+
+// Supports reports whether the node can run jobs of jobType.
+// Nodes that advertised no types are assumed to run anything.
+func (n Node) Supports(jobType string) bool {
+	if len(n.JobTypes) == 0 {
+		return true
+	}
+	for _, t := range n.JobTypes {
+		if t == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// nodesBucket is the Storage bucket holding one record per node.
+const nodesBucket = "nodes"
+
+// NodeRegistry safely stores nodes in memory and writes them through to a Storage.
 type NodeRegistry struct {
-	mu    sync.Mutex
-	nodes map[string]*Node
+	mu      sync.Mutex
+	nodes   map[string]*Node
+	storage Storage
 }
 
-// NewNodeRegistry creates an empty registry.
+// NewNodeRegistry creates an empty registry backed by in-memory storage.
 func NewNodeRegistry() *NodeRegistry {
 	return &NodeRegistry{
-		nodes: make(map[string]*Node),
+		nodes:   make(map[string]*Node),
+		storage: NewMemoryStorage(),
 	}
 }
 
+// NewNodeRegistryWithStorage creates a registry and replays nodes already in storage.
+// Restored nodes keep their last known LastSeen, so the health checker
+// demotes them until they heartbeat again.
+func NewNodeRegistryWithStorage(storage Storage) (*NodeRegistry, error) {
+	records, err := storage.Load(nodesBucket)
+	if err != nil {
+		return nil, fmt.Errorf("load nodes: %w", err)
+	}
+
+	r := &NodeRegistry{
+		nodes:   make(map[string]*Node, len(records)),
+		storage: storage,
+	}
+	for id, raw := range records {
+		var n Node
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, fmt.Errorf("decode node %q: %w", id, err)
+		}
+		r.nodes[id] = &n
+	}
+	return r, nil
+}
+
 // Register inserts or updates a node in the registry.
 // We treat registration as a heartbeat: each call updates LastSeen and sets state to HEALTHY.
-func (r *NodeRegistry) Register(id, addr string) Node {
+func (r *NodeRegistry) Register(id, addr string, info NodeInfo) Node {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -47,13 +190,92 @@ func (r *NodeRegistry) Register(id, addr string) Node {
 		r.nodes[id] = n
 	}
 	n.Address = addr
+	n.Mode = info.Mode
+	n.JobTypes = append([]string(nil), info.JobTypes...)
+	n.Capabilities = info.Capabilities
+	n.Slots = info.Slots
+	n.Running = info.Running
+	n.Load = info.Load
 	n.LastSeen = time.Now().UTC()
-	n.State = NodeStateHealthy
+	n.setHealth(NodeStateHealthy)
+
+	if err := r.storage.Put(nodesBucket, n.ID, n); err != nil {
+		log.Printf("[coordinator] failed to persist node %s: %v", n.ID, err)
+	}
 
 	// Return a copy so callers can't mutate internal state.
 	return *n
 }
 
+// Get returns a copy of the node with the given ID.
+func (r *NodeRegistry) Get(id string) (Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return *n, true
+}
+
+// Touch records a poll from a pull node as a heartbeat and updates how many
+// jobs it is running. It is not persisted: a restored node is demoted until
+// it is heard from again anyway.
+func (r *NodeRegistry) Touch(id string, running int) (Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	n.LastSeen = time.Now().UTC()
+	n.setHealth(NodeStateHealthy)
+	n.Running = running
+	if n.Slots > 0 {
+		n.Load = float64(running) / float64(n.Slots)
+	}
+	return *n, true
+}
+
+// RecordRTT folds a measured round-trip time into the node's smoothed RTT.
+func (r *NodeRegistry) RecordRTT(id string, rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok {
+		return
+	}
+	ms := float64(rtt) / float64(time.Millisecond)
+	if n.RTTMillis == 0 {
+		n.RTTMillis = ms
+	} else {
+		n.RTTMillis = 0.7*n.RTTMillis + 0.3*ms
+	}
+}
+
+// RecordOutcome adds a finished attempt to the node's success/failure history.
+func (r *NodeRegistry) RecordOutcome(id string, success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.nodes[id]
+	if !ok {
+		return
+	}
+	if success {
+		n.Successes++
+	} else {
+		n.Failures++
+	}
+
+	if err := r.storage.Put(nodesBucket, n.ID, n); err != nil {
+		log.Printf("[coordinator] failed to persist node %s: %v", n.ID, err)
+	}
+}
+
 // List returns a snapshot of all nodes as a slice of copies.
 func (r *NodeRegistry) List() []Node {
 	r.mu.Lock()
@@ -66,26 +288,44 @@ func (r *NodeRegistry) List() []Node {
 	return out
 }
 
-// UpdateHealthStates updates each node's State based on LastSeen and thresholds.
-func (r *NodeRegistry) UpdateHealthStates(now time.Time, suspectAfter, offlineAfter time.Duration) {
+// NodeTransition records a node's health moving from one state to another.
+type NodeTransition struct {
+	ID   string
+	From NodeState
+	To   NodeState
+}
+
+// UpdateHealthStates updates each node's health based on LastSeen and
+// thresholds, leaving the State of cordoned nodes alone.
+// It returns the nodes whose health changed, sorted by ID.
+func (r *NodeRegistry) UpdateHealthStates(now time.Time, suspectAfter, offlineAfter time.Duration) []NodeTransition {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	var changed []NodeTransition
 	for _, n := range r.nodes {
+		prev := n.HealthState()
 		age := now.Sub(n.LastSeen)
 		switch {
 		case age > offlineAfter:
-			n.State = NodeStateOffline
+			n.setHealth(NodeStateOffline)
 		case age > suspectAfter:
-			n.State = NodeStateSuspect
+			n.setHealth(NodeStateSuspect)
 		default:
-			n.State = NodeStateHealthy
+			n.setHealth(NodeStateHealthy)
+		}
+		if n.Health != prev {
+			changed = append(changed, NodeTransition{ID: n.ID, From: prev, To: n.Health})
 		}
 	}
+
+	sort.Slice(changed, func(i, k int) bool { return changed[i].ID < changed[k].ID })
+	return changed
 }
 
 // startHealthChecker launches a background goroutine that periodically updates node states.
-func startHealthChecker(registry *NodeRegistry) {
+// onTransition, if non-nil, is called with every batch of state changes.
+func startHealthChecker(registry *NodeRegistry, onTransition func([]NodeTransition)) {
 	// How long before a node is considered SUSPECT / OFFLINE.
 	suspectAfter := 15 * time.Second
 	offlineAfter := 30 * time.Second
@@ -93,7 +333,46 @@ func startHealthChecker(registry *NodeRegistry) {
 	ticker := time.NewTicker(5 * time.Second) // how often we recalc health
 	go func() {
 		for now := range ticker.C {
-			registry.UpdateHealthStates(now, suspectAfter, offlineAfter)
+			changed := registry.UpdateHealthStates(now, suspectAfter, offlineAfter)
+			if len(changed) > 0 && onTransition != nil {
+				onTransition(changed)
+			}
+		}
+	}()
+}
+
+// startRTTProber periodically times GET /healthz on every push node that
+// isn't OFFLINE and records the result as the node's RTT.
+func startRTTProber(registry *NodeRegistry, client *http.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			for _, n := range registry.List() {
+				// Pull nodes may not be reachable inbound at all.
+				if n.HealthState() == NodeStateOffline || n.Pulls() {
+					continue
+				}
+				rtt, err := probeRTT(client, n)
+				if err != nil {
+					log.Printf("[coordinator] rtt probe of node %s failed: %v", n.ID, err)
+					continue
+				}
+				registry.RecordRTT(n.ID, rtt)
+			}
 		}
 	}()
 }
+
+// probeRTT times a single GET /healthz against the node.
+func probeRTT(client *http.Client, n Node) (time.Duration, error) {
+	start := time.Now()
+	resp, err := client.Get(buildAgentBaseURL(n.Address) + "/healthz")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return time.Since(start), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
@@ -10,7 +11,7 @@ func TestNodeRegistryRegisterAndList(t *testing.T) {
 	reg := NewNodeRegistry()
 
 	// first registration
-	n1 := reg.Register("node-1", ":8081")
+	n1 := reg.Register("node-1", ":8081", NodeInfo{JobTypes: []string{"echo"}})
 	if n1.ID != "node-1" {
 		t.Fatalf("expected id node-1, got %s", n1.ID)
 	}
@@ -21,14 +22,18 @@ func TestNodeRegistryRegisterAndList(t *testing.T) {
 		t.Fatalf("expected state %s, got %s", NodeStateHealthy, n1.State)
 	}
 
+	if !n1.Supports("echo") || n1.Supports("shell") {
+		t.Fatalf("expected node-1 to support only echo, got %v", n1.JobTypes)
+	}
+
 	// re-register same ID with a different address; should update
-	n2 := reg.Register("node-1", ":9090")
+	n2 := reg.Register("node-1", ":9090", NodeInfo{})
 	if n2.Address != ":9090" {
 		t.Fatalf("expected address :9090, got %s", n2.Address)
 	}
 
 	// register a second node
-	reg.Register("node-2", ":8082")
+	reg.Register("node-2", ":8082", NodeInfo{})
 
 	nodes := reg.List()
 	if len(nodes) != 2 {
@@ -78,7 +83,15 @@ func TestNodeRegistryUpdateHealthStates(t *testing.T) {
 	suspectAfter := 15 * time.Second
 	offlineAfter := 30 * time.Second
 
-	reg.UpdateHealthStates(now, suspectAfter, offlineAfter)
+	changed := reg.UpdateHealthStates(now, suspectAfter, offlineAfter)
+
+	wantChanged := []NodeTransition{
+		{ID: "offline", From: NodeStateHealthy, To: NodeStateOffline},
+		{ID: "suspect", From: NodeStateHealthy, To: NodeStateSuspect},
+	}
+	if !reflect.DeepEqual(changed, wantChanged) {
+		t.Errorf("expected transitions %v, got %v", wantChanged, changed)
+	}
 
 	nodes := reg.List()
 	if len(nodes) != 3 {
@@ -100,3 +113,31 @@ func TestNodeRegistryUpdateHealthStates(t *testing.T) {
 		t.Errorf("expected 'offline' to be OFFLINE, got %s", byID["offline"].State)
 	}
 }
+
+// Test that RTT samples are smoothed and outcomes feed the node's history
+func TestNodeRegistryRecordRTTAndOutcome(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", ":8081", NodeInfo{Slots: 4, Running: 1, Load: 0.25})
+
+	reg.RecordRTT("node-1", 10*time.Millisecond)
+	reg.RecordRTT("node-1", 20*time.Millisecond)
+	reg.RecordOutcome("node-1", true)
+	reg.RecordOutcome("node-1", false)
+
+	// a heartbeat must not reset measured fields.
+	reg.Register("node-1", ":8081", NodeInfo{Slots: 4, Running: 2, Load: 0.5})
+
+	n, ok := reg.Get("node-1")
+	if !ok {
+		t.Fatalf("expected node-1 to exist")
+	}
+	if n.RTTMillis != 13 {
+		t.Errorf("expected smoothed RTT 13ms, got %v", n.RTTMillis)
+	}
+	if n.Successes != 1 || n.Failures != 1 {
+		t.Errorf("expected 1 success and 1 failure, got %d/%d", n.Successes, n.Failures)
+	}
+	if n.Running != 2 || n.Load != 0.5 {
+		t.Errorf("expected reported load to be updated, got running=%d load=%v", n.Running, n.Load)
+	}
+}
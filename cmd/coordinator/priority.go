@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// priorityClassesBucket is the Storage bucket holding one record per priority class.
+const priorityClassesBucket = "priority_classes"
+
+// errNoPriorityClass is returned for a priority class that doesn't exist.
+var errNoPriorityClass = errors.New("no such priority class")
+
+// AttemptPreempted is the outcome of an attempt evicted to make room for a
+// higher-priority job; it doesn't count against the job's retry policy
+const AttemptPreempted = "PREEMPTED"
+
+// PriorityClass names a job priority admins can hand out. Jobs with a
+// higher Value are dispatched first; with Preempt set they may also evict
+// lower-priority running jobs from a full node.
+type PriorityClass struct {
+	Name    string `json:"name"`
+	Value   int    `json:"value"`
+	Preempt bool   `json:"preempt,omitempty"`
+
+	// Default marks the class of jobs that name none; exactly one class has it
+	Default bool `json:"default,omitempty"`
+}
+
+// defaultPriorityClasses are the classes a store starts with until an admin changes them.
+func defaultPriorityClasses() map[string]*PriorityClass {
+	return map[string]*PriorityClass{
+		"low":    {Name: "low", Value: 0},
+		"normal": {Name: "normal", Value: 100, Default: true},
+		"high":   {Name: "high", Value: 1000},
+	}
+}
+
+// Returns every priority class, highest first
+func (s *JobStore) PriorityClasses() []PriorityClass {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]PriorityClass, 0, len(s.classes))
+	for _, c := range s.classes {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, k int) bool {
+		if out[i].Value != out[k].Value {
+			return out[i].Value > out[k].Value
+		}
+		return out[i].Name < out[k].Name
+	})
+	return out
+}
+
+// Returns the named priority class, or the default one for ""
+func (s *JobStore) PriorityClass(name string) (PriorityClass, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.priorityClass(name)
+	if c == nil {
+		return PriorityClass{}, false
+	}
+	return *c, true
+}
+
+// priorityClass returns the named class, or the default one for "". Callers hold s.mu
+func (s *JobStore) priorityClass(name string) *PriorityClass {
+	if name != "" {
+		return s.classes[name]
+	}
+	for _, c := range s.classes {
+		if c.Default {
+			return c
+		}
+	}
+	return nil
+}
+
+// Creates or replaces a priority class. Making it the default takes that
+// from the previous default; the default class can only lose it that way.
+// Jobs already submitted keep the priority they were given
+func (s *JobStore) SetPriorityClass(c PriorityClass) (PriorityClass, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !validStepName(c.Name) {
+		return PriorityClass{}, fmt.Errorf("invalid priority class name %q: use letters, digits, '-' and '_'", c.Name)
+	}
+	if old, ok := s.classes[c.Name]; ok && old.Default && !c.Default {
+		return PriorityClass{}, fmt.Errorf("priority class %q is the default; make another class the default first", c.Name)
+	}
+	if c.Default {
+		for _, other := range s.classes {
+			if other.Default && other.Name != c.Name {
+				other.Default = false
+				s.persistClass(other)
+			}
+		}
+	}
+
+	stored := c
+	s.classes[c.Name] = &stored
+	s.persistClass(&stored)
+	return c, nil
+}
+
+// Removes a priority class other than the default. Jobs that used it keep their priority
+func (s *JobStore) DeletePriorityClass(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.classes[name]
+	if !ok {
+		return fmt.Errorf("priority class %q: %w", name, errNoPriorityClass)
+	}
+	if c.Default {
+		return fmt.Errorf("priority class %q is the default and can't be deleted", name)
+	}
+	delete(s.classes, name)
+	if err := s.storage.Delete(priorityClassesBucket, name); err != nil {
+		log.Printf("[coordinator] failed to delete priority class %s: %v", name, err)
+	}
+	return nil
+}
+
+// persistClass writes c through to storage. Callers hold s.mu
+func (s *JobStore) persistClass(c *PriorityClass) {
+	if err := s.storage.Put(priorityClassesBucket, c.Name, c); err != nil {
+		log.Printf("[coordinator] failed to persist priority class %s: %v", c.Name, err)
+	}
+}
+
+// loadPriorityClasses replays stored priority classes into the store,
+// keeping the defaults if none were ever changed. Callers have exclusive access
+func (s *JobStore) loadPriorityClasses() error {
+	records, err := s.storage.Load(priorityClassesBucket)
+	if err != nil {
+		return fmt.Errorf("load priority classes: %w", err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	s.classes = make(map[string]*PriorityClass, len(records))
+	for name, raw := range records {
+		var c PriorityClass
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return fmt.Errorf("decode priority class %q: %w", name, err)
+		}
+		s.classes[name] = &c
+	}
+	return nil
+}
+
+// Evicts attempt n of an ASSIGNED or RUNNING job, e.g. to make room for a
+// higher-priority job, and puts the job back in the queue. The attempt
+// doesn't count against the job's retry policy
+func (s *JobStore) Preempt(id string, n int, reason string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().UTC()
+	if err := s.transition(j, JobEvent{Time: now, To: JobStatusQueued, NodeID: j.NodeID, Attempt: n, Reason: reason}); err != nil {
+		return Job{}, err
+	}
+	s.closeAttempt(j, now, AttemptPreempted, reason)
+	j.NextAttemptAt = nil
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// chargedAttempts counts the attempts that count against the retry policy:
+// all but the preempted ones
+func (j Job) chargedAttempts() int {
+	n := 0
+	for _, a := range j.Attempts {
+		if a.Outcome != AttemptPreempted {
+			n++
+		}
+	}
+	return n
+}
+
+// checkPriorityClass rejects a spec naming a priority class that doesn't exist.
+func (s *server) checkPriorityClass(spec JobSpec) error {
+	if _, ok := s.jobs.PriorityClass(spec.PriorityClass); !ok {
+		return fmt.Errorf("unknown priority_class %q", spec.PriorityClass)
+	}
+	return nil
+}
+
+// preemptFor evicts the lowest-priority job from a full node that could
+// otherwise run jobID, if the job's class allows preemption and no suitable node
+// has room already (e.g. one freed by an earlier eviction). Among equals the
+// most recently started job goes, losing the least work. It reports whether
+// a job was evicted.
+func (s *server) preemptFor(jobID string) bool {
+	job, ok := s.jobs.Get(jobID)
+	if !ok {
+		return false
+	}
+	class, ok := s.jobs.PriorityClass(job.PriorityClass)
+	if !ok || !class.Preempt {
+		return false
+	}
+
+	full := make(map[string]Node)
+	for _, n := range s.nodeSnapshot() {
+		if n.State != NodeStateHealthy || !n.Supports(job.Type) {
+			continue
+		}
+		if job.Requirements != nil && len(job.Requirements.UnmetEver(n.Capabilities)) > 0 {
+			continue
+		}
+		if n.HasCapacity() {
+			return false
+		}
+		full[n.ID] = n
+	}
+
+	var victim *Job
+	for _, j := range s.jobs.List() {
+		if !j.Active() || j.Priority >= job.Priority {
+			continue
+		}
+		if _, ok := full[j.NodeID]; !ok {
+			continue
+		}
+		if victim == nil || j.Priority < victim.Priority ||
+			(j.Priority == victim.Priority && j.Attempts[len(j.Attempts)-1].StartedAt.After(victim.Attempts[len(victim.Attempts)-1].StartedAt)) {
+			v := j
+			victim = &v
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	if _, err := s.evict(*victim, full[victim.NodeID], fmt.Sprintf("preempted by job %s", job.ID)); err != nil {
+		log.Printf("failed to preempt job %s for job %s: %v", victim.ID, job.ID, err)
+		return false
+	}
+	log.Printf("job %s (priority %d) preempted on node %s by job %s (priority %d)", victim.ID, victim.Priority, victim.NodeID, job.ID, job.Priority)
+	return true
+}
+
+// evict takes the current attempt of job off node and puts the job back
+// on the pending queue without charging it the attempt.
+func (s *server) evict(job Job, node Node, reason string) (Job, error) {
+	attempt := job.CurrentAttempt()
+	evicted, err := s.jobs.Preempt(job.ID, attempt, reason)
+	if err != nil {
+		return Job{}, err
+	}
+	if node.Pulls() {
+		// Not yet fetched: take it back. Otherwise the agent stops it once
+		// its next heartbeat finds the lease revoked.
+		s.pulls.Withdraw(node.ID, job.ID)
+	} else {
+		go s.cancelOnAgent(job.ID, job.Attempts[attempt-1].LeaseToken, node)
+	}
+	s.pending.Push(evicted.ID, evicted.Priority)
+	return evicted, nil
+}
+
+// handlePriorityClasses handles /admin/priority-classes:
+//   - GET /admin/priority-classes -> every class, highest first
+//   - PUT /admin/priority-classes/{name} -> create or replace a class
+//   - DELETE /admin/priority-classes/{name} -> remove a class
+func (s *server) handlePriorityClasses(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/priority-classes"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.jobs.PriorityClasses())
+	case name != "" && r.Method == http.MethodPut:
+		var c PriorityClass
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		c.Name = name
+		c, err := s.jobs.SetPriorityClass(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("priority class %s set to %d (preempt: %v, default: %v)", c.Name, c.Value, c.Preempt, c.Default)
+		writeJSON(w, http.StatusOK, c)
+	case name != "" && r.Method == http.MethodDelete:
+		err := s.jobs.DeletePriorityClass(name)
+		switch {
+		case errors.Is(err, errNoPriorityClass):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Printf("priority class %s deleted", name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that admins can change priority classes and jobs are given theirs
+func TestPriorityClasses(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs, wake: make(chan struct{}, 1)}
+
+	put := func(name, body string) int {
+		w := httptest.NewRecorder()
+		srv.handlePriorityClasses(w, httptest.NewRequest(http.MethodPut, "/admin/priority-classes/"+name, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := put("urgent", `{"value":5000,"preempt":true}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := put("normal", `{"value":100}`); code != http.StatusBadRequest {
+		t.Fatalf("expected the default class to keep its flag, got %d", code)
+	}
+	if code := put("bulk", `{"value":-10,"default":true}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handlePriorityClasses(w, httptest.NewRequest(http.MethodGet, "/admin/priority-classes", nil))
+	var classes []PriorityClass
+	if err := json.NewDecoder(w.Body).Decode(&classes); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(classes) != 5 || classes[0].Name != "urgent" || classes[4].Name != "bulk" || !classes[4].Default {
+		t.Fatalf("unexpected classes %+v", classes)
+	}
+
+	if w := postJob(srv, "", `{"type":"echo","priority_class":"nope"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown class, got %d", w.Code)
+	}
+	urgent := jobs.Submit(JobSpec{Type: "echo", PriorityClass: "urgent"})
+	plain := jobs.Submit(JobSpec{Type: "echo"})
+	if urgent.Priority != 5000 || plain.PriorityClass != "bulk" || plain.Priority != -10 {
+		t.Fatalf("unexpected priorities: %s=%d, %s=%d", urgent.PriorityClass, urgent.Priority, plain.PriorityClass, plain.Priority)
+	}
+
+	// classes survive a restart
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if c, ok := restored.PriorityClass(""); !ok || c.Name != "bulk" {
+		t.Fatalf("expected bulk to be the default after restart, got %+v", c)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handlePriorityClasses(w, httptest.NewRequest(http.MethodDelete, "/admin/priority-classes/bulk", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected the default class to be undeletable, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	srv.handlePriorityClasses(w, httptest.NewRequest(http.MethodDelete, "/admin/priority-classes/urgent", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+}
+
+// Test that a preempting job evicts a lower-priority one from a full node,
+// and that the evicted job keeps its attempts
+func TestPreemption(t *testing.T) {
+	var mu sync.Mutex
+	var cancels []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cancel" {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			cancels = append(cancels, string(body))
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"was_running":true}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer agent.Close()
+	u, _ := url.Parse(agent.URL)
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", u.Host, NodeInfo{Slots: 1})
+	jobs := NewJobStore()
+	if _, err := jobs.SetPriorityClass(PriorityClass{Name: "high", Value: 1000, Preempt: true}); err != nil {
+		t.Fatalf("set class: %v", err)
+	}
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	low := jobs.Submit(JobSpec{Type: "echo", PriorityClass: "low", Retry: &RetryPolicy{MaxAttempts: 2}})
+	running, err := jobs.StartAttempt(low.ID, "node-1", "")
+	if err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+
+	// a normal job waits for the slot
+	normal := jobs.Submit(JobSpec{Type: "echo"})
+	srv.enqueue(normal)
+	srv.dispatchPending()
+	if got, _ := jobs.Get(low.ID); got.Status != JobStatusAssigned {
+		t.Fatalf("a job without preemption must not evict, got %s", got.Status)
+	}
+
+	high := jobs.Submit(JobSpec{Type: "echo", PriorityClass: "high"})
+	srv.enqueue(high)
+	srv.dispatchPending()
+
+	if got, _ := jobs.Get(high.ID); got.Status != JobStatusAssigned || got.NodeID != "node-1" {
+		t.Fatalf("expected the high-priority job placed on node-1, got %s on %q", got.Status, got.NodeID)
+	}
+	evicted, _ := jobs.Get(low.ID)
+	if evicted.Status != JobStatusQueued || evicted.Attempts[0].Outcome != AttemptPreempted || evicted.chargedAttempts() != 0 {
+		t.Fatalf("expected the low job requeued without using its attempt, got %s %+v", evicted.Status, evicted.Attempts)
+	}
+	if q := srv.pending.Snapshot(); len(q) != 2 || q[0] != normal.ID || q[1] != low.ID {
+		t.Fatalf("expected the normal job ahead of the evicted one, got %v", q)
+	}
+
+	// the agent is told to stop just that attempt
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(cancels)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("agent was never asked to stop the evicted job")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var req struct {
+		JobID      string `json:"job_id"`
+		LeaseToken uint64 `json:"lease_token"`
+	}
+	_ = json.Unmarshal([]byte(cancels[0]), &req)
+	if req.JobID != low.ID || req.LeaseToken != running.Attempts[0].LeaseToken {
+		t.Fatalf("unexpected cancel request %s", cancels[0])
+	}
+
+	// its second attempt is only the first of the two it may use
+	if _, err := jobs.StartAttempt(low.ID, "node-1", ""); err != nil {
+		t.Fatalf("restart evicted job: %v", err)
+	}
+	if got, _ := jobs.FailAttempt(low.ID, 2, AttemptFailed, "boom", true); got.Status != JobStatusRetrying {
+		t.Fatalf("expected RETRYING after one charged attempt, got %s", got.Status)
+	}
+}
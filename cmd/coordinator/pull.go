@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPollWait is how long GET /tasks/next holds a request open when
+	// there is nothing to hand out; maxPollWait caps what agents may ask for.
+	defaultPollWait = 30 * time.Second
+	maxPollWait     = 60 * time.Second
+)
+
+// pollResponse is what GET /tasks/next returns: tasks for the node to
+// start, and jobs it is running that have been cancelled.
+type pollResponse struct {
+	Tasks  []executeRequest `json:"tasks"`
+	Cancel []string         `json:"cancel,omitempty"`
+}
+
+// mailbox holds what a pull node will get on its next poll.
+type mailbox struct {
+	tasks   []executeRequest
+	cancels []string
+
+	// notify is closed and replaced whenever something is added.
+	notify chan struct{}
+}
+
+// mailboxes holds a mailbox per pull node. The zero value is ready to use.
+type mailboxes struct {
+	mu    sync.Mutex
+	boxes map[string]*mailbox
+}
+
+// box returns nodeID's mailbox, creating it if needed. Callers hold m.mu.
+func (m *mailboxes) box(nodeID string) *mailbox {
+	if m.boxes == nil {
+		m.boxes = make(map[string]*mailbox)
+	}
+	b, ok := m.boxes[nodeID]
+	if !ok {
+		b = &mailbox{notify: make(chan struct{})}
+		m.boxes[nodeID] = b
+	}
+	return b
+}
+
+func (b *mailbox) signal() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// Offer leaves task for nodeID to pick up.
+func (m *mailboxes) Offer(nodeID string, task executeRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.box(nodeID)
+	b.tasks = append(b.tasks, task)
+	b.signal()
+}
+
+// Cancel withdraws jobID from nodeID's mailbox or, if the node has
+// already picked it up, tells the node to stop it on its next poll.
+func (m *mailboxes) Cancel(nodeID, jobID string) {
+	if m.Withdraw(nodeID, jobID) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.box(nodeID)
+	b.cancels = append(b.cancels, jobID)
+	b.signal()
+}
+
+// Withdraw removes jobID from nodeID's mailbox if the node hasn't picked
+// it up yet, and reports whether it did.
+func (m *mailboxes) Withdraw(nodeID, jobID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.box(nodeID)
+	for i, t := range b.tasks {
+		if t.JobID == jobID {
+			b.tasks = append(b.tasks[:i], b.tasks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Take removes up to max tasks and every pending cancellation from
+// nodeID's mailbox. The returned channel is closed when more arrive.
+// Callers that can't deliver them put them back with Return.
+func (m *mailboxes) Take(nodeID string, max int) ([]executeRequest, []string, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.box(nodeID)
+	n := min(max, len(b.tasks))
+	tasks := append([]executeRequest(nil), b.tasks[:n]...)
+	b.tasks = b.tasks[n:]
+
+	cancels := b.cancels
+	b.cancels = nil
+	return tasks, cancels, b.notify
+}
+
+// Return puts tasks and cancellations taken by Take back at the front of
+// nodeID's mailbox, for a poll whose response didn't reach the node.
+func (m *mailboxes) Return(nodeID string, tasks []executeRequest, cancels []string) {
+	if len(tasks) == 0 && len(cancels) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.box(nodeID)
+	b.tasks = append(tasks, b.tasks...)
+	b.cancels = append(cancels, b.cancels...)
+	b.signal()
+}
+
+// offerToPuller leaves a placed job for its pull node to fetch and starts
+// the attempt's timeout, since no request tracks it.
+func (s *server) offerToPuller(job Job, target *Node) {
+	req, timeout, err := s.newExecuteRequest(job)
+	if err != nil {
+		s.recordFailure(job.ID, job.CurrentAttempt(), AttemptTimedOut, err.Error(), false)
+		s.kick()
+		return
+	}
+	s.pulls.Offer(target.ID, req)
+	s.watchAttempt(job.ID, req.Attempt, timeout)
+	log.Printf("job %s attempt %d waiting for pull node %s", job.ID, req.Attempt, target.ID)
+}
+
+// stillAssigned reports whether task is still the current attempt of its
+// job on nodeID; tasks reaped or cancelled while waiting are not handed out.
+func (s *server) stillAssigned(task executeRequest, nodeID string) bool {
+	job, ok := s.jobs.Get(task.JobID)
+	return ok && job.Active() && job.NodeID == nodeID && job.CurrentAttempt() == task.Attempt
+}
+
+// handleNextTasks implements GET /tasks/next?node_id=...&slots=N[&wait=30s].
+// A registered node asks for up to N tasks (its free slots). The call
+// counts as a heartbeat, and is held open until something is placed on the
+// node or wait expires, when it returns an empty list.
+func (s *server) handleNextTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	nodeID := q.Get("node_id")
+	if nodeID == "" {
+		http.Error(w, "node_id is required", http.StatusBadRequest)
+		return
+	}
+	free := 1
+	if v := q.Get("slots"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "slots must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		free = n
+	}
+	wait := defaultPollWait
+	if v := q.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "wait must be a duration such as 30s", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxPollWait)
+	}
+
+	node, ok := s.registry.Get(nodeID)
+	if !ok {
+		http.Error(w, "node not registered", http.StatusNotFound)
+		return
+	}
+	running := node.Running
+	if node.Slots > 0 {
+		running = max(node.Slots-free, 0)
+	}
+	s.registry.Touch(nodeID, running)
+
+	// The node may have just freed capacity.
+	s.kick()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		tasks, cancels, notify := s.pulls.Take(nodeID, free)
+
+		resp := pollResponse{Tasks: []executeRequest{}, Cancel: cancels}
+		for _, t := range tasks {
+			if s.stillAssigned(t, nodeID) {
+				resp.Tasks = append(resp.Tasks, t)
+			}
+		}
+
+		if len(resp.Tasks) > 0 || len(resp.Cancel) > 0 {
+			s.writePoll(w, nodeID, resp)
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			s.writePoll(w, nodeID, resp)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writePoll sends resp to nodeID's poll. If it doesn't get out, the tasks
+// and cancellations go back to the mailbox for the node's next poll rather
+// than being lost until their leases lapse.
+func (s *server) writePoll(w http.ResponseWriter, nodeID string, resp pollResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err == nil {
+		err = http.NewResponseController(w).Flush()
+	}
+	if err != nil {
+		log.Printf("poll response to node %s failed, keeping its %d tasks: %v", nodeID, len(resp.Tasks), err)
+		s.pulls.Return(nodeID, resp.Tasks, resp.Cancel)
+	}
+}
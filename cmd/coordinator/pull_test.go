@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// poll sends GET /tasks/next for nodeID through handleTask.
+func poll(t *testing.T, srv *server, query string) (int, pollResponse) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	srv.handleTask(w, httptest.NewRequest(http.MethodGet, "/tasks/next?"+query, nil))
+
+	var resp pollResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode poll response: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestRegisterPullNodeWithoutAddress(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore()}
+
+	register := func(req registerRequest) int {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		srv.handleRegister(w, httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := register(registerRequest{ID: "laptop", Mode: NodeModePull}); code != http.StatusOK {
+		t.Fatalf("expected pull node without address to register, got %d", code)
+	}
+	if code := register(registerRequest{ID: "server"}); code != http.StatusBadRequest {
+		t.Fatalf("expected push node without address to be refused, got %d", code)
+	}
+	if code := register(registerRequest{ID: "x", Address: "h:1", Mode: "carrier-pigeon"}); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown mode to be refused, got %d", code)
+	}
+}
+
+// Test that a job placed on a pull node is handed out on its next poll
+func TestPullNodeFetchesPlacedJob(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull, Slots: 2})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	srv.enqueue(job)
+	srv.dispatchPending()
+
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusAssigned || job.NodeID != "laptop" {
+		t.Fatalf("expected job ASSIGNED to laptop, got %s on %q", job.Status, job.NodeID)
+	}
+
+	code, resp := poll(t, srv, "node_id=laptop&slots=2&wait=0s")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(resp.Tasks) != 1 || resp.Tasks[0].JobID != job.ID || resp.Tasks[0].Attempt != 1 || !resp.Tasks[0].Async {
+		t.Fatalf("expected the placed job as an async task, got %+v", resp.Tasks)
+	}
+
+	// a task is handed out once.
+	if _, resp := poll(t, srv, "node_id=laptop&slots=2&wait=0s"); len(resp.Tasks) != 0 {
+		t.Fatalf("expected no more tasks, got %+v", resp.Tasks)
+	}
+
+	node, _ := reg.Get("laptop")
+	if node.Running != 0 {
+		t.Fatalf("expected the poll to report 2 free slots as 0 running, got %d", node.Running)
+	}
+}
+
+// Test that a waiting poll returns as soon as a job is placed on the node
+func TestPullLongPollWakesOnPlacement(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	done := make(chan pollResponse, 1)
+	go func() {
+		_, resp := poll(t, srv, "node_id=laptop&wait=5s")
+		done <- resp
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	job := jobs.Create("echo", "hi")
+	srv.enqueue(job)
+	srv.dispatchPending()
+
+	select {
+	case resp := <-done:
+		if len(resp.Tasks) != 1 || resp.Tasks[0].JobID != job.ID {
+			t.Fatalf("expected the new job, got %+v", resp.Tasks)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("poll did not return after a job was placed")
+	}
+}
+
+// Test that cancelling a job a pull node already fetched is delivered on its next poll
+func TestPullNodeLearnsOfCancellation(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	srv.dispatchJob(job.ID)
+	if _, resp := poll(t, srv, "node_id=laptop&wait=0s"); len(resp.Tasks) != 1 {
+		t.Fatalf("expected the job to be fetched, got %+v", resp)
+	}
+
+	if _, err := srv.cancelJob(job.ID, "test"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if _, resp := poll(t, srv, "node_id=laptop&wait=0s"); len(resp.Cancel) != 1 || resp.Cancel[0] != job.ID {
+		t.Fatalf("expected a cancellation for %s, got %+v", job.ID, resp)
+	}
+}
+
+func TestPullSkipsReapedTasksAndUnknownNodes(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Submit(JobSpec{Type: "echo", Retry: &RetryPolicy{MaxAttempts: 1}})
+	srv.dispatchJob(job.ID)
+	srv.recordFailure(job.ID, 1, AttemptOrphaned, "node went offline", true)
+
+	if _, resp := poll(t, srv, "node_id=laptop&wait=0s"); len(resp.Tasks) != 0 {
+		t.Fatalf("expected a reaped task not to be handed out, got %+v", resp.Tasks)
+	}
+	if code, _ := poll(t, srv, "node_id=ghost&wait=0s"); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unregistered node, got %d", code)
+	}
+	if code, _ := poll(t, srv, "wait=0s"); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without node_id, got %d", code)
+	}
+}
+
+// brokenWriter is a ResponseWriter whose connection has gone away.
+type brokenWriter struct{ *httptest.ResponseRecorder }
+
+func (brokenWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+// Test that tasks of a poll whose response fails are handed out on the next one
+func TestPullKeepsTasksOfFailedPoll(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull, Slots: 1})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	srv.enqueue(job)
+	srv.dispatchPending()
+
+	w := brokenWriter{httptest.NewRecorder()}
+	srv.handleTask(w, httptest.NewRequest(http.MethodGet, "/tasks/next?node_id=laptop&wait=0s", nil))
+
+	if _, resp := poll(t, srv, "node_id=laptop&wait=0s"); len(resp.Tasks) != 1 || resp.Tasks[0].JobID != job.ID {
+		t.Fatalf("expected the task handed out again, got %+v", resp.Tasks)
+	}
+}
+
+// Test that a pull node's rejection of a task it can't run fails the job without retrying it
+func TestPullNodeRejectsTask(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull, Slots: 1})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("teleport", "hi")
+	srv.enqueue(job)
+	srv.dispatchPending()
+	_, resp := poll(t, srv, "node_id=laptop&wait=0s")
+	if len(resp.Tasks) != 1 {
+		t.Fatalf("expected the task handed out, got %+v", resp.Tasks)
+	}
+
+	task := resp.Tasks[0]
+	st := taskStatusRequest{Attempt: task.Attempt, NodeID: "laptop", LeaseToken: task.LeaseToken, State: taskStateRejected, Error: "job type \"teleport\" is not supported"}
+	if code, resp := postTaskStatus(t, srv, job.ID, st); code != http.StatusOK || !resp.Accepted {
+		t.Fatalf("expected the rejection accepted, got %d %+v", code, resp)
+	}
+	if job, _ = jobs.Get(job.ID); job.Status != JobStatusFailed {
+		t.Fatalf("expected the job FAILED right away, got %s", job.Status)
+	}
+}
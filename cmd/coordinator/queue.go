@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errNoNode is returned by placeJob when no node can take the job right now.
+	errNoNode = errors.New("no healthy node available")
+	// errBackoff is returned by placeJob while a retrying job waits out its backoff.
+	errBackoff = errors.New("waiting for retry backoff")
+)
+
+// pendingQueue holds the IDs of QUEUED jobs waiting for a node, highest
+// priority first and oldest first within a priority.
+// The zero value is an empty queue.
+type pendingQueue struct {
+	mu      sync.Mutex
+	entries []*queueEntry          // in order, including removed ones
+	queued  map[string]*queueEntry // the live entries by id
+	removed int                    // entries removed but not yet compacted away
+}
+
+// queueEntry is one job in the pending queue. Removing it only marks it;
+// the entries are compacted once removed ones make up half of them.
+type queueEntry struct {
+	id       string
+	priority int
+	removed  bool
+}
+
+// Push queues id behind the jobs of the same or higher priority, unless it
+// is already queued. It reports whether id was added.
+func (q *pendingQueue) Push(id string, priority int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.queued[id]; ok {
+		return false
+	}
+	if q.queued == nil {
+		q.queued = make(map[string]*queueEntry)
+	}
+	e := &queueEntry{id: id, priority: priority}
+	q.queued[id] = e
+	at := len(q.entries)
+	for at > 0 && q.entries[at-1].priority < priority {
+		at--
+	}
+	q.entries = slices.Insert(q.entries, at, e)
+	return true
+}
+
+// Remove drops id from the queue. It reports whether id was queued.
+func (q *pendingQueue) Remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.queued[id]
+	if !ok {
+		return false
+	}
+	delete(q.queued, id)
+	e.removed = true
+	q.removed++
+	if q.removed > len(q.entries)/2 {
+		q.entries = slices.DeleteFunc(q.entries, func(e *queueEntry) bool { return e.removed })
+		q.removed = 0
+	}
+	return true
+}
+
+// Snapshot returns a copy of the queued IDs in order.
+func (q *pendingQueue) Snapshot() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := make([]string, 0, len(q.queued))
+	for _, e := range q.entries {
+		if !e.removed {
+			ids = append(ids, e.id)
+		}
+	}
+	return ids
+}
+
+// Len returns the number of queued jobs.
+func (q *pendingQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queued)
+}
+
+// enqueue adds a job to the pending queue and wakes the dispatch loop.
+func (s *server) enqueue(job Job) {
+	s.pending.Push(job.ID, job.Priority)
+	s.kick()
+}
+
+// kick wakes the dispatch loop without blocking; kicks that arrive while
+// a pass is already pending coalesce into one.
+func (s *server) kick() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// requeuePending pushes every QUEUED or RETRYING job in the store onto the
+// pending queue, oldest first. It is used on startup to pick up restored
+// jobs; placeJob holds retrying ones back until their backoff is over.
+func (s *server) requeuePending() {
+	jobs := s.jobs.List()
+	sort.Slice(jobs, func(i, k int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[k].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[k].CreatedAt)
+		}
+		return jobs[i].ID < jobs[k].ID
+	})
+
+	for _, j := range jobs {
+		if (j.Status == JobStatusQueued || j.Status == JobStatusRetrying) && !j.IsParent() {
+			s.pending.Push(j.ID, j.Priority)
+		}
+	}
+	s.kick()
+}
+
+// runDispatchLoop expires lapsed leases, places pending jobs and notes
+// drained nodes each time it is kicked, and on every interval as a safety
+// net, when it also writes out the fair-share usage charged since the last
+// one. It returns when stop is closed.
+func (s *server) runDispatchLoop(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		case <-ticker.C:
+			s.jobs.FlushShares()
+		}
+		s.expireLeases()
+		s.dispatchPending()
+		s.finishDrains()
+	}
+}
+
+// dispatchPending makes one pass over the pending queue, by priority and
+// then fair share between accounts (see DispatchOrder).
+// Jobs that get a node are removed and either started in the background or,
+// for pull nodes, left for the node to fetch; jobs with no node available
+// stay queued for the next pass.
+func (s *server) dispatchPending() {
+	order := s.jobs.DispatchOrder(s.pending.Snapshot())
+	for id, ok := order.Next(); ok; id, ok = order.Next() {
+		if qe := order.OverQuota(id); qe != nil {
+			if _, err := s.jobs.SetPendingReason(id, qe.Error()); err != nil {
+				log.Printf("failed to record pending reason for job %s: %v", id, err)
+			}
+			continue
+		}
+		job, target, err := s.placeJob(id)
+		if errors.Is(err, errNoNode) && s.preemptFor(id) {
+			// The evicted job's slot is free now.
+			job, target, err = s.placeJob(id)
+		}
+		if errors.Is(err, errNoNode) {
+			if _, setErr := s.jobs.SetPendingReason(id, strings.TrimPrefix(err.Error(), errNoNode.Error()+": ")); setErr != nil {
+				log.Printf("failed to record pending reason for job %s: %v", id, setErr)
+			}
+			continue
+		}
+		if errors.Is(err, errBackoff) {
+			continue
+		}
+		s.pending.Remove(id)
+		if errors.Is(err, errDeadlinePassed) {
+			continue
+		}
+		if err != nil {
+			log.Printf("dropping job %s from pending queue: %v", id, err)
+			continue
+		}
+		order.Placed(id)
+		if target.Pulls() {
+			s.offerToPuller(job, target)
+			continue
+		}
+		go s.executeJob(job, target)
+	}
+}
+
+// handleNodeTransitions reacts to health changes found by the health checker.
+func (s *server) handleNodeTransitions(transitions []NodeTransition) {
+	for _, t := range transitions {
+		log.Printf("[coordinator] node %s: %s -> %s", t.ID, t.From, t.To)
+		if t.To == NodeStateHealthy {
+			s.kick()
+		}
+	}
+
+	for _, t := range transitions {
+		if t.To == NodeStateOffline {
+			s.reapOrphans()
+			break
+		}
+	}
+}
+
+// reapOrphans finds ASSIGNED or RUNNING jobs whose node is OFFLINE or no longer known
+// and records their current attempt as orphaned, which puts them back on
+// the queue while attempts remain.
+func (s *server) reapOrphans() {
+	nodes := make(map[string]NodeState)
+	for _, n := range s.registry.List() {
+		nodes[n.ID] = n.HealthState()
+	}
+
+	for _, j := range s.jobs.List() {
+		if !j.Active() {
+			continue
+		}
+		if state, ok := nodes[j.NodeID]; ok && state != NodeStateOffline {
+			continue
+		}
+		s.recordFailure(j.ID, j.CurrentAttempt(), AttemptOrphaned, fmt.Sprintf("node %s went offline", j.NodeID), true)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPendingQueuePushRemove(t *testing.T) {
+	var q pendingQueue
+
+	if !q.Push("job-1", 0) || !q.Push("job-2", 0) || !q.Push("job-3", 0) {
+		t.Fatalf("expected first pushes to succeed")
+	}
+	if q.Push("job-2", 0) {
+		t.Fatalf("expected duplicate push to be ignored")
+	}
+	if !q.Remove("job-2") {
+		t.Fatalf("expected job-2 to be removed")
+	}
+	if q.Remove("job-2") {
+		t.Fatalf("expected second remove of job-2 to report false")
+	}
+
+	if !q.Push("job-2", 0) {
+		t.Fatalf("expected a removed job to be pushed again")
+	}
+
+	want := []string{"job-1", "job-3", "job-2"}
+	if got := q.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected queue %v, got %v", want, got)
+	}
+}
+
+// Test that removed entries are skipped until enough pile up to be compacted away
+func TestPendingQueueCompactsRemoved(t *testing.T) {
+	var q pendingQueue
+
+	for _, id := range []string{"job-1", "job-2", "job-3", "job-4"} {
+		q.Push(id, 0)
+	}
+	q.Remove("job-1")
+	if len(q.entries) != 4 || q.Len() != 3 {
+		t.Fatalf("expected job-1 to stay behind as removed, got %d entries and %d queued", len(q.entries), q.Len())
+	}
+	q.Remove("job-3")
+	q.Remove("job-4")
+	if len(q.entries) != 1 || q.removed != 0 {
+		t.Fatalf("expected removed entries to be compacted away, got %d entries", len(q.entries))
+	}
+
+	q.Push("job-1", 0)
+	want := []string{"job-2", "job-1"}
+	if got := q.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected queue %v, got %v", want, got)
+	}
+}
+
+func TestPendingQueuePriorityOrder(t *testing.T) {
+	var q pendingQueue
+
+	q.Push("low-1", 0)
+	q.Push("normal-1", 100)
+	q.Push("high-1", 1000)
+	q.Push("normal-2", 100)
+	q.Push("low-2", 0)
+
+	want := []string{"high-1", "normal-1", "normal-2", "low-1", "low-2"}
+	if got := q.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected queue %v, got %v", want, got)
+	}
+}
+
+// Test that a job submitted before any agent joins runs once a node registers
+func TestDispatchLoopRunsJobWhenNodeRegisters(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(executeResponse{Status: "ok"})
+	}))
+	defer agent.Close()
+
+	u, err := url.Parse(agent.URL)
+	if err != nil {
+		t.Fatalf("failed to parse agent URL: %v", err)
+	}
+
+	srv := &server{
+		registry:   NewNodeRegistry(),
+		jobs:       NewJobStore(),
+		httpClient: agent.Client(),
+		wake:       make(chan struct{}, 1),
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go srv.runDispatchLoop(stop, time.Hour)
+
+	// submit with no nodes registered.
+	body, _ := json.Marshal(createJobRequest{Type: "echo", Payload: "early"})
+	w := httptest.NewRecorder()
+	srv.handleJobs(w, httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", w.Code)
+	}
+
+	var job Job
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatalf("failed to decode job: %v", err)
+	}
+
+	// the loop has nothing to place the job on yet.
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := srv.jobs.Get(job.ID); got.Status != JobStatusQueued {
+		t.Fatalf("expected job to stay QUEUED without nodes, got %s", got.Status)
+	}
+
+	// an agent joins; the registration kicks the loop.
+	reg, _ := json.Marshal(registerRequest{ID: "node-1", Address: u.Host})
+	wReg := httptest.NewRecorder()
+	srv.handleRegister(wReg, httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(reg)))
+	if wReg.Code != http.StatusOK {
+		t.Fatalf("expected register status 200, got %d", wReg.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := srv.jobs.Get(job.ID)
+		if got.Status == JobStatusCompleted {
+			if got.NodeID != "node-1" {
+				t.Fatalf("expected job to run on node-1, got %q", got.NodeID)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not complete after node registered; status %s", got.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := srv.pending.Len(); n != 0 {
+		t.Fatalf("expected empty pending queue, got %d", n)
+	}
+}
+
+// Test that jobs restored as QUEUED or RETRYING are put back on the pending queue in age order
+func TestRequeuePending(t *testing.T) {
+	jobs := NewJobStore()
+	j1 := jobs.Create("echo", "a")
+	j2 := jobs.Create("echo", "b")
+	j3 := jobs.Create("echo", "c")
+	if _, err := jobs.StartAttempt(j2.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	if _, err := jobs.CompleteAttempt(j2.ID, 1); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+	j4 := jobs.Create("echo", "d")
+	jobs.StartAttempt(j4.ID, "node-1", "")
+	if retrying, err := jobs.FailAttempt(j4.ID, 1, AttemptFailed, "boom", true); err != nil || retrying.Status != JobStatusRetrying {
+		t.Fatalf("expected j4 retrying, got %s (%v)", retrying.Status, err)
+	}
+
+	srv := &server{jobs: jobs}
+	srv.requeuePending()
+
+	want := []string{j1.ID, j3.ID, j4.ID}
+	if got := srv.pending.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected pending %v, got %v", want, got)
+	}
+}
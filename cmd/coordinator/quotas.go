@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage buckets holding one record per quota, and one per account's
+// CPU-seconds in the current quota period.
+const (
+	quotasBucket     = "quotas"
+	quotaUsageBucket = "quota_usage"
+)
+
+// defaultQuotaAccount names the quota of submitters without one of their own.
+const defaultQuotaAccount = "*"
+
+// defaultQuotaPeriod is the period CPU-seconds are counted over when a
+// quota doesn't set one.
+const defaultQuotaPeriod = 24 * time.Hour
+
+// errNoQuota is returned for an account without a quota.
+var errNoQuota = errors.New("no such quota")
+
+// Quota caps what an account may have in the mesh at once, and the CPU
+// time its jobs may use per period. A zero limit is no limit. A submitter's
+// jobs count against the submitter's quota and, when they name a group,
+// the group's as well.
+type Quota struct {
+	Account        string  `json:"account"`
+	MaxQueuedJobs  int     `json:"max_queued_jobs,omitempty"`
+	MaxRunningJobs int     `json:"max_running_jobs,omitempty"`
+	MaxCPUSeconds  float64 `json:"max_cpu_seconds,omitempty"`
+
+	// the period MaxCPUSeconds applies to; zero means a day
+	PeriodSeconds int64 `json:"period_seconds,omitempty"`
+}
+
+// QuotaStatus is a quota and how much of it its account is using, as
+// served by GET /admin/quotas.
+type QuotaStatus struct {
+	Quota
+	QueuedJobs   int        `json:"queued_jobs"`
+	RunningJobs  int        `json:"running_jobs"`
+	CPUSeconds   float64    `json:"cpu_seconds"`
+	PeriodEndsAt *time.Time `json:"period_ends_at,omitempty"`
+}
+
+// QuotaError says which quota stopped a job, and when trying again may
+// succeed if waiting alone will help.
+type QuotaError struct {
+	Account    string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota of %s exceeded: %s", e.Account, e.Reason)
+}
+
+// cpuWindow is the CPU time an account's jobs used in the quota period starting at Start
+type cpuWindow struct {
+	Account string    `json:"account"`
+	Start   time.Time `json:"start"`
+	Used    float64   `json:"used_cpu_seconds"`
+}
+
+// accountJobs is what of an account's jobs counts against its quota: how
+// many are queued, and the active ones by ID. The store keeps it up to date
+// as jobs change status, so quota checks don't have to scan every job.
+type accountJobs struct {
+	queued int
+	active map[string]*Job
+}
+
+// quotaUsage is what an account counts against its quota right now
+type quotaUsage struct {
+	queued, running int
+	cpuSeconds      float64
+	periodEnds      time.Time
+}
+
+// Validate rejects quotas that can't be applied
+func (q Quota) Validate() error {
+	if q.MaxQueuedJobs < 0 || q.MaxRunningJobs < 0 || q.MaxCPUSeconds < 0 || q.PeriodSeconds < 0 {
+		return errors.New("quota limits must not be negative")
+	}
+	if math.IsNaN(q.MaxCPUSeconds) || math.IsInf(q.MaxCPUSeconds, 0) {
+		return errors.New("max_cpu_seconds must be a number")
+	}
+	return nil
+}
+
+// period returns the period MaxCPUSeconds applies to
+func (q Quota) period() time.Duration {
+	if q.PeriodSeconds <= 0 {
+		return defaultQuotaPeriod
+	}
+	return time.Duration(q.PeriodSeconds) * time.Second
+}
+
+// quotaAccounts lists the accounts the job counts against: its submitter
+// (or the anonymous account) and its group, if any
+func (j Job) quotaAccounts() []string {
+	submitter := j.Submitter
+	if submitter == "" {
+		submitter = anonymousAccount
+	}
+	if j.Group == "" || j.Group == submitter {
+		return []string{submitter}
+	}
+	return []string{submitter, j.Group}
+}
+
+// quotaFor returns the quota of quotas that applies to account, if any:
+// its own, or the default one for a submitter
+func quotaFor(quotas map[string]*Quota, account string, submitter bool) (Quota, bool) {
+	if q, ok := quotas[account]; ok {
+		return *q, true
+	}
+	if q, ok := quotas[defaultQuotaAccount]; ok && submitter {
+		return *q, true
+	}
+	return Quota{}, false
+}
+
+// quotaPeriod returns the period account's CPU time is counted over. Callers hold s.mu
+func (s *JobStore) quotaPeriod(account string) time.Duration {
+	if q, ok := s.quotas[account]; ok {
+		return q.period()
+	}
+	if q, ok := s.quotas[defaultQuotaAccount]; ok {
+		return q.period()
+	}
+	return defaultQuotaPeriod
+}
+
+// currentWindow returns the CPU time account used in its current quota
+// period and when the period started and ends. Without one, a period
+// would start at the next charge, and running jobs count in full. Callers hold s.mu
+func (s *JobStore) currentWindow(account string, now time.Time) (used float64, start, end time.Time) {
+	period := s.quotaPeriod(account)
+	if w, ok := s.cpuWindows[account]; ok && now.Before(w.Start.Add(period)) {
+		return w.Used, w.Start, w.Start.Add(period)
+	}
+	return 0, time.Time{}, now.Add(period)
+}
+
+// chargeQuota adds cpuSeconds to the current quota period of each account
+// j counts against, starting a new period where the last one is over. Callers hold s.mu
+func (s *JobStore) chargeQuota(j *Job, cpuSeconds float64, now time.Time) {
+	for _, account := range j.quotaAccounts() {
+		w, ok := s.cpuWindows[account]
+		if !ok || !now.Before(w.Start.Add(s.quotaPeriod(account))) {
+			w = &cpuWindow{Account: account, Start: now}
+			s.cpuWindows[account] = w
+		}
+		w.Used += cpuSeconds
+		if err := s.storage.Put(quotaUsageBucket, account, w); err != nil {
+			log.Printf("[coordinator] failed to persist quota usage of %s: %v", account, err)
+		}
+	}
+}
+
+// quotaCounted says whether j counts against its accounts' quotas as a
+// queued job or as a running one while in status
+func quotaCounted(j *Job, status JobStatus) (queued, running bool) {
+	if j.IsParent() {
+		return false, false
+	}
+	switch status {
+	case JobStatusQueued, JobStatusRetrying, JobStatusWaiting:
+		return true, false
+	case JobStatusAssigned, JobStatusRunning:
+		return false, true
+	}
+	return false, false
+}
+
+// countJob moves j from status from to status to in the job counts of the
+// accounts it counts against and of its node; from is empty for a new job.
+// Callers hold s.mu
+func (s *JobStore) countJob(j *Job, from, to JobStatus) {
+	wasQueued, wasRunning := quotaCounted(j, from)
+	queued, running := quotaCounted(j, to)
+	if wasQueued == queued && wasRunning == running {
+		return
+	}
+	if wasRunning != running {
+		s.countRunning(j, running)
+		if running {
+			s.countInFlight(j.NodeID, 1)
+		} else {
+			s.countInFlight(j.NodeID, -1)
+		}
+	}
+	for _, account := range j.quotaAccounts() {
+		a, ok := s.accounts[account]
+		if !ok {
+			a = &accountJobs{active: make(map[string]*Job)}
+			s.accounts[account] = a
+		}
+		switch {
+		case wasQueued:
+			a.queued--
+		case wasRunning:
+			delete(a.active, j.ID)
+		}
+		switch {
+		case queued:
+			a.queued++
+		case running:
+			a.active[j.ID] = j
+		}
+		if a.queued == 0 && len(a.active) == 0 {
+			delete(s.accounts, account)
+		}
+	}
+}
+
+// quotaUsage returns what every account with jobs or CPU time this period
+// counts against its quota. Callers hold s.mu
+func (s *JobStore) quotaUsage(now time.Time) map[string]*quotaUsage {
+	out := make(map[string]*quotaUsage, len(s.cpuWindows)+len(s.accounts))
+	for account := range s.cpuWindows {
+		used, _, end := s.currentWindow(account, now)
+		out[account] = &quotaUsage{cpuSeconds: used, periodEnds: end}
+	}
+	for account, a := range s.accounts {
+		used, start, end := s.currentWindow(account, now)
+		u := &quotaUsage{queued: a.queued, running: len(a.active), cpuSeconds: used, periodEnds: end}
+		for _, j := range a.active {
+			// only the part of the attempt in this period counts
+			at := j.Attempts[len(j.Attempts)-1]
+			if at.StartedAt.Before(start) {
+				at.StartedAt = start
+			}
+			u.cpuSeconds += j.cpuSeconds(at, now)
+		}
+		out[account] = u
+	}
+	return out
+}
+
+// overQuota says why newQueued more queued jobs or newRunning more running
+// ones of j's accounts, given their usage, would break one of quotas, or returns nil
+func overQuota(j Job, quotas map[string]*Quota, usage map[string]*quotaUsage, newQueued, newRunning int, now time.Time) *QuotaError {
+	for i, account := range j.quotaAccounts() {
+		q, ok := quotaFor(quotas, account, i == 0)
+		if !ok {
+			continue
+		}
+		u, ok := usage[account]
+		if !ok {
+			u = &quotaUsage{}
+		}
+		switch {
+		case q.MaxCPUSeconds > 0 && u.cpuSeconds >= q.MaxCPUSeconds:
+			return &QuotaError{
+				Account:    account,
+				Reason:     fmt.Sprintf("used %.0f of %.0f CPU-seconds this period", u.cpuSeconds, q.MaxCPUSeconds),
+				RetryAfter: u.periodEnds.Sub(now),
+			}
+		case newQueued > 0 && q.MaxQueuedJobs > 0 && u.queued+newQueued > q.MaxQueuedJobs:
+			return &QuotaError{Account: account, Reason: fmt.Sprintf("%d of %d queued jobs, %d more requested", u.queued, q.MaxQueuedJobs, newQueued)}
+		case newRunning > 0 && q.MaxRunningJobs > 0 && u.running+newRunning > q.MaxRunningJobs:
+			return &QuotaError{Account: account, Reason: fmt.Sprintf("%d of %d running jobs", u.running, q.MaxRunningJobs)}
+		}
+	}
+	return nil
+}
+
+// jobCount returns how many jobs spec queues: one per task if it fans out
+func (spec JobSpec) jobCount() int {
+	if spec.Fanout != nil {
+		return int(spec.Fanout.size())
+	}
+	return 1
+}
+
+// admit checks each spec against the queued-jobs and CPU-seconds quotas of
+// its accounts, counting the specs admitted before it. It returns nil for
+// an admitted spec and a *QuotaError for one that isn't. Callers hold s.mu
+// until the admitted specs are submitted, so nothing else can take their room
+func (s *JobStore) admit(specs []JobSpec, now time.Time) []error {
+	usage := s.quotaUsage(now)
+	out := make([]error, len(specs))
+	for i, spec := range specs {
+		j := Job{Submitter: spec.Submitter, Group: spec.Group}
+		n := spec.jobCount()
+		if err := overQuota(j, s.quotas, usage, n, 0, now); err != nil {
+			out[i] = err
+			continue
+		}
+		for _, account := range j.quotaAccounts() {
+			if _, ok := usage[account]; !ok {
+				usage[account] = &quotaUsage{}
+			}
+			usage[account].queued += n
+		}
+	}
+	return out
+}
+
+// admitAll admits specs submitted together, returning the first
+// *QuotaError if any of them is refused. Callers hold s.mu
+func (s *JobStore) admitAll(specs []JobSpec, now time.Time) error {
+	for _, err := range s.admit(specs, now) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Submits spec like Submit if its accounts' quotas have room for it, and
+// otherwise returns the *QuotaError it broke
+func (s *JobStore) SubmitAdmitted(spec JobSpec) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	if err := s.admitAll([]JobSpec{spec}, now); err != nil {
+		return Job{}, err
+	}
+	return *s.submit(spec, now), nil
+}
+
+// Returns every quota with its account's current usage, by account
+func (s *JobStore) Quotas() []QuotaStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.quotaUsage(time.Now().UTC())
+	out := make([]QuotaStatus, 0, len(s.quotas))
+	for account, q := range s.quotas {
+		st := QuotaStatus{Quota: *q}
+		if u, ok := usage[account]; ok {
+			st.QueuedJobs, st.RunningJobs, st.CPUSeconds = u.queued, u.running, u.cpuSeconds
+			ends := u.periodEnds
+			st.PeriodEndsAt = &ends
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].Account < out[k].Account })
+	return out
+}
+
+// Creates or replaces an account's quota; "*" sets the default quota of submitters
+func (s *JobStore) SetQuota(q Quota) (Quota, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if q.Account == "" || !validAccountName(q.Account) {
+		return Quota{}, fmt.Errorf("invalid account %q", q.Account)
+	}
+	if err := q.Validate(); err != nil {
+		return Quota{}, err
+	}
+	stored := q
+	s.quotas[q.Account] = &stored
+	if err := s.storage.Put(quotasBucket, q.Account, &stored); err != nil {
+		log.Printf("[coordinator] failed to persist quota of %s: %v", q.Account, err)
+	}
+	return q, nil
+}
+
+// Removes an account's quota; its jobs are no longer limited
+func (s *JobStore) DeleteQuota(account string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.quotas[account]; !ok {
+		return fmt.Errorf("account %q: %w", account, errNoQuota)
+	}
+	delete(s.quotas, account)
+	if err := s.storage.Delete(quotasBucket, account); err != nil {
+		log.Printf("[coordinator] failed to delete quota of %s: %v", account, err)
+	}
+	return nil
+}
+
+// loadQuotas replays stored quotas and quota usage into the store. Callers have exclusive access
+func (s *JobStore) loadQuotas() error {
+	records, err := s.storage.Load(quotasBucket)
+	if err != nil {
+		return fmt.Errorf("load quotas: %w", err)
+	}
+	for account, raw := range records {
+		var q Quota
+		if err := json.Unmarshal(raw, &q); err != nil {
+			return fmt.Errorf("decode quota %q: %w", account, err)
+		}
+		s.quotas[account] = &q
+	}
+
+	records, err = s.storage.Load(quotaUsageBucket)
+	if err != nil {
+		return fmt.Errorf("load quota usage: %w", err)
+	}
+	for account, raw := range records {
+		var w cpuWindow
+		if err := json.Unmarshal(raw, &w); err != nil {
+			return fmt.Errorf("decode quota usage %q: %w", account, err)
+		}
+		s.cpuWindows[account] = &w
+	}
+	return nil
+}
+
+// writeQuotaError answers 429 Too Many Requests with the quota err broke,
+// and Retry-After when the quota period ending will make room.
+func writeQuotaError(w http.ResponseWriter, err error) {
+	var qe *QuotaError
+	if errors.As(err, &qe) && qe.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(qe.RetryAfter.Seconds()))))
+	}
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// handleQuotas handles /admin/quotas:
+//   - GET /admin/quotas -> every quota and its account's usage
+//   - PUT /admin/quotas/{account} -> create or replace a quota
+//   - DELETE /admin/quotas/{account} -> remove a quota
+func (s *server) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	account := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/quotas"), "/")
+	switch {
+	case account == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.jobs.Quotas())
+	case account != "" && r.Method == http.MethodPut:
+		var q Quota
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		q.Account = account
+		q, err := s.jobs.SetQuota(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("quota of %s set: %d queued, %d running, %.0f CPU-seconds per %s", q.Account, q.MaxQueuedJobs, q.MaxRunningJobs, q.MaxCPUSeconds, q.period())
+		writeJSON(w, http.StatusOK, q)
+		s.kick()
+	case account != "" && r.Method == http.MethodDelete:
+		if err := s.jobs.DeleteQuota(account); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("quota of %s removed", account)
+		w.WriteHeader(http.StatusNoContent)
+		s.kick()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// putQuota sets a quota through the admin endpoint and returns the status code
+func putQuota(srv *server, account, body string) int {
+	w := httptest.NewRecorder()
+	srv.handleQuotas(w, httptest.NewRequest(http.MethodPut, "/admin/quotas/"+account, strings.NewReader(body)))
+	return w.Code
+}
+
+// Test that submissions past a queued-jobs quota are refused with 429
+func TestQuotaAdmission(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+
+	if code := putQuota(srv, "alice", `{"max_queued_jobs":-1}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", code)
+	}
+	for account, body := range map[string]string{"alice": `{"max_queued_jobs":2}`, "lab": `{"max_queued_jobs":1}`, "*": `{"max_queued_jobs":1}`} {
+		if code := putQuota(srv, account, body); code != http.StatusOK {
+			t.Fatalf("expected 200 setting the quota of %s, got %d", account, code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := postJob(srv, "", `{"type":"echo","submitter":"alice"}`); w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", w.Code)
+		}
+	}
+	w := postJob(srv, "", `{"type":"echo","submitter":"alice"}`)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "quota of alice exceeded: 2 of 2 queued jobs") {
+		t.Fatalf("expected 429 naming alice's quota, got %d: %s", w.Code, w.Body)
+	}
+	if w := postJob(srv, "", `{"type":"echo","submitter":"alice","fanout":{"items":["a","b"]}}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the tasks of a fan-out to count, got %d", w.Code)
+	}
+
+	// group quotas apply to all of the group's submitters, the default one
+	// to submitters without their own
+	if w := postJob(srv, "", `{"type":"echo","submitter":"bob","group":"lab"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	if w := postJob(srv, "", `{"type":"echo","submitter":"carol","group":"lab"}`); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "quota of lab") {
+		t.Fatalf("expected lab's quota to stop carol, got %d: %s", w.Code, w.Body)
+	}
+	if w := postJob(srv, "", `{"type":"echo"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	if w := postJob(srv, "", `{"type":"echo"}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the default quota to apply to anonymous jobs, got %d", w.Code)
+	}
+
+	// an atomic batch over quota is refused whole, a partial one in part
+	batch := `{"jobs":[{"type":"echo","submitter":"dave"},{"type":"echo","submitter":"dave"}]%s}`
+	w = httptest.NewRecorder()
+	srv.handleBatchJobs(w, httptest.NewRequest(http.MethodPost, "/jobs:batch", strings.NewReader(strings.Replace(batch, "%s", "", 1))))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 for an atomic batch over quota, got %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	srv.handleBatchJobs(w, httptest.NewRequest(http.MethodPost, "/jobs:batch", strings.NewReader(strings.Replace(batch, "%s", `,"mode":"partial"`, 1))))
+	var resp batchJobsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if w.Code != http.StatusMultiStatus || len(resp.JobIDs) != 1 || !strings.Contains(resp.Results[1].Error, "quota of dave") {
+		t.Fatalf("expected the second job refused, got %d %+v", w.Code, resp)
+	}
+}
+
+// Test that a retry of a submission that went through isn't refused over quota
+func TestQuotaIdempotentReplay(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+	putQuota(srv, "alice", `{"max_queued_jobs":1}`)
+
+	body := `{"type":"echo","submitter":"alice"}`
+	if w := postJob(srv, "k1", body); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	if w := postJob(srv, "k1", body); w.Code != http.StatusOK {
+		t.Fatalf("expected the replay answered 200, got %d", w.Code)
+	}
+	if w := postJob(srv, "k2", body); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a new key over quota refused, got %d", w.Code)
+	}
+
+	// a key repeated in a batch counts once
+	putQuota(srv, "bob", `{"max_queued_jobs":1}`)
+	code, resp := postBatch(t, srv, `{"jobs":[{"type":"echo","submitter":"bob","idempotency_key":"k3"},{"type":"echo","submitter":"bob","idempotency_key":"k3"}]}`)
+	if code != http.StatusCreated || len(resp.JobIDs) != 2 || resp.JobIDs[0] != resp.JobIDs[1] {
+		t.Fatalf("expected the repeated key admitted as one job, got %d %+v", code, resp)
+	}
+	code, resp = postBatch(t, srv, `{"mode":"partial","jobs":[{"type":"echo","submitter":"bob","idempotency_key":"k4"},{"type":"echo","submitter":"bob","idempotency_key":"k4"}]}`)
+	if code != http.StatusMultiStatus || len(resp.JobIDs) != 0 || resp.Results[1].Error == "" {
+		t.Fatalf("expected both repeats of a key over quota refused, got %d %+v", code, resp)
+	}
+}
+
+// Test that concurrent submissions can't together go past a quota
+func TestQuotaConcurrentSubmissions(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 10)}
+	putQuota(srv, "alice", `{"max_queued_jobs":3}`)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = postJob(srv, "", `{"type":"echo","submitter":"alice"}`).Code
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 3 {
+		t.Fatalf("expected 3 of the submissions created, got %d (%v)", created, codes)
+	}
+}
+
+// Test that CPU time used this period blocks submissions until the period ends
+func TestQuotaCPUSeconds(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs, wake: make(chan struct{}, 1)}
+	putQuota(srv, "alice", `{"max_cpu_seconds":30,"period_seconds":3600}`)
+
+	job := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice", Requirements: &Requirements{MinCPUCores: 2}})
+	if _, err := jobs.StartAttempt(job.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	jobs.mu.Lock()
+	jobs.jobs[job.ID].Attempts[0].StartedAt = time.Now().UTC().Add(-20 * time.Second)
+	jobs.mu.Unlock()
+
+	// the running attempt counts already
+	w := postJob(srv, "", `{"type":"echo","submitter":"alice"}`)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "CPU-seconds") {
+		t.Fatalf("expected 429 over the CPU quota, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+
+	if _, err := jobs.CompleteAttempt(job.ID, 1); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+	restored, _ := NewJobStoreWithStorage(storage)
+	quotas := restored.Quotas()
+	if len(quotas) != 1 || quotas[0].CPUSeconds < 40 || quotas[0].PeriodEndsAt == nil {
+		t.Fatalf("expected alice's CPU time restored, got %+v", quotas)
+	}
+	if _, err := restored.SubmitAdmitted(JobSpec{Type: "echo", Submitter: "alice"}); err == nil {
+		t.Fatalf("expected the restored store to refuse alice too")
+	}
+}
+
+// Test that dispatch keeps an account within its running-jobs quota
+func TestQuotaDispatch(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("laptop", "", NodeInfo{Mode: NodeModePull, Slots: 3})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+	putQuota(srv, "alice", `{"max_running_jobs":1}`)
+
+	a1 := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice"})
+	a2 := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice"})
+	b1 := jobs.Submit(JobSpec{Type: "echo", Submitter: "bob"})
+	for _, j := range []Job{a1, a2, b1} {
+		srv.enqueue(j)
+	}
+	srv.dispatchPending()
+
+	for id, want := range map[string]JobStatus{a1.ID: JobStatusAssigned, a2.ID: JobStatusQueued, b1.ID: JobStatusAssigned} {
+		if got, _ := jobs.Get(id); got.Status != want {
+			t.Fatalf("expected job %s %s, got %s", id, want, got.Status)
+		}
+	}
+	if got, _ := jobs.Get(a2.ID); !strings.Contains(got.PendingReason, "1 of 1 running jobs") {
+		t.Fatalf("expected the pending reason to name the quota, got %q", got.PendingReason)
+	}
+
+	// raising the quota lets the job through
+	putQuota(srv, "alice", `{"max_running_jobs":2}`)
+	srv.dispatchPending()
+	if got, _ := jobs.Get(a2.ID); got.Status != JobStatusAssigned {
+		t.Fatalf("expected job %s placed, got %s", a2.ID, got.Status)
+	}
+
+	w := httptest.NewRecorder()
+	srv.handleQuotas(w, httptest.NewRequest(http.MethodGet, "/admin/quotas", nil))
+	var quotas []QuotaStatus
+	if err := json.NewDecoder(w.Body).Decode(&quotas); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(quotas) != 1 || quotas[0].Account != "alice" || quotas[0].RunningJobs != 2 || quotas[0].MaxRunningJobs != 2 {
+		t.Fatalf("unexpected quotas %+v", quotas)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleQuotas(w, httptest.NewRequest(http.MethodDelete, "/admin/quotas/alice", nil))
+	if w.Code != http.StatusNoContent || len(jobs.Quotas()) != 0 {
+		t.Fatalf("expected the quota removed, got %d", w.Code)
+	}
+}
+
+// Test that the per-account job counts follow jobs through their statuses
+// and are rebuilt on restore
+func TestQuotaAccountCounts(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+
+	a := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice", Group: "lab"})
+	b := jobs.Submit(JobSpec{Type: "echo", Submitter: "alice"})
+	jobs.Submit(JobSpec{Type: "echo", Submitter: "bob", Fanout: &FanoutSpec{Items: []string{"x", "y"}}})
+	jobs.StartAttempt(a.ID, "node-1", "")
+	jobs.StartAttempt(b.ID, "node-1", "")
+	jobs.CompleteAttempt(b.ID, 1)
+
+	want := map[string][2]int{"alice": {0, 1}, "lab": {0, 1}, "bob": {2, 0}}
+	check := func(store *JobStore) {
+		t.Helper()
+		store.mu.Lock()
+		defer store.mu.Unlock()
+
+		got := make(map[string][2]int)
+		for account, c := range store.accounts {
+			got[account] = [2]int{c.queued, len(c.active)}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected queued and running jobs %v, got %v", want, got)
+		}
+	}
+	check(jobs)
+	restored, _ := NewJobStoreWithStorage(storage)
+	check(restored)
+}
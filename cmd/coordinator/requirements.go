@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Capabilities is what an agent reports about its machine.
+// Memory and disk are in megabytes; 0 means the agent could not measure them.
+type Capabilities struct {
+	CPUCores      int               `json:"cpu_cores"`
+	MemoryTotalMB int64             `json:"memory_total_mb"`
+	MemoryFreeMB  int64             `json:"memory_free_mb"`
+	DiskFreeMB    int64             `json:"disk_free_mb"`
+	OS            string            `json:"os,omitempty"`
+	Arch          string            `json:"arch,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// Requirements are the resources and labels a job needs from its node.
+// Zero values mean "no requirement"; every listed label must match exactly.
+type Requirements struct {
+	MinCPUCores int               `json:"min_cpu_cores,omitempty"`
+	MinMemoryMB int64             `json:"min_memory_mb,omitempty"`
+	MinDiskMB   int64             `json:"min_disk_mb,omitempty"`
+	OS          string            `json:"os,omitempty"`
+	Arch        string            `json:"arch,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// Validate rejects requirements that can never make sense.
+func (r Requirements) Validate() error {
+	if r.MinCPUCores < 0 || r.MinMemoryMB < 0 || r.MinDiskMB < 0 {
+		return errors.New("requirements must not be negative")
+	}
+	for k := range r.Labels {
+		if k == "" {
+			return errors.New("requirement labels must have a key")
+		}
+	}
+	return nil
+}
+
+// Unmet lists the requirements c does not satisfy right now, using the
+// node's free memory. It returns nil when c satisfies r.
+func (r Requirements) Unmet(c Capabilities) []string {
+	return r.unmet(c, c.MemoryFreeMB)
+}
+
+// UnmetEver lists the requirements c could not satisfy even when idle,
+// using the node's total memory.
+func (r Requirements) UnmetEver(c Capabilities) []string {
+	return r.unmet(c, c.MemoryTotalMB)
+}
+
+func (r Requirements) unmet(c Capabilities, memoryMB int64) []string {
+	var out []string
+	if r.MinCPUCores > 0 && c.CPUCores < r.MinCPUCores {
+		out = append(out, fmt.Sprintf("cpu_cores %d < %d", c.CPUCores, r.MinCPUCores))
+	}
+	if r.MinMemoryMB > 0 && memoryMB < r.MinMemoryMB {
+		out = append(out, fmt.Sprintf("memory_mb %d < %d", memoryMB, r.MinMemoryMB))
+	}
+	if r.MinDiskMB > 0 && c.DiskFreeMB < r.MinDiskMB {
+		out = append(out, fmt.Sprintf("disk_mb %d < %d", c.DiskFreeMB, r.MinDiskMB))
+	}
+	if r.OS != "" && c.OS != r.OS {
+		out = append(out, fmt.Sprintf("os %q != %q", c.OS, r.OS))
+	}
+	if r.Arch != "" && c.Arch != r.Arch {
+		out = append(out, fmt.Sprintf("arch %q != %q", c.Arch, r.Arch))
+	}
+
+	keys := make([]string, 0, len(r.Labels))
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch got, ok := c.Labels[k]; {
+		case !ok:
+			out = append(out, fmt.Sprintf("label %s=%s missing", k, r.Labels[k]))
+		case got != r.Labels[k]:
+			out = append(out, fmt.Sprintf("label %s %q != %q", k, got, r.Labels[k]))
+		}
+	}
+	return out
+}
+
+// unschedulableReason explains why no registered node, in any state, could
+// ever run job. It returns "" if some node could, or if there are no nodes
+// yet (more may join).
+func unschedulableReason(job Job, nodes []Node) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+
+	var typeOK []Node
+	for _, n := range nodes {
+		if n.Supports(job.Type) {
+			typeOK = append(typeOK, n)
+		}
+	}
+	if len(typeOK) == 0 {
+		return fmt.Sprintf("unschedulable: no registered node supports job type %q", job.Type)
+	}
+	if job.Requirements == nil {
+		return ""
+	}
+
+	sort.Slice(typeOK, func(i, k int) bool { return typeOK[i].ID < typeOK[k].ID })
+
+	var details []string
+	for _, n := range typeOK {
+		unmet := job.Requirements.UnmetEver(n.Capabilities)
+		if len(unmet) == 0 {
+			return ""
+		}
+		details = append(details, fmt.Sprintf("%s: %s", n.ID, strings.Join(unmet, ", ")))
+	}
+	return "unschedulable: no registered node could ever satisfy the requirements (" + strings.Join(details, "; ") + ")"
+}
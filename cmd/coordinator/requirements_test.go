@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequirementsUnmet(t *testing.T) {
+	caps := Capabilities{
+		CPUCores:      8,
+		MemoryTotalMB: 16000,
+		MemoryFreeMB:  2000,
+		DiskFreeMB:    50000,
+		OS:            "linux",
+		Arch:          "amd64",
+		Labels:        map[string]string{"gpu": "nvidia"},
+	}
+
+	ok := Requirements{MinCPUCores: 4, MinMemoryMB: 1000, OS: "linux", Labels: map[string]string{"gpu": "nvidia"}}
+	if unmet := ok.Unmet(caps); unmet != nil {
+		t.Fatalf("expected requirements to be met, got %v", unmet)
+	}
+
+	// needs more memory than is free now, but less than the node's total.
+	bigMem := Requirements{MinMemoryMB: 8000}
+	if unmet := bigMem.Unmet(caps); len(unmet) != 1 {
+		t.Fatalf("expected memory to be unmet now, got %v", unmet)
+	}
+	if unmet := bigMem.UnmetEver(caps); unmet != nil {
+		t.Fatalf("expected memory to be satisfiable when idle, got %v", unmet)
+	}
+
+	bad := Requirements{MinCPUCores: 64, Arch: "arm64", Labels: map[string]string{"gpu": "amd", "zone": "lab"}}
+	want := []string{
+		"cpu_cores 8 < 64",
+		`arch "amd64" != "arm64"`,
+		`label gpu "nvidia" != "amd"`,
+		"label zone=lab missing",
+	}
+	if got := bad.Unmet(caps); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected unmet %v, got %v", want, got)
+	}
+}
+
+func TestSchedulerHonoursRequirements(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo", Requirements: &Requirements{Labels: map[string]string{"gpu": "nvidia"}}}
+	nodes := []Node{
+		{ID: "cpu-only", State: NodeStateHealthy},
+		{ID: "gpu", State: NodeStateHealthy, Capabilities: Capabilities{Labels: map[string]string{"gpu": "nvidia"}}},
+	}
+
+	got, err := (&scoreScheduler{}).Pick(job, nodes)
+	if err != nil || got.ID != "gpu" {
+		t.Fatalf("expected gpu node, got %+v (%v)", got, err)
+	}
+
+	// the only matching node is offline: waiting is reasonable.
+	nodes[1].State = NodeStateOffline
+	_, err = (&scoreScheduler{}).Pick(job, nodes)
+	if err == nil || !strings.Contains(err.Error(), "no healthy node currently meets") {
+		t.Fatalf("expected a requirements reason, got %v", err)
+	}
+}
+
+// Test that submitting a job no registered node could ever run says so
+func TestHandleCreateJobUnschedulable(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("small", ":1", NodeInfo{Capabilities: Capabilities{CPUCores: 2}})
+
+	srv := &server{registry: reg, jobs: NewJobStore()}
+
+	body, _ := json.Marshal(createJobRequest{Type: "echo", Requirements: &Requirements{MinCPUCores: 32}})
+	w := httptest.NewRecorder()
+	srv.handleJobs(w, httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader(body)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", w.Code)
+	}
+
+	var job Job
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatalf("failed to decode job: %v", err)
+	}
+	if job.Status != JobStatusQueued {
+		t.Fatalf("expected job to stay QUEUED, got %s", job.Status)
+	}
+	want := "unschedulable: no registered node could ever satisfy the requirements (small: cpu_cores 2 < 32)"
+	if job.PendingReason != want {
+		t.Fatalf("expected pending reason %q, got %q", want, job.PendingReason)
+	}
+
+	// negative requirements are rejected outright.
+	bad, _ := json.Marshal(createJobRequest{Type: "echo", Requirements: &Requirements{MinMemoryMB: -1}})
+	wBad := httptest.NewRecorder()
+	srv.handleJobs(wBad, httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader(bad)))
+	if wBad.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for negative requirements, got %d", wBad.Code)
+	}
+}
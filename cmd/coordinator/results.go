@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// resultsBucket is the Storage bucket holding the latest result of each job.
+const resultsBucket = "results"
+
+// maxResultOutput caps the stdout and stderr stored for a job. Agents
+// already send only a 64 KiB tail of each stream; this guards against
+// ones that don't, with room to spare so their tails are never cut again.
+const maxResultOutput = 256 << 10
+
+// maxResultBody bounds how much of an /execute response is read.
+const maxResultBody = 1 << 20
+
+// truncationMarker prefixes an output whose beginning was dropped.
+const truncationMarker = "[... %d bytes truncated ...]\n"
+
+// ResourceUsage is what the agent measured of a job's process.
+type ResourceUsage struct {
+	UserCPUMS   int64 `json:"user_cpu_ms"`
+	SystemCPUMS int64 `json:"system_cpu_ms"`
+	MaxRSSKB    int64 `json:"max_rss_kb,omitempty"`
+}
+
+// JobResult is the structured outcome an agent reported for one attempt of a job
+type JobResult struct {
+	JobID    string `json:"job_id"`
+	Attempt  int    `json:"attempt"`
+	NodeID   string `json:"node_id"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+
+	// the last maxResultOutput bytes of each stream, with a marker when cut
+	Stdout          string `json:"stdout,omitempty"`
+	Stderr          string `json:"stderr,omitempty"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+
+	Outputs    map[string]string `json:"outputs,omitempty"`
+	DurationMS int64             `json:"duration_ms"`
+	Usage      *ResourceUsage    `json:"usage,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// newJobResult builds the stored result for attempt n of a job from the agent's response.
+func newJobResult(jobID string, n int, nodeID string, r executeResponse) JobResult {
+	res := JobResult{
+		JobID:           jobID,
+		Attempt:         n,
+		NodeID:          nodeID,
+		Status:          r.Status,
+		ExitCode:        r.ExitCode,
+		StdoutTruncated: r.StdoutTruncated,
+		StderrTruncated: r.StderrTruncated,
+		Outputs:         r.Outputs,
+		DurationMS:      r.DurationMS,
+		Usage:           r.Usage,
+		Error:           r.Error,
+		ReceivedAt:      time.Now().UTC(),
+	}
+
+	var cut bool
+	res.Stdout, cut = truncateTail(r.Stdout, maxResultOutput)
+	res.StdoutTruncated = res.StdoutTruncated || cut
+	res.Stderr, cut = truncateTail(r.Stderr, maxResultOutput)
+	res.StderrTruncated = res.StderrTruncated || cut
+	return res
+}
+
+// truncateTail keeps the last limit bytes of s, prefixed with truncationMarker
+// when anything was dropped, and reports whether it was.
+func truncateTail(s string, limit int) (string, bool) {
+	if len(s) <= limit {
+		return s, false
+	}
+	return fmt.Sprintf(truncationMarker, len(s)-limit) + s[len(s)-limit:], true
+}
+
+// Stores r as the job's result if attempt n is still the job's current,
+// running attempt, and records n as the accepted attempt
+func (s *JobStore) RecordResult(id string, n int, r JobResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return err
+	}
+	j.AcceptedAttempt = n
+	s.persist(j)
+
+	s.results[id] = &r
+	if err := s.storage.Put(resultsBucket, id, r); err != nil {
+		log.Printf("[coordinator] failed to persist result of job %s: %v", id, err)
+	}
+	return nil
+}
+
+// Returns a copy of the latest result recorded for the job
+func (s *JobStore) Result(id string) (JobResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.results[id]
+	if !ok {
+		return JobResult{}, false
+	}
+	return *r, true
+}
+
+// loadResults replays stored results into the store. Callers have exclusive access
+func (s *JobStore) loadResults() error {
+	records, err := s.storage.Load(resultsBucket)
+	if err != nil {
+		return fmt.Errorf("load results: %w", err)
+	}
+	for id, raw := range records {
+		var r JobResult
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return fmt.Errorf("decode result of job %q: %w", id, err)
+		}
+		s.results[id] = &r
+	}
+	return nil
+}
+
+// decodeResult reads an /execute response body, refusing oversized ones.
+func decodeResult(body io.Reader) (executeResponse, error) {
+	var result executeResponse
+	err := json.NewDecoder(io.LimitReader(body, maxResultBody)).Decode(&result)
+	return result, err
+}
+
+// handleGetJob implements GET /jobs/{id}.
+func (s *server) handleGetJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	job, ok := s.jobs.Get(jobID)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Printf("encode job response: %v", err)
+	}
+}
+
+// handleGetResult implements GET /jobs/{id}/result.
+func (s *server) handleGetResult(w http.ResponseWriter, r *http.Request, jobID string) {
+	if _, ok := s.jobs.Get(jobID); !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	result, ok := s.jobs.Result(jobID)
+	if !ok {
+		http.Error(w, "job has no result yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("encode result response: %v", err)
+	}
+}
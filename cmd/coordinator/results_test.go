@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that an agent's result is stored against the job and served over the API
+func TestDispatchStoresResult(t *testing.T) {
+	_, addr := newFakeAgent(t, http.StatusOK, executeResponse{
+		Status:     "ok",
+		Stdout:     "hello\n",
+		Outputs:    map[string]string{"answer": "42"},
+		DurationMS: 12,
+		Usage:      &ResourceUsage{UserCPUMS: 3},
+	})
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", addr, NodeInfo{})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hello")
+	srv.dispatchJob(job.ID)
+
+	w := httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/result", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var got JobResult
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if got.Attempt != 1 || got.NodeID != "node-1" || got.Stdout != "hello\n" || got.Outputs["answer"] != "42" {
+		t.Fatalf("unexpected result: %+v", got)
+	}
+	if got.DurationMS != 12 || got.Usage == nil || got.Usage.UserCPUMS != 3 {
+		t.Fatalf("expected duration and usage to be kept, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil))
+	var gotJob Job
+	if err := json.NewDecoder(w.Body).Decode(&gotJob); err != nil || gotJob.Status != JobStatusCompleted {
+		t.Fatalf("expected GET /jobs/{id} to return the COMPLETED job, got %+v (%v)", gotJob, err)
+	}
+}
+
+func TestGetResultNotFound(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+	job := jobs.Create("echo", "hello")
+
+	for _, path := range []string{"/jobs/" + job.ID + "/result", "/jobs/job-999/result", "/jobs/job-999"} {
+		w := httptest.NewRecorder()
+		srv.handleJob(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, w.Code)
+		}
+	}
+}
+
+// Test that results survive a restart and that a stale attempt can't overwrite them
+func TestResultPersistenceAndStaleAttempts(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	job := jobs.Create("echo", "hi")
+	if _, err := jobs.StartAttempt(job.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	if err := jobs.RecordResult(job.ID, 2, JobResult{Attempt: 2}); err == nil {
+		t.Fatalf("expected result for a non-current attempt to be rejected")
+	}
+	if err := jobs.RecordResult(job.ID, 1, JobResult{Attempt: 1, ExitCode: 7}); err != nil {
+		t.Fatalf("record result: %v", err)
+	}
+
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("restore store: %v", err)
+	}
+	if got, ok := restored.Result(job.ID); !ok || got.ExitCode != 7 {
+		t.Fatalf("expected result to survive a restart, got %+v (%v)", got, ok)
+	}
+}
+
+func TestNewJobResultCapsOutput(t *testing.T) {
+	big := strings.Repeat("x", maxResultOutput+10)
+	got := newJobResult("job-1", 1, "node-1", executeResponse{Stdout: big, Stderr: "err"})
+
+	if !got.StdoutTruncated || !strings.HasPrefix(got.Stdout, "[... 10 bytes truncated ...]\n") {
+		t.Fatalf("expected stdout to be truncated with a marker, got prefix %q", got.Stdout[:40])
+	}
+	if got.StderrTruncated || got.Stderr != "err" {
+		t.Fatalf("expected short stderr untouched, got %q", got.Stderr)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Scheduler chooses a node for a job from a snapshot of NodeRegistry.List().
+// When no node fits it returns an error wrapping errNoNode that says why.
+type Scheduler interface {
+	Name() string
+	Pick(job Job, nodes []Node) (*Node, error)
+}
+
+// Names of the built-in scheduling policies.
+const (
+	SchedulerScore       = "score"
+	SchedulerRoundRobin  = "round-robin"
+	SchedulerRandom      = "random"
+	SchedulerLeastLoaded = "least-loaded"
+	SchedulerBinPacking  = "bin-packing"
+)
+
+// NewScheduler returns the built-in policy called name. weights are only
+// used by the score policy.
+func NewScheduler(name string, weights ScoreWeights) (Scheduler, error) {
+	switch name {
+	case SchedulerScore, "":
+		return &scoreScheduler{weights: weights}, nil
+	case SchedulerRoundRobin:
+		return &roundRobinScheduler{}, nil
+	case SchedulerRandom:
+		return &randomScheduler{rng: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}, nil
+	case SchedulerLeastLoaded:
+		return leastLoadedScheduler{}, nil
+	case SchedulerBinPacking:
+		return binPackingScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler %q", name)
+	}
+}
+
+// schedulerNames lists the built-in policies, in the order they're documented.
+var schedulerNames = []string{SchedulerScore, SchedulerRoundRobin, SchedulerRandom, SchedulerLeastLoaded, SchedulerBinPacking}
+
+// schedulerSet holds one instance of each policy in use, so stateful ones
+// like round-robin keep their state across jobs, and the default policy for
+// jobs that don't ask for one. Admins can change the default at runtime to
+// compare policies. The zero value places jobs with the score policy and
+// zero weights, which ranks nodes by ID.
+type schedulerSet struct {
+	mu       sync.Mutex
+	weights  ScoreWeights
+	policies map[string]Scheduler
+	def      string
+}
+
+// Use makes sched the default policy, and weights those of the score
+// policy when it isn't the default.
+func (ss *schedulerSet) Use(sched Scheduler, weights ScoreWeights) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.policies == nil {
+		ss.policies = make(map[string]Scheduler)
+	}
+	ss.weights = weights
+	ss.policies[sched.Name()] = sched
+	ss.def = sched.Name()
+}
+
+// Get returns the policy called name, creating it on first use; an empty
+// name means the default policy.
+func (ss *schedulerSet) Get(name string) (Scheduler, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if name == "" {
+		name = ss.def
+	}
+	if name == "" {
+		name = SchedulerScore
+	}
+	if sched, ok := ss.policies[name]; ok {
+		return sched, nil
+	}
+	sched, err := NewScheduler(name, ss.weights)
+	if err != nil {
+		return nil, err
+	}
+	if ss.policies == nil {
+		ss.policies = make(map[string]Scheduler)
+	}
+	ss.policies[name] = sched
+	return sched, nil
+}
+
+// Default returns the name of the policy jobs are placed by unless they ask
+// for another.
+func (ss *schedulerSet) Default() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.def == "" {
+		return SchedulerScore
+	}
+	return ss.def
+}
+
+// SetDefault makes the policy called name the default.
+func (ss *schedulerSet) SetDefault(name string) error {
+	if _, err := ss.Get(name); err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.def = name
+	return nil
+}
+
+// schedulerSettings is the body of GET and PUT /admin/scheduler.
+type schedulerSettings struct {
+	Default  string   `json:"default"`
+	Policies []string `json:"policies,omitempty"`
+}
+
+// handleAdminScheduler handles /admin/scheduler:
+//   - GET /admin/scheduler -> the default policy and the available ones
+//   - PUT /admin/scheduler -> change the default policy
+func (s *server) handleAdminScheduler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req schedulerSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := s.schedulers.SetDefault(req.Default); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("default scheduler set to %s", req.Default)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, schedulerSettings{Default: s.schedulers.Default(), Policies: schedulerNames})
+}
+
+// ScoreWeights are the coefficients of the placement score from
+// docs/tech-choices.md:
+//
+//	score = α*RTT + β*Load + γ*Queue + δ*Reliability
+//
+// Lower scores win. RTT is the smoothed round trip in milliseconds, Load is
+// the agent-reported busy fraction, Queue is the node's in-flight job count,
+// and the reliability term is the node's failure ratio (1 - Reliability())
+// so that nodes with a better history score lower.
+type ScoreWeights struct {
+	RTT         float64 `json:"rtt"`
+	Load        float64 `json:"load"`
+	Queue       float64 `json:"queue"`
+	Reliability float64 `json:"reliability"`
+}
+
+// DefaultScoreWeights roughly equates 20ms of RTT, half the agent's slots
+// busy, one queued job, and a 33% failure ratio.
+func DefaultScoreWeights() ScoreWeights {
+	return ScoreWeights{
+		RTT:         0.05,
+		Load:        2,
+		Queue:       1,
+		Reliability: 3,
+	}
+}
+
+// ParseScoreWeights reads weights like "rtt=0.1,load=2,queue=1,reliability=3".
+// Weights that aren't mentioned keep their default value.
+func ParseScoreWeights(s string) (ScoreWeights, error) {
+	w := DefaultScoreWeights()
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return ScoreWeights{}, fmt.Errorf("weight %q is not key=value", part)
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil || f < 0 {
+			return ScoreWeights{}, fmt.Errorf("weight %q must be a non-negative number", part)
+		}
+		switch strings.TrimSpace(key) {
+		case "rtt":
+			w.RTT = f
+		case "load":
+			w.Load = f
+		case "queue":
+			w.Queue = f
+		case "reliability":
+			w.Reliability = f
+		default:
+			return ScoreWeights{}, fmt.Errorf("unknown weight %q", key)
+		}
+	}
+	return w, nil
+}
+
+// Score returns the node's placement score; lower is better.
+func (w ScoreWeights) Score(n Node) float64 {
+	return w.RTT*n.RTTMillis +
+		w.Load*n.Load +
+		w.Queue*float64(n.InFlight) +
+		w.Reliability*(1-n.Reliability())
+}
+
+// candidates splits the nodes that can run job now into preferred ones and
+// fallbacks it already failed on (when the job excludes those), each sorted
+// by ID. If there are none, reason says why.
+func candidates(job Job, nodes []Node) (preferred, fallback []Node, reason string) {
+	var failed map[string]bool
+	if job.Retry.ExcludeFailedNodes {
+		failed = job.FailedNodes()
+	}
+
+	healthy, supported, fits := 0, 0, 0
+	for _, n := range nodes {
+		if n.State != NodeStateHealthy {
+			continue
+		}
+		healthy++
+		if !n.Supports(job.Type) {
+			continue
+		}
+		supported++
+		if job.Requirements != nil && len(job.Requirements.Unmet(n.Capabilities)) > 0 {
+			continue
+		}
+		fits++
+		if !n.HasCapacity() {
+			continue
+		}
+		if failed[n.ID] {
+			fallback = append(fallback, n)
+		} else {
+			preferred = append(preferred, n)
+		}
+	}
+
+	if len(preferred)+len(fallback) == 0 {
+		reason = unschedulableReason(job, nodes)
+		switch {
+		case reason != "":
+		case len(nodes) == 0:
+			reason = "no nodes registered"
+		case healthy == 0:
+			reason = "no healthy nodes"
+		case supported == 0:
+			reason = fmt.Sprintf("no healthy node supports job type %q", job.Type)
+		case fits == 0:
+			reason = "no healthy node currently meets the job's requirements"
+		default:
+			reason = "every eligible node is at capacity"
+		}
+	}
+
+	byID := func(ns []Node) {
+		sort.Slice(ns, func(i, k int) bool { return ns[i].ID < ns[k].ID })
+	}
+	byID(preferred)
+	byID(fallback)
+	return preferred, fallback, reason
+}
+
+// pickWith applies choose to the preferred candidates, falling back to
+// nodes the job already failed on only when no other node qualifies, so a
+// single-node mesh can still retry.
+func pickWith(job Job, nodes []Node, choose func([]Node) *Node) (*Node, error) {
+	preferred, fallback, reason := candidates(job, nodes)
+	if reason != "" {
+		return nil, fmt.Errorf("%w: %s", errNoNode, reason)
+	}
+	if len(preferred) > 0 {
+		return choose(preferred), nil
+	}
+	return choose(fallback), nil
+}
+
+// scoreScheduler picks the node with the lowest ScoreWeights score, ties
+// broken by node ID.
+type scoreScheduler struct {
+	weights ScoreWeights
+}
+
+func (s *scoreScheduler) Name() string { return SchedulerScore }
+
+func (s *scoreScheduler) Pick(job Job, nodes []Node) (*Node, error) {
+	return pickWith(job, nodes, func(ns []Node) *Node {
+		best := 0
+		for i := range ns {
+			if s.weights.Score(ns[i]) < s.weights.Score(ns[best]) {
+				best = i
+			}
+		}
+		return &ns[best]
+	})
+}
+
+// roundRobinScheduler cycles through candidate nodes in ID order, starting
+// after the node it picked last.
+type roundRobinScheduler struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (s *roundRobinScheduler) Name() string { return SchedulerRoundRobin }
+
+func (s *roundRobinScheduler) Pick(job Job, nodes []Node) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := pickWith(job, nodes, func(ns []Node) *Node {
+		for i := range ns {
+			if ns[i].ID > s.last {
+				return &ns[i]
+			}
+		}
+		return &ns[0]
+	})
+	if err == nil {
+		s.last = n.ID
+	}
+	return n, err
+}
+
+// randomScheduler picks uniformly among candidate nodes.
+type randomScheduler struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (s *randomScheduler) Name() string { return SchedulerRandom }
+
+func (s *randomScheduler) Pick(job Job, nodes []Node) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return pickWith(job, nodes, func(ns []Node) *Node {
+		return &ns[s.rng.IntN(len(ns))]
+	})
+}
+
+// leastLoadedScheduler picks the node with the fewest in-flight jobs, then
+// the lowest reported load, then the lowest ID.
+type leastLoadedScheduler struct{}
+
+func (leastLoadedScheduler) Name() string { return SchedulerLeastLoaded }
+
+func (leastLoadedScheduler) Pick(job Job, nodes []Node) (*Node, error) {
+	return pickWith(job, nodes, func(ns []Node) *Node {
+		best := 0
+		for i := range ns {
+			a, b := ns[i], ns[best]
+			if a.InFlight < b.InFlight || (a.InFlight == b.InFlight && a.Load < b.Load) {
+				best = i
+			}
+		}
+		return &ns[best]
+	})
+}
+
+// binPackingScheduler fills the busiest node that still has a free slot, so
+// idle nodes stay idle. Nodes without a slot limit are treated as empty.
+type binPackingScheduler struct{}
+
+func (binPackingScheduler) Name() string { return SchedulerBinPacking }
+
+func (binPackingScheduler) Pick(job Job, nodes []Node) (*Node, error) {
+	return pickWith(job, nodes, func(ns []Node) *Node {
+		best := 0
+		for i := range ns {
+			if fillRatio(ns[i]) > fillRatio(ns[best]) {
+				best = i
+			}
+		}
+		return &ns[best]
+	})
+}
+
+// fillRatio is the fraction of the node's slots in use.
+func fillRatio(n Node) float64 {
+	if n.Slots <= 0 {
+		return 0
+	}
+	return float64(n.InFlight) / float64(n.Slots)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseScoreWeights(t *testing.T) {
+	w, err := ParseScoreWeights("rtt=0.5, queue=4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	def := DefaultScoreWeights()
+	if w.RTT != 0.5 || w.Queue != 4 || w.Load != def.Load || w.Reliability != def.Reliability {
+		t.Fatalf("unexpected weights: %+v", w)
+	}
+
+	for _, bad := range []string{"rtt", "rtt=x", "rtt=-1", "latency=1"} {
+		if _, err := ParseScoreWeights(bad); err == nil {
+			t.Errorf("expected error for %q, got nil", bad)
+		}
+	}
+}
+
+func TestScoreSchedulerPicksLowestScore(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo"}
+	weights := ScoreWeights{RTT: 1, Load: 10, Queue: 5, Reliability: 10}
+
+	nodes := []Node{
+		{ID: "far", State: NodeStateHealthy, RTTMillis: 40},
+		{ID: "busy", State: NodeStateHealthy, RTTMillis: 1, Load: 0.9, InFlight: 3, Slots: 4},
+		{ID: "near", State: NodeStateHealthy, RTTMillis: 2, Successes: 8},
+		{ID: "flaky", State: NodeStateHealthy, RTTMillis: 1, Failures: 8},
+		{ID: "offline", State: NodeStateOffline},
+	}
+
+	got, err := (&scoreScheduler{weights: weights}).Pick(job, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.ID != "near" {
+		t.Fatalf("expected node near, got %+v", got)
+	}
+}
+
+func TestScoreSchedulerDeterministicTies(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo"}
+	nodes := []Node{
+		{ID: "node-c", State: NodeStateHealthy},
+		{ID: "node-a", State: NodeStateHealthy},
+		{ID: "node-b", State: NodeStateHealthy},
+	}
+
+	for i := 0; i < 10; i++ {
+		got, err := (&scoreScheduler{weights: DefaultScoreWeights()}).Pick(job, append([]Node(nil), nodes...))
+		if err != nil || got.ID != "node-a" {
+			t.Fatalf("expected tie broken to node-a, got %+v (%v)", got, err)
+		}
+	}
+}
+
+func TestSchedulerReasons(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo"}
+
+	tests := []struct {
+		name   string
+		nodes  []Node
+		reason string
+	}{
+		{"empty cluster", nil, "no nodes registered"},
+		{"all offline", []Node{{ID: "n", State: NodeStateOffline}}, "no healthy nodes"},
+		{"wrong type", []Node{{ID: "n", State: NodeStateHealthy, JobTypes: []string{"shell"}}}, `unschedulable: no registered node supports job type "echo"`},
+		{"only offline node has type", []Node{
+			{ID: "n1", State: NodeStateHealthy, JobTypes: []string{"shell"}},
+			{ID: "n2", State: NodeStateOffline, JobTypes: []string{"echo"}},
+		}, `no healthy node supports job type "echo"`},
+		{"full", []Node{{ID: "n", State: NodeStateHealthy, Slots: 2, InFlight: 2}}, "every eligible node is at capacity"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&scoreScheduler{}).Pick(job, tt.nodes)
+			if got != nil {
+				t.Fatalf("expected no node, got %+v", got)
+			}
+			if !errors.Is(err, errNoNode) || !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("expected errNoNode with reason %q, got %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	if _, err := NewScheduler("fastest", DefaultScoreWeights()); err == nil {
+		t.Fatalf("expected error for unknown scheduler, got nil")
+	}
+	for _, name := range []string{SchedulerScore, SchedulerRoundRobin, SchedulerRandom, SchedulerLeastLoaded, SchedulerBinPacking} {
+		s, err := NewScheduler(name, DefaultScoreWeights())
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+		if s.Name() != name {
+			t.Fatalf("expected name %s, got %s", name, s.Name())
+		}
+	}
+}
+
+func TestRoundRobinScheduler(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo"}
+	nodes := []Node{
+		{ID: "node-b", State: NodeStateHealthy},
+		{ID: "node-a", State: NodeStateHealthy},
+		{ID: "node-c", State: NodeStateHealthy},
+	}
+
+	s := &roundRobinScheduler{}
+	var got []string
+	for i := 0; i < 4; i++ {
+		n, err := s.Pick(job, append([]Node(nil), nodes...))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, n.ID)
+	}
+
+	want := "node-a,node-b,node-c,node-a"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("expected order %s, got %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestLoadBasedSchedulers(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo"}
+	nodes := []Node{
+		{ID: "empty", State: NodeStateHealthy, Slots: 4},
+		{ID: "half", State: NodeStateHealthy, Slots: 4, InFlight: 2},
+		{ID: "almost", State: NodeStateHealthy, Slots: 4, InFlight: 3},
+		{ID: "full", State: NodeStateHealthy, Slots: 4, InFlight: 4},
+	}
+
+	least, err := leastLoadedScheduler{}.Pick(job, append([]Node(nil), nodes...))
+	if err != nil || least.ID != "empty" {
+		t.Fatalf("expected least-loaded to pick empty, got %+v (%v)", least, err)
+	}
+
+	packed, err := binPackingScheduler{}.Pick(job, append([]Node(nil), nodes...))
+	if err != nil || packed.ID != "almost" {
+		t.Fatalf("expected bin-packing to pick almost, got %+v (%v)", packed, err)
+	}
+}
+
+func TestRandomSchedulerPicksCandidate(t *testing.T) {
+	job := Job{ID: "job-1", Type: "echo"}
+	nodes := []Node{
+		{ID: "node-a", State: NodeStateHealthy},
+		{ID: "node-b", State: NodeStateHealthy},
+		{ID: "node-c", State: NodeStateOffline},
+	}
+
+	s := &randomScheduler{rng: rand.New(rand.NewPCG(1, 2))}
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		n, err := s.Pick(job, append([]Node(nil), nodes...))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seen[n.ID] = true
+	}
+
+	if seen["node-c"] {
+		t.Fatalf("random scheduler picked an offline node")
+	}
+	if !seen["node-a"] || !seen["node-b"] {
+		t.Fatalf("expected both healthy nodes to be picked over 50 tries, got %v", seen)
+	}
+}
+
+func TestNodeReliability(t *testing.T) {
+	if r := (Node{}).Reliability(); r != 0.5 {
+		t.Fatalf("expected 0.5 for a new node, got %v", r)
+	}
+	if r := (Node{Successes: 8}).Reliability(); r != 0.9 {
+		t.Fatalf("expected 0.9 after 8 successes, got %v", r)
+	}
+}
+
+// Test that jobs can pick their placement policy, admins can change the
+// default, and each attempt records the policy that placed it
+func TestSchedulerSelection(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("a", "", NodeInfo{Mode: NodeModePull, Slots: 4})
+	reg.Register("b", "", NodeInfo{Mode: NodeModePull, Slots: 4})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	if _, err := (createJobRequest{Type: "echo", Scheduler: "fastest"}).toSpec(); err == nil {
+		t.Fatalf("expected an unknown scheduler refused")
+	}
+
+	place := func(spec JobSpec) Attempt {
+		t.Helper()
+		job := jobs.Submit(spec)
+		placed, _, err := srv.placeJob(job.ID)
+		if err != nil {
+			t.Fatalf("place %s: %v", job.ID, err)
+		}
+		return placed.Attempts[0]
+	}
+	if a := place(JobSpec{Type: "echo"}); a.NodeID != "a" || a.Scheduler != SchedulerScore {
+		t.Fatalf("expected the score policy to pick a, got %+v", a)
+	}
+	if a := place(JobSpec{Type: "echo", Scheduler: SchedulerLeastLoaded}); a.NodeID != "b" || a.Scheduler != SchedulerLeastLoaded {
+		t.Fatalf("expected least-loaded to pick b, got %+v", a)
+	}
+
+	put := func(body string) int {
+		w := httptest.NewRecorder()
+		srv.handleAdminScheduler(w, httptest.NewRequest(http.MethodPut, "/admin/scheduler", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := put(`{"default":"fastest"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown policy, got %d", code)
+	}
+	if code := put(`{"default":"bin-packing"}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if a := place(JobSpec{Type: "echo"}); a.Scheduler != SchedulerBinPacking {
+		t.Fatalf("expected the new default to place the job, got %+v", a)
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// Schedules name IANA time zones; embed the database so they resolve
+	// on hosts without one.
+	_ "time/tzdata"
+)
+
+// schedulesBucket is the Storage bucket holding one record per schedule.
+const schedulesBucket = "schedules"
+
+// ConcurrencyPolicy says what a schedule does when a run comes due while
+// the job from an earlier run hasn't finished.
+type ConcurrencyPolicy string
+
+const (
+	ConcurrencyAllow   ConcurrencyPolicy = "allow"   // start another job alongside it
+	ConcurrencyForbid  ConcurrencyPolicy = "forbid"  // skip the new run
+	ConcurrencyReplace ConcurrencyPolicy = "replace" // cancel the old job and start a new one
+)
+
+// CatchUpPolicy says what a schedule does about runs that came due while
+// the coordinator was down.
+type CatchUpPolicy string
+
+const (
+	CatchUpSkip CatchUpPolicy = "skip" // drop them
+	CatchUpOnce CatchUpPolicy = "once" // run once for all of them
+	CatchUpAll  CatchUpPolicy = "all"  // run each of them, up to maxCatchUpRuns
+)
+
+const (
+	// maxCatchUpRuns bounds the missed runs CatchUpAll starts at once.
+	maxCatchUpRuns = 100
+
+	// maxScheduleRuns is how many recent runs a schedule remembers.
+	maxScheduleRuns = 20
+
+	// maxIntervalSeconds bounds interval_seconds (ten years) so the
+	// interval fits a time.Duration.
+	maxIntervalSeconds = 10 * 365 * 24 * 60 * 60
+)
+
+// missedRunGrace is how late a run may be noticed before it counts as
+// missed rather than just due.
+var missedRunGrace = time.Minute
+
+// Schedule creates a job from its template on a cron expression, every
+// interval, or once at a given time.
+type Schedule struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+
+	// exactly one of these is set
+	Cron            string     `json:"cron,omitempty"`
+	IntervalSeconds int64      `json:"interval_seconds,omitempty"`
+	RunAt           *time.Time `json:"run_at,omitempty"`
+
+	// IANA zone the cron expression is read in; empty means UTC
+	Timezone string `json:"timezone,omitempty"`
+
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrency_policy"`
+	CatchUp           CatchUpPolicy     `json:"catch_up"`
+
+	Job createJobRequest `json:"job"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// NextRunAt is nil once the schedule has nothing left to run
+	NextRunAt *time.Time    `json:"next_run_at,omitempty"`
+	LastRunAt *time.Time    `json:"last_run_at,omitempty"`
+	Runs      []ScheduleRun `json:"runs,omitempty"` // most recent last
+}
+
+// ScheduleRun is one time a schedule came due: the job it created, or why
+// it created none.
+type ScheduleRun struct {
+	ScheduledAt time.Time `json:"scheduled_at"`
+	JobID       string    `json:"job_id,omitempty"`
+	Skipped     string    `json:"skipped,omitempty"`
+}
+
+// createScheduleRequest is the JSON body of POST /schedules.
+type createScheduleRequest struct {
+	Name string `json:"name,omitempty"`
+
+	Cron            string     `json:"cron,omitempty"`
+	IntervalSeconds int64      `json:"interval_seconds,omitempty"`
+	RunAt           *time.Time `json:"run_at,omitempty"`
+	Timezone        string     `json:"timezone,omitempty"`
+
+	// optional; allow and skip by default
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrency_policy,omitempty"`
+	CatchUp           CatchUpPolicy     `json:"catch_up,omitempty"`
+
+	Job createJobRequest `json:"job"`
+}
+
+// toSchedule validates the request and turns it into a Schedule.
+func (req createScheduleRequest) toSchedule() (Schedule, error) {
+	set := 0
+	for _, ok := range []bool{req.Cron != "", req.IntervalSeconds != 0, req.RunAt != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return Schedule{}, errors.New("exactly one of cron, interval_seconds and run_at is required")
+	}
+	if req.Cron != "" {
+		if _, err := parseCron(req.Cron); err != nil {
+			return Schedule{}, err
+		}
+	}
+	if req.IntervalSeconds < 0 {
+		return Schedule{}, errors.New("interval_seconds must be positive")
+	}
+	if req.IntervalSeconds > maxIntervalSeconds {
+		return Schedule{}, fmt.Errorf("interval_seconds must be at most %d (ten years)", maxIntervalSeconds)
+	}
+	if req.RunAt != nil && !req.RunAt.After(time.Now()) {
+		return Schedule{}, errors.New("run_at must be in the future")
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil {
+		return Schedule{}, fmt.Errorf("unknown timezone %q", req.Timezone)
+	}
+
+	sc := Schedule{
+		Name:              req.Name,
+		Cron:              req.Cron,
+		IntervalSeconds:   req.IntervalSeconds,
+		RunAt:             req.RunAt,
+		Timezone:          req.Timezone,
+		ConcurrencyPolicy: req.ConcurrencyPolicy,
+		CatchUp:           req.CatchUp,
+		Job:               req.Job,
+	}
+	switch sc.ConcurrencyPolicy {
+	case "":
+		sc.ConcurrencyPolicy = ConcurrencyAllow
+	case ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace:
+	default:
+		return Schedule{}, fmt.Errorf("unknown concurrency_policy %q", sc.ConcurrencyPolicy)
+	}
+	switch sc.CatchUp {
+	case "":
+		sc.CatchUp = CatchUpSkip
+	case CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return Schedule{}, fmt.Errorf("unknown catch_up %q", sc.CatchUp)
+	}
+
+	// A fixed deadline would pass after the first run.
+	if req.Job.Deadline != nil {
+		return Schedule{}, errors.New("scheduled jobs can't have a deadline; use max_runtime_seconds")
+	}
+	if _, err := req.Job.toSpec(); err != nil {
+		return Schedule{}, fmt.Errorf("job: %w", err)
+	}
+	return sc, nil
+}
+
+// clock returns a function giving the schedule's first run time after t,
+// and false when there is none.
+func (sc Schedule) clock() func(t time.Time) (time.Time, bool) {
+	switch {
+	case sc.RunAt != nil:
+		at := *sc.RunAt
+		return func(t time.Time) (time.Time, bool) {
+			return at, at.After(t)
+		}
+	case sc.IntervalSeconds > 0:
+		every := sc.interval()
+		return func(t time.Time) (time.Time, bool) {
+			if t.Before(sc.CreatedAt) {
+				return sc.CreatedAt.Add(every), true
+			}
+			return sc.CreatedAt.Add((t.Sub(sc.CreatedAt)/every + 1) * every), true
+		}
+	default:
+		cron, err := parseCron(sc.Cron)
+		loc, locErr := time.LoadLocation(sc.Timezone)
+		if err != nil || locErr != nil {
+			return func(time.Time) (time.Time, bool) { return time.Time{}, false }
+		}
+		return func(t time.Time) (time.Time, bool) {
+			next, ok := cron.next(t, loc)
+			return next.UTC(), ok
+		}
+	}
+}
+
+// interval returns the time between an interval schedule's runs, and 0
+// for other schedules.
+func (sc Schedule) interval() time.Duration {
+	if sc.IntervalSeconds <= 0 || sc.IntervalSeconds > maxIntervalSeconds {
+		return 0
+	}
+	return time.Duration(sc.IntervalSeconds) * time.Second
+}
+
+// skipMissed counts the runs of an interval schedule from t that came due
+// before cutoff and returns the first of the last keep of them, with how
+// many runs before it were skipped. Other schedules are returned t and 0,
+// to be walked run by run.
+func (sc Schedule) skipMissed(t, cutoff time.Time, keep int) (time.Time, int) {
+	every := sc.interval()
+	late := cutoff.Sub(t)
+	if every <= 0 || late <= 0 {
+		return t, 0
+	}
+	missed := int64((late-1)/every) + 1
+	if missed <= int64(keep) {
+		return t, 0
+	}
+	skip := missed - int64(keep)
+	return t.Add(time.Duration(skip) * every), int(skip)
+}
+
+// ScheduleStore is a concurrency-safe schedule registry written through to
+// a Storage, like JobStore.
+type ScheduleStore struct {
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+	nextID    uint64
+	storage   Storage
+}
+
+// NewScheduleStore creates an empty schedule store backed by in-memory storage.
+func NewScheduleStore() *ScheduleStore {
+	return &ScheduleStore{
+		schedules: make(map[string]*Schedule),
+		storage:   NewMemoryStorage(),
+	}
+}
+
+// NewScheduleStoreWithStorage creates a schedule store and replays the
+// schedules already in storage. Runs missed while they were stored are
+// found by the next call to Due.
+func NewScheduleStoreWithStorage(storage Storage) (*ScheduleStore, error) {
+	records, err := storage.Load(schedulesBucket)
+	if err != nil {
+		return nil, fmt.Errorf("load schedules: %w", err)
+	}
+
+	s := &ScheduleStore{
+		schedules: make(map[string]*Schedule, len(records)),
+		storage:   storage,
+	}
+	for id, raw := range records {
+		var sc Schedule
+		if err := json.Unmarshal(raw, &sc); err != nil {
+			return nil, fmt.Errorf("decode schedule %q: %w", id, err)
+		}
+		s.schedules[id] = &sc
+
+		var n uint64
+		if _, err := fmt.Sscanf(id, "sched-%d", &n); err == nil && n > s.nextID {
+			s.nextID = n
+		}
+	}
+	return s, nil
+}
+
+// persist writes sc through to storage. Callers hold s.mu.
+func (s *ScheduleStore) persist(sc *Schedule) {
+	if err := s.storage.Put(schedulesBucket, sc.ID, sc); err != nil {
+		log.Printf("[coordinator] failed to persist schedule %s: %v", sc.ID, err)
+	}
+}
+
+// Add stores a validated schedule under a new ID with its first run time.
+func (s *ScheduleStore) Add(sc Schedule) Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	sc.ID = fmt.Sprintf("sched-%d", s.nextID)
+	sc.CreatedAt = time.Now().UTC()
+	sc.NextRunAt, sc.LastRunAt, sc.Runs = nil, nil, nil
+	if next, ok := sc.clock()(sc.CreatedAt); ok {
+		sc.NextRunAt = &next
+	}
+
+	stored := sc
+	s.schedules[sc.ID] = &stored
+	s.persist(&stored)
+	return sc
+}
+
+// Get returns a copy of the schedule.
+func (s *ScheduleStore) Get(id string) (Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	return sc.copy(), true
+}
+
+// List returns every schedule, oldest first.
+func (s *ScheduleStore) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		out = append(out, sc.copy())
+	}
+	sort.Slice(out, func(i, k int) bool {
+		if !out[i].CreatedAt.Equal(out[k].CreatedAt) {
+			return out[i].CreatedAt.Before(out[k].CreatedAt)
+		}
+		return out[i].ID < out[k].ID
+	})
+	return out
+}
+
+// Delete removes a schedule; jobs it already created are left alone.
+func (s *ScheduleStore) Delete(id string) (Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	delete(s.schedules, id)
+	if err := s.storage.Delete(schedulesBucket, id); err != nil {
+		log.Printf("[coordinator] failed to delete schedule %s: %v", id, err)
+	}
+	return sc.copy(), true
+}
+
+// dueRuns is a schedule with the run times that came due, and how many
+// missed runs its catch-up policy dropped.
+type dueRuns struct {
+	ScheduleID string
+	Times      []time.Time
+	Dropped    int
+}
+
+// Due advances every schedule past now and returns the run times that came
+// due, oldest first. Runs more than missedRunGrace old were missed (the
+// coordinator was down) and are kept or dropped by the schedule's catch-up policy.
+func (s *ScheduleStore) Due(now time.Time) []dueRuns {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []dueRuns
+	for _, sc := range s.schedules {
+		if sc.NextRunAt == nil || sc.NextRunAt.After(now) {
+			continue
+		}
+
+		var missed, onTime []time.Time
+		next := sc.clock()
+		t, missedCount := sc.skipMissed(*sc.NextRunAt, now.Add(-missedRunGrace), maxCatchUpRuns)
+		ok := true
+		for ; ok && !t.After(now); t, ok = next(t) {
+			if now.Sub(t) <= missedRunGrace {
+				onTime = append(onTime, t)
+				continue
+			}
+			missedCount++
+			missed = append(missed, t)
+			if len(missed) > maxCatchUpRuns {
+				missed = missed[1:]
+			}
+		}
+		sc.NextRunAt = nil
+		if ok {
+			sc.NextRunAt = &t
+		}
+		s.persist(sc)
+
+		switch {
+		case sc.CatchUp == CatchUpSkip:
+			missed = nil
+		case sc.CatchUp == CatchUpOnce && len(missed) > 0:
+			missed = missed[len(missed)-1:]
+		}
+		due := dueRuns{ScheduleID: sc.ID, Times: append(missed, onTime...), Dropped: missedCount - len(missed)}
+		if len(due.Times) > 0 || due.Dropped > 0 {
+			out = append(out, due)
+		}
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].ScheduleID < out[k].ScheduleID })
+	return out
+}
+
+// Record appends a run to the schedule's recent runs.
+func (s *ScheduleStore) Record(id string, run ScheduleRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return
+	}
+	sc.Runs = append(sc.Runs, run)
+	if len(sc.Runs) > maxScheduleRuns {
+		sc.Runs = append([]ScheduleRun(nil), sc.Runs[len(sc.Runs)-maxScheduleRuns:]...)
+	}
+	if run.JobID != "" {
+		at := run.ScheduledAt
+		sc.LastRunAt = &at
+	}
+	s.persist(sc)
+}
+
+// copy returns sc with its slices and pointers detached from the store's.
+func (sc *Schedule) copy() Schedule {
+	out := *sc
+	out.Runs = append([]ScheduleRun(nil), sc.Runs...)
+	if sc.NextRunAt != nil {
+		t := *sc.NextRunAt
+		out.NextRunAt = &t
+	}
+	if sc.LastRunAt != nil {
+		t := *sc.LastRunAt
+		out.LastRunAt = &t
+	}
+	return out
+}
+
+// runSchedules starts the jobs of schedules as they come due, checking
+// every interval until stop is closed. Runs missed while the coordinator
+// was down are handled on the first check.
+func (s *server) runSchedules(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.fireSchedules(time.Now().UTC())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fireSchedules starts a job for every schedule run due by now.
+func (s *server) fireSchedules(now time.Time) {
+	for _, due := range s.schedules.Due(now) {
+		if due.Dropped > 0 {
+			reason := fmt.Sprintf("missed %d runs while the coordinator was down", due.Dropped)
+			log.Printf("[coordinator] schedule %s %s", due.ScheduleID, reason)
+			s.schedules.Record(due.ScheduleID, ScheduleRun{ScheduledAt: now, Skipped: reason})
+		}
+		for _, at := range due.Times {
+			s.fireSchedule(due.ScheduleID, at)
+		}
+	}
+}
+
+// fireSchedule creates the job for one run of a schedule, applying its
+// concurrency policy to jobs from earlier runs still unfinished.
+func (s *server) fireSchedule(id string, at time.Time) {
+	sc, ok := s.schedules.Get(id)
+	if !ok {
+		return
+	}
+
+	var active []Job
+	for _, run := range sc.Runs {
+		if j, ok := s.jobs.Get(run.JobID); ok && !j.Finished() {
+			active = append(active, j)
+		}
+	}
+	if len(active) > 0 {
+		switch sc.ConcurrencyPolicy {
+		case ConcurrencyForbid:
+			reason := fmt.Sprintf("job %s from an earlier run is still %s", active[0].ID, active[0].Status)
+			log.Printf("[coordinator] schedule %s skipped its %s run: %s", id, at.Format(time.RFC3339), reason)
+			s.schedules.Record(id, ScheduleRun{ScheduledAt: at, Skipped: reason})
+			return
+		case ConcurrencyReplace:
+			for _, j := range active {
+				if _, err := s.cancelJob(j.ID, fmt.Sprintf("replaced by the %s run of schedule %s", at.Format(time.RFC3339), id)); err != nil {
+					log.Printf("[coordinator] schedule %s failed to replace job %s: %v", id, j.ID, err)
+				}
+			}
+		}
+	}
+
+	spec, err := sc.Job.toSpec()
+	var job Job
+	if err == nil {
+		job, err = s.jobs.SubmitAdmitted(spec)
+	}
+	if err != nil {
+		log.Printf("[coordinator] schedule %s skipped its %s run: %v", id, at.Format(time.RFC3339), err)
+		s.schedules.Record(id, ScheduleRun{ScheduledAt: at, Skipped: err.Error()})
+		return
+	}
+	s.schedules.Record(id, ScheduleRun{ScheduledAt: at, JobID: job.ID})
+	log.Printf("[coordinator] schedule %s created job %s for its %s run", id, job.ID, at.Format(time.RFC3339))
+	s.enqueueJob(job)
+}
+
+// handleSchedules handles /schedules:
+//   - GET /schedules -> list schedules
+//   - POST /schedules -> create a schedule
+func (s *server) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.schedules.List())
+	case http.MethodPost:
+		var req createScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		s.identify(r, &req.Job)
+		sc, err := req.toSchedule()
+		if err == nil {
+			err = s.checkPriorityClass(JobSpec{PriorityClass: req.Job.PriorityClass})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sc = s.schedules.Add(sc)
+		log.Printf("[coordinator] schedule %s created", sc.ID)
+		writeJSON(w, http.StatusCreated, sc)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSchedule handles /schedules/{id}:
+//   - GET -> the schedule, its next run and its recent runs
+//   - DELETE -> stop it; jobs it created keep running
+func (s *server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules/"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		sc Schedule
+		ok bool
+	)
+	switch r.Method {
+	case http.MethodGet:
+		sc, ok = s.schedules.Get(id)
+	case http.MethodDelete:
+		if sc, ok = s.schedules.Delete(id); ok {
+			log.Printf("[coordinator] schedule %s deleted", id)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ok {
+		http.Error(w, "schedule not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, sc)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleRequestValidation(t *testing.T) {
+	job := createJobRequest{Type: "echo"}
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	bad := map[string]createScheduleRequest{
+		"no timing":   {Job: job},
+		"two timings": {Cron: "* * * * *", IntervalSeconds: 60, Job: job},
+		"bad cron":    {Cron: "* * *", Job: job},
+		"negative":    {IntervalSeconds: -1, Job: job},
+		"too long":    {IntervalSeconds: 1 << 40, Job: job},
+		"past run_at": {RunAt: &past, Job: job},
+		"timezone":    {Cron: "@daily", Timezone: "Mars/Olympus", Job: job},
+		"concurrency": {IntervalSeconds: 60, ConcurrencyPolicy: "sometimes", Job: job},
+		"catch up":    {IntervalSeconds: 60, CatchUp: "later", Job: job},
+		"no job type": {IntervalSeconds: 60},
+		"deadline":    {IntervalSeconds: 60, Job: createJobRequest{Type: "echo", Deadline: &future}},
+	}
+	for name, req := range bad {
+		if _, err := req.toSchedule(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	sc, err := createScheduleRequest{Cron: "@daily", Timezone: "Europe/Berlin", Job: job}.toSchedule()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sc.ConcurrencyPolicy != ConcurrencyAllow || sc.CatchUp != CatchUpSkip {
+		t.Fatalf("expected allow/skip defaults, got %s/%s", sc.ConcurrencyPolicy, sc.CatchUp)
+	}
+}
+
+// newScheduleServer returns a server with no nodes and one interval
+// schedule using the given policies.
+func newScheduleServer(t *testing.T, concurrency ConcurrencyPolicy) (*server, Schedule) {
+	t.Helper()
+
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), schedules: NewScheduleStore(), wake: make(chan struct{}, 1)}
+	sc, err := createScheduleRequest{IntervalSeconds: 60, ConcurrencyPolicy: concurrency, Job: createJobRequest{Type: "echo", Payload: "tick"}}.toSchedule()
+	if err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	return srv, srv.schedules.Add(sc)
+}
+
+// runs returns the schedule's recent runs.
+func runs(t *testing.T, srv *server, id string) []ScheduleRun {
+	t.Helper()
+
+	sc, ok := srv.schedules.Get(id)
+	if !ok {
+		t.Fatalf("schedule %s not found", id)
+	}
+	return sc.Runs
+}
+
+// Test that each concurrency policy treats a job still running from the previous run
+func TestScheduleConcurrencyPolicies(t *testing.T) {
+	for _, policy := range []ConcurrencyPolicy{ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace} {
+		srv, sc := newScheduleServer(t, policy)
+		first := sc.CreatedAt.Add(time.Minute)
+		if !sc.NextRunAt.Equal(first) {
+			t.Fatalf("%s: expected first run at %s, got %s", policy, first, sc.NextRunAt)
+		}
+
+		srv.fireSchedules(first.Add(-time.Second))
+		if len(runs(t, srv, sc.ID)) != 0 {
+			t.Fatalf("%s: schedule fired early", policy)
+		}
+		srv.fireSchedules(first)
+		srv.fireSchedules(first.Add(time.Minute))
+
+		got := runs(t, srv, sc.ID)
+		if len(got) != 2 || got[0].JobID == "" || !got[1].ScheduledAt.Equal(first.Add(time.Minute)) {
+			t.Fatalf("%s: unexpected runs %+v", policy, got)
+		}
+		old, _ := srv.jobs.Get(got[0].JobID)
+		switch policy {
+		case ConcurrencyAllow:
+			if got[1].JobID == "" || old.Status != JobStatusQueued {
+				t.Errorf("allow: expected both jobs queued, got %+v and %s", got[1], old.Status)
+			}
+		case ConcurrencyForbid:
+			if got[1].JobID != "" || !strings.Contains(got[1].Skipped, old.ID) {
+				t.Errorf("forbid: expected the second run skipped, got %+v", got[1])
+			}
+		case ConcurrencyReplace:
+			if got[1].JobID == "" || old.Status != JobStatusCancelled {
+				t.Errorf("replace: expected the old job cancelled, got %+v and %s", got[1], old.Status)
+			}
+		}
+		if q := srv.pending.Snapshot(); policy != ConcurrencyAllow && len(q) != 1 {
+			t.Errorf("%s: expected one job queued, got %v", policy, q)
+		}
+	}
+}
+
+// Test that runs missed while the coordinator was down follow the catch-up policy
+func TestScheduleCatchUp(t *testing.T) {
+	defer func(old time.Duration) { missedRunGrace = old }(missedRunGrace)
+	missedRunGrace = 10 * time.Second
+
+	for policy, want := range map[CatchUpPolicy]int{CatchUpSkip: 0, CatchUpOnce: 1, CatchUpAll: 10} {
+		storage := NewMemoryStorage()
+		schedules, _ := NewScheduleStoreWithStorage(storage)
+		sc, err := createScheduleRequest{IntervalSeconds: 60, CatchUp: policy, Job: createJobRequest{Type: "echo"}}.toSchedule()
+		if err != nil {
+			t.Fatalf("schedule: %v", err)
+		}
+		sc = schedules.Add(sc)
+
+		// the coordinator restarts ten and a half minutes later
+		restored, err := NewScheduleStoreWithStorage(storage)
+		if err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), schedules: restored, wake: make(chan struct{}, 1)}
+		now := sc.CreatedAt.Add(10*time.Minute + 30*time.Second)
+		srv.fireSchedules(now)
+
+		if got := len(srv.jobs.List()); got != want {
+			t.Errorf("%s: expected %d jobs, got %d", policy, want, got)
+		}
+		after, _ := restored.Get(sc.ID)
+		if !after.NextRunAt.Equal(sc.CreatedAt.Add(11 * time.Minute)) {
+			t.Errorf("%s: expected the next run at minute 11, got %s", policy, after.NextRunAt)
+		}
+		if policy == CatchUpSkip && (len(after.Runs) != 1 || !strings.Contains(after.Runs[0].Skipped, "missed 10 runs")) {
+			t.Errorf("skip: expected the missed runs recorded, got %+v", after.Runs)
+		}
+	}
+}
+
+// Test that a long outage under a short interval is caught up without
+// walking every missed run
+func TestScheduleCatchUpLongOutage(t *testing.T) {
+	schedules := NewScheduleStore()
+	sc, err := createScheduleRequest{IntervalSeconds: 1, CatchUp: CatchUpAll, Job: createJobRequest{Type: "echo"}}.toSchedule()
+	if err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	sc = schedules.Add(sc)
+
+	now := sc.CreatedAt.Add(5 * 365 * 24 * time.Hour)
+	due := schedules.Due(now)
+	onTime := int(missedRunGrace/time.Second) + 1
+	if len(due) != 1 {
+		t.Fatalf("expected one schedule due, got %d", len(due))
+	}
+	if len(due[0].Times) != maxCatchUpRuns+onTime {
+		t.Fatalf("expected the last %d missed runs and %d on time, got %d", maxCatchUpRuns, onTime, len(due[0].Times))
+	}
+	missed := int(now.Add(-missedRunGrace).Sub(sc.CreatedAt)/time.Second) - 1
+	if due[0].Dropped != missed-maxCatchUpRuns {
+		t.Fatalf("expected %d dropped runs, got %d", missed-maxCatchUpRuns, due[0].Dropped)
+	}
+	after, _ := schedules.Get(sc.ID)
+	if !after.NextRunAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected the next run a second from now, got %s", after.NextRunAt)
+	}
+}
+
+// Test that a one-off schedule runs once and then has nothing left to run
+func TestScheduleRunAt(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), schedules: NewScheduleStore(), wake: make(chan struct{}, 1)}
+	w := httptest.NewRecorder()
+	at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body := `{"run_at":"` + at.Format(time.RFC3339) + `","job":{"type":"echo"}}`
+	srv.handleSchedules(w, httptest.NewRequest(http.MethodPost, "/schedules", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	srv.fireSchedules(at)
+	srv.fireSchedules(at.Add(time.Hour))
+	sc, _ := srv.schedules.Get("sched-1")
+	if len(sc.Runs) != 1 || sc.NextRunAt != nil {
+		t.Fatalf("expected one run and nothing next, got %+v", sc)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleSchedule(w, httptest.NewRequest(http.MethodDelete, "/schedules/sched-1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	srv.handleSchedule(w, httptest.NewRequest(http.MethodGet, "/schedules/sched-1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", w.Code)
+	}
+}
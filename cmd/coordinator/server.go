@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // server holds dependencies for HTTP handlers.
@@ -13,23 +18,113 @@ type server struct {
 	registry   *NodeRegistry
 	jobs       *JobStore
 	httpClient *http.Client
+
+	// pending holds QUEUED jobs; wake signals the dispatch loop to look at it.
+	pending pendingQueue
+	wake    chan struct{}
+
+	// schedulers place jobs on nodes, by the job's own policy or the default one.
+	schedulers schedulerSet
+
+	// defaultTimeout bounds attempts of jobs that set no max runtime or
+	// deadline of their own; zero means they may run forever.
+	defaultTimeout time.Duration
+
+	// logs holds recent output streamed by agents for GET /jobs/{id}/logs.
+	logs logStore
+
+	// pulls holds jobs placed on pull nodes until they fetch them.
+	pulls mailboxes
+
+	// schedules create jobs on a timetable; see runSchedules.
+	schedules *ScheduleStore
+
+	// identity names the headers an authenticating proxy sets to say who
+	// is submitting; see identify.
+	identity identityHeaders
 }
 
 // registerRequest is the JSON payload agents send to /register.
 type registerRequest struct {
-	ID      string `json:"id"`
-	Address string `json:"address"`
+	ID       string   `json:"id"`
+	Address  string   `json:"address"`
+	Mode     NodeMode `json:"mode,omitempty"`
+	JobTypes []string `json:"job_types,omitempty"`
+
+	Capabilities Capabilities `json:"capabilities"`
+
+	Slots   int     `json:"slots"`
+	Running int     `json:"running"`
+	Load    float64 `json:"load"`
+
+	// leases of the attempts running on the node, renewed by this heartbeat
+	Leases []leaseRef `json:"leases,omitempty"`
 }
 
 type createJobRequest struct {
 	Type    string `json:"type"`
 	Payload string `json:"payload"`
+
+	// optional resources and labels the job's node must have
+	Requirements *Requirements `json:"requirements,omitempty"`
+
+	// optional; DefaultRetryPolicy applies when omitted
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// optional limits: per attempt, and an absolute time by which the job must finish
+	MaxRuntimeSeconds int64      `json:"max_runtime_seconds,omitempty"`
+	Deadline          *time.Time `json:"deadline,omitempty"`
+
+	// optional; splits the job into tasks whose results are aggregated
+	Fanout *FanoutSpec `json:"fanout,omitempty"`
+
+	// optional; the default priority class applies when omitted
+	PriorityClass string `json:"priority_class,omitempty"`
+
+	// optional; who the job is for, used to share the mesh fairly
+	Submitter string `json:"submitter,omitempty"`
+	Group     string `json:"group,omitempty"`
+
+	// optional; the placement policy, instead of the default one
+	Scheduler string `json:"scheduler,omitempty"`
+
+	// optional; same as the Idempotency-Key header
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 type executeRequest struct {
 	JobID   string `json:"job_id"`
 	Type    string `json:"type"`
 	Payload string `json:"payload"`
+
+	// how long the agent lets the job run before killing it; zero means no limit
+	TimeoutMS int64 `json:"timeout_ms,omitempty"`
+
+	// echoed back by the agent on the logs and status reports it sends
+	Attempt int `json:"attempt,omitempty"`
+
+	// fencing token of the attempt's lease, renewed by the agent's heartbeats
+	LeaseToken uint64 `json:"lease_token,omitempty"`
+
+	// ask the agent to answer 202 and report the outcome to /tasks/{id}/status
+	Async bool `json:"async,omitempty"`
+}
+
+// executeResponse mirrors what the agent's /execute returns.
+type executeResponse struct {
+	JobID    string `json:"job_id"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	StdoutTruncated bool `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool `json:"stderr_truncated,omitempty"`
+
+	Outputs    map[string]string `json:"outputs,omitempty"`
+	DurationMS int64             `json:"duration_ms"`
+	Usage      *ResourceUsage    `json:"usage,omitempty"`
 }
 
 // healthHandler is a basic health check.
@@ -43,7 +138,8 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleRegister handles POST /register from agents.
-// We treat each call as both registration and heartbeat.
+// We treat each call as both registration and heartbeat; it also renews
+// the leases the agent reports and tells it which ones to give up.
 func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -57,17 +153,40 @@ func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.ID == "" || req.Address == "" {
-		http.Error(w, "id and address are required", http.StatusBadRequest)
+	switch req.Mode {
+	case "", NodeModePush:
+		if req.ID == "" || req.Address == "" {
+			http.Error(w, "id and address are required", http.StatusBadRequest)
+			return
+		}
+	case NodeModePull:
+		// Pull nodes are never called, so they need no address.
+		if req.ID == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", req.Mode), http.StatusBadRequest)
 		return
 	}
 
-	node := s.registry.Register(req.ID, req.Address)
-	log.Printf("[coordinator] node registered/heartbeat: id=%s addr=%s", node.ID, node.Address)
+	node := s.registry.Register(req.ID, req.Address, NodeInfo{
+		Mode:         req.Mode,
+		JobTypes:     req.JobTypes,
+		Capabilities: req.Capabilities,
+		Slots:        req.Slots,
+		Running:      req.Running,
+		Load:         req.Load,
+	})
+	log.Printf("[coordinator] node registered/heartbeat: id=%s addr=%s mode=%s types=%v", node.ID, node.Address, node.Mode, node.JobTypes)
+	revoked := s.renewLeases(node.ID, req.Leases)
+
+	// A new or returning node may be able to take queued jobs.
+	s.kick()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(node); err != nil {
+	if err := json.NewEncoder(w).Encode(registerResponse{Node: node, RevokedLeases: revoked}); err != nil {
 		log.Printf("[coordinator] failed to encode register response: %v", err)
 	}
 }
@@ -79,7 +198,7 @@ func (s *server) handleListNodes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodes := s.registry.List()
+	nodes := s.nodeSnapshot()
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(nodes); err != nil {
@@ -101,6 +220,41 @@ func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleJob is the multiplexer for /jobs/{id}/...:
+//   - GET /jobs/{id} -> the job record
+//   - GET /jobs/{id}/result -> the job's latest result
+//   - GET /jobs/{id}/events -> the job's status changes
+//   - GET /jobs/{id}/logs -> the job's output, optionally followed live
+//   - POST /jobs/{id}/logs -> output streamed by the job's agent
+//   - POST /jobs/{id}/cancel -> cancel the job
+//   - DELETE /jobs/{id} -> cancel the job
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	jobID, action, _ := strings.Cut(rest, "/")
+	if jobID == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		s.handleGetJob(w, r, jobID)
+	case action == "result" && r.Method == http.MethodGet:
+		s.handleGetResult(w, r, jobID)
+	case action == "events" && r.Method == http.MethodGet:
+		s.handleJobEvents(w, r, jobID)
+	case action == "logs":
+		s.handleJobLogs(w, r, jobID)
+	case action == "cancel" && r.Method == http.MethodPost,
+		action == "" && r.Method == http.MethodDelete:
+		s.handleCancelJob(w, r, jobID)
+	case action == "cancel", action == "result", action == "events", action == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
 // handleCreateJob implements POST /jobs.
 func (s *server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 	var req createJobRequest
@@ -108,12 +262,48 @@ func (s *server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if req.Type == "" {
-		http.Error(w, "type is required", http.StatusBadRequest)
+	s.identify(r, &req)
+
+	spec, err := req.toSpec()
+	if err == nil {
+		err = s.checkPriorityClass(spec)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := idempotencyKey(r, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	job := s.jobs.Create(req.Type, req.Payload)
+	// Quotas are checked as the job is added, so concurrent submissions
+	// can't both take the last of the room. A retry of a submission that
+	// went through answers as before, whatever the quota.
+	var job Job
+	if key == "" {
+		job, err = s.jobs.SubmitAdmitted(spec)
+	} else {
+		var replayed bool
+		job, replayed, err = s.jobs.SubmitOnce(key, req.fingerprint(), spec)
+		if errors.Is(err, errIdempotencyConflict) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if replayed {
+			// A retry of a submission that already went through.
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+	}
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+
+	job = s.noteUnschedulable(job, s.registry.List())
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -121,7 +311,68 @@ func (s *server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 		log.Printf("encode job response: %v", err)
 	}
 
-	go s.dispatchJob(job.ID)
+	s.enqueueJob(job)
+}
+
+// noteUnschedulable says up front, in the job's pending reason, if none of
+// nodes could ever run it. It stays QUEUED in case a suitable node joins later.
+func (s *server) noteUnschedulable(job Job, nodes []Node) Job {
+	if reason := unschedulableReason(job, nodes); reason != "" {
+		if updated, err := s.jobs.SetPendingReason(job.ID, reason); err == nil {
+			return updated
+		}
+	}
+	return job
+}
+
+// toSpec validates a create request and turns it into a JobSpec.
+func (req createJobRequest) toSpec() (JobSpec, error) {
+	if req.Type == "" {
+		return JobSpec{}, errors.New("type is required")
+	}
+	if req.Requirements != nil {
+		if err := req.Requirements.Validate(); err != nil {
+			return JobSpec{}, err
+		}
+	}
+	if req.Retry != nil {
+		if err := req.Retry.Validate(); err != nil {
+			return JobSpec{}, err
+		}
+	}
+	if req.MaxRuntimeSeconds < 0 {
+		return JobSpec{}, errors.New("max_runtime_seconds must not be negative")
+	}
+	if req.Deadline != nil && !req.Deadline.After(time.Now()) {
+		return JobSpec{}, errors.New("deadline must be in the future")
+	}
+	if req.Fanout != nil {
+		if err := req.Fanout.Validate(); err != nil {
+			return JobSpec{}, err
+		}
+	}
+	if !validAccountName(req.Submitter) || !validAccountName(req.Group) {
+		return JobSpec{}, fmt.Errorf("submitter and group must be at most %d characters without spaces or '/'", maxAccountNameLen)
+	}
+	if req.Scheduler != "" {
+		if _, err := NewScheduler(req.Scheduler, ScoreWeights{}); err != nil {
+			return JobSpec{}, err
+		}
+	}
+
+	return JobSpec{
+		Type:              req.Type,
+		Payload:           req.Payload,
+		Requirements:      req.Requirements,
+		Retry:             req.Retry,
+		MaxRuntimeSeconds: req.MaxRuntimeSeconds,
+		Deadline:          req.Deadline,
+		Fanout:            req.Fanout,
+		PriorityClass:     req.PriorityClass,
+		Submitter:         req.Submitter,
+		Group:             req.Group,
+		Scheduler:         req.Scheduler,
+	}, nil
 }
 
 // handleListJobs implements GET /jobs.
@@ -134,48 +385,113 @@ func (s *server) handleListJobs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *server) dispatchJob(jobID string) {
+// nodeSnapshot lists the registry's nodes with their in-flight job counts filled in.
+func (s *server) nodeSnapshot() []Node {
 	nodes := s.registry.List()
-
-	var target *Node
+	running := s.jobs.RunningByNode()
 	for i := range nodes {
-		if nodes[i].State == NodeStateHealthy {
-			target = &nodes[i]
-			break
-		}
+		nodes[i].InFlight = running[nodes[i].ID]
 	}
+	return nodes
+}
 
-	if target == nil {
-		log.Printf("no healthy nodes available for job %s; leaving as QUEUED", jobID)
+// dispatchJob places a job and hands it to the chosen node, waiting for
+// a push node to answer. If no node is available the job is left where it is.
+func (s *server) dispatchJob(jobID string) {
+	job, target, err := s.placeJob(jobID)
+	if err != nil {
+		log.Printf("job %s not dispatched: %v; leaving as is", jobID, err)
 		return
 	}
+	if target.Pulls() {
+		s.offerToPuller(job, target)
+		return
+	}
+	s.executeJob(job, target)
+}
+
+// placeJob picks a node for a QUEUED or RETRYING job and starts a new attempt on it.
+// It returns an error wrapping errNoNode when the scheduler finds no node,
+// errBackoff while a retrying job is still waiting out its backoff, and
+// errDeadlinePassed (after failing the job) once its deadline has gone by.
+func (s *server) placeJob(jobID string) (Job, *Node, error) {
+	queued, ok := s.jobs.Get(jobID)
+	if !ok {
+		return Job{}, nil, fmt.Errorf("job %q not found", jobID)
+	}
+	if queued.IsParent() {
+		return Job{}, nil, fmt.Errorf("job %q is split into tasks and is not run itself", jobID)
+	}
+	if queued.Status != JobStatusQueued && queued.Status != JobStatusRetrying {
+		return Job{}, nil, fmt.Errorf("job %q is %s, not waiting to run", jobID, queued.Status)
+	}
+	if queued.deadlinePassed(time.Now()) {
+		expired, err := s.jobs.ExpireDeadline(jobID)
+		if err != nil {
+			return Job{}, nil, fmt.Errorf("expire job: %w", err)
+		}
+		s.settle(expired)
+		log.Printf("job %s timed out: deadline passed while it was waiting for a node", jobID)
+		return Job{}, nil, errDeadlinePassed
+	}
+	if queued.NextAttemptAt != nil && time.Now().Before(*queued.NextAttemptAt) {
+		return Job{}, nil, errBackoff
+	}
 
-	job, err := s.jobs.UpdateStatus(jobID, JobStatusRunning, target.ID)
+	sched, err := s.schedulers.Get(queued.Scheduler)
 	if err != nil {
-		log.Printf("failed to update job %s to RUNNING: %v", jobID, err)
-		return
+		return Job{}, nil, err
 	}
+	target, err := sched.Pick(queued, s.nodeSnapshot())
+	if err != nil {
+		return Job{}, nil, err
+	}
+
+	job, err := s.jobs.StartAttempt(jobID, target.ID, sched.Name())
+	if err != nil {
+		return Job{}, nil, fmt.Errorf("start attempt: %w", err)
+	}
+	s.settle(job)
+	return job, target, nil
+}
+
+// executeJob sends a placed job to its node. Agents that accept it
+// asynchronously (202) report the outcome later to /tasks/{id}/status; for
+// the rest the outcome is the response. Finishing a job frees capacity, so
+// it always wakes the dispatch loop.
+func (s *server) executeJob(job Job, target *Node) {
+	defer s.kick()
+
+	jobID := job.ID
+	attempt := job.CurrentAttempt()
 
 	agentBase := buildAgentBaseURL(target.Address)
 	agentURL := agentBase + "/execute"
 
-	reqBody := executeRequest{
-		JobID:   jobID,
-		Type:    job.Type,
-		Payload: job.Payload,
+	reqBody, timeout, err := s.newExecuteRequest(job)
+	if err != nil {
+		s.recordFailure(jobID, attempt, AttemptTimedOut, err.Error(), false)
+		return
 	}
 
 	bodyBytes, err := json.Marshal(reqBody)
 	if err != nil {
-		log.Printf("failed to marshal execute request for job %s: %v", jobID, err)
-		_, _ = s.jobs.UpdateStatus(jobID, JobStatusFailed, target.ID)
+		s.failAttempt(jobID, attempt, fmt.Sprintf("marshal execute request: %v", err), false)
 		return
 	}
 
-	httpReq, err := http.NewRequest(http.MethodPost, agentURL, bytes.NewReader(bodyBytes))
+	// Give up on an agent that doesn't answer in time rather than pinning
+	// this goroutine forever.
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout+executeGrace)
+		defer cancel()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, agentURL, bytes.NewReader(bodyBytes))
 	if err != nil {
-		log.Printf("failed to create HTTP request for job %s: %v", jobID, err)
-		_, _ = s.jobs.UpdateStatus(jobID, JobStatusFailed, target.ID)
+		s.failAttempt(jobID, attempt, fmt.Sprintf("create execute request: %v", err), false)
 		return
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
@@ -186,22 +502,149 @@ func (s *server) dispatchJob(jobID string) {
 	}
 
 	resp, err := client.Do(httpReq)
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.recordFailure(jobID, attempt, AttemptTimedOut, fmt.Sprintf("no result from node %s within %s", target.ID, timeout+executeGrace), true)
+		return
+	}
 	if err != nil {
-		log.Printf("job %s execution request failed: %v", jobID, err)
-		_, _ = s.jobs.UpdateStatus(jobID, JobStatusFailed, target.ID)
+		s.failAttempt(jobID, attempt, fmt.Sprintf("execute request failed: %v", err), true)
 		return
 	}
 	defer resp.Body.Close()
 
+	// The agent rejects payloads and job types it can't run with 400;
+	// sending the same job again won't help.
+	if resp.StatusCode == http.StatusBadRequest {
+		s.failAttempt(jobID, attempt, fmt.Sprintf("agent rejected job: %s", readErrorBody(resp)), false)
+		return
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		if _, err := s.jobs.MarkRunning(jobID, attempt); err != nil {
+			log.Printf("job %s attempt %d accepted but not marked running: %v", jobID, attempt, err)
+		}
+		s.watchAttempt(jobID, attempt, timeout)
+		return
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("job %s execution failed, status code: %d", jobID, resp.StatusCode)
-		_, _ = s.jobs.UpdateStatus(jobID, JobStatusFailed, target.ID)
+		s.failAttempt(jobID, attempt, fmt.Sprintf("agent returned status %d", resp.StatusCode), true)
 		return
 	}
 
-	if _, err := s.jobs.UpdateStatus(jobID, JobStatusCompleted, target.ID); err != nil {
+	result, err := decodeResult(resp.Body)
+	if err != nil {
+		s.failAttempt(jobID, attempt, fmt.Sprintf("unreadable result: %v", err), true)
+		return
+	}
+	s.applyResult(jobID, attempt, target.ID, result)
+}
+
+// newExecuteRequest builds what the agent is sent for job's current attempt,
+// and returns the attempt's time limit (zero for none). It returns
+// errDeadlinePassed if the job has no time left to run the attempt.
+func (s *server) newExecuteRequest(job Job) (executeRequest, time.Duration, error) {
+	now := time.Now()
+	if job.deadlinePassed(now) {
+		return executeRequest{}, 0, errDeadlinePassed
+	}
+	timeout := job.attemptTimeout(now, s.defaultTimeout)
+	var token uint64
+	if n := job.CurrentAttempt(); n > 0 {
+		token = job.Attempts[n-1].LeaseToken
+	}
+	return executeRequest{
+		JobID:     job.ID,
+		Type:      job.Type,
+		Payload:   job.Payload,
+		TimeoutMS: timeout.Milliseconds(),
+		Attempt:   job.CurrentAttempt(),
+		Async:     true,
+
+		LeaseToken: token,
+	}, timeout, nil
+}
+
+// applyResult records what nodeID reported for an attempt and closes it:
+// COMPLETED on success, otherwise failed and possibly retried. It reports
+// whether the attempt was still current, i.e. the result was used.
+func (s *server) applyResult(jobID string, attempt int, nodeID string, result executeResponse) bool {
+	// Keep what the agent reported, whichever way the attempt went.
+	if err := s.jobs.RecordResult(jobID, attempt, newJobResult(jobID, attempt, nodeID, result)); errors.Is(err, errStaleAttempt) {
+		log.Printf("ignoring result of job %s attempt %d: %v", jobID, attempt, err)
+		return false
+	} else if err != nil {
+		log.Printf("failed to record result of job %s: %v", jobID, err)
+		return false
+	}
+	// A synchronous result may be the first sign the node ran the job.
+	if _, err := s.jobs.MarkRunning(jobID, attempt); err != nil {
+		log.Printf("failed to mark job %s attempt %d running: %v", jobID, attempt, err)
+	}
+
+	if result.Status == "timed_out" {
+		return s.recordFailure(jobID, attempt, AttemptTimedOut, result.Error, true)
+	}
+	if result.Status != "ok" || result.ExitCode != 0 {
+		return s.failAttempt(jobID, attempt, fmt.Sprintf("exit code %d: %s", result.ExitCode, result.Error), true)
+	}
+
+	job, err := s.jobs.CompleteAttempt(jobID, attempt)
+	if errors.Is(err, errStaleAttempt) {
+		log.Printf("ignoring result of job %s attempt %d: %v", jobID, attempt, err)
+		return false
+	} else if err != nil {
 		log.Printf("failed to update job %s to COMPLETED: %v", jobID, err)
+		return false
+	}
+	s.registry.RecordOutcome(nodeID, true)
+	s.settle(job)
+	return true
+}
+
+// failAttempt records a failed attempt and requeues the job if it will be retried.
+func (s *server) failAttempt(jobID string, attempt int, msg string, retryable bool) bool {
+	return s.recordFailure(jobID, attempt, AttemptFailed, msg, retryable)
+}
+
+// recordFailure closes the attempt with outcome and, for jobs that will be
+// retried, puts them back on the pending queue and wakes the loop once
+// their backoff has passed. It reports whether the attempt was still current.
+func (s *server) recordFailure(jobID string, attempt int, outcome, msg string, retryable bool) bool {
+	job, err := s.jobs.FailAttempt(jobID, attempt, outcome, msg, retryable)
+	if errors.Is(err, errStaleAttempt) {
+		// e.g. the job was cancelled or reaped while the agent was still running it.
+		log.Printf("ignoring outcome of job %s attempt %d: %v", jobID, attempt, err)
+		return false
+	}
+	if err != nil {
+		log.Printf("failed to record failure of job %s attempt %d: %v", jobID, attempt, err)
+		return false
+	}
+
+	// Only failures that might go differently elsewhere count against the node.
+	if retryable {
+		s.registry.RecordOutcome(job.NodeID, false)
+	}
+
+	if job.Status != JobStatusRetrying {
+		log.Printf("job %s failed after %d attempt(s): %s", jobID, attempt, msg)
+		s.settle(job)
+		return true
+	}
+
+	wait := time.Until(*job.NextAttemptAt)
+	log.Printf("job %s attempt %d failed (%s); retrying in %s", jobID, attempt, msg, wait.Round(time.Millisecond))
+	s.pending.Push(jobID, job.Priority)
+	time.AfterFunc(wait, s.kick)
+	return true
+}
+
+// readErrorBody returns a short description of an error response body.
+func readErrorBody(resp *http.Response) string {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil || len(body) == 0 {
+		return resp.Status
 	}
+	return strings.TrimSpace(string(body))
 }
 
 // Converts a node's Address into a usable base URL
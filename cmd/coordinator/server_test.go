@@ -34,7 +34,7 @@ func TestHealthHandler(t *testing.T) {
 // and GET /nodes returns it.
 func TestHandleRegisterAndListNodes(t *testing.T) {
 	reg := NewNodeRegistry()
-	srv := &server{registry: reg}
+	srv := &server{registry: reg, jobs: NewJobStore()}
 
 	// 1) Register a node via HTTP.
 	payload := registerRequest{
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// eventsBucket is the Storage bucket holding each job's event history.
+const eventsBucket = "events"
+
+// jobTransitions lists the statuses each status may move to. A job is
+// ASSIGNED once placed on a node and RUNNING once the node has it, and goes
+// back to QUEUED if preempted; a finished job never moves again. Only
+// workflow jobs start out WAITING.
+var jobTransitions = transitionTable{
+	JobStatusWaiting:   {JobStatusQueued, JobStatusSkipped, JobStatusCancelled},
+	JobStatusQueued:    {JobStatusAssigned, JobStatusFailed, JobStatusCancelled},
+	JobStatusAssigned:  {JobStatusRunning, JobStatusQueued, JobStatusRetrying, JobStatusFailed, JobStatusCancelled},
+	JobStatusRunning:   {JobStatusCompleted, JobStatusQueued, JobStatusRetrying, JobStatusFailed, JobStatusCancelled},
+	JobStatusRetrying:  {JobStatusAssigned, JobStatusFailed, JobStatusCancelled},
+	JobStatusCompleted: nil,
+	JobStatusFailed:    nil,
+	JobStatusCancelled: nil,
+	JobStatusSkipped:   nil,
+}
+
+// TransitionError is returned when a job is asked to move to a status its
+// current status can't lead to
+type TransitionError struct {
+	JobID string
+	From  JobStatus
+	To    JobStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("job %q cannot go from %s to %s", e.JobID, e.From, e.To)
+}
+
+// transitionTable maps each status to the statuses that may follow it
+type transitionTable map[JobStatus][]JobStatus
+
+// allows reports whether a job may move from one status to another
+func (t transitionTable) allows(from, to JobStatus) bool {
+	for _, s := range t[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// JobEvent is one status change in a job's history
+type JobEvent struct {
+	Time    time.Time `json:"time"`
+	From    JobStatus `json:"from,omitempty"`
+	To      JobStatus `json:"to"`
+	NodeID  string    `json:"node_id,omitempty"`
+	Attempt int       `json:"attempt,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Active reports whether the job holds a node: ASSIGNED or RUNNING. A job
+// split into tasks never does itself
+func (j Job) Active() bool {
+	return !j.IsParent() && (j.Status == JobStatusAssigned || j.Status == JobStatusRunning)
+}
+
+// transition moves j to ev.To and appends ev to its history, or returns a
+// *TransitionError and leaves j alone. ev.Time defaults to now. The caller
+// persists j. Callers hold s.mu
+func (s *JobStore) transition(j *Job, ev JobEvent) error {
+	table := jobTransitions
+	if j.IsParent() {
+		table = parentTransitions
+	}
+	if !table.allows(j.Status, ev.To) {
+		return &TransitionError{JobID: j.ID, From: j.Status, To: ev.To}
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	ev.From = j.Status
+
+	s.countJob(j, j.Status, ev.To)
+	s.countTask(j, j.Status, ev.To)
+	j.Status = ev.To
+	j.UpdatedAt = ev.Time
+	s.record(j, ev)
+	return nil
+}
+
+// record appends ev to j's history and writes it through. Callers hold s.mu
+func (s *JobStore) record(j *Job, ev JobEvent) {
+	s.events[j.ID] = append(s.events[j.ID], ev)
+	if err := s.storage.Put(eventsBucket, j.ID, s.events[j.ID]); err != nil {
+		log.Printf("[coordinator] failed to persist events of job %s: %v", j.ID, err)
+	}
+}
+
+// Returns a copy of the job's event history, oldest first
+func (s *JobStore) Events(id string) ([]JobEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return nil, false
+	}
+	return append([]JobEvent{}, s.events[id]...), true
+}
+
+// Marks an ASSIGNED job RUNNING once its node has attempt n; a job already
+// RUNNING is left as it is
+func (s *JobStore) MarkRunning(id string, n int) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return Job{}, err
+	}
+	if err := s.markRunning(j, n); err != nil {
+		return Job{}, err
+	}
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// markRunning moves an ASSIGNED job to RUNNING for attempt n. Callers hold s.mu
+func (s *JobStore) markRunning(j *Job, n int) error {
+	if j.Status == JobStatusRunning {
+		return nil
+	}
+	return s.transition(j, JobEvent{
+		To:      JobStatusRunning,
+		NodeID:  j.Attempts[n-1].NodeID,
+		Attempt: n,
+		Reason:  "node started the attempt",
+	})
+}
+
+// loadEvents replays stored event histories into the store. Callers have exclusive access
+func (s *JobStore) loadEvents() error {
+	records, err := s.storage.Load(eventsBucket)
+	if err != nil {
+		return fmt.Errorf("load events: %w", err)
+	}
+	for id, raw := range records {
+		var evs []JobEvent
+		if err := json.Unmarshal(raw, &evs); err != nil {
+			return fmt.Errorf("decode events of job %q: %w", id, err)
+		}
+		s.events[id] = evs
+	}
+	return nil
+}
+
+// handleJobEvents implements GET /jobs/{id}/events: the job's status
+// changes, oldest first.
+func (s *server) handleJobEvents(w http.ResponseWriter, r *http.Request, jobID string) {
+	events, ok := s.jobs.Events(jobID)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Printf("encode events response: %v", err)
+	}
+}
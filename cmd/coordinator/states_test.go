@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test the transitions the state machine allows and refuses
+func TestCanTransition(t *testing.T) {
+	cases := []struct {
+		from, to JobStatus
+		ok       bool
+	}{
+		{JobStatusQueued, JobStatusAssigned, true},
+		{JobStatusAssigned, JobStatusRunning, true},
+		{JobStatusRunning, JobStatusCompleted, true},
+		{JobStatusRunning, JobStatusRetrying, true},
+		{JobStatusRetrying, JobStatusAssigned, true},
+		{JobStatusRunning, JobStatusQueued, true},
+		{JobStatusQueued, JobStatusCancelled, true},
+		{JobStatusQueued, JobStatusRunning, false},
+		{JobStatusAssigned, JobStatusCompleted, false},
+		{JobStatusCompleted, JobStatusRunning, false},
+		{JobStatusCancelled, JobStatusQueued, false},
+		{JobStatusFailed, JobStatusRetrying, false},
+	}
+	for _, c := range cases {
+		if got := jobTransitions.allows(c.from, c.to); got != c.ok {
+			t.Errorf("%s -> %s: expected %v, got %v", c.from, c.to, c.ok, got)
+		}
+	}
+}
+
+// Test that a late outcome can't move a finished job
+func TestFinishedJobRefusesTransitions(t *testing.T) {
+	jobs := NewJobStore()
+	j := jobs.Create("echo", "hi")
+	if _, _, err := jobs.Cancel(j.ID, "stop"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	_, err := jobs.StartAttempt(j.ID, "node-1", "")
+	var terr *TransitionError
+	if !errors.As(err, &terr) || terr.From != JobStatusCancelled || terr.To != JobStatusAssigned {
+		t.Fatalf("expected a CANCELLED -> ASSIGNED TransitionError, got %v", err)
+	}
+	if got, _ := jobs.Get(j.ID); got.Status != JobStatusCancelled || got.CurrentAttempt() != 0 {
+		t.Fatalf("expected job left CANCELLED with no attempts, got %s with %d", got.Status, got.CurrentAttempt())
+	}
+}
+
+// Test that GET /jobs/{id}/events returns the job's timeline, also after a restart
+func TestJobEvents(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	j := jobs.Submit(JobSpec{Type: "echo", Retry: &RetryPolicy{MaxAttempts: 2}})
+	jobs.StartAttempt(j.ID, "node-1", "")
+	jobs.MarkRunning(j.ID, 1)
+	jobs.FailAttempt(j.ID, 1, AttemptFailed, "boom", true)
+	jobs.StartAttempt(j.ID, "node-2", "")
+	jobs.CompleteAttempt(j.ID, 2)
+
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("failed to restore store: %v", err)
+	}
+	srv := &server{registry: NewNodeRegistry(), jobs: restored}
+
+	w := httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodGet, "/jobs/"+j.ID+"/events", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var events []JobEvent
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatalf("failed to decode events: %v", err)
+	}
+
+	want := []JobStatus{JobStatusQueued, JobStatusAssigned, JobStatusRunning, JobStatusRetrying, JobStatusAssigned, JobStatusRunning, JobStatusCompleted}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, ev := range events {
+		if ev.To != want[i] {
+			t.Fatalf("event %d: expected %s, got %s", i, want[i], ev.To)
+		}
+		if i > 0 && ev.From != want[i-1] {
+			t.Fatalf("event %d: expected from %s, got %s", i, want[i-1], ev.From)
+		}
+		if ev.Time.IsZero() {
+			t.Fatalf("event %d has no timestamp", i)
+		}
+	}
+	if events[1].NodeID != "node-1" || events[4].NodeID != "node-2" || events[4].Attempt != 2 {
+		t.Fatalf("expected placements on node-1 then node-2, got %+v and %+v", events[1], events[4])
+	}
+	if events[3].Reason != "FAILED: boom" {
+		t.Fatalf("expected the failure reason on the RETRYING event, got %q", events[3].Reason)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleJob(w, httptest.NewRequest(http.MethodGet, "/jobs/job-404/events", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown job, got %d", w.Code)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage persists coordinator state as JSON records grouped into buckets.
+// JobStore and NodeRegistry keep their working set in memory and write
+// every mutation through a Storage so it can be replayed on startup.
+type Storage interface {
+	// Put stores value (marshalled as JSON) under bucket/key.
+	Put(bucket, key string, value any) error
+	// PutAll stores every value of values under bucket and its key, as one
+	// write.
+	PutAll(bucket string, values map[string]any) error
+	// Delete removes bucket/key; deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// Load returns every record currently in bucket.
+	Load(bucket string) (map[string]json.RawMessage, error)
+	// Close flushes and releases any underlying resources.
+	Close() error
+}
+
+// storageState is the materialized content of a Storage.
+type storageState map[string]map[string]json.RawMessage
+
+func (st storageState) put(bucket, key string, value json.RawMessage) {
+	b, ok := st[bucket]
+	if !ok {
+		b = make(map[string]json.RawMessage)
+		st[bucket] = b
+	}
+	b[key] = value
+}
+
+func (st storageState) delete(bucket, key string) {
+	delete(st[bucket], key)
+}
+
+func (st storageState) load(bucket string) map[string]json.RawMessage {
+	out := make(map[string]json.RawMessage, len(st[bucket]))
+	for k, v := range st[bucket] {
+		out[k] = v
+	}
+	return out
+}
+
+// memoryStorage is a Storage that lives only as long as the process.
+// It is the default for tests and for coordinators run without a data dir.
+type memoryStorage struct {
+	mu    sync.Mutex
+	state storageState
+}
+
+// NewMemoryStorage creates an empty in-memory Storage.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{state: make(storageState)}
+}
+
+func (m *memoryStorage) Put(bucket, key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal %s/%s: %w", bucket, key, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.put(bucket, key, raw)
+	return nil
+}
+
+func (m *memoryStorage) PutAll(bucket string, values map[string]any) error {
+	raws := make(map[string]json.RawMessage, len(values))
+	for key, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("marshal %s/%s: %w", bucket, key, err)
+		}
+		raws[key] = raw
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, raw := range raws {
+		m.state.put(bucket, key, raw)
+	}
+	return nil
+}
+
+func (m *memoryStorage) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.delete(bucket, key)
+	return nil
+}
+
+func (m *memoryStorage) Load(bucket string) (map[string]json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.load(bucket), nil
+}
+
+func (m *memoryStorage) Close() error { return nil }
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// walRecord is one line of the write-ahead log.
+type walRecord struct {
+	Op     string          `json:"op"` // "put" or "delete"
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// fileStorage is a Storage backed by an append-only WAL plus snapshots.
+//
+// Every mutation is appended to wal.log and fsynced before it is applied.
+// After snapshotEvery appends the full state is written to snapshot.json
+// (via a temp file and rename) and the WAL is truncated. On open the
+// snapshot is loaded and the WAL replayed on top of it; a torn final
+// line from a crash mid-write is discarded.
+type fileStorage struct {
+	mu            sync.Mutex
+	dir           string
+	wal           *os.File
+	state         storageState
+	appended      int
+	snapshotEvery int
+}
+
+// OpenFileStorage opens (or creates) a file-backed Storage in dir.
+// snapshotEvery <= 0 disables automatic compaction.
+func OpenFileStorage(dir string, snapshotEvery int) (Storage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+
+	fs := &fileStorage{
+		dir:           dir,
+		state:         make(storageState),
+		snapshotEvery: snapshotEvery,
+	}
+
+	if err := fs.readSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := fs.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	// Start from a clean WAL so a torn tail never survives a second restart.
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileStorage) Put(bucket, key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal %s/%s: %w", bucket, key, err)
+	}
+	return fs.append(walRecord{Op: "put", Bucket: bucket, Key: key, Value: raw})
+}
+
+func (fs *fileStorage) PutAll(bucket string, values map[string]any) error {
+	recs := make([]walRecord, 0, len(values))
+	for key, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("marshal %s/%s: %w", bucket, key, err)
+		}
+		recs = append(recs, walRecord{Op: "put", Bucket: bucket, Key: key, Value: raw})
+	}
+	return fs.append(recs...)
+}
+
+func (fs *fileStorage) Delete(bucket, key string) error {
+	return fs.append(walRecord{Op: "delete", Bucket: bucket, Key: key})
+}
+
+func (fs *fileStorage) Load(bucket string) (map[string]json.RawMessage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.state.load(bucket), nil
+}
+
+func (fs *fileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.wal == nil {
+		return nil
+	}
+	err := fs.wal.Close()
+	fs.wal = nil
+	return err
+}
+
+// Snapshot writes the current state to disk and truncates the WAL.
+func (fs *fileStorage) Snapshot() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.compact()
+}
+
+// append writes recs to the WAL with a single fsync, applies them, and
+// compacts when due.
+func (fs *fileStorage) append(recs ...walRecord) error {
+	var lines []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("marshal wal record: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.wal == nil {
+		return errors.New("storage is closed")
+	}
+	if _, err := fs.wal.Write(lines); err != nil {
+		return fmt.Errorf("append wal: %w", err)
+	}
+	if err := fs.wal.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+
+	for _, rec := range recs {
+		fs.apply(rec)
+	}
+	fs.appended += len(recs)
+
+	if fs.snapshotEvery > 0 && fs.appended >= fs.snapshotEvery {
+		if err := fs.compact(); err != nil {
+			// The record itself is durable in the WAL; compaction can retry later.
+			log.Printf("[storage] compaction failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (fs *fileStorage) apply(rec walRecord) {
+	switch rec.Op {
+	case "put":
+		fs.state.put(rec.Bucket, rec.Key, rec.Value)
+	case "delete":
+		fs.state.delete(rec.Bucket, rec.Key)
+	}
+}
+
+func (fs *fileStorage) readSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(fs.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, &fs.state); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	if fs.state == nil {
+		fs.state = make(storageState)
+	}
+	return nil
+}
+
+func (fs *fileStorage) replayWAL() error {
+	f, err := os.Open(filepath.Join(fs.dir, walFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	replayed := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("[storage] discarding torn wal record after %d records", replayed)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read wal: %w", err)
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("[storage] discarding unreadable wal record after %d records: %v", replayed, err)
+			break
+		}
+		fs.apply(rec)
+		replayed++
+	}
+	return nil
+}
+
+// compact writes a snapshot and starts a fresh WAL. Callers hold fs.mu
+// (or have exclusive access during open).
+func (fs *fileStorage) compact() error {
+	data, err := json.Marshal(fs.state)
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+
+	tmp := filepath.Join(fs.dir, snapshotFileName+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(fs.dir, snapshotFileName)); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+
+	// Replaying the old WAL over the new snapshot is harmless, so a crash
+	// between the rename and the truncate loses nothing.
+	if fs.wal != nil {
+		_ = fs.wal.Close()
+	}
+	wal, err := os.OpenFile(filepath.Join(fs.dir, walFileName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		fs.wal = nil
+		return fmt.Errorf("reset wal: %w", err)
+	}
+	fs.wal = wal
+	fs.appended = 0
+	return nil
+}
+
+// writeFileSync writes data to path and fsyncs it before returning.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
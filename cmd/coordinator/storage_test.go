@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that records written to file storage survive a reopen, including deletes
+func TestFileStorageReplaysWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	st, err := OpenFileStorage(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	if err := st.Put("jobs", "job-1", map[string]string{"id": "job-1"}); err != nil {
+		t.Fatalf("put job-1: %v", err)
+	}
+	if err := st.Put("jobs", "job-2", map[string]string{"id": "job-2"}); err != nil {
+		t.Fatalf("put job-2: %v", err)
+	}
+	if err := st.Delete("jobs", "job-1"); err != nil {
+		t.Fatalf("delete job-1: %v", err)
+	}
+	if err := st.PutAll("jobs", map[string]any{"job-3": map[string]string{"id": "job-3"}, "job-4": map[string]string{"id": "job-4"}}); err != nil {
+		t.Fatalf("put job-3 and job-4: %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFileStorage(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+
+	records, err := reopened.Load("jobs")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records after replay, got %d", len(records))
+	}
+	for _, id := range []string{"job-2", "job-3", "job-4"} {
+		if _, ok := records[id]; !ok {
+			t.Fatalf("expected %s to survive replay, got %v", id, records)
+		}
+	}
+}
+
+// Test that compaction truncates the WAL and a torn tail is discarded on open
+func TestFileStorageCompactionAndTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	st, err := OpenFileStorage(dir, 2)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := st.Put("nodes", id, id); err != nil {
+			t.Fatalf("put %s: %v", id, err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// two puts triggered a snapshot, so only "c" should be left in the WAL.
+	wal, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("read wal: %v", err)
+	}
+	if n := countLines(wal); n != 1 {
+		t.Fatalf("expected 1 wal record after compaction, got %d", n)
+	}
+
+	// simulate a crash halfway through writing a record.
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	_, _ = f.WriteString(`{"op":"put","bucket":"nodes","key":"d","val`)
+	f.Close()
+
+	reopened, err := OpenFileStorage(dir, 2)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+
+	records, err := reopened.Load("nodes")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d (%v)", len(records), records)
+	}
+	if _, ok := records["d"]; ok {
+		t.Fatalf("expected torn record d to be discarded")
+	}
+}
+
+// Test that a job store restored from storage keeps jobs and does not reuse IDs
+func TestJobStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	st, err := OpenFileStorage(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	store, err := NewJobStoreWithStorage(st)
+	if err != nil {
+		t.Fatalf("failed to create job store: %v", err)
+	}
+	j1 := store.Create("echo", "one")
+	if _, err := store.StartAttempt(j1.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	if _, err := store.CompleteAttempt(j1.ID, 1); err != nil {
+		t.Fatalf("complete attempt: %v", err)
+	}
+	reg, err := NewNodeRegistryWithStorage(st)
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+	reg.Register("node-1", ":8081", NodeInfo{JobTypes: []string{"echo"}})
+	st.Close()
+
+	st2, err := OpenFileStorage(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer st2.Close()
+
+	restored, err := NewJobStoreWithStorage(st2)
+	if err != nil {
+		t.Fatalf("failed to restore job store: %v", err)
+	}
+	got, ok := restored.Get(j1.ID)
+	if !ok {
+		t.Fatalf("expected job %s to be restored", j1.ID)
+	}
+	if got.Status != JobStatusCompleted || got.NodeID != "node-1" {
+		t.Fatalf("expected restored job COMPLETED on node-1, got %s on %q", got.Status, got.NodeID)
+	}
+
+	j2 := restored.Create("echo", "two")
+	if j2.ID == j1.ID {
+		t.Fatalf("expected a new job ID after restart, got reused %s", j2.ID)
+	}
+
+	restoredReg, err := NewNodeRegistryWithStorage(st2)
+	if err != nil {
+		t.Fatalf("failed to restore registry: %v", err)
+	}
+	nodes := restoredReg.List()
+	if len(nodes) != 1 || !nodes[0].Supports("echo") || nodes[0].Supports("shell") {
+		t.Fatalf("expected node-1 with job types [echo], got %+v", nodes)
+	}
+}
+
+func countLines(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c == '\n' {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// States an agent reports to /tasks/{id}/status for an async job.
+const (
+	taskStateRunning  = "running"
+	taskStateFinished = "finished"
+	taskStateRejected = "rejected"
+)
+
+// taskStatusRequest is what agents POST to /tasks/{id}/status.
+type taskStatusRequest struct {
+	JobID   string `json:"job_id"`
+	Attempt int    `json:"attempt"`
+	NodeID  string `json:"node_id"`
+	State   string `json:"state"`
+
+	// the fencing token the attempt was dispatched with
+	LeaseToken uint64 `json:"lease_token,omitempty"`
+
+	Result *executeResponse `json:"result,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// taskStatusResponse tells the agent whether its report changed anything.
+// A report for an attempt that is already closed is acknowledged but not
+// applied, so agents can safely send the same report again.
+type taskStatusResponse struct {
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Records that attempt n of a job is alive, marking it RUNNING if it was
+// still ASSIGNED, and renews its lease
+func (s *JobStore) TouchAttempt(id string, n int) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.currentAttempt(id, n)
+	if err != nil {
+		return Job{}, err
+	}
+	if err := s.markRunning(j, n); err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(s.ttl())
+	j.Attempts[n-1].LastReportAt = &now
+	j.Attempts[n-1].LeaseExpiresAt = &expires
+	j.UpdatedAt = now
+	s.persist(j)
+
+	return j.clone(), nil
+}
+
+// watchAttempt fails an async attempt as timed out if its agent hasn't
+// reported an outcome within timeout plus executeGrace. Zero timeout means
+// the attempt is only ended by its agent or by its node going offline.
+func (s *server) watchAttempt(jobID string, attempt int, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	limit := timeout + executeGrace
+	time.AfterFunc(limit, func() {
+		job, ok := s.jobs.Get(jobID)
+		if !ok || !job.Active() || job.CurrentAttempt() != attempt {
+			return
+		}
+		s.recordFailure(jobID, attempt, AttemptTimedOut, fmt.Sprintf("no result from node %s within %s", job.NodeID, limit), true)
+		s.kick()
+	})
+}
+
+// watchRunning re-arms the timeout of every ASSIGNED or RUNNING job, e.g. after a
+// restart, and renews their leases so agents have time to check back in.
+func (s *server) watchRunning() {
+	s.jobs.RenewAllLeases()
+	now := time.Now()
+	for _, j := range s.jobs.List() {
+		if !j.Active() || len(j.Attempts) == 0 {
+			continue
+		}
+		started := j.Attempts[len(j.Attempts)-1].StartedAt
+		timeout := j.attemptTimeout(started, s.defaultTimeout)
+		if timeout <= 0 {
+			continue
+		}
+		// Count time already spent so the attempt isn't given a fresh budget.
+		remaining := timeout - now.Sub(started)
+		if remaining <= 0 {
+			remaining = time.Millisecond
+		}
+		s.watchAttempt(j.ID, j.CurrentAttempt(), remaining)
+	}
+}
+
+// handleTask is the multiplexer for /tasks/...:
+//   - GET /tasks/next -> a pull node fetches tasks placed on it
+//   - POST /tasks/{id}/status -> an agent reports progress or the outcome of an attempt
+func (s *server) handleTask(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/")
+	if rest == "next" {
+		s.handleNextTasks(w, r)
+		return
+	}
+	jobID, action, _ := strings.Cut(rest, "/")
+	if jobID == "" || action != "status" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.handleTaskStatus(w, r, jobID)
+}
+
+// handleTaskStatus implements POST /tasks/{id}/status.
+// Reports are keyed by job ID and attempt number: one for the current
+// attempt is applied, one for an attempt that has already been closed is
+// acknowledged without effect, and one for an attempt that never existed,
+// belongs to another node or carries the wrong lease token is refused with 409.
+func (s *server) handleTaskStatus(w http.ResponseWriter, r *http.Request, jobID string) {
+	var req taskStatusRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxResultBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("status report larger than %d bytes", tooBig.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.JobID != "" && req.JobID != jobID {
+		http.Error(w, "job_id does not match the URL", http.StatusBadRequest)
+		return
+	}
+	if req.NodeID == "" {
+		http.Error(w, "node_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.State == taskStateFinished && req.Result == nil {
+		http.Error(w, "result is required when state is finished", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := s.jobs.Get(jobID)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if req.Attempt < 1 || req.Attempt > job.CurrentAttempt() {
+		http.Error(w, fmt.Sprintf("job %s has no attempt %d", jobID, req.Attempt), http.StatusConflict)
+		return
+	}
+	attempt := job.Attempts[req.Attempt-1]
+	if req.NodeID != attempt.NodeID {
+		http.Error(w, fmt.Sprintf("attempt %d of job %s belongs to node %s", req.Attempt, jobID, attempt.NodeID), http.StatusConflict)
+		return
+	}
+	if req.LeaseToken != attempt.LeaseToken {
+		http.Error(w, fmt.Sprintf("lease %d does not fence attempt %d of job %s", req.LeaseToken, req.Attempt, jobID), http.StatusConflict)
+		return
+	}
+	if attempt.FinishedAt != nil {
+		writeTaskStatus(w, taskStatusResponse{Reason: fmt.Sprintf("attempt %d is already closed (%s)", req.Attempt, attempt.Outcome)})
+		return
+	}
+
+	var applied bool
+	switch req.State {
+	case taskStateRunning:
+		_, err := s.jobs.TouchAttempt(jobID, req.Attempt)
+		applied = err == nil
+	case taskStateFinished:
+		applied = s.applyResult(jobID, req.Attempt, attempt.NodeID, *req.Result)
+		s.kick()
+	case taskStateRejected:
+		// Same as a synchronous 400: sending the job again won't help.
+		applied = s.failAttempt(jobID, req.Attempt, fmt.Sprintf("agent rejected job: %s", req.Error), false)
+		s.kick()
+	default:
+		http.Error(w, fmt.Sprintf("unknown state %q", req.State), http.StatusBadRequest)
+		return
+	}
+
+	resp := taskStatusResponse{Accepted: applied}
+	if !applied {
+		resp.Reason = fmt.Sprintf("attempt %d is no longer current", req.Attempt)
+	}
+	writeTaskStatus(w, resp)
+}
+
+func writeTaskStatus(w http.ResponseWriter, resp taskStatusResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("encode task status response: %v", err)
+	}
+}
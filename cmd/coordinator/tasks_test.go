@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postTaskStatus sends st for jobID through handleTask.
+func postTaskStatus(t *testing.T, srv *server, jobID string, st taskStatusRequest) (int, taskStatusResponse) {
+	t.Helper()
+
+	body, _ := json.Marshal(st)
+	w := httptest.NewRecorder()
+	srv.handleTask(w, httptest.NewRequest(http.MethodPost, "/tasks/"+jobID+"/status", bytes.NewReader(body)))
+
+	var resp taskStatusResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode status response: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+// Test that an async agent's 202 leaves the job running until it reports back
+func TestAsyncDispatchAndStatusReports(t *testing.T) {
+	_, addr := newFakeAgent(t, http.StatusAccepted, executeResponse{})
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", addr, NodeInfo{})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs}
+
+	job := jobs.Create("echo", "hi")
+	srv.dispatchJob(job.ID)
+
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusRunning {
+		t.Fatalf("expected job to stay RUNNING after 202, got %s", job.Status)
+	}
+	token := job.Attempts[0].LeaseToken
+
+	if code, resp := postTaskStatus(t, srv, job.ID, taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token, State: taskStateRunning}); code != http.StatusOK || !resp.Accepted {
+		t.Fatalf("expected running report to be accepted, got %d %+v", code, resp)
+	}
+	if job, _ = jobs.Get(job.ID); job.Attempts[0].LastReportAt == nil {
+		t.Fatalf("expected running report to be recorded on the attempt")
+	}
+
+	finished := taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token, State: taskStateFinished, Result: &executeResponse{Status: "ok", Stdout: "hi"}}
+	if code, resp := postTaskStatus(t, srv, job.ID, finished); code != http.StatusOK || !resp.Accepted {
+		t.Fatalf("expected result to be accepted, got %d %+v", code, resp)
+	}
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusCompleted {
+		t.Fatalf("expected COMPLETED, got %s", job.Status)
+	}
+	if res, ok := jobs.Result(job.ID); !ok || res.Stdout != "hi" {
+		t.Fatalf("expected result to be stored, got %+v", res)
+	}
+
+	// the same report again is acknowledged without effect.
+	finished.Result = &executeResponse{Status: "failed", ExitCode: 1}
+	if code, resp := postTaskStatus(t, srv, job.ID, finished); code != http.StatusOK || resp.Accepted {
+		t.Fatalf("expected duplicate report to be acknowledged but not applied, got %d %+v", code, resp)
+	}
+	if job, _ = jobs.Get(job.ID); job.Status != JobStatusCompleted {
+		t.Fatalf("expected job to stay COMPLETED, got %s", job.Status)
+	}
+}
+
+func TestTaskStatusRefusesUnknownAttempts(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+	job := jobs.Create("echo", "hi")
+	job, err := jobs.StartAttempt(job.ID, "node-1", "")
+	if err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+	token := job.Attempts[0].LeaseToken
+
+	tests := []struct {
+		name string
+		st   taskStatusRequest
+		code int
+	}{
+		{"no node", taskStatusRequest{Attempt: 1, State: taskStateRunning}, http.StatusBadRequest},
+		{"future attempt", taskStatusRequest{Attempt: 2, NodeID: "node-1", State: taskStateRunning}, http.StatusConflict},
+		{"other node", taskStatusRequest{Attempt: 1, NodeID: "node-2", State: taskStateRunning}, http.StatusConflict},
+		{"no lease", taskStatusRequest{Attempt: 1, NodeID: "node-1", State: taskStateRunning}, http.StatusConflict},
+		{"missing result", taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token, State: taskStateFinished}, http.StatusBadRequest},
+		{"unknown state", taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token, State: "paused"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := postTaskStatus(t, srv, job.ID, tt.st); code != tt.code {
+				t.Fatalf("expected status %d, got %d", tt.code, code)
+			}
+		})
+	}
+
+	huge := taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: token, State: taskStateFinished, Result: &executeResponse{Stdout: strings.Repeat("x", maxResultBody)}}
+	if code, _ := postTaskStatus(t, srv, job.ID, huge); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 for an oversized report, got %d", code)
+	}
+
+	if code, _ := postTaskStatus(t, srv, "job-999", taskStatusRequest{Attempt: 1, NodeID: "node-1", State: taskStateRunning}); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unknown job, got %d", code)
+	}
+}
+
+func TestTaskStatusRejected(t *testing.T) {
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+	job := jobs.Create("exec", "not json")
+	job, err := jobs.StartAttempt(job.ID, "node-1", "")
+	if err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+
+	if code, resp := postTaskStatus(t, srv, job.ID, taskStatusRequest{Attempt: 1, NodeID: "node-1", LeaseToken: job.Attempts[0].LeaseToken, State: taskStateRejected, Error: "bad payload"}); code != http.StatusOK || !resp.Accepted {
+		t.Fatalf("expected rejection to be accepted, got %d %+v", code, resp)
+	}
+	if job, _ = jobs.Get(job.ID); job.Status != JobStatusFailed {
+		t.Fatalf("expected a rejected job to fail without retrying, got %s", job.Status)
+	}
+}
+
+// Test that an async attempt whose agent never reports back times out
+func TestWatchAttemptTimesOut(t *testing.T) {
+	defer func(g time.Duration) { executeGrace = g }(executeGrace)
+	executeGrace = 10 * time.Millisecond
+
+	jobs := NewJobStore()
+	srv := &server{registry: NewNodeRegistry(), jobs: jobs}
+	job := jobs.Submit(JobSpec{Type: "echo", Retry: &RetryPolicy{MaxAttempts: 1}})
+	if _, err := jobs.StartAttempt(job.ID, "node-1", ""); err != nil {
+		t.Fatalf("start attempt: %v", err)
+	}
+
+	srv.watchAttempt(job.ID, 1, 10*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, _ = jobs.Get(job.ID)
+		if job.Status == JobStatusFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected attempt to time out, job is %s", job.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if job.Reason != ReasonTimedOut {
+		t.Fatalf("expected reason TIMED_OUT, got %q", job.Reason)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errDeadlinePassed is returned by placeJob for a job whose deadline passed
+// before it could be placed; the job is marked FAILED with ReasonTimedOut.
+var errDeadlinePassed = errors.New("job deadline has passed")
+
+// AttemptTimedOut is recorded on an attempt that ran past its time limit.
+const AttemptTimedOut = "TIMED_OUT"
+
+// ReasonTimedOut is the terminal reason of a job that ran out of time, either
+// because its last attempt exceeded max_runtime_seconds or because its
+// deadline passed before it could finish.
+const ReasonTimedOut = "TIMED_OUT"
+
+// executeGrace is how much longer than the job's own limit the coordinator
+// waits for /execute, so the agent normally reports the timeout itself.
+// It is a variable so tests can shorten it.
+var executeGrace = 10 * time.Second
+
+// attemptTimeout returns how long an attempt started at now may run: the
+// job's max runtime, cut short by its deadline, or fallback when the job
+// sets neither. Zero means no limit, so any limit is at least a millisecond,
+// the agent's resolution.
+func (j Job) attemptTimeout(now time.Time, fallback time.Duration) time.Duration {
+	limit := fallback
+	if j.MaxRuntimeSeconds > 0 {
+		limit = time.Duration(j.MaxRuntimeSeconds) * time.Second
+	}
+	if j.Deadline != nil {
+		remaining := j.Deadline.Sub(now)
+		if limit == 0 || remaining < limit {
+			limit = remaining
+		}
+		limit = max(limit, time.Millisecond)
+	}
+	return limit
+}
+
+// deadlinePassed reports whether the job's deadline is at or before t.
+func (j Job) deadlinePassed(t time.Time) bool {
+	return j.Deadline != nil && !t.Before(*j.Deadline)
+}
+
+// Marks a QUEUED or RETRYING job whose deadline has passed as FAILED with ReasonTimedOut
+func (s *JobStore) ExpireDeadline(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %q not found", id)
+	}
+	if j.Status != JobStatusQueued && j.Status != JobStatusRetrying {
+		return Job{}, fmt.Errorf("job %q is %s; cannot expire it", id, j.Status)
+	}
+
+	now := time.Now().UTC()
+	if !j.deadlinePassed(now) {
+		return Job{}, fmt.Errorf("job %q has not reached its deadline", id)
+	}
+
+	msg := fmt.Sprintf("deadline %s passed before the job could run", j.Deadline.Format(time.RFC3339))
+	if err := s.transition(j, JobEvent{Time: now, To: JobStatusFailed, Reason: msg}); err != nil {
+		return Job{}, err
+	}
+	j.Reason = ReasonTimedOut
+	j.LastError = msg
+	j.NextAttemptAt = nil
+	j.PendingReason = ""
+	s.persist(j)
+
+	return j.clone(), nil
+}
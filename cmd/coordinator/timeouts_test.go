@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestJobAttemptTimeout(t *testing.T) {
+	now := time.Now()
+	soon := now.Add(30 * time.Second)
+	nearly := now.Add(100 * time.Microsecond)
+
+	tests := []struct {
+		name     string
+		job      Job
+		fallback time.Duration
+		want     time.Duration
+	}{
+		{"no limits", Job{}, 0, 0},
+		{"fallback only", Job{}, time.Hour, time.Hour},
+		{"max runtime overrides fallback", Job{MaxRuntimeSeconds: 5}, time.Hour, 5 * time.Second},
+		{"deadline cuts max runtime short", Job{MaxRuntimeSeconds: 60, Deadline: &soon}, 0, 30 * time.Second},
+		{"deadline alone", Job{Deadline: &soon}, 0, 30 * time.Second},
+		{"under a millisecond left", Job{Deadline: &nearly}, time.Hour, time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.attemptTimeout(now, tt.fallback); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// Test that an agent-reported timeout fails the job with reason TIMED_OUT
+func TestDispatchAgentTimeout(t *testing.T) {
+	var got executeRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(executeResponse{Status: "timed_out", ExitCode: -1, Error: "job exceeded its 2s timeout"})
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", u.Host, NodeInfo{})
+	jobs := NewJobStore()
+	job := jobs.Submit(JobSpec{Type: "echo", MaxRuntimeSeconds: 2, Retry: &RetryPolicy{MaxAttempts: 1}})
+
+	srv := &server{registry: reg, jobs: jobs}
+	srv.dispatchJob(job.ID)
+
+	if got.TimeoutMS != 2000 {
+		t.Fatalf("expected agent to be given a 2000ms timeout, got %d", got.TimeoutMS)
+	}
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusFailed || job.Reason != ReasonTimedOut {
+		t.Fatalf("expected FAILED with reason TIMED_OUT, got %s/%q", job.Status, job.Reason)
+	}
+	if job.Attempts[0].Outcome != AttemptTimedOut {
+		t.Fatalf("expected attempt outcome TIMED_OUT, got %s", job.Attempts[0].Outcome)
+	}
+}
+
+// Test that the coordinator gives up on an agent that never answers and retries the job
+func TestDispatchHungAgentTimesOut(t *testing.T) {
+	defer func(g time.Duration) { executeGrace = g }(executeGrace)
+	executeGrace = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	u, _ := url.Parse(ts.URL)
+
+	reg := NewNodeRegistry()
+	reg.Register("node-1", u.Host, NodeInfo{})
+	jobs := NewJobStore()
+	job := jobs.Submit(JobSpec{Type: "echo", Retry: &RetryPolicy{MaxAttempts: 2}})
+
+	srv := &server{registry: reg, jobs: jobs, defaultTimeout: 50 * time.Millisecond}
+
+	done := make(chan struct{})
+	go func() {
+		srv.dispatchJob(job.ID)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("dispatch did not give up on a hung agent")
+	}
+
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusRetrying {
+		t.Fatalf("expected timed out attempt to be retried, got %s", job.Status)
+	}
+	if job.Attempts[0].Outcome != AttemptTimedOut {
+		t.Fatalf("expected attempt outcome TIMED_OUT, got %s", job.Attempts[0].Outcome)
+	}
+}
+
+// Test that a job whose deadline passes while queued is failed instead of placed
+func TestPlaceJobPastDeadline(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{})
+	jobs := NewJobStore()
+
+	past := time.Now().Add(-time.Second)
+	job := jobs.Submit(JobSpec{Type: "echo", Deadline: &past})
+
+	srv := &server{registry: reg, jobs: jobs}
+	if _, _, err := srv.placeJob(job.ID); !errors.Is(err, errDeadlinePassed) {
+		t.Fatalf("expected errDeadlinePassed, got %v", err)
+	}
+
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusFailed || job.Reason != ReasonTimedOut || len(job.Attempts) != 0 {
+		t.Fatalf("expected FAILED/TIMED_OUT with no attempts, got %s/%q with %d attempts", job.Status, job.Reason, len(job.Attempts))
+	}
+}
+
+// Test that an attempt whose deadline passes before it is sent times out
+// instead of running without a limit
+func TestExecutePastDeadline(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{})
+	jobs := NewJobStore()
+	srv := &server{registry: reg, jobs: jobs, wake: make(chan struct{}, 1)}
+
+	soon := time.Now().Add(time.Hour)
+	job := jobs.Submit(JobSpec{Type: "echo", Deadline: &soon})
+	placed, target, err := srv.placeJob(job.ID)
+	if err != nil {
+		t.Fatalf("place job: %v", err)
+	}
+	past := time.Now().Add(-time.Second)
+	placed.Deadline = &past
+	srv.executeJob(placed, target)
+
+	job, _ = jobs.Get(job.ID)
+	if job.Status != JobStatusFailed || job.Reason != ReasonTimedOut || job.Attempts[0].Outcome != AttemptTimedOut {
+		t.Fatalf("expected FAILED/TIMED_OUT, got %s/%q %+v", job.Status, job.Reason, job.Attempts)
+	}
+}
+
+func TestCreateJobRequestTimeoutValidation(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	bad := []createJobRequest{
+		{Type: "echo", MaxRuntimeSeconds: -1},
+		{Type: "echo", Deadline: &past},
+	}
+	for _, req := range bad {
+		if _, err := req.toSpec(); err == nil {
+			t.Errorf("expected error for %+v, got nil", req)
+		}
+	}
+
+	future := time.Now().Add(time.Hour)
+	spec, err := createJobRequest{Type: "echo", MaxRuntimeSeconds: 30, Deadline: &future}.toSpec()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.MaxRuntimeSeconds != 30 || spec.Deadline == nil {
+		t.Fatalf("expected limits to be carried into the spec, got %+v", spec)
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statuses of jobs that belong to a workflow: WAITING until every upstream
+// job has completed, SKIPPED if one of them didn't
+const (
+	JobStatusWaiting JobStatus = "WAITING"
+	JobStatusSkipped JobStatus = "SKIPPED"
+)
+
+// workflowsBucket is the Storage bucket holding one record per workflow.
+const workflowsBucket = "workflows"
+
+// Workflow is a set of jobs wired together by their dependencies.
+// Status is derived from the jobs whenever the workflow is read
+type Workflow struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name,omitempty"`
+	Status    JobStatus      `json:"status,omitempty"`
+	Steps     []WorkflowStep `json:"steps"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// WorkflowStep is one named job of a workflow, in dependency order
+type WorkflowStep struct {
+	Name      string    `json:"name"`
+	JobID     string    `json:"job_id"`
+	DependsOn []string  `json:"depends_on,omitempty"`
+	Status    JobStatus `json:"status,omitempty"`
+}
+
+// WorkflowStepSpec is a step as submitted: its name, the names of the
+// steps it waits for, and its job
+type WorkflowStepSpec struct {
+	Name      string
+	DependsOn []string
+	Job       JobSpec
+}
+
+// createWorkflowRequest is the body of POST /workflows.
+type createWorkflowRequest struct {
+	Name string               `json:"name,omitempty"`
+	Jobs []workflowJobRequest `json:"jobs"`
+}
+
+// workflowJobRequest is a job of a workflow: a create request plus the
+// step's name and the steps it depends on.
+type workflowJobRequest struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	createJobRequest
+}
+
+// workflowGraph is the dependency graph of a workflow.
+type workflowGraph struct {
+	Nodes []WorkflowStep `json:"nodes"`
+	Edges []workflowEdge `json:"edges"`
+}
+
+// workflowEdge says job To waits for job From.
+type workflowEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// toSteps validates a workflow request and returns its steps so that every
+// step comes after the steps it depends on.
+func (req createWorkflowRequest) toSteps() ([]WorkflowStepSpec, error) {
+	if len(req.Jobs) == 0 {
+		return nil, errors.New("jobs is required")
+	}
+
+	steps := make([]WorkflowStepSpec, 0, len(req.Jobs))
+	names := make(map[string]bool, len(req.Jobs))
+	for _, j := range req.Jobs {
+		if !validStepName(j.Name) {
+			return nil, fmt.Errorf("job name %q must be letters, digits, '-' or '_'", j.Name)
+		}
+		if names[j.Name] {
+			return nil, fmt.Errorf("job name %q is used twice", j.Name)
+		}
+		names[j.Name] = true
+
+		spec, err := j.toSpec()
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", j.Name, err)
+		}
+		steps = append(steps, WorkflowStepSpec{Name: j.Name, DependsOn: j.DependsOn, Job: spec})
+	}
+	for _, st := range steps {
+		for _, d := range st.DependsOn {
+			if !names[d] {
+				return nil, fmt.Errorf("job %s depends on unknown job %q", st.Name, d)
+			}
+			if d == st.Name {
+				return nil, fmt.Errorf("job %s depends on itself", st.Name)
+			}
+		}
+	}
+	return orderSteps(steps)
+}
+
+// validStepName reports whether name can be used in {{name.stdout}} references
+func validStepName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// orderSteps sorts steps so each comes after its dependencies, keeping the
+// submitted order otherwise, and refuses dependency cycles
+func orderSteps(steps []WorkflowStepSpec) ([]WorkflowStepSpec, error) {
+	placed := make(map[string]bool, len(steps))
+	out := make([]WorkflowStepSpec, 0, len(steps))
+	for len(out) < len(steps) {
+		progress := false
+		for _, st := range steps {
+			if placed[st.Name] {
+				continue
+			}
+			ready := true
+			for _, d := range st.DependsOn {
+				ready = ready && placed[d]
+			}
+			if ready {
+				placed[st.Name] = true
+				out = append(out, st)
+				progress = true
+			}
+		}
+		if !progress {
+			var cycle []string
+			for _, st := range steps {
+				if !placed[st.Name] {
+					cycle = append(cycle, st.Name)
+				}
+			}
+			return nil, fmt.Errorf("jobs %s have a dependency cycle", strings.Join(cycle, ", "))
+		}
+	}
+	return out, nil
+}
+
+// spec returns what the job was submitted with, e.g. to create the tasks
+// of a job released from WAITING
+func (j Job) spec() JobSpec {
+	retry := j.Retry
+	return JobSpec{
+		Type:              j.Type,
+		Payload:           j.Payload,
+		Requirements:      j.Requirements,
+		Retry:             &retry,
+		MaxRuntimeSeconds: j.MaxRuntimeSeconds,
+		Deadline:          j.Deadline,
+		Fanout:            j.Fanout,
+		PriorityClass:     j.PriorityClass,
+		Submitter:         j.Submitter,
+		Group:             j.Group,
+		Scheduler:         j.Scheduler,
+	}
+}
+
+// Creates a workflow and a job per step, in the given (dependency) order.
+// Steps without dependencies are QUEUED and returned so they can be
+// dispatched; the rest are WAITING. If the jobs don't fit their accounts'
+// quotas, none is created and the *QuotaError is returned
+func (s *JobStore) SubmitWorkflow(name string, steps []WorkflowStepSpec) (Workflow, []Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	specs := make([]JobSpec, len(steps))
+	for i, st := range steps {
+		specs[i] = st.Job
+	}
+	if err := s.admitAll(specs, now); err != nil {
+		return Workflow{}, nil, err
+	}
+
+	s.nextWorkflowID++
+	wf := &Workflow{ID: fmt.Sprintf("wf-%d", s.nextWorkflowID), Name: name, CreatedAt: now}
+
+	var ready []Job
+	ids := make(map[string]string, len(steps))
+	for _, st := range steps {
+		status := JobStatusQueued
+		if len(st.DependsOn) > 0 {
+			status = JobStatusWaiting
+		}
+
+		j := s.newJob(st.Job, status, now)
+		j.WorkflowID = wf.ID
+		j.Step = st.Name
+		for _, d := range st.DependsOn {
+			j.DependsOn = append(j.DependsOn, ids[d])
+		}
+		if st.Job.Fanout != nil && status == JobStatusQueued {
+			s.submitTasks(j, st.Job, now)
+		}
+		s.persist(j)
+		if status == JobStatusQueued {
+			ready = append(ready, j.clone())
+		}
+
+		ids[st.Name] = j.ID
+		wf.Steps = append(wf.Steps, WorkflowStep{Name: st.Name, JobID: j.ID, DependsOn: st.DependsOn})
+	}
+
+	s.workflows[wf.ID] = wf
+	if err := s.storage.Put(workflowsBucket, wf.ID, wf); err != nil {
+		log.Printf("[coordinator] failed to persist workflow %s: %v", wf.ID, err)
+	}
+	return s.workflowView(wf), ready, nil
+}
+
+// Releases the WAITING jobs of a workflow whose upstream jobs have all
+// completed, and skips those with an upstream job that finished otherwise.
+// It returns the released jobs, now QUEUED
+func (s *JobStore) AdvanceWorkflow(id string) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wf, ok := s.workflows[id]
+	if !ok {
+		return nil, fmt.Errorf("workflow %q not found", id)
+	}
+
+	// Steps are in dependency order, so one pass sees every skip cascade.
+	now := time.Now().UTC()
+	var released []Job
+	for _, st := range wf.Steps {
+		j := s.jobs[st.JobID]
+		if j.Status != JobStatusWaiting {
+			continue
+		}
+
+		ready, blocked := true, ""
+		for _, dep := range j.DependsOn {
+			d := s.jobs[dep]
+			if d.Status == JobStatusCompleted {
+				continue
+			}
+			ready = false
+			if d.Finished() {
+				blocked = fmt.Sprintf("upstream job %s (%s) is %s", d.Step, d.ID, d.Status)
+				break
+			}
+		}
+
+		switch {
+		case blocked != "":
+			if err := s.transition(j, JobEvent{Time: now, To: JobStatusSkipped, Reason: blocked}); err != nil {
+				return released, err
+			}
+			j.LastError = blocked
+			s.persist(j)
+		case ready:
+			j.Payload = expandPayload(j.Payload, quoteInputs(j.Type, s.upstreamInputs(j)))
+			if err := s.transition(j, JobEvent{Time: now, To: JobStatusQueued, Reason: "upstream jobs completed"}); err != nil {
+				return released, err
+			}
+			if j.IsParent() {
+				s.submitTasks(j, j.spec(), now)
+			}
+			s.persist(j)
+			released = append(released, j.clone())
+		}
+	}
+	return released, nil
+}
+
+// upstreamInputs returns the values a released job's payload can refer to:
+// {{step.stdout}} and {{step.outputs.key}} for every job it depends on.
+// Callers hold s.mu
+func (s *JobStore) upstreamInputs(j *Job) map[string]string {
+	inputs := make(map[string]string)
+	for _, dep := range j.DependsOn {
+		d := s.jobs[dep]
+		r, ok := s.results[dep]
+		if !ok {
+			inputs[d.Step+".stdout"] = ""
+			continue
+		}
+		inputs[d.Step+".stdout"] = strings.TrimRight(r.Stdout, "\r\n")
+		for k, v := range r.Outputs {
+			inputs[d.Step+".outputs."+k] = v
+		}
+	}
+	return inputs
+}
+
+// quoteInputs makes values produced by other jobs safe to splice into a
+// payload of jobType, so that they can't run commands or change the spec:
+// shell commands get each value as one single-quoted word, and the JSON
+// payloads of exec, script and http-fetch jobs get it escaped as (part of)
+// a JSON string. echo payloads take them as they are.
+func quoteInputs(jobType string, values map[string]string) map[string]string {
+	quote := func(v string) string { return v }
+	switch jobType {
+	case "shell":
+		quote = shellQuote
+	case "script":
+		quote = func(v string) string { return jsonEscape(shellQuote(v)) }
+	case "exec", "http-fetch":
+		quote = jsonEscape
+	}
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = quote(v)
+	}
+	return out
+}
+
+// shellQuote returns v as a single-quoted sh word
+func shellQuote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
+// jsonEscape returns v escaped to go between the quotes of a JSON string
+func jsonEscape(v string) string {
+	b, _ := json.Marshal(v)
+	return string(b[1 : len(b)-1])
+}
+
+// Returns the workflow with its current status
+func (s *JobStore) Workflow(id string) (Workflow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wf, ok := s.workflows[id]
+	if !ok {
+		return Workflow{}, false
+	}
+	return s.workflowView(wf), true
+}
+
+// Returns every workflow with its current status, oldest first
+func (s *JobStore) Workflows() []Workflow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Workflow, 0, len(s.workflows))
+	for _, wf := range s.workflows {
+		out = append(out, s.workflowView(wf))
+	}
+	sort.Slice(out, func(i, k int) bool {
+		if !out[i].CreatedAt.Equal(out[k].CreatedAt) {
+			return out[i].CreatedAt.Before(out[k].CreatedAt)
+		}
+		return out[i].ID < out[k].ID
+	})
+	return out
+}
+
+// workflowView copies wf with each step's job status and the workflow's
+// status filled in: RUNNING until every job has finished, then COMPLETED,
+// CANCELLED if a job was cancelled and none failed, or FAILED. Callers hold s.mu
+func (s *JobStore) workflowView(wf *Workflow) Workflow {
+	out := *wf
+	out.Steps = make([]WorkflowStep, len(wf.Steps))
+
+	var finished, completed, cancelled, failed int
+	for i, st := range wf.Steps {
+		st.Status = s.jobs[st.JobID].Status
+		out.Steps[i] = st
+
+		switch st.Status {
+		case JobStatusCompleted:
+			completed++
+		case JobStatusCancelled:
+			cancelled++
+		case JobStatusFailed, JobStatusPartiallyCompleted:
+			failed++
+		}
+		if s.jobs[st.JobID].Finished() {
+			finished++
+		}
+	}
+
+	switch {
+	case finished < len(wf.Steps):
+		out.Status = JobStatusRunning
+	case completed == len(wf.Steps):
+		out.Status = JobStatusCompleted
+	case cancelled > 0 && failed == 0:
+		out.Status = JobStatusCancelled
+	default:
+		out.Status = JobStatusFailed
+	}
+	return out
+}
+
+// loadWorkflows replays stored workflows into the store. Callers have exclusive access
+func (s *JobStore) loadWorkflows() error {
+	records, err := s.storage.Load(workflowsBucket)
+	if err != nil {
+		return fmt.Errorf("load workflows: %w", err)
+	}
+	for id, raw := range records {
+		var wf Workflow
+		if err := json.Unmarshal(raw, &wf); err != nil {
+			return fmt.Errorf("decode workflow %q: %w", id, err)
+		}
+		s.workflows[id] = &wf
+
+		var n uint64
+		if _, err := fmt.Sscanf(id, "wf-%d", &n); err == nil && n > s.nextWorkflowID {
+			s.nextWorkflowID = n
+		}
+	}
+	return nil
+}
+
+// advanceWorkflow moves a finished job's workflow along, queueing the jobs
+// that were waiting only for it.
+func (s *server) advanceWorkflow(job Job) {
+	if job.WorkflowID == "" || !job.Finished() {
+		return
+	}
+	released, err := s.jobs.AdvanceWorkflow(job.WorkflowID)
+	if err != nil {
+		log.Printf("failed to advance workflow %s after job %s: %v", job.WorkflowID, job.ID, err)
+	}
+	for _, j := range released {
+		log.Printf("workflow %s: job %s (%s) released", j.WorkflowID, j.Step, j.ID)
+		s.enqueueJob(j)
+	}
+}
+
+// advanceWorkflows catches every workflow up with its jobs, e.g. after a
+// restart; released jobs are QUEUED and picked up by requeuePending.
+func (s *server) advanceWorkflows() {
+	for _, wf := range s.jobs.Workflows() {
+		if wf.Status != JobStatusRunning {
+			continue
+		}
+		if _, err := s.jobs.AdvanceWorkflow(wf.ID); err != nil {
+			log.Printf("failed to advance workflow %s: %v", wf.ID, err)
+		}
+	}
+}
+
+// settle passes a change in a job's status on to whatever depends on it:
+// the job it is a task of, and the workflow jobs downstream of it.
+func (s *server) settle(job Job) {
+	s.settleParent(job)
+	s.advanceWorkflow(job)
+}
+
+// handleWorkflows handles /workflows:
+//   - GET /workflows -> list workflows
+//   - POST /workflows -> submit a workflow
+func (s *server) handleWorkflows(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.jobs.Workflows())
+	case http.MethodPost:
+		s.handleCreateWorkflow(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCreateWorkflow implements POST /workflows.
+func (s *server) handleCreateWorkflow(w http.ResponseWriter, r *http.Request) {
+	var req createWorkflowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	for i := range req.Jobs {
+		s.identify(r, &req.Jobs[i].createJobRequest)
+	}
+	steps, err := req.toSteps()
+	for i := 0; err == nil && i < len(steps); i++ {
+		if err = s.checkPriorityClass(steps[i].Job); err != nil {
+			err = fmt.Errorf("job %q: %w", steps[i].Name, err)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wf, ready, err := s.jobs.SubmitWorkflow(req.Name, steps)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	log.Printf("workflow %s submitted with %d jobs", wf.ID, len(wf.Steps))
+	writeJSON(w, http.StatusCreated, wf)
+
+	for _, j := range ready {
+		s.enqueueJob(j)
+	}
+}
+
+// handleWorkflow is the multiplexer for /workflows/{id}/...:
+//   - GET /workflows/{id} -> the workflow and the status of its jobs
+//   - GET /workflows/{id}/graph -> its dependency graph, as JSON or with format=dot as Graphviz
+func (s *server) handleWorkflow(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/workflows/"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	if id == "" || (action != "" && action != "graph") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	wf, ok := s.jobs.Workflow(id)
+	if !ok {
+		http.Error(w, "workflow not found", http.StatusNotFound)
+		return
+	}
+	if action == "" {
+		writeJSON(w, http.StatusOK, wf)
+		return
+	}
+
+	graph := workflowGraph{Nodes: wf.Steps, Edges: []workflowEdge{}}
+	for _, st := range wf.Steps {
+		for _, d := range st.DependsOn {
+			graph.Edges = append(graph.Edges, workflowEdge{From: d, To: st.Name})
+		}
+	}
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		fmt.Fprint(w, graph.dot(wf.ID))
+		return
+	}
+	writeJSON(w, http.StatusOK, graph)
+}
+
+// dot renders the graph in Graphviz's DOT language, labelling each job with its status.
+func (g workflowGraph) dot(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", name)
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "  %q [label=%q];\n", n.Name, fmt.Sprintf("%s\n%s", n.Name, n.Status))
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "  %q -> %q;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeJSON writes v as the JSON body of a response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that workflow requests are validated and ordered by dependency
+func TestWorkflowRequestToSteps(t *testing.T) {
+	job := func(name string, deps ...string) workflowJobRequest {
+		return workflowJobRequest{Name: name, DependsOn: deps, createJobRequest: createJobRequest{Type: "echo"}}
+	}
+
+	steps, err := createWorkflowRequest{Jobs: []workflowJobRequest{job("c", "b"), job("a"), job("b", "a")}}.toSteps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var order []string
+	for _, st := range steps {
+		order = append(order, st.Name)
+	}
+	if strings.Join(order, ",") != "a,b,c" {
+		t.Fatalf("expected a,b,c, got %v", order)
+	}
+
+	bad := map[string][]workflowJobRequest{
+		"empty":      nil,
+		"cycle":      {job("a", "b"), job("b", "a")},
+		"self":       {job("a", "a")},
+		"unknown":    {job("a", "zzz")},
+		"duplicate":  {job("a"), job("a")},
+		"bad name":   {job("a.b")},
+		"bad job":    {{Name: "a"}},
+		"cycle tail": {job("a"), job("b", "c"), job("c", "b")},
+	}
+	for name, jobs := range bad {
+		if _, err := (createWorkflowRequest{Jobs: jobs}).toSteps(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// submitWorkflow posts body to /workflows and returns the created workflow.
+func submitWorkflow(t *testing.T, srv *server, body string) Workflow {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	srv.handleWorkflows(w, httptest.NewRequest(http.MethodPost, "/workflows", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var wf Workflow
+	if err := json.NewDecoder(w.Body).Decode(&wf); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return wf
+}
+
+// Test that jobs run once their upstream completes, with its output, and are skipped after a failure
+func TestWorkflowRunsInDependencyOrder(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{})
+	srv := &server{registry: reg, jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+
+	wf := submitWorkflow(t, srv, `{"name":"etl","jobs":[
+		{"name":"load","type":"echo","payload":"load","depends_on":["transform"]},
+		{"name":"extract","type":"echo","payload":"extract"},
+		{"name":"transform","type":"echo","payload":"t {{extract.stdout}} {{extract.outputs.rows}}","depends_on":["extract"],"retry":{"max_attempts":1}}
+	]}`)
+	if wf.Status != JobStatusRunning || len(wf.Steps) != 3 || wf.Steps[0].Name != "extract" {
+		t.Fatalf("unexpected workflow %+v", wf)
+	}
+	ids := map[string]string{}
+	for _, st := range wf.Steps {
+		ids[st.Name] = st.JobID
+	}
+	if q := srv.pending.Snapshot(); len(q) != 1 || q[0] != ids["extract"] {
+		t.Fatalf("expected only extract queued, got %v", q)
+	}
+	if j, _ := srv.jobs.Get(ids["transform"]); j.Status != JobStatusWaiting {
+		t.Fatalf("expected transform WAITING, got %s", j.Status)
+	}
+
+	srv.pending.Remove(ids["extract"])
+	finishTask(t, srv, ids["extract"], executeResponse{Status: "ok", Stdout: "data\n", Outputs: map[string]string{"rows": "42"}})
+
+	transform, _ := srv.jobs.Get(ids["transform"])
+	if transform.Status != JobStatusQueued || transform.Payload != "t data 42" {
+		t.Fatalf("expected transform QUEUED with its inputs, got %s %q", transform.Status, transform.Payload)
+	}
+	if q := srv.pending.Snapshot(); len(q) != 1 || q[0] != transform.ID {
+		t.Fatalf("expected transform queued, got %v", q)
+	}
+
+	srv.pending.Remove(transform.ID)
+	finishTask(t, srv, transform.ID, executeResponse{Status: "failed", ExitCode: 1})
+
+	load, _ := srv.jobs.Get(ids["load"])
+	if load.Status != JobStatusSkipped || !strings.Contains(load.LastError, "transform") {
+		t.Fatalf("expected load SKIPPED because of transform, got %s (%s)", load.Status, load.LastError)
+	}
+	if got, _ := srv.jobs.Workflow(wf.ID); got.Status != JobStatusFailed {
+		t.Fatalf("expected workflow FAILED, got %s", got.Status)
+	}
+}
+
+// Test that upstream output can't break out of a shell word or a JSON string
+func TestWorkflowQuotesUpstreamOutput(t *testing.T) {
+	reg := NewNodeRegistry()
+	reg.Register("node-1", "127.0.0.1:1", NodeInfo{})
+	srv := &server{registry: reg, jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+	wf := submitWorkflow(t, srv, `{"jobs":[
+		{"name":"a","type":"echo"},
+		{"name":"sh","type":"shell","payload":"echo {{a.stdout}}","depends_on":["a"]},
+		{"name":"ex","type":"exec","payload":"{\"executable\":\"echo\",\"args\":[\"{{a.stdout}}\"]}","depends_on":["a"]}
+	]}`)
+	ids := map[string]string{}
+	for _, st := range wf.Steps {
+		ids[st.Name] = st.JobID
+	}
+
+	srv.pending.Remove(ids["a"])
+	finishTask(t, srv, ids["a"], executeResponse{Status: "ok", Stdout: `x'; rm -rf ~ #","--evil`})
+
+	sh, _ := srv.jobs.Get(ids["sh"])
+	if want := `echo 'x'\''; rm -rf ~ #","--evil'`; sh.Payload != want {
+		t.Fatalf("expected the shell payload %q, got %q", want, sh.Payload)
+	}
+	ex, _ := srv.jobs.Get(ids["ex"])
+	var spec struct{ Args []string }
+	if err := json.Unmarshal([]byte(ex.Payload), &spec); err != nil || len(spec.Args) != 1 || spec.Args[0] != `x'; rm -rf ~ #","--evil` {
+		t.Fatalf("expected the output as the one argument, got %q (%v)", ex.Payload, err)
+	}
+}
+
+// Test the workflow status and graph endpoints
+func TestWorkflowEndpoints(t *testing.T) {
+	srv := &server{registry: NewNodeRegistry(), jobs: NewJobStore(), wake: make(chan struct{}, 1)}
+	wf := submitWorkflow(t, srv, `{"jobs":[{"name":"a","type":"echo"},{"name":"b","type":"echo","depends_on":["a"]}]}`)
+
+	w := httptest.NewRecorder()
+	srv.handleWorkflow(w, httptest.NewRequest(http.MethodGet, "/workflows/"+wf.ID+"/graph", nil))
+	var graph workflowGraph
+	if err := json.NewDecoder(w.Body).Decode(&graph); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(graph.Nodes) != 2 || len(graph.Edges) != 1 || graph.Edges[0] != (workflowEdge{From: "a", To: "b"}) {
+		t.Fatalf("unexpected graph %+v", graph)
+	}
+	if graph.Nodes[1].Status != JobStatusWaiting {
+		t.Fatalf("expected b WAITING in the graph, got %s", graph.Nodes[1].Status)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleWorkflow(w, httptest.NewRequest(http.MethodGet, "/workflows/"+wf.ID+"/graph?format=dot", nil))
+	if !strings.Contains(w.Body.String(), `"a" -> "b";`) {
+		t.Fatalf("unexpected dot output:\n%s", w.Body)
+	}
+
+	if _, err := srv.cancelJob(wf.Steps[0].JobID, "stop"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	w = httptest.NewRecorder()
+	srv.handleWorkflow(w, httptest.NewRequest(http.MethodGet, "/workflows/"+wf.ID, nil))
+	var got Workflow
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Status != JobStatusCancelled || got.Steps[1].Status != JobStatusSkipped {
+		t.Fatalf("expected CANCELLED with b SKIPPED, got %s %+v", got.Status, got.Steps)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleWorkflow(w, httptest.NewRequest(http.MethodGet, "/workflows/wf-404", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+// Test that workflows survive a restart and are caught up with their jobs
+func TestWorkflowRestored(t *testing.T) {
+	storage := NewMemoryStorage()
+	jobs, _ := NewJobStoreWithStorage(storage)
+	wf, ready, _ := jobs.SubmitWorkflow("wf", []WorkflowStepSpec{
+		{Name: "a", Job: JobSpec{Type: "echo"}},
+		{Name: "b", DependsOn: []string{"a"}, Job: JobSpec{Type: "echo"}},
+	})
+	jobs.StartAttempt(ready[0].ID, "node-1", "")
+	jobs.CompleteAttempt(ready[0].ID, 1)
+
+	restored, err := NewJobStoreWithStorage(storage)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	srv := &server{registry: NewNodeRegistry(), jobs: restored, wake: make(chan struct{}, 1)}
+	srv.advanceWorkflows()
+	srv.requeuePending()
+
+	if q := srv.pending.Snapshot(); len(q) != 1 || q[0] != wf.Steps[1].JobID {
+		t.Fatalf("expected b queued after restart, got %v", q)
+	}
+	if next, _, _ := restored.SubmitWorkflow("again", []WorkflowStepSpec{{Name: "x", Job: JobSpec{Type: "echo"}}}); next.ID == wf.ID {
+		t.Fatalf("workflow ID %s reused after restart", next.ID)
+	}
+}